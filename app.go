@@ -0,0 +1,12 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/sftp"
+)
+
+// App 是进程中运行的所有服务器
+type App struct {
+	Web  *gin.Engine
+	Sftp *sftp.Server
+}
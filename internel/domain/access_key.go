@@ -0,0 +1,12 @@
+package domain
+
+import "time"
+
+// AccessKey S3 接口使用的访问密钥。SigV4 需要用密钥原文计算签名，所以
+// 服务端保存原文，但只在创建时返回给用户一次
+type AccessKey struct {
+	Id     string    `json:"access_key_id"`
+	Secret string    `json:"secret_access_key,omitempty"`
+	UserId string    `json:"-"`
+	Ctime  time.Time `json:"ctime"`
+}
@@ -1,11 +1,44 @@
 package domain
 
+import "time"
+
 // 文件元数据
 type FileMetadata struct {
-	Name    string `json:"name"`     // 文件名称
-	Size    int    `json:"size"`     // 文件大小 (字节)
-	Type    string `json:"type"`     // 文件类型 (例如 "image/png")
-	OwnerID string `json:"owner_id"` // 上传者ID (例如用户ID)
-	MD5     string `json:"md5"`      // 文件内容的MD5哈希值
-	Path    string `json:"path"`
+	Name     string    `json:"name"`               // 文件名称
+	Path     string    `json:"path"`               // 文件在用户目录树中的绝对路径
+	IsDir    bool      `json:"is_dir"`             // 是否是目录
+	Size     int64     `json:"size"`               // 文件大小 (字节)，目录为 0
+	Type     string    `json:"type"`               // 文件类型 (例如 "image/png")
+	OwnerID  string    `json:"owner_id"`           // 上传者ID (例如用户ID)
+	Digest   string    `json:"digest"`             // 文件内容的摘要，md5 或 sha256
+	CTime    time.Time `json:"ctime"`              // 创建时间
+	ModTime  time.Time `json:"mtime"`              // 最后修改时间
+	Children int       `json:"children,omitempty"` // 目录下的条目数
+}
+
+// 目录列表中的一页
+type FileList struct {
+	Total int            `json:"total"` // 目录下的条目总数
+	Files []FileMetadata `json:"files"`
+}
+
+// 回收站中的一项，即一次删除的文件或目录树
+type TrashItem struct {
+	Id           uint      `json:"id"`
+	Name         string    `json:"name"`          // 删除前的名称
+	OriginalPath string    `json:"original_path"` // 删除前的路径，恢复时放回这里
+	IsDir        bool      `json:"is_dir"`        // 是否是目录
+	Size         int64     `json:"size"`          // 包含的文件总大小 (字节)
+	DeletedAt    time.Time `json:"deleted_at"`    // 删除时间
+}
+
+// 文件的一个历史版本，即被新内容替换前的内容
+type FileVersion struct {
+	Id         uint      `json:"id"`
+	Digest     string    `json:"digest"`      // 文件内容的摘要
+	Size       int64     `json:"size"`        // 文件大小 (字节)
+	Type       string    `json:"type"`        // 文件类型
+	Uploader   string    `json:"uploader"`    // 上传这个版本的用户
+	ModTime    time.Time `json:"mtime"`       // 这个版本的修改时间
+	ReplacedAt time.Time `json:"replaced_at"` // 被新内容替换的时间
 }
@@ -0,0 +1,18 @@
+package domain
+
+// ObjectList 按 S3 ListObjectsV2 的语义列出的一页对象，对象的 key 是去掉
+// 开头的 / 的路径，空目录以 key 以 / 结尾的对象表示
+type ObjectList struct {
+	Objects []FileMetadata
+	// Prefixes 按分隔符折叠的公共前缀，即 key 前缀下的子目录
+	Prefixes []string
+	// Truncated 为 true 时还有下一页，Next 是本页的最后一个 key
+	Truncated bool
+	Next      string
+}
+
+// UploadPart 完成分段上传时客户端列出的一个分段
+type UploadPart struct {
+	Index int
+	Md5   string
+}
@@ -0,0 +1,61 @@
+package domain
+
+import "time"
+
+const (
+	// ShareModeRead 访客只能浏览和下载
+	ShareModeRead = "read"
+	// ShareModeUpload 访客还可以向分享的目录上传文件
+	ShareModeUpload = "upload"
+)
+
+// Share 分享链接，访客通过 token 访问 Path 指向的文件或目录树
+type Share struct {
+	Id     int64  `json:"id"`
+	Token  string `json:"token"`
+	UserId string `json:"-"`
+	Path   string `json:"path"` // 分享的文件或目录在分享者目录树中的路径
+	IsDir  bool   `json:"is_dir"`
+	// Code 提取码的哈希，为空时不需要提取码
+	Code    string `json:"-"`
+	HasCode bool   `json:"has_code"`
+	Mode    string `json:"mode"`
+	// Expire 为零值时永不过期
+	Expire time.Time `json:"expire"`
+	// MaxDownloads 为 0 时不限制下载次数
+	MaxDownloads int64     `json:"max_downloads"`
+	Downloads    int64     `json:"downloads"`
+	Ctime        time.Time `json:"ctime"`
+}
+
+// Expired 分享在 now 时是否已经过期
+func (s Share) Expired(now time.Time) bool {
+	return !s.Expire.IsZero() && now.After(s.Expire)
+}
+
+// Exhausted 分享的下载次数是否已经用完
+func (s Share) Exhausted() bool {
+	return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+const (
+	SaveJobRunning = "running"
+	SaveJobDone    = "done"
+	SaveJobFailed  = "failed"
+)
+
+// SaveJob 把分享的内容转存到自己目录树的后台任务
+type SaveJob struct {
+	Id     string `json:"id"`
+	UserId string `json:"-"`
+	State  string `json:"state"`
+	// Path 转存到的路径，冲突时可能被改名
+	Path string `json:"path"`
+	// Total 要创建的文件和目录数，开始创建前为 0
+	Total      int       `json:"total"`
+	Done       int       `json:"done"`
+	Code       int       `json:"code,omitempty"` // 失败时的错误码
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
@@ -0,0 +1,13 @@
+package domain
+
+import "time"
+
+// SSHKey 用户登记的 SSH 公钥，用于登录 SFTP
+type SSHKey struct {
+	Id          int64     `json:"id"`
+	Name        string    `json:"name"`        // 便于用户区分的名称，默认是公钥的注释
+	Fingerprint string    `json:"fingerprint"` // SHA256:... 格式的指纹
+	PublicKey   string    `json:"public_key"`  // authorized_keys 格式的公钥
+	UserId      string    `json:"-"`
+	Ctime       time.Time `json:"ctime"`
+}
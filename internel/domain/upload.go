@@ -0,0 +1,73 @@
+package domain
+
+import "time"
+
+// UploadPlan 告诉客户端如何上传一个文件
+type UploadPlan struct {
+	SessionId string `json:"session_id"` // 分片上传的会话
+	ChunkSize int    `json:"chunk_size"` // 分片大小 (字节)
+	// Challenge 用于秒传，回答正确时服务端已有相同内容，无需上传任何分片。
+	// 服务端是否已有该内容只有回答之后才知道，回答错误时继续分片上传
+	Challenge *UploadChallenge `json:"challenge,omitempty"`
+}
+
+// UploadChallenge 要求客户端证明自己持有文件内容，防止只凭摘要就链接别人的文件。
+// 客户端需要回答 hex(sha256(Nonce + 文件中 [Offset, Offset+Length) 的字节))
+type UploadChallenge struct {
+	Id     string `json:"id"`
+	Nonce  string `json:"nonce"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// UploadSession 一次分片上传的会话，记录服务端已经收到了哪些分片
+type UploadSession struct {
+	Id          string    `json:"id"`
+	UserId      string    `json:"-"`
+	Path        string    `json:"path"`   // 目标路径
+	Digest      string    `json:"digest"` // 整个文件的摘要
+	Size        int64     `json:"size"`
+	ChunkSize   int64     `json:"chunk_size"`
+	TotalChunks int       `json:"total_chunks"`
+	Conflict    string    `json:"conflict"` // 目标路径已存在时的处理方式
+	Received    []bool    `json:"-"`
+	ChunkMd5s   []string  `json:"-"` // 已收到的分片的 md5，没有收到的为空
+	Expire      time.Time `json:"expire"`
+}
+
+// Multipart 判断是否是 S3 的分段上传。分段上传的分段大小不固定，
+// 整个文件的摘要和大小在完成时才知道
+func (s UploadSession) Multipart() bool {
+	return s.Digest == ""
+}
+
+// Bitmap 返回分片接收情况，第 i 个字符为 '1' 表示第 i 个分片已收到
+func (s UploadSession) Bitmap() string {
+	bitmap := make([]byte, s.TotalChunks)
+	for i := range bitmap {
+		bitmap[i] = '0'
+		if i < len(s.Received) && s.Received[i] {
+			bitmap[i] = '1'
+		}
+	}
+	return string(bitmap)
+}
+
+// Missing 返回还没有收到的分片序号
+func (s UploadSession) Missing() []int {
+	missing := []int{}
+	for i := 0; i < s.TotalChunks; i++ {
+		if i >= len(s.Received) || !s.Received[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// ChunkLength 返回第 index 个分片应有的长度，最后一个分片可能不满
+func (s UploadSession) ChunkLength(index int) int64 {
+	if index == s.TotalChunks-1 {
+		return s.Size - int64(index)*s.ChunkSize
+	}
+	return s.ChunkSize
+}
@@ -14,3 +14,11 @@ type User struct {
 	// UTC 0 的时区
 	Ctime time.Time
 }
+
+// 用户的存储限额及用量，回收站中的文件和历史版本都计入用量
+type Quota struct {
+	MaxBytes  int64 `json:"max_bytes"`  // 可用的字节数
+	MaxFiles  int64 `json:"max_files"`  // 可用的文件数
+	UsedBytes int64 `json:"used_bytes"` // 已用的字节数
+	UsedFiles int64 `json:"used_files"` // 已用的文件数
+}
@@ -0,0 +1,65 @@
+package blob
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+var (
+	ErrNotFound       = errors.New("blob not found")
+	ErrInvalidDigest  = errors.New("invalid blob digest")
+	ErrDigestMismatch = errors.New("blob digest mismatch")
+)
+
+// Info describes a stored blob.
+type Info struct {
+	Digest  string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore stores immutable objects addressed by the hex digest of their content,
+// so that any number of users and paths can share one physical object.
+type BlobStore interface {
+	// Put stores the content read from r under digest. The content is verified
+	// against the digest, and storing an existing digest again is a no-op.
+	Put(digest string, r io.Reader) (Info, error)
+	// Get opens the blob for reading.
+	Get(digest string) (io.ReadSeekCloser, error)
+	Stat(digest string) (Info, error)
+	Delete(digest string) error
+	Exists(digest string) (bool, error)
+	// Walk calls fn for every stored blob, stopping at the first error.
+	Walk(fn func(info Info) error) error
+}
+
+// NewHash returns the hash function matching the length of digest:
+// md5 for 32 hex characters and sha256 for 64.
+func NewHash(digest string) (hash.Hash, error) {
+	if !validDigest(digest) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDigest, digest)
+	}
+	if len(digest) == 2*md5.Size {
+		return md5.New(), nil
+	}
+	return sha256.New(), nil
+}
+
+// validDigest accepts lowercase hex md5 or sha256 digests only, which also
+// keeps digests safe to use as file names.
+func validDigest(digest string) bool {
+	if len(digest) != 2*md5.Size && len(digest) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range digest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package blob
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var _ BlobStore = &LocalBlobStore{}
+
+// LocalBlobStore keeps blobs on the local disk. Digests are sharded into two
+// levels of subdirectories, e.g. root/d4/1d/d41d8cd98f00b204e9800998ecf8427e,
+// so that no single directory grows too large.
+type LocalBlobStore struct {
+	root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create blob root %s: %v", root, err)
+	}
+	return &LocalBlobStore{root: root}, nil
+}
+
+func (s *LocalBlobStore) Put(digest string, r io.Reader) (Info, error) {
+	h, err := NewHash(digest)
+	if err != nil {
+		return Info{}, err
+	}
+
+	// Write to a temporary file first, it is only moved into place once verified
+	tmp, err := os.CreateTemp(s.root, ".put-*")
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to create temporary blob: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		return Info{}, fmt.Errorf("failed to write blob %s: %v", digest, err)
+	}
+	if calculated := hex.EncodeToString(h.Sum(nil)); calculated != digest {
+		return Info{}, fmt.Errorf("%w: calculated %s, expected %s", ErrDigestMismatch, calculated, digest)
+	}
+	if err := tmp.Close(); err != nil {
+		return Info{}, fmt.Errorf("failed to write blob %s: %v", digest, err)
+	}
+
+	// Identical content is already stored, keep the existing object
+	if info, err := s.Stat(digest); err == nil {
+		return info, nil
+	}
+
+	path := s.path(digest)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return Info{}, fmt.Errorf("failed to create blob directory: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return Info{}, fmt.Errorf("failed to store blob %s: %v", digest, err)
+	}
+	return s.Stat(digest)
+}
+
+func (s *LocalBlobStore) Get(digest string) (io.ReadSeekCloser, error) {
+	if !validDigest(digest) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDigest, digest)
+	}
+	file, err := os.Open(s.path(digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, digest)
+	}
+	return file, err
+}
+
+func (s *LocalBlobStore) Stat(digest string) (Info, error) {
+	if !validDigest(digest) {
+		return Info{}, fmt.Errorf("%w: %q", ErrInvalidDigest, digest)
+	}
+	fi, err := os.Stat(s.path(digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return Info{}, fmt.Errorf("%w: %s", ErrNotFound, digest)
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Digest: digest, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *LocalBlobStore) Delete(digest string) error {
+	if !validDigest(digest) {
+		return fmt.Errorf("%w: %q", ErrInvalidDigest, digest)
+	}
+	err := os.Remove(s.path(digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNotFound, digest)
+	}
+	return err
+}
+
+func (s *LocalBlobStore) Exists(digest string) (bool, error) {
+	_, err := s.Stat(digest)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *LocalBlobStore) Walk(fn func(info Info) error) error {
+	return filepath.WalkDir(s.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Only sharded blobs count, temporary files of unfinished puts are skipped
+		if d.IsDir() || !validDigest(d.Name()) || path != s.path(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(Info{Digest: d.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+}
+
+// path returns the sharded location of digest below the root.
+func (s *LocalBlobStore) path(digest string) string {
+	return filepath.Join(s.root, digest[0:2], digest[2:4], digest)
+}
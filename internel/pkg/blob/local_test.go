@@ -0,0 +1,67 @@
+package blob
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalBlobStore(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewLocalBlobStore(root)
+	if err != nil {
+		t.Fatalf("Error creating store: %v", err)
+	}
+
+	// md5("Hello, World!")
+	const digest = "65a8e27d8879283831b664bd8b7f0ad4"
+	info, err := store.Put(digest, strings.NewReader("Hello, World!"))
+	if err != nil {
+		t.Fatalf("Error putting blob: %v", err)
+	}
+	if info.Size != 13 {
+		t.Fatalf("Size mismatch: expected 13, got %d", info.Size)
+	}
+	if _, err := os.Stat(filepath.Join(root, "65", "a8", digest)); err != nil {
+		t.Fatalf("Expected blob to be sharded: %v", err)
+	}
+
+	// Putting the same content again keeps the existing object
+	if _, err := store.Put(digest, strings.NewReader("Hello, World!")); err != nil {
+		t.Fatalf("Error putting duplicate blob: %v", err)
+	}
+
+	r, err := store.Get(digest)
+	if err != nil {
+		t.Fatalf("Error getting blob: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "Hello, World!" {
+		t.Fatalf("Content mismatch: got '%s'", string(data))
+	}
+
+	// Content that does not match the digest is rejected
+	other := "0123456789abcdef0123456789abcdef"
+	if _, err := store.Put(other, strings.NewReader("Hello, World!")); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("Expected ErrDigestMismatch, got %v", err)
+	}
+	if ok, _ := store.Exists(other); ok {
+		t.Fatalf("Expected mismatched blob not to be stored")
+	}
+
+	// Digests are never used as paths unless they are plain hex
+	if _, err := store.Get("../../etc/passwd"); !errors.Is(err, ErrInvalidDigest) {
+		t.Fatalf("Expected ErrInvalidDigest, got %v", err)
+	}
+
+	if err := store.Delete(digest); err != nil {
+		t.Fatalf("Error deleting blob: %v", err)
+	}
+	if _, err := store.Stat(digest); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound after delete, got %v", err)
+	}
+}
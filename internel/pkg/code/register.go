@@ -0,0 +1,49 @@
+// Copyright 2020 Lingfei Kong <colin404@foxmail.com>. All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package code
+
+// init register error codes defines in this source code to `github.com/lvow2022/udisk/pkg/ginx/errors`.
+// The registrations are maintained by hand, keep them in sync with the constants and their comments.
+func init() {
+	register(ErrFileNotFound, 404, "File not found")
+	register(ErrNotAFile, 400, "Path is a directory, not a file")
+	register(ErrChunkOutOfRange, 400, "Chunk index out of range")
+	register(ErrFileExists, 400, "File already exists")
+	register(ErrNotADirectory, 400, "Path is a file, not a directory")
+	register(ErrDirectoryNotEmpty, 400, "Directory is not empty")
+	register(ErrQuotaExceeded, 403, "Storage quota exceeded")
+	register(ErrShareNotFound, 404, "Share not found")
+	register(ErrShareExpired, 404, "Share has expired")
+	register(ErrShareCodeIncorrect, 403, "Share extraction code is incorrect")
+	register(ErrShareExhausted, 403, "Share download limit reached")
+	register(ErrShareReadOnly, 403, "Share does not allow uploads")
+	register(ErrAccessKeyNotFound, 404, "Access key not found")
+	register(ErrAccessKeyLimit, 400, "Too many access keys")
+	register(ErrSSHKeyNotFound, 404, "SSH key not found")
+	register(ErrSSHKeyInvalid, 400, "Invalid SSH public key")
+	register(ErrSSHKeyExists, 400, "SSH key already registered")
+	register(ErrSuccess, 200, "OK")
+	register(ErrUnknown, 500, "Internal server error")
+	register(ErrBind, 400, "Error occurred while binding the request body to the struct")
+	register(ErrValidation, 400, "Validation failed")
+	register(ErrTokenInvalid, 401, "Token invalid")
+	register(ErrPageNotFound, 404, "Page not found")
+	register(ErrDatabase, 500, "Database error")
+	register(ErrEncrypt, 401, "Error occurred while encrypting the user password")
+	register(ErrSignatureInvalid, 401, "Signature is invalid")
+	register(ErrExpired, 401, "Token expired")
+	register(ErrInvalidAuthHeader, 401, "Invalid authorization header")
+	register(ErrMissingHeader, 401, "The `Authorization` header was empty")
+	register(ErrPasswordIncorrect, 401, "Password was incorrect")
+	register(ErrPermissionDenied, 403, "Permission denied")
+	register(ErrEncodingFailed, 500, "Encoding failed due to an error with the data")
+	register(ErrDecodingFailed, 500, "Decoding failed due to an error with the data")
+	register(ErrInvalidJSON, 500, "Data is not valid JSON")
+	register(ErrEncodingJSON, 500, "JSON data could not be encoded")
+	register(ErrDecodingJSON, 500, "JSON data could not be decoded")
+	register(ErrInvalidYaml, 500, "Data is not valid Yaml")
+	register(ErrEncodingYaml, 500, "Yaml data could not be encoded")
+	register(ErrDecodingYaml, 500, "Yaml data could not be decoded")
+}
@@ -0,0 +1,68 @@
+package code
+
+// udisk: file errors.
+// Code must start with 1100xx.
+const (
+	// ErrFileNotFound - 404: File not found.
+	ErrFileNotFound int = iota + 110001
+
+	// ErrNotAFile - 400: Path is a directory, not a file.
+	ErrNotAFile
+
+	// ErrChunkOutOfRange - 400: Chunk index out of range.
+	ErrChunkOutOfRange
+
+	// ErrFileExists - 400: File already exists.
+	ErrFileExists
+
+	// ErrNotADirectory - 400: Path is a file, not a directory.
+	ErrNotADirectory
+
+	// ErrDirectoryNotEmpty - 400: Directory is not empty.
+	ErrDirectoryNotEmpty
+
+	// ErrQuotaExceeded - 403: Storage quota exceeded.
+	ErrQuotaExceeded
+)
+
+// udisk: share errors.
+// Code must start with 1101xx.
+const (
+	// ErrShareNotFound - 404: Share not found.
+	ErrShareNotFound int = iota + 110101
+
+	// ErrShareExpired - 404: Share has expired.
+	ErrShareExpired
+
+	// ErrShareCodeIncorrect - 403: Share extraction code is incorrect.
+	ErrShareCodeIncorrect
+
+	// ErrShareExhausted - 403: Share download limit reached.
+	ErrShareExhausted
+
+	// ErrShareReadOnly - 403: Share does not allow uploads.
+	ErrShareReadOnly
+)
+
+// udisk: access key errors.
+// Code must start with 1102xx.
+const (
+	// ErrAccessKeyNotFound - 404: Access key not found.
+	ErrAccessKeyNotFound int = iota + 110201
+
+	// ErrAccessKeyLimit - 400: Too many access keys.
+	ErrAccessKeyLimit
+)
+
+// udisk: ssh key errors.
+// Code must start with 1103xx.
+const (
+	// ErrSSHKeyNotFound - 404: SSH key not found.
+	ErrSSHKeyNotFound int = iota + 110301
+
+	// ErrSSHKeyInvalid - 400: Invalid SSH public key.
+	ErrSSHKeyInvalid
+
+	// ErrSSHKeyExists - 400: SSH key already registered.
+	ErrSSHKeyExists
+)
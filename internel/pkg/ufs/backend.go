@@ -0,0 +1,33 @@
+package ufs
+
+import "gorm.io/gorm"
+
+// Backend is a Persistor implementation together with the services that work
+// across the owners of its store. They must all use the same store, a garbage
+// collector reading the counts of another store would collect every blob.
+type Backend struct {
+	Persistors PersistorFactory
+	Refs       RefCounter
+	Trash      TrashCollector
+	Versions   VersionPruner
+}
+
+// GormBackend returns the Backend that keeps the records in db.
+func GormBackend(db *gorm.DB) Backend {
+	return Backend{
+		Persistors: GormPersistors(db),
+		Refs:       NewGormRefCounter(db),
+		Trash:      NewGormTrashCollector(db),
+		Versions:   NewGormVersionPruner(db),
+	}
+}
+
+// KVBackend returns the Backend that keeps the records in store.
+func KVBackend(store KVStore) Backend {
+	return Backend{
+		Persistors: KVPersistors(store),
+		Refs:       NewKVRefCounter(store),
+		Trash:      NewKVTrashCollector(store),
+		Versions:   NewKVVersionPruner(store),
+	}
+}
@@ -0,0 +1,96 @@
+package ufs
+
+import (
+	"bytes"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a KVStore in a bbolt database file, for single-node
+// deployments that do without a SQL database.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens the bbolt database at path, creating it if necessary.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) View(fn func(tx KVTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *BoltStore) Update(fn func(tx KVTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+// boltTx maps buckets to bbolt buckets, which are created by the first write.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) bucket(name string) (*bolt.Bucket, error) {
+	if !t.tx.Writable() {
+		return nil, errReadOnlyTx
+	}
+	return t.tx.CreateBucketIfNotExists([]byte(name))
+}
+
+func (t boltTx) Get(bucket string, key []byte) ([]byte, error) {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil, nil
+	}
+	return b.Get(key), nil
+}
+
+func (t boltTx) Put(bucket string, key, value []byte) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+func (t boltTx) Delete(bucket string, key []byte) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Delete(key)
+}
+
+func (t boltTx) Scan(bucket string, prefix []byte, fn func(key, value []byte) error) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t boltTx) NextID(bucket string) (uint64, error) {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return b.NextSequence()
+}
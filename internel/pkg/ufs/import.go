@@ -0,0 +1,97 @@
+package ufs
+
+import (
+	"fmt"
+	"os"
+)
+
+// ImportOptions controls how Import copies a tree from another file system.
+type ImportOptions struct {
+	// Policy applies to conflicts as in CopyOptions.
+	Policy ConflictPolicy
+	// BatchSize is the number of entries persisted per transaction, zero
+	// persists the whole tree in a single one.
+	BatchSize int
+	// Check, if set, is called with the bytes and files the import adds
+	// before anything is persisted, an error aborts the import.
+	Check func(bytes, files int64) error
+	// Progress, if set, is called after every batch with the number of
+	// entries persisted so far and the total.
+	Progress func(done, total int)
+}
+
+// Import copies the file or directory tree at srcName of src to dst, which
+// may belong to another owner. Like Copy no content is copied, every new file
+// references the blob of its source. With a BatchSize an import that fails
+// half way leaves the batches persisted so far in place. It returns the path
+// of the copy.
+func (ufs *UserFileSystem) Import(src *UserFileSystem, srcName, dst string, opts ImportOptions) (string, error) {
+	srcPath := src.resolvePath(srcName)
+	dstPath := ufs.resolvePath(dst)
+
+	var records []FileSystem
+	var err error
+	if src != ufs {
+		src.fsMutex.RLock()
+		records, err = src.loadTree(srcPath)
+		src.fsMutex.RUnlock()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	ufs.fsMutex.Lock()
+	defer ufs.fsMutex.Unlock()
+
+	if src == ufs {
+		if records, err = ufs.loadTree(srcPath); err != nil {
+			return "", err
+		}
+		if _, ok := relativeTo(srcPath, dstPath); ok {
+			return "", &os.PathError{Op: "import", Path: dstPath, Err: os.ErrInvalid}
+		}
+	}
+	if dstPath, err = ufs.copyTarget(dstPath, opts.Policy); err != nil {
+		return "", err
+	}
+	entries, err := ufs.copyEntries(records, srcPath, dstPath, opts.Policy)
+	if err != nil {
+		return "", err
+	}
+
+	if opts.Check != nil {
+		var bytes, files int64
+		for _, entry := range entries {
+			if entry.IsDir {
+				continue
+			}
+			// An overwritten file keeps counting as a version, but not as a file
+			bytes += entry.Ref.Size
+			if _, err := ufs.fs.Stat(entry.Path); err != nil {
+				files++
+			}
+		}
+		if err := opts.Check(bytes, files); err != nil {
+			return "", err
+		}
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(entries)
+	}
+	for done := 0; done < len(entries); {
+		batch := entries[done:min(done+batchSize, len(entries))]
+		if err := ufs.persistor.PersistEntries(batch); err != nil {
+			return "", fmt.Errorf("failed to persist import: %v", err)
+		}
+		if err := ufs.applyEntries(batch); err != nil {
+			return "", err
+		}
+		done += len(batch)
+		if opts.Progress != nil {
+			opts.Progress(done, len(entries))
+		}
+	}
+	return dstPath, nil
+}
@@ -0,0 +1,43 @@
+package ufs
+
+import "gorm.io/gorm"
+
+// LegacyOwner owns the records written before they were scoped per user,
+// back when every file request ran as a placeholder user. Owners are user
+// IDs, so no real user can ever be handed these records.
+const LegacyOwner = "legacy"
+
+// legacyPathIndex is the global unique index on path used before records had an owner.
+const legacyPathIndex = "idx_file_systems_path"
+
+func InitTables(db *gorm.DB) error {
+	m := db.Migrator()
+	if m.HasTable(&FileSystem{}) && m.HasIndex(&FileSystem{}, legacyPathIndex) {
+		if err := m.DropIndex(&FileSystem{}, legacyPathIndex); err != nil {
+			return err
+		}
+	}
+
+	countRefs := !m.HasTable(&BlobRefCount{})
+	countUsage := !m.HasTable(&Quota{})
+	if err := db.AutoMigrate(&FileSystem{}, &BlobRefCount{}, &TrashItem{}, &FileVersion{}, &Quota{}); err != nil {
+		return err
+	}
+
+	// Hand the rows written before the owner column existed to the legacy owner
+	if err := db.Model(&FileSystem{}).Where("owner = ?", "").Update("owner", LegacyOwner).Error; err != nil {
+		return err
+	}
+
+	// Count the references of the records written before counts were kept
+	if countRefs {
+		if err := rebuildRefCounts(db); err != nil {
+			return err
+		}
+	}
+	// Count the usage of the records written before quotas were kept
+	if countUsage {
+		return rebuildQuotas(db)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package ufs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BlobOpener opens the content of a blob by its digest, blob.BlobStore satisfies it.
+type BlobOpener interface {
+	Get(digest string) (io.ReadSeekCloser, error)
+}
+
+// ReadOnlyFS is a read-only view of a UserFileSystem that implements fs.FS,
+// fs.ReadDirFS, fs.StatFS and fs.SubFS. Directory listings come from the
+// persisted records and file contents from the blobs they reference, so it
+// can be handed to anything that consumes an fs.FS, e.g. http.FS, fs.WalkDir
+// or template.ParseFS. Changes made to the UserFileSystem are visible
+// through the view immediately.
+type ReadOnlyFS struct {
+	ufs   *UserFileSystem
+	blobs BlobOpener
+	root  string
+}
+
+var (
+	_ fs.ReadDirFS = (*ReadOnlyFS)(nil)
+	_ fs.StatFS    = (*ReadOnlyFS)(nil)
+	_ fs.SubFS     = (*ReadOnlyFS)(nil)
+)
+
+// ReadOnly returns a read-only view of the whole file system whose file contents are read from blobs.
+func (ufs *UserFileSystem) ReadOnly(blobs BlobOpener) *ReadOnlyFS {
+	return &ReadOnlyFS{ufs: ufs, blobs: blobs, root: "/"}
+}
+
+// Open opens the named file or directory, names are slash-separated and relative to the root of the view.
+func (rfs *ReadOnlyFS) Open(name string) (fs.File, error) {
+	info, err := rfs.stat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return &readOnlyDir{rfs: rfs, name: name, info: info}, nil
+	}
+
+	var r io.ReadSeekCloser
+	if info.Digest == "" {
+		// Files created empty never reference a blob
+		r = emptyBlob{strings.NewReader("")}
+	} else if r, err = rfs.blobs.Get(info.Digest); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &readOnlyFile{ReadSeekCloser: r, info: info}, nil
+}
+
+// ReadDir returns the entries of the named directory ordered by name.
+func (rfs *ReadOnlyFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	infos, err := rfs.ufs.ListDetailed(rfs.absPath(name))
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(fileStat{info}))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Stat returns the fs.FileInfo of the named file or directory, Sys returns its FileInfo.
+func (rfs *ReadOnlyFS) Stat(name string) (fs.FileInfo, error) {
+	info, err := rfs.stat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileStat{info}, nil
+}
+
+// Sub returns a view of the subtree rooted at dir. Like os.DirFS, dir does not need to exist yet.
+func (rfs *ReadOnlyFS) Sub(dir string) (fs.FS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	return &ReadOnlyFS{ufs: rfs.ufs, blobs: rfs.blobs, root: rfs.absPath(dir)}, nil
+}
+
+func (rfs *ReadOnlyFS) stat(op, name string) (FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return FileInfo{}, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := rfs.ufs.Stat(rfs.absPath(name))
+	if err != nil {
+		return FileInfo{}, pathError(op, name, err)
+	}
+	if name == "." {
+		info.Name = "."
+	}
+	return info, nil
+}
+
+func (rfs *ReadOnlyFS) absPath(name string) string {
+	return path.Join(rfs.root, name)
+}
+
+// pathError reports err against the name used within the view rather than the absolute path.
+func pathError(op, name string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// fileStat adapts a FileInfo to fs.FileInfo.
+type fileStat struct {
+	info FileInfo
+}
+
+func (s fileStat) Name() string       { return s.info.Name }
+func (s fileStat) Size() int64        { return s.info.Size }
+func (s fileStat) ModTime() time.Time { return s.info.ModTime }
+func (s fileStat) IsDir() bool        { return s.info.IsDir }
+func (s fileStat) Sys() any           { return s.info }
+
+func (s fileStat) Mode() fs.FileMode {
+	if s.info.IsDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// readOnlyFile is an open file of a ReadOnlyFS, it also implements io.Seeker as http.FS requires.
+type readOnlyFile struct {
+	io.ReadSeekCloser
+	info FileInfo
+}
+
+func (f *readOnlyFile) Stat() (fs.FileInfo, error) {
+	return fileStat{f.info}, nil
+}
+
+type emptyBlob struct {
+	*strings.Reader
+}
+
+func (emptyBlob) Close() error {
+	return nil
+}
+
+// readOnlyDir is an open directory of a ReadOnlyFS, its entries are loaded by the first ReadDir.
+type readOnlyDir struct {
+	rfs     *ReadOnlyFS
+	name    string
+	info    FileInfo
+	entries []fs.DirEntry
+	loaded  bool
+}
+
+func (d *readOnlyDir) Stat() (fs.FileInfo, error) {
+	return fileStat{d.info}, nil
+}
+
+func (d *readOnlyDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: ErrIsDirectory}
+}
+
+func (d *readOnlyDir) Close() error {
+	return nil
+}
+
+// ReadDir follows the contract of fs.ReadDirFile: with n > 0 it returns at
+// most n entries and io.EOF once the directory is exhausted.
+func (d *readOnlyDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.loaded {
+		entries, err := d.rfs.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.loaded = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,724 @@
+package ufs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// KVStore is a transactional, ordered key-value store that KVPersistor keeps
+// the records of every owner in. Keys are grouped in buckets, which exist as
+// soon as something is written to them.
+type KVStore interface {
+	// View runs fn in a read-only transaction.
+	View(fn func(tx KVTx) error) error
+	// Update runs fn in a read-write transaction, which is rolled back if fn returns an error.
+	Update(fn func(tx KVTx) error) error
+}
+
+// KVTx is a transaction of a KVStore. Values handed out are only valid
+// until the transaction ends.
+type KVTx interface {
+	// Get returns the value of key, nil if there is none.
+	Get(bucket string, key []byte) ([]byte, error)
+	Put(bucket string, key, value []byte) error
+	Delete(bucket string, key []byte) error
+	// Scan calls fn for every key starting with prefix in key order, fn must not modify the bucket.
+	Scan(bucket string, prefix []byte, fn func(key, value []byte) error) error
+	// NextID returns a new, increasing ID unique within bucket.
+	NextID(bucket string) (uint64, error)
+}
+
+var errReadOnlyTx = errors.New("write in a read-only transaction")
+
+// The buckets of a KVStore used by KVPersistor.
+const (
+	// kvFiles holds the records by owner and path, see fileKey.
+	kvFiles = "files"
+	// kvFileIDs maps the ID of a record to its key in kvFiles.
+	kvFileIDs = "file_ids"
+	// kvVersions holds the versions by the ID of their file and their own ID.
+	kvVersions = "versions"
+	// kvTrash holds the trash items by ID.
+	kvTrash = "trash"
+	// kvRefs holds the blob reference counts by digest.
+	kvRefs = "blob_refs"
+	// kvQuotas holds the quotas by owner.
+	kvQuotas = "quotas"
+)
+
+// fileKey orders the records of an owner by path, so that the records of a
+// subtree are adjacent and parents come before their children.
+func fileKey(owner, path string) []byte {
+	return []byte(owner + "\x00" + path)
+}
+
+func idKey(id uint) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(id))
+}
+
+func versionKey(fileID, id uint) []byte {
+	return append(idKey(fileID), idKey(id)...)
+}
+
+func kvGet(tx KVTx, bucket string, key []byte, v any) (found bool, err error) {
+	data, err := tx.Get(bucket, key)
+	if err != nil || data == nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to decode %s record %q: %v", bucket, key, err)
+	}
+	return true, nil
+}
+
+func kvPut(tx KVTx, bucket string, key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Put(bucket, key, data)
+}
+
+func kvScan[T any](tx KVTx, bucket string, prefix []byte) ([]T, error) {
+	var values []T
+	err := tx.Scan(bucket, prefix, func(key, data []byte) error {
+		var v T
+		if err := json.Unmarshal(data, &v); err != nil {
+			return fmt.Errorf("failed to decode %s record %q: %v", bucket, key, err)
+		}
+		values = append(values, v)
+		return nil
+	})
+	return values, err
+}
+
+// KVPersistor stores the records of a single owner in a KVStore, which may
+// be shared with the persistors of other owners. It behaves exactly like
+// GormPersistor, versions, trash, reference counts and quotas included.
+type KVPersistor struct {
+	store KVStore
+	owner string
+}
+
+func NewKVPersistor(store KVStore, owner string) *KVPersistor {
+	return &KVPersistor{store: store, owner: owner}
+}
+
+// KVPersistors returns a PersistorFactory whose persistors share store.
+func KVPersistors(store KVStore) PersistorFactory {
+	return func(owner string) Persistor {
+		return NewKVPersistor(store, owner)
+	}
+}
+
+// PersistFile inserts or updates the record for path, persisting any missing parent directories first.
+func (p *KVPersistor) PersistFile(path string, isDir bool, content []byte) error {
+	return p.store.Update(func(tx KVTx) error {
+		return persistRecord(kvRecords{tx}, p.owner, filepath.Clean(path), FileSystem{IsDirectory: isDir, Content: content})
+	})
+}
+
+// PersistBlob inserts or updates the file record for path as a reference to a blob.
+func (p *KVPersistor) PersistBlob(path string, ref BlobRef) error {
+	return p.store.Update(func(tx KVTx) error {
+		return persistRecord(kvRecords{tx}, p.owner, filepath.Clean(path), blobRecord(ref))
+	})
+}
+
+// PersistEntries persists all entries in a single transaction.
+func (p *KVPersistor) PersistEntries(entries []Entry) error {
+	return p.store.Update(func(tx KVTx) error {
+		return persistEntries(kvRecords{tx}, p.owner, entries)
+	})
+}
+
+// RemovePersistedFile deletes the record for path together with all of its descendants.
+func (p *KVPersistor) RemovePersistedFile(path string) error {
+	return p.store.Update(func(tx KVTx) error {
+		return removeRecords(kvRecords{tx}, p.owner, filepath.Clean(path))
+	})
+}
+
+// LoadDirMap returns the children of every directory whose path starts with path.
+func (p *KVPersistor) LoadDirMap(path string) (dirMap map[string][]string, err error) {
+	var records []FileSystem
+	err = p.store.View(func(tx KVTx) error {
+		records, err = kvScan[FileSystem](tx, kvFiles, fileKey(p.owner, path))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dirMap = make(map[string][]string)
+	for _, fs := range records {
+		if fs.IsDirectory {
+			dirMap[fs.Path] = []string{}
+		}
+		dirPath := filepath.Dir(fs.Path)
+		if _, exists := dirMap[dirPath]; exists {
+			dirMap[dirPath] = append(dirMap[dirPath], fs.Name)
+		}
+	}
+	return dirMap, nil
+}
+
+// LoadRecords returns every record at or below path, ordered by path.
+func (p *KVPersistor) LoadRecords(path string) (records []FileSystem, err error) {
+	absPath := filepath.Clean(path)
+	err = p.store.View(func(tx KVTx) error {
+		records, err = kvRecords{tx}.subtree(p.owner, absPath)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load records under %s: %v", absPath, err)
+	}
+	return records, nil
+}
+
+// LoadChildren returns the records directly below the directory at path, ordered by name.
+func (p *KVPersistor) LoadChildren(path string) (children []FileSystem, err error) {
+	absPath := filepath.Clean(path)
+	err = p.store.View(func(tx KVTx) error {
+		var parentID uint
+		if absPath != "/" {
+			parent, found, err := p.find(tx, absPath)
+			if err != nil || !found {
+				return err
+			}
+			parentID = parent.ID
+		}
+
+		records, err := kvScan[FileSystem](tx, kvFiles, fileKey(p.owner, childPrefix(absPath)))
+		for _, record := range records {
+			if record.ParentID == parentID {
+				children = append(children, record)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load children of %s: %v", absPath, err)
+	}
+	// A name sorts before the paths below it, but not necessarily before a longer sibling
+	sort.Slice(children, func(i, j int) bool { return children[i].Name < children[j].Name })
+	return children, nil
+}
+
+// UpdatePaths rewrites the record of srcPath and all of its descendants so
+// that they live under dstPath.
+func (p *KVPersistor) UpdatePaths(srcPath, dstPath string) error {
+	return p.store.Update(func(tx KVTx) error {
+		return transferRecords(kvRecords{tx}, p.owner, filepath.Clean(srcPath), p.owner, filepath.Clean(dstPath))
+	})
+}
+
+// PathExists checks if a given path has a record.
+func (p *KVPersistor) PathExists(path string) bool {
+	_, found, err := p.FindRecord(path)
+	return err == nil && found
+}
+
+// FindRecord returns the record stored for path, if any.
+func (p *KVPersistor) FindRecord(path string) (fs FileSystem, found bool, err error) {
+	err = p.store.View(func(tx KVTx) error {
+		fs, found, err = p.find(tx, filepath.Clean(path))
+		return err
+	})
+	return fs, found, err
+}
+
+func (p *KVPersistor) find(tx KVTx, path string) (fs FileSystem, found bool, err error) {
+	return kvRecords{tx}.find(p.owner, path)
+}
+
+// MoveToTrash moves the subtree at path into the trash and records it as a TrashItem.
+func (p *KVPersistor) MoveToTrash(path string) (item TrashItem, err error) {
+	absPath := filepath.Clean(path)
+	err = p.store.Update(func(tx KVTx) error {
+		records, err := kvRecords{tx}.subtree(p.owner, absPath)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 || records[0].Path != absPath {
+			return &os.PathError{Op: "trash", Path: absPath, Err: os.ErrNotExist}
+		}
+
+		var size int64
+		for _, record := range records {
+			size += record.Size
+		}
+		id, err := tx.NextID(kvTrash)
+		if err != nil {
+			return err
+		}
+		item = TrashItem{
+			ID:           uint(id),
+			Owner:        p.owner,
+			Name:         records[0].Name,
+			OriginalPath: absPath,
+			IsDirectory:  records[0].IsDirectory,
+			Size:         size,
+			DeletedAt:    time.Now(),
+		}
+		if err := kvPut(tx, kvTrash, idKey(item.ID), item); err != nil {
+			return fmt.Errorf("failed to create trash item: %v", err)
+		}
+		return transferRecords(kvRecords{tx}, p.owner, absPath, trashOwner(p.owner), trashPath(item.ID, item.Name))
+	})
+	return item, err
+}
+
+// ListTrash returns the trash items of the owner, most recently deleted first.
+func (p *KVPersistor) ListTrash() (items []TrashItem, err error) {
+	err = p.store.View(func(tx KVTx) error {
+		all, err := kvScan[TrashItem](tx, kvTrash, nil)
+		for _, item := range all {
+			if item.Owner == p.owner {
+				items = append(items, item)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list trash: %v", err)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].DeletedAt.Equal(items[j].DeletedAt) {
+			return items[i].DeletedAt.After(items[j].DeletedAt)
+		}
+		return items[i].ID > items[j].ID
+	})
+	return items, nil
+}
+
+// FindTrash returns the trash item with id, if the owner has one.
+func (p *KVPersistor) FindTrash(id uint) (item TrashItem, found bool, err error) {
+	err = p.store.View(func(tx KVTx) error {
+		item, found, err = p.findTrash(tx, id)
+		return err
+	})
+	return item, found, err
+}
+
+func (p *KVPersistor) findTrash(tx KVTx, id uint) (item TrashItem, found bool, err error) {
+	found, err = kvGet(tx, kvTrash, idKey(id), &item)
+	if err != nil {
+		return item, false, fmt.Errorf("failed to query trash item %d: %v", id, err)
+	}
+	if found && item.Owner != p.owner {
+		return TrashItem{}, false, nil
+	}
+	return item, found, nil
+}
+
+// RestoreFromTrash moves the tree of the trash item with id back to dstPath and forgets the item.
+func (p *KVPersistor) RestoreFromTrash(id uint, dstPath string) error {
+	return p.store.Update(func(tx KVTx) error {
+		item, err := p.takeTrash(tx, id)
+		if err != nil {
+			return err
+		}
+		return restoreTrash(kvRecords{tx}, p.owner, item, filepath.Clean(dstPath))
+	})
+}
+
+// PurgeTrash deletes the trash item with id and its tree, releasing the blobs it references.
+func (p *KVPersistor) PurgeTrash(id uint) error {
+	return p.store.Update(func(tx KVTx) error {
+		item, err := p.takeTrash(tx, id)
+		if err != nil {
+			return err
+		}
+		return removeRecords(kvRecords{tx}, trashOwner(p.owner), filepath.Dir(trashPath(item.ID, item.Name)))
+	})
+}
+
+// takeTrash deletes the trash item with id and returns it.
+func (p *KVPersistor) takeTrash(tx KVTx, id uint) (TrashItem, error) {
+	item, found, err := p.findTrash(tx, id)
+	if err != nil {
+		return item, err
+	}
+	if !found {
+		return item, ErrTrashItemNotFound
+	}
+	if err := tx.Delete(kvTrash, idKey(id)); err != nil {
+		return item, fmt.Errorf("failed to delete trash item %d: %v", id, err)
+	}
+	return item, nil
+}
+
+// LoadVersions returns the versions of the file at path, most recent first.
+func (p *KVPersistor) LoadVersions(path string) (versions []FileVersion, err error) {
+	absPath := filepath.Clean(path)
+	err = p.store.View(func(tx KVTx) error {
+		file, err := p.findFile(tx, absPath)
+		if err != nil {
+			return err
+		}
+		if versions, err = kvScan[FileVersion](tx, kvVersions, idKey(file.ID)); err != nil {
+			return fmt.Errorf("failed to load versions of %s: %v", absPath, err)
+		}
+		return nil
+	})
+	sortVersions(versions)
+	return versions, err
+}
+
+// sortVersions orders versions most recent first, like LoadVersions.
+func sortVersions(versions []FileVersion) {
+	sort.Slice(versions, func(i, j int) bool {
+		if !versions[i].CreatedAt.Equal(versions[j].CreatedAt) {
+			return versions[i].CreatedAt.After(versions[j].CreatedAt)
+		}
+		return versions[i].ID > versions[j].ID
+	})
+}
+
+// FindVersion returns the version with id of the file at path.
+func (p *KVPersistor) FindVersion(path string, id uint) (version FileVersion, err error) {
+	err = p.store.View(func(tx KVTx) error {
+		version, err = p.findVersion(tx, filepath.Clean(path), id)
+		return err
+	})
+	return version, err
+}
+
+// RestoreVersion makes the version with id the current content of the file
+// at path, keeping the replaced content as a version in turn.
+func (p *KVPersistor) RestoreVersion(path string, id uint) (version FileVersion, err error) {
+	absPath := filepath.Clean(path)
+	err = p.store.Update(func(tx KVTx) error {
+		if version, err = p.findVersion(tx, absPath, id); err != nil {
+			return err
+		}
+		return restoreVersion(kvRecords{tx}, p.owner, absPath, version)
+	})
+	return version, err
+}
+
+func (p *KVPersistor) findVersion(tx KVTx, absPath string, id uint) (version FileVersion, err error) {
+	file, err := p.findFile(tx, absPath)
+	if err != nil {
+		return version, err
+	}
+	found, err := kvGet(tx, kvVersions, versionKey(file.ID, id), &version)
+	if err != nil {
+		return version, fmt.Errorf("failed to query version %d: %v", id, err)
+	}
+	if !found {
+		return version, ErrVersionNotFound
+	}
+	return version, nil
+}
+
+// findFile returns the record of the file at absPath, failing for directories and missing paths.
+func (p *KVPersistor) findFile(tx KVTx, absPath string) (FileSystem, error) {
+	file, found, err := p.find(tx, absPath)
+	if err != nil {
+		return file, err
+	}
+	if !found {
+		return file, &os.PathError{Op: "versions", Path: absPath, Err: os.ErrNotExist}
+	}
+	if file.IsDirectory {
+		return file, &os.PathError{Op: "versions", Path: absPath, Err: ErrIsDirectory}
+	}
+	return file, nil
+}
+
+// LoadQuota returns the quota of the owner, an owner that never stored a file has a zero one.
+func (p *KVPersistor) LoadQuota() (quota Quota, err error) {
+	owner := quotaOwner(p.owner)
+	err = p.store.View(func(tx KVTx) error {
+		_, err := kvGet(tx, kvQuotas, []byte(owner), &quota)
+		return err
+	})
+	if err != nil {
+		return quota, fmt.Errorf("failed to query quota of %s: %v", owner, err)
+	}
+	quota.Owner = owner
+	return quota, nil
+}
+
+// kvRecords is the recordTx of a KVPersistor transaction.
+type kvRecords struct {
+	tx KVTx
+}
+
+func (r kvRecords) find(owner, path string) (fs FileSystem, found bool, err error) {
+	found, err = kvGet(r.tx, kvFiles, fileKey(owner, path), &fs)
+	if err != nil {
+		return fs, false, fmt.Errorf("failed to query path %s: %v", path, err)
+	}
+	return fs, found, nil
+}
+
+// subtree scans the keys of the descendants of absPath, which are adjacent
+// to the key of absPath itself.
+func (r kvRecords) subtree(owner, absPath string) ([]FileSystem, error) {
+	var records []FileSystem
+	if absPath != "/" {
+		root, found, err := r.find(owner, absPath)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			records = append(records, root)
+		}
+	}
+	descendants, err := kvScan[FileSystem](r.tx, kvFiles, fileKey(owner, childPrefix(absPath)))
+	return append(records, descendants...), err
+}
+
+// save stores record under its owner and path, assigning an ID to a new record.
+func (r kvRecords) save(record *FileSystem) error {
+	if record.ID == 0 {
+		id, err := r.tx.NextID(kvFiles)
+		if err != nil {
+			return err
+		}
+		record.ID = uint(id)
+	}
+	key := fileKey(record.Owner, record.Path)
+	if err := kvPut(r.tx, kvFiles, key, record); err != nil {
+		return err
+	}
+	return r.tx.Put(kvFileIDs, idKey(record.ID), key)
+}
+
+// relocate takes every record out first, a subtree may move below its old path.
+func (r kvRecords) relocate(records []FileSystem) error {
+	for _, record := range records {
+		key, err := r.tx.Get(kvFileIDs, idKey(record.ID))
+		if err != nil {
+			return err
+		}
+		if err := r.tx.Delete(kvFiles, bytes.Clone(key)); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		// Paths are unique per owner, like the index of the file_systems table
+		if _, found, err := r.find(record.Owner, record.Path); err != nil || found {
+			if err == nil {
+				err = &os.PathError{Op: "move", Path: record.Path, Err: os.ErrExist}
+			}
+			return err
+		}
+		if err := r.save(&record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r kvRecords) delete(records []FileSystem) error {
+	versions, err := r.versions(recordIDs(records))
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := r.tx.Delete(kvVersions, versionKey(version.FileID, version.ID)); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		if err := r.tx.Delete(kvFiles, fileKey(record.Owner, record.Path)); err != nil {
+			return err
+		}
+		if err := r.tx.Delete(kvFileIDs, idKey(record.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r kvRecords) versions(fileIDs []uint) ([]FileVersion, error) {
+	var versions []FileVersion
+	for _, fileID := range fileIDs {
+		found, err := kvScan[FileVersion](r.tx, kvVersions, idKey(fileID))
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, found...)
+	}
+	return versions, nil
+}
+
+func (r kvRecords) saveVersion(version *FileVersion) error {
+	id, err := r.tx.NextID(kvVersions)
+	if err != nil {
+		return err
+	}
+	version.ID = uint(id)
+	return kvPut(r.tx, kvVersions, versionKey(version.FileID, version.ID), version)
+}
+
+func (r kvRecords) deleteVersion(version FileVersion) (bool, error) {
+	key := versionKey(version.FileID, version.ID)
+	if data, err := r.tx.Get(kvVersions, key); err != nil || data == nil {
+		return false, err
+	}
+	return true, r.tx.Delete(kvVersions, key)
+}
+
+func (r kvRecords) addRef(digest string, size int64, delta int64) error {
+	if digest == "" || delta == 0 {
+		return nil
+	}
+	count := BlobRefCount{Digest: digest, Size: size}
+	if _, err := kvGet(r.tx, kvRefs, []byte(digest), &count); err != nil {
+		return fmt.Errorf("failed to update refs of %s: %v", digest, err)
+	}
+	count.Refs += delta
+	count.UpdatedAt = time.Now()
+	if err := kvPut(r.tx, kvRefs, []byte(digest), count); err != nil {
+		return fmt.Errorf("failed to update refs of %s: %v", digest, err)
+	}
+	return nil
+}
+
+func (r kvRecords) addUsage(owner string, bytes, files int64) error {
+	if bytes == 0 && files == 0 {
+		return nil
+	}
+	owner = quotaOwner(owner)
+	quota := Quota{Owner: owner}
+	if _, err := kvGet(r.tx, kvQuotas, []byte(owner), &quota); err != nil {
+		return fmt.Errorf("failed to update usage of %s: %v", owner, err)
+	}
+	quota.UsedBytes += bytes
+	quota.UsedFiles += files
+	quota.UpdatedAt = time.Now()
+	if err := kvPut(r.tx, kvQuotas, []byte(owner), quota); err != nil {
+		return fmt.Errorf("failed to update usage of %s: %v", owner, err)
+	}
+	return nil
+}
+
+// KVRefCounter gives the garbage collector access to the reference counts kept in a KVStore.
+type KVRefCounter struct {
+	store KVStore
+}
+
+func NewKVRefCounter(store KVStore) RefCounter {
+	return &KVRefCounter{store: store}
+}
+
+func (c *KVRefCounter) Refs(digest string) (count BlobRefCount, found bool, err error) {
+	err = c.store.View(func(tx KVTx) error {
+		found, err = kvGet(tx, kvRefs, []byte(digest), &count)
+		return err
+	})
+	if err != nil {
+		return count, false, fmt.Errorf("failed to query refs of %s: %v", digest, err)
+	}
+	return count, found, nil
+}
+
+func (c *KVRefCounter) Forget(digest string) (forgotten bool, err error) {
+	err = c.store.Update(func(tx KVTx) error {
+		var count BlobRefCount
+		found, err := kvGet(tx, kvRefs, []byte(digest), &count)
+		if err != nil || !found || count.Refs > 0 {
+			return err
+		}
+		forgotten = true
+		return tx.Delete(kvRefs, []byte(digest))
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to forget refs of %s: %v", digest, err)
+	}
+	return forgotten, nil
+}
+
+// KVTrashCollector finds the expired trash items kept in a KVStore.
+type KVTrashCollector struct {
+	store KVStore
+}
+
+func NewKVTrashCollector(store KVStore) TrashCollector {
+	return &KVTrashCollector{store: store}
+}
+
+func (c *KVTrashCollector) Expired(before time.Time, limit int) (items []TrashItem, err error) {
+	err = c.store.View(func(tx KVTx) error {
+		all, err := kvScan[TrashItem](tx, kvTrash, nil)
+		for _, item := range all {
+			if item.DeletedAt.Before(before) {
+				items = append(items, item)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired trash items: %v", err)
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].DeletedAt.Before(items[j].DeletedAt) })
+	return items[:min(limit, len(items))], nil
+}
+
+// KVVersionPruner applies the version retention to the versions kept in a KVStore.
+type KVVersionPruner struct {
+	store KVStore
+}
+
+func NewKVVersionPruner(store KVStore) VersionPruner {
+	return &KVVersionPruner{store: store}
+}
+
+func (v *KVVersionPruner) Prune(keep int, before time.Time) (int, error) {
+	var versions []FileVersion
+	err := v.store.View(func(tx KVTx) (err error) {
+		versions, err = kvScan[FileVersion](tx, kvVersions, nil)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to find expired versions: %v", err)
+	}
+
+	// Versions are ordered by file, the most recent of each file come first after sorting
+	byFile := make(map[uint][]FileVersion)
+	for _, version := range versions {
+		byFile[version.FileID] = append(byFile[version.FileID], version)
+	}
+	var expired []FileVersion
+	for _, versions := range byFile {
+		sortVersions(versions)
+		for i, version := range versions {
+			if (keep > 0 && i >= keep) || (!before.IsZero() && version.CreatedAt.Before(before)) {
+				expired = append(expired, version)
+			}
+		}
+	}
+
+	pruned := 0
+	for _, version := range expired {
+		err := v.store.Update(func(tx KVTx) error {
+			// The version counted toward the quota of whoever owns its file now
+			fileKey, err := tx.Get(kvFileIDs, idKey(version.FileID))
+			if err != nil {
+				return err
+			}
+			owner, _, _ := bytes.Cut(fileKey, []byte{0})
+			released, err := releaseVersion(kvRecords{tx}, string(owner), version)
+			if released && err == nil {
+				pruned++
+			}
+			return err
+		})
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune version %d: %v", version.ID, err)
+		}
+	}
+	return pruned, nil
+}
@@ -1,7 +1,6 @@
 package ufs
 
 import (
-	"gorm.io/gorm"
 	"sync"
 )
 
@@ -11,16 +10,17 @@ type UserManager interface {
 
 // UserManager manages file systems for multiple users.
 type userManager struct {
-	users map[string]*UserFileSystem
-	mutex sync.RWMutex
-	db    *gorm.DB
+	users        map[string]*UserFileSystem
+	mutex        sync.RWMutex
+	newPersistor PersistorFactory
 }
 
-// NewUserManager creates a new UserManager instance.
-func NewUserManager(db *gorm.DB) UserManager {
+// NewUserManager creates a new UserManager instance whose file systems are
+// backed by the persistors newPersistor creates, e.g. GormPersistors(db).
+func NewUserManager(newPersistor PersistorFactory) UserManager {
 	return &userManager{
-		users: make(map[string]*UserFileSystem),
-		db:    db,
+		users:        make(map[string]*UserFileSystem),
+		newPersistor: newPersistor,
 	}
 }
 
@@ -41,7 +41,7 @@ func (um *userManager) User(username string) *UserFileSystem {
 		return ufs
 	}
 
-	ufs = NewUserFileSystem(um.db)
+	ufs = NewPersistedFileSystem(um.newPersistor(username))
 	um.users[username] = ufs
 	return ufs
 }
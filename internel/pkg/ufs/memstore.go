@@ -0,0 +1,128 @@
+package ufs
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStore is a KVStore that keeps everything in memory, for tests and
+// for file systems that do not need to outlive the process. Transactions
+// are serialized, and an update that fails is undone.
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	buckets map[string]map[string][]byte
+	ids     map[string]uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]map[string][]byte),
+		ids:     make(map[string]uint64),
+	}
+}
+
+// MemoryPersistors returns a PersistorFactory whose persistors share a new MemoryStore.
+func MemoryPersistors() PersistorFactory {
+	return KVPersistors(NewMemoryStore())
+}
+
+func (s *MemoryStore) View(fn func(tx KVTx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return fn(&memoryTx{store: s})
+}
+
+func (s *MemoryStore) Update(fn func(tx KVTx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx := &memoryTx{store: s, writable: true}
+	if err := fn(tx); err != nil {
+		tx.rollback()
+		return err
+	}
+	return nil
+}
+
+// memoryTx records how to undo each change it makes, most recent last.
+type memoryTx struct {
+	store    *MemoryStore
+	writable bool
+	undo     []func()
+}
+
+func (tx *memoryTx) Get(bucket string, key []byte) ([]byte, error) {
+	return tx.store.buckets[bucket][string(key)], nil
+}
+
+func (tx *memoryTx) Put(bucket string, key, value []byte) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+	b, ok := tx.store.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		tx.store.buckets[bucket] = b
+	}
+	tx.remember(b, string(key))
+	b[string(key)] = bytes.Clone(value)
+	return nil
+}
+
+func (tx *memoryTx) Delete(bucket string, key []byte) error {
+	if !tx.writable {
+		return errReadOnlyTx
+	}
+	b := tx.store.buckets[bucket]
+	if _, ok := b[string(key)]; ok {
+		tx.remember(b, string(key))
+		delete(b, string(key))
+	}
+	return nil
+}
+
+func (tx *memoryTx) Scan(bucket string, prefix []byte, fn func(key, value []byte) error) error {
+	b := tx.store.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn([]byte(key), b[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) NextID(bucket string) (uint64, error) {
+	if !tx.writable {
+		return 0, errReadOnlyTx
+	}
+	id := tx.store.ids[bucket]
+	tx.undo = append(tx.undo, func() { tx.store.ids[bucket] = id })
+	tx.store.ids[bucket] = id + 1
+	return id + 1, nil
+}
+
+// remember records how to restore the current value of key in b.
+func (tx *memoryTx) remember(b map[string][]byte, key string) {
+	value, ok := b[key]
+	tx.undo = append(tx.undo, func() {
+		if ok {
+			b[key] = value
+		} else {
+			delete(b, key)
+		}
+	})
+}
+
+func (tx *memoryTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+}
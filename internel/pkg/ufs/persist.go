@@ -4,88 +4,137 @@ import (
 	"fmt"
 	"gorm.io/gorm"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 // Persistor is the interface for persistence operations.
 type Persistor interface {
-	PersistFile(path string, isDir bool) error
+	PersistFile(path string, isDir bool, content []byte) error
+	PersistBlob(path string, ref BlobRef) error
+	PersistEntries(entries []Entry) error
 	RemovePersistedFile(path string) error
 	LoadDirMap(path string) (dirMap map[string][]string, err error)
+	LoadRecords(path string) ([]FileSystem, error)
+	LoadChildren(path string) ([]FileSystem, error)
 	UpdatePaths(srcPath, dstPath string) error
 	PathExists(path string) bool
+	FindRecord(path string) (fs FileSystem, found bool, err error)
+	MoveToTrash(path string) (TrashItem, error)
+	ListTrash() ([]TrashItem, error)
+	FindTrash(id uint) (item TrashItem, found bool, err error)
+	RestoreFromTrash(id uint, dstPath string) error
+	PurgeTrash(id uint) error
+	LoadVersions(path string) ([]FileVersion, error)
+	FindVersion(path string, id uint) (FileVersion, error)
+	RestoreVersion(path string, id uint) (FileVersion, error)
+	LoadQuota() (Quota, error)
+}
+
+// PersistorFactory returns the Persistor of the records of owner.
+type PersistorFactory func(owner string) Persistor
+
+// BlobRef points a file at a blob in the BlobStore. Many files, of any owner,
+// may reference the same blob.
+type BlobRef struct {
+	Digest   string
+	Size     int64
+	MimeType string
+	ModTime  time.Time
+	// Uploader is the user who uploaded the content, the owner of the file when empty.
+	Uploader string
+}
+
+// blobRecord returns a file record that references ref.
+func blobRecord(ref BlobRef) FileSystem {
+	return FileSystem{Digest: ref.Digest, Size: ref.Size, MimeType: ref.MimeType, ModTime: ref.ModTime, Uploader: ref.Uploader}
+}
+
+// blobRef returns the blob referenced by the file record.
+func (fs FileSystem) blobRef() BlobRef {
+	ref := BlobRef{Digest: fs.Digest, Size: fs.Size, MimeType: fs.MimeType, ModTime: fs.ModTime, Uploader: fs.Uploader}
+	// Records written before blob references existed hold the md5 as their content
+	if fs.Digest == "" {
+		ref.Digest = string(fs.Content)
+	}
+	return ref
+}
+
+// Entry is a file or directory persisted as part of a batch, files reference a blob.
+type Entry struct {
+	Path  string
+	IsDir bool
+	Ref   BlobRef
 }
 
 type FileSystem struct {
-	ID          uint        `gorm:"column:id;primaryKey;autoIncrement"`                                // 自动递增主键，列名为 "id"
-	Name        string      `gorm:"column:name;size:255;not null"`                                     // 文件或目录名称，最大长度255，非空，列名为 "name"
-	Path        string      `gorm:"column:path;size:1024;not null;uniqueIndex"`                        // 文件或目录路径，最大长度1024，非空，唯一索引，列名为 "path"
-	ParentID    uint        `gorm:"column:parent_id;index"`                                            // 父目录ID，普通索引，列名为 "parent_id"
-	IsDirectory bool        `gorm:"column:is_directory;not null;default:false"`                        // 是否为目录，默认为false（文件），列名为 "is_directory"
-	Content     []byte      `gorm:"column:content;type:blob"`                                          // 文件内容，BLOB类型，列名为 "content"
-	Parent      *FileSystem `gorm:"foreignKey:ParentID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"` // 外键，父目录ID，级联更新和删除
+	ID          uint        `gorm:"column:id;primaryKey;autoIncrement"`                                  // 自动递增主键，列名为 "id"
+	Owner       string      `gorm:"column:owner;size:64;not null;default:'';uniqueIndex:idx_owner_path"` // 所属用户，与 path 组成联合唯一索引，列名为 "owner"
+	Name        string      `gorm:"column:name;size:255;not null"`                                       // 文件或目录名称，最大长度255，非空，列名为 "name"
+	Path        string      `gorm:"column:path;size:1024;not null;uniqueIndex:idx_owner_path"`           // 文件或目录路径，最大长度1024，非空，联合唯一索引，列名为 "path"
+	ParentID    uint        `gorm:"column:parent_id;index"`                                              // 父目录ID，普通索引，列名为 "parent_id"
+	IsDirectory bool        `gorm:"column:is_directory;not null;default:false"`                          // 是否为目录，默认为false（文件），列名为 "is_directory"
+	Content     []byte      `gorm:"column:content;type:blob"`                                            // 文件内容，BLOB类型，列名为 "content"
+	Digest      string      `gorm:"column:digest;size:64;index"`                                         // 引用的 blob 摘要，普通索引，列名为 "digest"
+	Size        int64       `gorm:"column:size;not null;default:0"`                                      // 文件大小 (字节)，列名为 "size"
+	MimeType    string      `gorm:"column:mime_type;size:255"`                                           // 文件类型，列名为 "mime_type"
+	Uploader    string      `gorm:"column:uploader;size:64"`                                             // 上传文件内容的用户，列名为 "uploader"
+	CTime       time.Time   `gorm:"column:ctime"`                                                        // 创建时间，列名为 "ctime"
+	ModTime     time.Time   `gorm:"column:mtime"`                                                        // 文件修改时间，列名为 "mtime"
+	Parent      *FileSystem `gorm:"foreignKey:ParentID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`   // 外键，父目录ID，级联更新和删除
 }
 
+// GormPersistor stores the records of a single owner, every query is scoped by it.
 type GormPersistor struct {
-	db *gorm.DB
+	db    *gorm.DB
+	owner string
 }
 
-func NewGormPersistor(db *gorm.DB) *GormPersistor {
-	return &GormPersistor{db: db}
+func NewGormPersistor(db *gorm.DB, owner string) *GormPersistor {
+	return &GormPersistor{db: db, owner: owner}
 }
 
-func (p *GormPersistor) PersistFile(path string, isDir bool) error {
-	return p.db.Transaction(func(tx *gorm.DB) error {
-		absPath := filepath.Clean(path)
-		dirPath := filepath.Dir(absPath)
-
-		// Check if the parent directory exists, if not persist it first
-		if dirPath != "/" && dirPath != "." && !p.PathExists(dirPath) {
-			// Recursively persist the parent directory
-			if err := p.PersistFile(dirPath, true); err != nil {
-				return fmt.Errorf("failed to persist parent directory %s: %v", dirPath, err)
-			}
-		}
+// GormPersistors returns a PersistorFactory whose persistors share db.
+func GormPersistors(db *gorm.DB) PersistorFactory {
+	return func(owner string) Persistor {
+		return NewGormPersistor(db, owner)
+	}
+}
 
-		// Remove existing entry for the path
-		if err := tx.Where("path = ?", absPath).Delete(&FileSystem{}).Error; err != nil {
-			return fmt.Errorf("failed to delete existing data for path %s: %v", absPath, err)
-		}
+// PersistFile inserts or updates the record for path, persisting any missing
+// parent directories first. Existing records keep their ID so that the
+// ParentID of their children stays valid.
+func (p *GormPersistor) PersistFile(path string, isDir bool, content []byte) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		return persistRecord(gormRecords{tx}, p.owner, filepath.Clean(path), FileSystem{IsDirectory: isDir, Content: content})
+	})
+}
 
-		// Insert or update the file or directory itself
-		fs := FileSystem{
-			Name:        filepath.Base(absPath),
-			Path:        absPath,
-			ParentID:    p.getParentID(dirPath),
-			IsDirectory: isDir,
-		}
-		if err := tx.Save(&fs).Error; err != nil {
-			return fmt.Errorf("failed to insert or update data for path %s: %v", absPath, err)
-		}
+// PersistBlob inserts or updates the file record for path as a reference to a blob.
+func (p *GormPersistor) PersistBlob(path string, ref BlobRef) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		return persistRecord(gormRecords{tx}, p.owner, filepath.Clean(path), blobRecord(ref))
+	})
+}
 
-		return nil
+// PersistEntries persists all entries in a single transaction, either every
+// entry is stored or none is.
+func (p *GormPersistor) PersistEntries(entries []Entry) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		return persistEntries(gormRecords{tx}, p.owner, entries)
 	})
 }
 
+// RemovePersistedFile deletes the record for path together with all of its descendants.
 func (p *GormPersistor) RemovePersistedFile(path string) error {
 	return p.db.Transaction(func(tx *gorm.DB) error {
-		// First, find the parent ID of the path to delete
-		var parentID uint
-		if err := tx.Model(&FileSystem{}).Select("parent_id").Where("path = ?", path).Scan(&parentID).Error; err != nil {
-			return fmt.Errorf("failed to find parent ID: %v", err)
-		}
-
-		// Delete the file and its child entries
-		if err := tx.Where("path = ? OR parent_id = ?", path, parentID).Delete(&FileSystem{}).Error; err != nil {
-			return fmt.Errorf("failed to delete persisted data: %v", err)
-		}
-
-		return nil
+		return removeRecords(gormRecords{tx}, p.owner, filepath.Clean(path))
 	})
 }
 
 func (p *GormPersistor) LoadDirMap(path string) (dirMap map[string][]string, err error) {
 	var fsRecords []FileSystem
-	if err := p.db.Where("path LIKE ?", path+"%").Find(&fsRecords).Error; err != nil {
+	if err := p.scope(p.db).Where("path LIKE ?", path+"%").Find(&fsRecords).Error; err != nil {
 		return nil, err
 	}
 
@@ -103,30 +152,174 @@ func (p *GormPersistor) LoadDirMap(path string) (dirMap map[string][]string, err
 	return dirMap, nil
 }
 
+// LoadRecords returns every record at or below path, ordered by path so that
+// parents always come before their children.
+func (p *GormPersistor) LoadRecords(path string) ([]FileSystem, error) {
+	absPath := filepath.Clean(path)
+	fsRecords, err := gormRecords{p.db}.subtree(p.owner, absPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load records under %s: %v", absPath, err)
+	}
+	return fsRecords, nil
+}
+
+// LoadChildren returns the records directly below the directory at path, ordered by name.
+func (p *GormPersistor) LoadChildren(path string) ([]FileSystem, error) {
+	absPath := filepath.Clean(path)
+	var parentID uint
+	if absPath != "/" {
+		parent, found, err := p.find(p.db, absPath)
+		if err != nil || !found {
+			return nil, err
+		}
+		parentID = parent.ID
+	}
+
+	var fsRecords []FileSystem
+	if err := p.scope(p.db).Where("parent_id = ?", parentID).Order("name").
+		Find(&fsRecords).Error; err != nil {
+		return nil, fmt.Errorf("failed to load children of %s: %v", absPath, err)
+	}
+	return fsRecords, nil
+}
+
+// UpdatePaths rewrites the record of srcPath and all of its descendants so
+// that they live under dstPath.
 func (p *GormPersistor) UpdatePaths(srcPath, dstPath string) error {
 	return p.db.Transaction(func(tx *gorm.DB) error {
-		// Update the paths for all records affected by the move operation
-		if err := tx.Model(&FileSystem{}).Where("path LIKE ?", srcPath+"%").
-			Update("path", gorm.Expr("REPLACE(path, ?, ?)", srcPath, dstPath)).Error; err != nil {
-			return fmt.Errorf("failed to update paths: %v", err)
-		}
-		return nil
+		return transferRecords(gormRecords{tx}, p.owner, filepath.Clean(srcPath), p.owner, filepath.Clean(dstPath))
 	})
 }
 
 // PathExists checks if a given path already exists in the database.
 func (p *GormPersistor) PathExists(path string) bool {
 	var count int64
-	err := p.db.Model(&FileSystem{}).Where("path = ?", filepath.Clean(path)).Count(&count).Error
+	err := p.scope(p.db).Model(&FileSystem{}).Where("path = ?", filepath.Clean(path)).Count(&count).Error
 	return err == nil && count > 0
 }
 
+// FindRecord returns the record stored for path, if any.
+func (p *GormPersistor) FindRecord(path string) (fs FileSystem, found bool, err error) {
+	return p.find(p.db, filepath.Clean(path))
+}
+
 // Helper methods
-func (p *GormPersistor) getParentID(path string) uint {
-	parentPath := filepath.Dir(path)
-	var fs FileSystem
-	if err := p.db.Where("path = ?", parentPath).First(&fs).Error; err != nil {
-		return 0 // No parent found, or error occurred
+func (p *GormPersistor) scope(tx *gorm.DB) *gorm.DB {
+	return tx.Where("owner = ?", p.owner)
+}
+
+func (p *GormPersistor) find(tx *gorm.DB, path string) (fs FileSystem, found bool, err error) {
+	return gormRecords{tx}.find(p.owner, path)
+}
+
+// gormRecords is the recordTx of a GormPersistor transaction.
+type gormRecords struct {
+	tx *gorm.DB
+}
+
+func (r gormRecords) find(owner, path string) (fs FileSystem, found bool, err error) {
+	res := r.tx.Where("owner = ? AND path = ?", owner, path).Limit(1).Find(&fs)
+	if res.Error != nil {
+		return fs, false, fmt.Errorf("failed to query path %s: %v", path, res.Error)
+	}
+	return fs, res.RowsAffected > 0, nil
+}
+
+func (r gormRecords) subtree(owner, absPath string) ([]FileSystem, error) {
+	query := r.tx.Where("owner = ?", owner).Order("path")
+	if absPath != "/" {
+		query = query.Where(subtreeQuery, absPath, descendantPattern(absPath))
+	}
+	var records []FileSystem
+	if err := query.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (r gormRecords) save(record *FileSystem) error {
+	return r.tx.Save(record).Error
+}
+
+func (r gormRecords) relocate(records []FileSystem) error {
+	for _, fs := range records {
+		updates := map[string]interface{}{
+			"owner":     fs.Owner,
+			"name":      fs.Name,
+			"path":      fs.Path,
+			"parent_id": fs.ParentID,
+		}
+		if err := r.tx.Model(&FileSystem{}).Where("id = ?", fs.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r gormRecords) delete(records []FileSystem) error {
+	for _, batch := range idBatches(recordIDs(records)) {
+		if err := r.tx.Where("file_id IN ?", batch).Delete(&FileVersion{}).Error; err != nil {
+			return err
+		}
+		if err := r.tx.Where("id IN ?", batch).Delete(&FileSystem{}).Error; err != nil {
+			return err
+		}
 	}
-	return fs.ID
+	return nil
+}
+
+func (r gormRecords) versions(fileIDs []uint) ([]FileVersion, error) {
+	var versions []FileVersion
+	for _, batch := range idBatches(fileIDs) {
+		var found []FileVersion
+		if err := r.tx.Where("file_id IN ?", batch).Find(&found).Error; err != nil {
+			return nil, err
+		}
+		versions = append(versions, found...)
+	}
+	return versions, nil
+}
+
+func (r gormRecords) saveVersion(version *FileVersion) error {
+	return r.tx.Create(version).Error
+}
+
+func (r gormRecords) deleteVersion(version FileVersion) (bool, error) {
+	res := r.tx.Delete(&FileVersion{}, version.ID)
+	return res.RowsAffected > 0, res.Error
+}
+
+func (r gormRecords) addRef(digest string, size int64, delta int64) error {
+	return addRef(r.tx, digest, size, delta)
+}
+
+func (r gormRecords) addUsage(owner string, bytes, files int64) error {
+	return addUsage(r.tx, owner, bytes, files)
+}
+
+// maxBatchIDs keeps the IDs bound in a single IN clause below the variable limit of SQLite.
+const maxBatchIDs = 500
+
+// idBatches splits ids into batches of at most maxBatchIDs.
+func idBatches(ids []uint) [][]uint {
+	var batches [][]uint
+	for len(ids) > maxBatchIDs {
+		batches = append(batches, ids[:maxBatchIDs])
+		ids = ids[maxBatchIDs:]
+	}
+	if len(ids) > 0 {
+		batches = append(batches, ids)
+	}
+	return batches
+}
+
+// subtreeQuery matches a path and everything below it, see descendantPattern.
+const subtreeQuery = "path = ? OR path LIKE ? ESCAPE '!'"
+
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// descendantPattern returns the LIKE pattern matching every path strictly
+// below dir, the paths childPrefix is a prefix of.
+func descendantPattern(dir string) string {
+	return likeEscaper.Replace(childPrefix(dir)) + "%"
 }
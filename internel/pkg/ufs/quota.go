@@ -0,0 +1,98 @@
+package ufs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Quota holds the storage limits of an owner and what it uses of them. Usage
+// counts the files of the owner, those in its trash included, and the bytes
+// of those files and of the versions they keep. It is maintained by the
+// Persistor in the same transaction as the records.
+type Quota struct {
+	Owner     string    `gorm:"column:owner;size:64;primaryKey"`      // 所属用户，主键，列名为 "owner"
+	MaxBytes  int64     `gorm:"column:max_bytes;not null;default:0"`  // 可用的字节数，0 表示使用默认限额，列名为 "max_bytes"
+	MaxFiles  int64     `gorm:"column:max_files;not null;default:0"`  // 可用的文件数，0 表示使用默认限额，列名为 "max_files"
+	UsedBytes int64     `gorm:"column:used_bytes;not null;default:0"` // 已用的字节数，列名为 "used_bytes"
+	UsedFiles int64     `gorm:"column:used_files;not null;default:0"` // 已用的文件数，列名为 "used_files"
+	UpdatedAt time.Time `gorm:"column:updated_at"`                    // 最后一次用量变化的时间，列名为 "updated_at"
+}
+
+// quotaOwner returns the owner whose quota the records of owner count
+// toward, trashed records count toward the owner of the trash.
+func quotaOwner(owner string) string {
+	return strings.TrimSuffix(owner, trashOwnerSuffix)
+}
+
+// addUsage adds bytes and files to the usage of owner within tx.
+func addUsage(tx *gorm.DB, owner string, bytes, files int64) error {
+	if bytes == 0 && files == 0 {
+		return nil
+	}
+	owner = quotaOwner(owner)
+	now := time.Now()
+	err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "owner"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"used_bytes": gorm.Expr("used_bytes + ?", bytes),
+			"used_files": gorm.Expr("used_files + ?", files),
+			"updated_at": now,
+		}),
+	}).Create(&Quota{Owner: owner, UsedBytes: bytes, UsedFiles: files, UpdatedAt: now}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update usage of %s: %v", owner, err)
+	}
+	return nil
+}
+
+// LoadQuota returns the quota of the owner, an owner that never stored a
+// file has a zero one.
+func (p *GormPersistor) LoadQuota() (quota Quota, err error) {
+	owner := quotaOwner(p.owner)
+	if err := p.db.Where("owner = ?", owner).Limit(1).Find(&quota).Error; err != nil {
+		return quota, fmt.Errorf("failed to query quota of %s: %v", owner, err)
+	}
+	quota.Owner = owner
+	return quota, nil
+}
+
+// rebuildQuotas recounts the usage of every owner from the records.
+func rebuildQuotas(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		type usage struct {
+			Owner string
+			Bytes int64
+			Files int64
+		}
+		var files, versions []usage
+		err := tx.Model(&FileSystem{}).
+			Select("owner, COALESCE(SUM(size), 0) AS bytes, COUNT(*) AS files").
+			Where("is_directory = ?", false).Group("owner").Scan(&files).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&FileVersion{}).
+			Select("file_systems.owner AS owner, COALESCE(SUM(file_versions.size), 0) AS bytes").
+			Joins("JOIN file_systems ON file_systems.id = file_versions.file_id").
+			Group("file_systems.owner").Scan(&versions).Error
+		if err != nil {
+			return err
+		}
+
+		for _, u := range append(files, versions...) {
+			if err := addUsage(tx, u.Owner, u.Bytes, u.Files); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Quota returns the quota of the owner of the file system.
+func (ufs *UserFileSystem) Quota() (Quota, error) {
+	return ufs.persistor.LoadQuota()
+}
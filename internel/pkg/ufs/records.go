@@ -0,0 +1,297 @@
+package ufs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// recordTx is a transaction over the records of every owner, as stored by a
+// Persistor backend. The bookkeeping built on top of it, reference counts,
+// usage and versions, is shared by GormPersistor and KVPersistor so that the
+// two cannot drift apart.
+type recordTx interface {
+	// find returns the record of owner at path.
+	find(owner, path string) (fs FileSystem, found bool, err error)
+	// subtree returns the records of owner at or below absPath, ordered by path.
+	subtree(owner, absPath string) ([]FileSystem, error)
+	// save inserts or updates record, assigning an ID to a new one.
+	save(record *FileSystem) error
+	// relocate updates the owner, name, path and parent of records that are
+	// stored under the same IDs, failing if a path is already taken.
+	relocate(records []FileSystem) error
+	// delete deletes records together with their versions.
+	delete(records []FileSystem) error
+	// versions returns the versions of the files with the given IDs.
+	versions(fileIDs []uint) ([]FileVersion, error)
+	// saveVersion inserts version, assigning it an ID.
+	saveVersion(version *FileVersion) error
+	// deleteVersion deletes version, reporting whether it still existed.
+	deleteVersion(version FileVersion) (bool, error)
+	// addRef adds delta to the reference count of digest.
+	addRef(digest string, size int64, delta int64) error
+	// addUsage adds bytes and files to the usage of owner.
+	addUsage(owner string, bytes, files int64) error
+}
+
+// persistRecord stores node at absPath in the scope of owner, persisting any
+// missing parent directories first. Only the directory flag, content and blob
+// fields of node are used. Existing records keep their ID so that the
+// ParentID of their children stays valid.
+func persistRecord(tx recordTx, owner, absPath string, node FileSystem) error {
+	// The root directory is implicit and never stored
+	if absPath == "/" || absPath == "." {
+		return nil
+	}
+
+	// Check if the parent directory exists, if not persist it first
+	dirPath := filepath.Dir(absPath)
+	var parentID uint
+	if dirPath != "/" && dirPath != "." {
+		parent, found, err := tx.find(owner, dirPath)
+		if err != nil {
+			return err
+		}
+		if !found {
+			if err := persistRecord(tx, owner, dirPath, FileSystem{IsDirectory: true}); err != nil {
+				return fmt.Errorf("failed to persist parent directory %s: %v", dirPath, err)
+			}
+			if parent, _, err = tx.find(owner, dirPath); err != nil {
+				return err
+			}
+		}
+		parentID = parent.ID
+	}
+
+	// Insert or update the file or directory itself
+	fs, _, err := tx.find(owner, absPath)
+	if err != nil {
+		return err
+	}
+
+	// Move the reference from the blob previously stored at this path to the
+	// new one, replaced file content is kept as a version holding its reference
+	kept := false
+	if fs.Digest != node.Digest {
+		if fs.ID != 0 && fs.Digest != "" && !fs.IsDirectory && !node.IsDirectory {
+			if err := keepVersion(tx, owner, fs); err != nil {
+				return err
+			}
+			kept = true
+		} else if err := tx.addRef(fs.Digest, fs.Size, -1); err != nil {
+			return err
+		}
+		if err := tx.addRef(node.Digest, node.Size, 1); err != nil {
+			return err
+		}
+	}
+
+	// The file replaced here stops counting toward the quota, unless its
+	// content lives on as a version
+	var bytes, files int64
+	if fs.ID != 0 && !fs.IsDirectory {
+		files--
+		if !kept {
+			bytes -= fs.Size
+		}
+	}
+	if !node.IsDirectory {
+		files++
+		bytes += node.Size
+	}
+	if err := tx.addUsage(owner, bytes, files); err != nil {
+		return err
+	}
+	fs.Owner = owner
+	fs.Name = filepath.Base(absPath)
+	fs.Path = absPath
+	fs.ParentID = parentID
+	fs.IsDirectory = node.IsDirectory
+	fs.Content = node.Content
+	fs.Digest = node.Digest
+	fs.Size = node.Size
+	fs.MimeType = node.MimeType
+	fs.ModTime = node.ModTime
+	fs.Uploader = node.Uploader
+	if fs.Uploader == "" && !fs.IsDirectory {
+		fs.Uploader = owner
+	}
+	now := time.Now()
+	if fs.ModTime.IsZero() {
+		fs.ModTime = now
+	}
+	if fs.ID == 0 {
+		fs.CTime = now
+	}
+	if err := tx.save(&fs); err != nil {
+		return fmt.Errorf("failed to insert or update data for path %s: %v", absPath, err)
+	}
+	return nil
+}
+
+// persistEntries persists all entries in the scope of owner.
+func persistEntries(tx recordTx, owner string, entries []Entry) error {
+	for _, entry := range entries {
+		node := FileSystem{IsDirectory: entry.IsDir}
+		if !entry.IsDir {
+			node = blobRecord(entry.Ref)
+		}
+		if err := persistRecord(tx, owner, filepath.Clean(entry.Path), node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRecords deletes the subtree at absPath in the scope of owner,
+// including the versions of its files, and releases the blobs and the usage
+// it holds.
+func removeRecords(tx recordTx, owner, absPath string) error {
+	records, err := tx.subtree(owner, absPath)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	versions, err := tx.versions(recordIDs(records))
+	if err != nil {
+		return fmt.Errorf("failed to count released versions: %v", err)
+	}
+
+	var bytes, files int64
+	for _, version := range versions {
+		if err := tx.addRef(version.Digest, 0, -1); err != nil {
+			return err
+		}
+		bytes += version.Size
+	}
+	for _, record := range records {
+		if err := tx.addRef(record.Digest, 0, -1); err != nil {
+			return err
+		}
+		if !record.IsDirectory {
+			bytes += record.Size
+			files++
+		}
+	}
+	if err := tx.addUsage(owner, -bytes, -files); err != nil {
+		return err
+	}
+
+	if err := tx.delete(records); err != nil {
+		return fmt.Errorf("failed to delete persisted data: %v", err)
+	}
+	return nil
+}
+
+// transferRecords moves the subtree at srcPath of srcOwner to dstPath in the
+// scope of dstOwner, which may be another owner. The records keep their IDs,
+// and with them the blob references and versions they hold.
+func transferRecords(tx recordTx, srcOwner, srcPath, dstOwner, dstPath string) error {
+	records, err := tx.subtree(srcOwner, srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to load paths: %v", err)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	// Make sure the destination parent exists so the moved root can be attached to it
+	dstDir := filepath.Dir(dstPath)
+	var parentID uint
+	if dstDir != "/" {
+		if err := persistRecord(tx, dstOwner, dstDir, FileSystem{IsDirectory: true}); err != nil {
+			return err
+		}
+		parent, _, err := tx.find(dstOwner, dstDir)
+		if err != nil {
+			return err
+		}
+		parentID = parent.ID
+	}
+
+	for i := range records {
+		fs := &records[i]
+		if fs.Path == srcPath {
+			fs.Name = filepath.Base(dstPath)
+			fs.ParentID = parentID
+		}
+		fs.Owner = dstOwner
+		fs.Path = dstPath + strings.TrimPrefix(fs.Path, srcPath)
+	}
+	if err := tx.relocate(records); err != nil {
+		return fmt.Errorf("failed to update paths: %v", err)
+	}
+	return nil
+}
+
+// keepVersion records the current content of file as a version, which takes
+// over the reference file holds on its blob. Records written before
+// uploaders were stored are attributed to the owner.
+func keepVersion(tx recordTx, owner string, file FileSystem) error {
+	version := FileVersion{
+		FileID:    file.ID,
+		Digest:    file.Digest,
+		Size:      file.Size,
+		MimeType:  file.MimeType,
+		Uploader:  file.Uploader,
+		ModTime:   file.ModTime,
+		CreatedAt: time.Now(),
+	}
+	if version.Uploader == "" {
+		version.Uploader = owner
+	}
+	if err := tx.saveVersion(&version); err != nil {
+		return fmt.Errorf("failed to keep version of %s: %v", file.Path, err)
+	}
+	return nil
+}
+
+// restoreVersion makes version the current content of the file at absPath.
+// The restored content is current again, persistRecord takes a new reference
+// for it and the version gives up its own.
+func restoreVersion(tx recordTx, owner, absPath string, version FileVersion) error {
+	ref := version.Ref()
+	ref.ModTime = time.Now()
+	if err := persistRecord(tx, owner, absPath, blobRecord(ref)); err != nil {
+		return err
+	}
+	if _, err := releaseVersion(tx, owner, version); err != nil {
+		return fmt.Errorf("failed to delete version %d: %v", version.ID, err)
+	}
+	return nil
+}
+
+// releaseVersion deletes version, which counted toward the quota of owner,
+// and releases the blob it references. It reports false if the version was
+// already gone.
+func releaseVersion(tx recordTx, owner string, version FileVersion) (bool, error) {
+	deleted, err := tx.deleteVersion(version)
+	if err != nil || !deleted {
+		return false, err
+	}
+	if err := tx.addUsage(owner, -version.Size, 0); err != nil {
+		return false, err
+	}
+	return true, tx.addRef(version.Digest, version.Size, -1)
+}
+
+// recordIDs returns the IDs of records.
+func recordIDs(records []FileSystem) []uint {
+	ids := make([]uint, len(records))
+	for i, record := range records {
+		ids[i] = record.ID
+	}
+	return ids
+}
+
+// childPrefix returns the prefix shared by every path strictly below dir.
+func childPrefix(dir string) string {
+	if dir == "/" {
+		return "/"
+	}
+	return dir + "/"
+}
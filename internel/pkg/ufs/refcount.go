@@ -0,0 +1,112 @@
+package ufs
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// BlobRefCount counts the records, of all owners, that reference a blob.
+// It is maintained by the Persistor in the same transaction as the records.
+type BlobRefCount struct {
+	Digest    string    `gorm:"column:digest;size:64;primaryKey"` // blob 摘要，主键，列名为 "digest"
+	Refs      int64     `gorm:"column:refs;not null;default:0"`   // 引用计数，列名为 "refs"
+	Size      int64     `gorm:"column:size;not null;default:0"`   // blob 大小 (字节)，列名为 "size"
+	UpdatedAt time.Time `gorm:"column:updated_at;index"`          // 最后一次引用变化的时间，列名为 "updated_at"
+}
+
+// RefCounter gives the garbage collector access to the blob reference counts.
+type RefCounter interface {
+	// Refs returns the count of digest and when it last changed, found is
+	// false when the digest has never been referenced.
+	Refs(digest string) (count BlobRefCount, found bool, err error)
+	// Forget drops the count of digest if nothing references it anymore,
+	// reporting whether it did so.
+	Forget(digest string) (bool, error)
+}
+
+type GormRefCounter struct {
+	db *gorm.DB
+}
+
+func NewGormRefCounter(db *gorm.DB) RefCounter {
+	return &GormRefCounter{db: db}
+}
+
+func (c *GormRefCounter) Refs(digest string) (count BlobRefCount, found bool, err error) {
+	res := c.db.Where("digest = ?", digest).Limit(1).Find(&count)
+	if res.Error != nil {
+		return count, false, fmt.Errorf("failed to query refs of %s: %v", digest, res.Error)
+	}
+	return count, res.RowsAffected > 0, nil
+}
+
+func (c *GormRefCounter) Forget(digest string) (bool, error) {
+	res := c.db.Where("digest = ? AND refs <= 0", digest).Delete(&BlobRefCount{})
+	if res.Error != nil {
+		return false, fmt.Errorf("failed to forget refs of %s: %v", digest, res.Error)
+	}
+	return res.RowsAffected > 0, nil
+}
+
+// addRef adds delta to the reference count of digest within tx.
+func addRef(tx *gorm.DB, digest string, size int64, delta int64) error {
+	if digest == "" || delta == 0 {
+		return nil
+	}
+	now := time.Now()
+	err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "digest"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"refs":       gorm.Expr("refs + ?", delta),
+			"updated_at": now,
+		}),
+	}).Create(&BlobRefCount{Digest: digest, Refs: delta, Size: size, UpdatedAt: now}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update refs of %s: %v", digest, err)
+	}
+	return nil
+}
+
+// rebuildRefCounts recounts the references of every blob from the records.
+func rebuildRefCounts(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&BlobRefCount{}).Error; err != nil {
+			return err
+		}
+
+		var files, versions []BlobRefCount
+		err := tx.Model(&FileSystem{}).
+			Select("digest, COUNT(*) AS refs, MAX(size) AS size").
+			Where("is_directory = ? AND digest <> ?", false, "").
+			Group("digest").Scan(&files).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&FileVersion{}).
+			Select("digest, COUNT(*) AS refs, MAX(size) AS size").
+			Group("digest").Scan(&versions).Error
+		if err != nil {
+			return err
+		}
+
+		// Both files and versions reference blobs, byDigest indexes counts
+		// since appending may move its elements
+		byDigest := make(map[string]int)
+		var counts []BlobRefCount
+		for _, count := range append(files, versions...) {
+			if i, ok := byDigest[count.Digest]; ok {
+				counts[i].Refs += count.Refs
+				continue
+			}
+			count.UpdatedAt = time.Now()
+			byDigest[count.Digest] = len(counts)
+			counts = append(counts, count)
+		}
+		if len(counts) == 0 {
+			return nil
+		}
+		return tx.Create(&counts).Error
+	})
+}
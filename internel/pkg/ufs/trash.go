@@ -0,0 +1,244 @@
+package ufs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrTrashItemNotFound is returned when a trash item does not exist or belongs to another owner.
+var ErrTrashItemNotFound = errors.New("trash item not found")
+
+// trashOwnerSuffix turns an owner into the owner of its trash. Trashed records
+// keep living in the file_systems table, in a scope of their own, so they keep
+// their blob references until they are purged.
+const trashOwnerSuffix = "#trash"
+
+// TrashItem records a file or directory tree that was moved to the trash.
+type TrashItem struct {
+	ID           uint      `gorm:"column:id;primaryKey;autoIncrement"`  // 自动递增主键，列名为 "id"
+	Owner        string    `gorm:"column:owner;size:64;not null;index"` // 所属用户，列名为 "owner"
+	Name         string    `gorm:"column:name;size:255;not null"`       // 删除前的名称，列名为 "name"
+	OriginalPath string    `gorm:"column:original_path;size:1024"`      // 删除前的路径，列名为 "original_path"
+	IsDirectory  bool      `gorm:"column:is_directory;not null"`        // 是否为目录，列名为 "is_directory"
+	Size         int64     `gorm:"column:size;not null;default:0"`      // 包含的文件总大小 (字节)，列名为 "size"
+	DeletedAt    time.Time `gorm:"column:deleted_at;index"`             // 删除时间，列名为 "deleted_at"
+}
+
+// trashPath is where the tree of item lives in the trash scope.
+func trashPath(id uint, name string) string {
+	return fmt.Sprintf("/%d/%s", id, name)
+}
+
+// trashOwner returns the owner of the trash scope of owner.
+func trashOwner(owner string) string {
+	return owner + trashOwnerSuffix
+}
+
+// MoveToTrash moves the subtree at path into the trash and records it as a TrashItem.
+func (p *GormPersistor) MoveToTrash(path string) (item TrashItem, err error) {
+	absPath := filepath.Clean(path)
+	err = p.db.Transaction(func(tx *gorm.DB) error {
+		root, found, err := p.find(tx, absPath)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return &os.PathError{Op: "trash", Path: absPath, Err: os.ErrNotExist}
+		}
+
+		var size int64
+		if err := p.scope(tx).Model(&FileSystem{}).Select("COALESCE(SUM(size), 0)").
+			Where(subtreeQuery, absPath, descendantPattern(absPath)).Scan(&size).Error; err != nil {
+			return fmt.Errorf("failed to sum the size of %s: %v", absPath, err)
+		}
+
+		item = TrashItem{
+			Owner:        p.owner,
+			Name:         root.Name,
+			OriginalPath: absPath,
+			IsDirectory:  root.IsDirectory,
+			Size:         size,
+			DeletedAt:    time.Now(),
+		}
+		if err := tx.Create(&item).Error; err != nil {
+			return fmt.Errorf("failed to create trash item: %v", err)
+		}
+		return transferRecords(gormRecords{tx}, p.owner, absPath, trashOwner(p.owner), trashPath(item.ID, item.Name))
+	})
+	return item, err
+}
+
+// ListTrash returns the trash items of the owner, most recently deleted first.
+func (p *GormPersistor) ListTrash() ([]TrashItem, error) {
+	var items []TrashItem
+	if err := p.scope(p.db).Order("deleted_at DESC, id DESC").Find(&items).Error; err != nil {
+		return nil, fmt.Errorf("failed to list trash: %v", err)
+	}
+	return items, nil
+}
+
+// FindTrash returns the trash item with id, if the owner has one.
+func (p *GormPersistor) FindTrash(id uint) (item TrashItem, found bool, err error) {
+	res := p.scope(p.db).Where("id = ?", id).Limit(1).Find(&item)
+	if res.Error != nil {
+		return item, false, fmt.Errorf("failed to query trash item %d: %v", id, res.Error)
+	}
+	return item, res.RowsAffected > 0, nil
+}
+
+// RestoreFromTrash moves the tree of the trash item with id back to dstPath
+// and forgets the item.
+func (p *GormPersistor) RestoreFromTrash(id uint, dstPath string) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		item, err := p.takeTrash(tx, id)
+		if err != nil {
+			return err
+		}
+		return restoreTrash(gormRecords{tx}, p.owner, item, filepath.Clean(dstPath))
+	})
+}
+
+// PurgeTrash deletes the trash item with id and its tree, releasing the blobs it references.
+func (p *GormPersistor) PurgeTrash(id uint) error {
+	return p.db.Transaction(func(tx *gorm.DB) error {
+		item, err := p.takeTrash(tx, id)
+		if err != nil {
+			return err
+		}
+		return removeRecords(gormRecords{tx}, trashOwner(p.owner), filepath.Dir(trashPath(item.ID, item.Name)))
+	})
+}
+
+// takeTrash deletes the trash item with id and returns it.
+func (p *GormPersistor) takeTrash(tx *gorm.DB, id uint) (TrashItem, error) {
+	var item TrashItem
+	res := p.scope(tx).Where("id = ?", id).Limit(1).Find(&item)
+	if res.Error != nil {
+		return item, fmt.Errorf("failed to query trash item %d: %v", id, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return item, ErrTrashItemNotFound
+	}
+	if err := tx.Delete(&item).Error; err != nil {
+		return item, fmt.Errorf("failed to delete trash item %d: %v", id, err)
+	}
+	return item, nil
+}
+
+// restoreTrash moves the tree of item back to dstPath in the scope of owner
+// and drops what is left of it in the trash.
+func restoreTrash(tx recordTx, owner string, item TrashItem, dstPath string) error {
+	if err := transferRecords(tx, trashOwner(owner), trashPath(item.ID, item.Name), owner, dstPath); err != nil {
+		return err
+	}
+	return removeRecords(tx, trashOwner(owner), filepath.Dir(trashPath(item.ID, item.Name)))
+}
+
+// TrashCollector finds trash items of every owner, for purging them in the background.
+type TrashCollector interface {
+	// Expired returns up to limit trash items deleted before the given time, oldest first.
+	Expired(before time.Time, limit int) ([]TrashItem, error)
+}
+
+type GormTrashCollector struct {
+	db *gorm.DB
+}
+
+func NewGormTrashCollector(db *gorm.DB) TrashCollector {
+	return &GormTrashCollector{db: db}
+}
+
+func (c *GormTrashCollector) Expired(before time.Time, limit int) ([]TrashItem, error) {
+	var items []TrashItem
+	if err := c.db.Where("deleted_at < ?", before).Order("deleted_at").Limit(limit).
+		Find(&items).Error; err != nil {
+		return nil, fmt.Errorf("failed to find expired trash items: %v", err)
+	}
+	return items, nil
+}
+
+// Trash moves the file or directory at name to the trash. Unlike Remove the
+// tree can be restored until it is purged.
+func (ufs *UserFileSystem) Trash(name string) (TrashItem, error) {
+	absPath := ufs.resolvePath(name)
+
+	ufs.fsMutex.Lock()
+	defer ufs.fsMutex.Unlock()
+
+	if _, err := ufs.fs.Stat(absPath); err != nil {
+		return TrashItem{}, err
+	}
+	if absPath == "/" {
+		return TrashItem{}, fmt.Errorf("cannot remove root directory")
+	}
+
+	item, err := ufs.persistor.MoveToTrash(absPath)
+	if err != nil {
+		return TrashItem{}, err
+	}
+	return item, ufs.forget(absPath)
+}
+
+// ListTrash returns the trash items of the file system, most recently deleted first.
+func (ufs *UserFileSystem) ListTrash() ([]TrashItem, error) {
+	return ufs.persistor.ListTrash()
+}
+
+// RestoreTrash moves the trash item with id back to its original path,
+// resolving a conflict with an entry now at that path according to policy.
+// A file replaced with ConflictOverwrite is moved to the trash in turn.
+// It returns the path the tree was restored to.
+func (ufs *UserFileSystem) RestoreTrash(id uint, policy ConflictPolicy) (string, error) {
+	ufs.fsMutex.Lock()
+	defer ufs.fsMutex.Unlock()
+
+	item, found, err := ufs.persistor.FindTrash(id)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", ErrTrashItemNotFound
+	}
+
+	dstPath, err := ufs.resolveConflict(item.OriginalPath, policy)
+	if err != nil {
+		return "", err
+	}
+	if _, err := ufs.fs.Stat(dstPath); err == nil {
+		if _, err := ufs.persistor.MoveToTrash(dstPath); err != nil {
+			return "", err
+		}
+		if err := ufs.forget(dstPath); err != nil {
+			return "", err
+		}
+	}
+
+	if err := ufs.persistor.RestoreFromTrash(id, dstPath); err != nil {
+		return "", err
+	}
+
+	// Load the restored records below their, possibly recreated, parent
+	records, err := ufs.persistor.LoadRecords(dstPath)
+	if err != nil {
+		return "", err
+	}
+	if err := ufs.mkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return "", err
+	}
+	for _, record := range records {
+		if err := loadRecord(ufs.fs, ufs.dirMap, record); err != nil {
+			return "", err
+		}
+	}
+	return dstPath, nil
+}
+
+// PurgeTrash deletes the trash item with id for good, releasing the blobs it references.
+func (ufs *UserFileSystem) PurgeTrash(id uint) error {
+	return ufs.persistor.PurgeTrash(id)
+}
@@ -1,15 +1,26 @@
 package ufs
 
 import (
+	"errors"
 	"fmt"
+	"github.com/lvow2022/udisk/pkg/log"
 	"gorm.io/gorm"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/spf13/afero"
 )
 
+var (
+	// ErrIsDirectory is returned when a file operation is applied to a directory.
+	ErrIsDirectory = errors.New("is a directory")
+	// ErrNotDirectory is returned when a directory operation is applied to a file.
+	ErrNotDirectory = errors.New("not a directory")
+)
+
 // UserFileSystem represents an in-memory file system with a current working directory.
 type UserFileSystem struct {
 	fs      afero.Fs
@@ -20,29 +31,155 @@ type UserFileSystem struct {
 	dirMap    map[string][]string
 }
 
-// NewUserFileSystem creates a new UserFileSystem instance with an in-memory filesystem.
-func NewUserFileSystem(db *gorm.DB) *UserFileSystem {
+// NewUserFileSystem creates a new UserFileSystem instance with an in-memory filesystem,
+// backed by the records that belong to owner.
+func NewUserFileSystem(db *gorm.DB, owner string) *UserFileSystem {
+	return NewPersistedFileSystem(NewGormPersistor(db, owner))
+}
+
+// NewPersistedFileSystem creates a new UserFileSystem instance with an in-memory
+// filesystem, restored from and backed by the records of persistor.
+func NewPersistedFileSystem(persistor Persistor) *UserFileSystem {
 	fs := afero.NewMemMapFs()
 	ufs := &UserFileSystem{
 		fs:        fs,
 		cwd:       "/",
-		persistor: NewGormPersistor(db),
+		persistor: persistor,
 		dirMap:    make(map[string][]string),
 	}
 
 	// Restore the file system state from the database
-	ufs.persistor.LoadDirMap("/")
+	report, err := ufs.Restore()
+	if err != nil {
+		log.Errorf("failed to restore user file system: %v", err)
+	} else if len(report.Orphans) > 0 {
+		log.Warnf("restored user file system with %d orphaned records", len(report.Orphans))
+	}
 
 	return ufs
 }
 
-// persistFile persists the metadata of a specific file or directory to disk using gob encoding.
+// RestoreReport describes the result of rebuilding a UserFileSystem from its Persistor.
+type RestoreReport struct {
+	Dirs  int
+	Files int
+	// Orphans are records whose parent is missing, either because ParentID
+	// points to no record or because the parent path is not a directory.
+	// They are left in the database but not loaded.
+	Orphans []FileSystem
+}
+
+// Restore rebuilds the in-memory file system and directory map from the
+// persisted records, replacing whatever state is currently held.
+func (ufs *UserFileSystem) Restore() (*RestoreReport, error) {
+	records, err := ufs.persistor.LoadRecords("/")
+	if err != nil {
+		return nil, err
+	}
+
+	ufs.fsMutex.Lock()
+	defer ufs.fsMutex.Unlock()
+
+	fs := afero.NewMemMapFs()
+	dirMap := map[string][]string{"/": {}}
+	ids := make(map[uint]FileSystem, len(records))
+	for _, record := range records {
+		ids[record.ID] = record
+	}
+
+	// Records are ordered by path, so a parent is always restored before its children
+	report := &RestoreReport{}
+	for _, record := range records {
+		absPath := filepath.Clean(record.Path)
+		if absPath == "/" {
+			continue
+		}
+
+		dirPath := filepath.Dir(absPath)
+		_, parentLoaded := dirMap[dirPath]
+		_, parentKnown := ids[record.ParentID]
+		if !parentLoaded || (record.ParentID != 0 && !parentKnown) {
+			log.Warnf("orphaned record %d at %s: parent %d not found", record.ID, record.Path, record.ParentID)
+			report.Orphans = append(report.Orphans, record)
+			continue
+		}
+
+		if err := loadRecord(fs, dirMap, record); err != nil {
+			return nil, err
+		}
+		if record.IsDirectory {
+			report.Dirs++
+		} else {
+			report.Files++
+		}
+	}
+
+	ufs.fs = fs
+	ufs.dirMap = dirMap
+	return report, nil
+}
+
+// loadRecord adds a persisted record to fs and dirMap, its parent directory must already be loaded.
+func loadRecord(fs afero.Fs, dirMap map[string][]string, record FileSystem) error {
+	absPath := filepath.Clean(record.Path)
+	if record.IsDirectory {
+		if err := fs.MkdirAll(absPath, 0755); err != nil {
+			return fmt.Errorf("failed to restore directory %s: %v", absPath, err)
+		}
+		if _, ok := dirMap[absPath]; !ok {
+			dirMap[absPath] = []string{}
+		}
+	} else {
+		// Files hold the digest of the blob they reference, legacy records the md5 pointer itself
+		content := record.Content
+		if record.Digest != "" {
+			content = []byte(record.Digest)
+		}
+		if err := afero.WriteFile(fs, absPath, content, 0644); err != nil {
+			return fmt.Errorf("failed to restore file %s: %v", absPath, err)
+		}
+		if !record.ModTime.IsZero() {
+			if err := fs.Chtimes(absPath, record.ModTime, record.ModTime); err != nil {
+				return fmt.Errorf("failed to restore file %s: %v", absPath, err)
+			}
+		}
+	}
+
+	dirPath := filepath.Dir(absPath)
+	for _, entry := range dirMap[dirPath] {
+		if entry == record.Name {
+			return nil
+		}
+	}
+	dirMap[dirPath] = append(dirMap[dirPath], record.Name)
+	return nil
+}
+
+// persistFile persists a specific file or directory, including the content of files.
 func (ufs *UserFileSystem) persistFile(path string) error {
 	isDir, err := ufs.IsDir(path)
 	if err != nil {
 		return err
 	}
-	return ufs.persistor.PersistFile(path, isDir)
+	if isDir {
+		return ufs.persistor.PersistFile(path, true, nil)
+	}
+
+	content, err := afero.ReadFile(ufs.fs, ufs.resolvePath(path))
+	if err != nil {
+		return err
+	}
+	return ufs.persistor.PersistFile(path, false, content)
+}
+
+// addEntry records name as a child of dir in the in-memory directory map.
+func (ufs *UserFileSystem) addEntry(dir, name string) {
+	for _, entry := range ufs.dirMap[dir] {
+		if entry == name {
+			return
+		}
+	}
+	ufs.dirMap[dir] = append(ufs.dirMap[dir], name)
 }
 
 // ReadFile reads the contents of a file.
@@ -54,14 +191,19 @@ func (ufs *UserFileSystem) ReadFile(name string) ([]byte, error) {
 // WriteFile writes data to a file.
 func (ufs *UserFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
 	absPath := ufs.resolvePath(name)
+
+	ufs.fsMutex.Lock()
+	defer ufs.fsMutex.Unlock()
+
 	err := afero.WriteFile(ufs.fs, absPath, data, perm)
 	if err != nil {
 		return err
 	}
+	ufs.addEntry(filepath.Dir(absPath), filepath.Base(absPath))
 
-	// Persist the changes for the parent directory
-	if err := ufs.persistFile(filepath.Dir(absPath)); err != nil {
-		return fmt.Errorf("failed to persist directory data: %v", err)
+	// Persist the file together with its content
+	if err := ufs.persistor.PersistFile(absPath, false, data); err != nil {
+		return fmt.Errorf("failed to persist file data: %v", err)
 	}
 	return nil
 }
@@ -79,39 +221,26 @@ func (ufs *UserFileSystem) Mv(src, dst string) error {
 		return err
 	}
 
-	// Update the in-memory directory map
-	srcDir := filepath.Dir(srcPath)
-	dstDir := filepath.Dir(dstPath)
-	srcBase := filepath.Base(srcPath)
-	dstBase := filepath.Base(dstPath)
-
-	// Remove the entry from the source directory
-	entries := ufs.dirMap[srcDir]
-	var newEntries []string
-	for _, entry := range entries {
-		if entry != srcBase {
-			newEntries = append(newEntries, entry)
+	// Remove the entry from the source directory and add it to the destination directory
+	ufs.removeEntry(filepath.Dir(srcPath), filepath.Base(srcPath))
+	ufs.addEntry(filepath.Dir(dstPath), filepath.Base(dstPath))
+
+	// Re-key the moved directory and all of its subdirectories
+	moved := make(map[string][]string)
+	for dir, entries := range ufs.dirMap {
+		if rel, ok := relativeTo(srcPath, dir); ok {
+			delete(ufs.dirMap, dir)
+			moved[filepath.Join(dstPath, rel)] = entries
 		}
 	}
-	if len(newEntries) > 0 {
-		ufs.dirMap[srcDir] = newEntries
-	} else {
-		delete(ufs.dirMap, srcDir)
+	for dir, entries := range moved {
+		ufs.dirMap[dir] = entries
 	}
 
-	// Add the entry to the destination directory
-	ufs.dirMap[dstDir] = append(ufs.dirMap[dstDir], dstBase)
-
-	// Persist changes to the source and destination directories
-	if err := ufs.persistFile(srcDir); err != nil {
-		return fmt.Errorf("failed to persist source directory data: %v", err)
-	}
-	if err := ufs.persistFile(dstDir); err != nil {
-		return fmt.Errorf("failed to persist destination directory data: %v", err)
+	// Persist the new location of the moved records
+	if err := ufs.persistor.UpdatePaths(srcPath, dstPath); err != nil {
+		return fmt.Errorf("failed to persist moved paths: %v", err)
 	}
-
-	// Remove any previous entry in the destination path, as it should not be listed twice
-	delete(ufs.dirMap, dstPath)
 	return nil
 }
 
@@ -124,10 +253,11 @@ func (ufs *UserFileSystem) Ls(path string) ([]string, error) {
 
 	entries, ok := ufs.dirMap[dirPath]
 	if !ok {
-		return nil, fmt.Errorf("directory not found: %s", dirPath)
+		return nil, &os.PathError{Op: "ls", Path: dirPath, Err: os.ErrNotExist}
 	}
 
-	return entries, nil
+	// Hand out a copy, the directory map is only safe to touch under fsMutex
+	return append([]string(nil), entries...), nil
 }
 
 // Mkdir creates a new directory and all necessary parent directories using afero's MkdirAll.
@@ -137,29 +267,405 @@ func (ufs *UserFileSystem) Mkdir(path string, perm os.FileMode) error {
 
 	absPath := ufs.resolvePath(path)
 
+	if err := ufs.mkdirAll(absPath, perm); err != nil {
+		return err
+	}
+
+	// Persist the new directory, its parents are persisted along with it
+	if err := ufs.persistFile(absPath); err != nil {
+		return fmt.Errorf("failed to persist directory %s: %v", absPath, err)
+	}
+
+	return nil
+}
+
+// mkdirAll creates absPath and its parents in memory only, the caller must hold fsMutex.
+func (ufs *UserFileSystem) mkdirAll(absPath string, perm os.FileMode) error {
 	// Use afero's MkdirAll to create the directory and its parents
 	if err := ufs.fs.MkdirAll(absPath, perm); err != nil {
 		return err
 	}
 
-	// Update the in-memory directory map
-	dirPath := filepath.Dir(absPath)
-	ufs.dirMap[dirPath] = append(ufs.dirMap[dirPath], filepath.Base(absPath))
-	ufs.dirMap[absPath] = []string{} // Initialize the new directory
+	// Update the in-memory directory map for the new directory and its parents
+	for dir := absPath; dir != "/"; dir = filepath.Dir(dir) {
+		if _, ok := ufs.dirMap[dir]; !ok {
+			ufs.dirMap[dir] = []string{} // Initialize the new directory
+		}
+		ufs.addEntry(filepath.Dir(dir), filepath.Base(dir))
+	}
+	return nil
+}
 
-	// Persist the parent directory first
-	if err := ufs.persistFile(dirPath); err != nil {
-		return fmt.Errorf("failed to persist parent directory %s: %v", dirPath, err)
+// LinkBlob creates or replaces the file at name as a reference to the blob
+// described by ref, creating missing parent directories.
+func (ufs *UserFileSystem) LinkBlob(name string, ref BlobRef) error {
+	absPath := ufs.resolvePath(name)
+
+	ufs.fsMutex.Lock()
+	defer ufs.fsMutex.Unlock()
+
+	return ufs.link(absPath, ref)
+}
+
+// ConflictPolicy decides what happens when the destination of an operation already exists.
+type ConflictPolicy string
+
+const (
+	// ConflictSkip leaves an existing destination untouched, only used by Copy.
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictFail refuses to touch an existing destination.
+	ConflictFail ConflictPolicy = "fail"
+	// ConflictOverwrite replaces an existing file, directories are never replaced.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictRename picks a free name next to the destination, e.g. "a (1).txt".
+	ConflictRename ConflictPolicy = "rename"
+)
+
+// ParseConflictPolicy parses a policy name, an empty name means ConflictFail.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case "":
+		return ConflictFail, nil
+	case ConflictSkip, ConflictFail, ConflictOverwrite, ConflictRename:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy: %s", name)
 	}
+}
 
-	// Persist the new directory
-	if err := ufs.persistFile(absPath); err != nil {
-		return fmt.Errorf("failed to persist directory %s: %v", absPath, err)
+// Commit atomically links ref at name, resolving a conflict with an existing
+// entry according to policy. It returns the path the file was created at.
+func (ufs *UserFileSystem) Commit(name string, ref BlobRef, policy ConflictPolicy) (string, error) {
+	absPath := ufs.resolvePath(name)
+
+	ufs.fsMutex.Lock()
+	defer ufs.fsMutex.Unlock()
+
+	absPath, err := ufs.resolveConflict(absPath, policy)
+	if err != nil {
+		return "", err
+	}
+	return absPath, ufs.link(absPath, ref)
+}
+
+// resolveConflict returns where an entry meant for absPath should go under
+// policy, the caller must hold fsMutex.
+func (ufs *UserFileSystem) resolveConflict(absPath string, policy ConflictPolicy) (string, error) {
+	info, err := ufs.fs.Stat(absPath)
+	if err != nil {
+		return absPath, nil
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		if info.IsDir() {
+			return "", &os.PathError{Op: "overwrite", Path: absPath, Err: ErrIsDirectory}
+		}
+		return absPath, nil
+	case ConflictRename:
+		dir, base := filepath.Split(absPath)
+		ext := filepath.Ext(base)
+		for i := 1; ; i++ {
+			candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), i, ext))
+			if _, err := ufs.fs.Stat(candidate); err != nil {
+				return candidate, nil
+			}
+		}
+	default:
+		return "", &os.PathError{Op: "commit", Path: absPath, Err: os.ErrExist}
+	}
+}
+
+// link stores the reference and then mirrors it in memory, the caller must hold fsMutex.
+func (ufs *UserFileSystem) link(absPath string, ref BlobRef) error {
+	if info, err := ufs.fs.Stat(absPath); err == nil && info.IsDir() {
+		return &os.PathError{Op: "link", Path: absPath, Err: ErrIsDirectory}
+	}
+	if ref.ModTime.IsZero() {
+		ref.ModTime = time.Now()
+	}
+
+	if err := ufs.persistor.PersistBlob(absPath, ref); err != nil {
+		return fmt.Errorf("failed to persist blob reference: %v", err)
+	}
+	return ufs.linkInMemory(absPath, ref)
+}
+
+// linkInMemory mirrors a persisted blob reference in memory, the caller must hold fsMutex.
+func (ufs *UserFileSystem) linkInMemory(absPath string, ref BlobRef) error {
+	if err := ufs.mkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return err
+	}
+	// The in-memory file holds the digest, the rest of the reference lives in the record
+	if err := afero.WriteFile(ufs.fs, absPath, []byte(ref.Digest), 0644); err != nil {
+		return err
+	}
+	if err := ufs.fs.Chtimes(absPath, ref.ModTime, ref.ModTime); err != nil {
+		return err
+	}
+	ufs.addEntry(filepath.Dir(absPath), filepath.Base(absPath))
+	return nil
+}
+
+// CopyOptions controls how Copy treats entries that already exist at the destination.
+type CopyOptions struct {
+	// Policy applies to every conflicting file. With ConflictSkip and
+	// ConflictOverwrite directories are merged, ConflictRename renames the copy
+	// as a whole and ConflictFail refuses to copy onto an existing entry.
+	Policy ConflictPolicy
+}
+
+// Copy copies the file or directory tree at src to dst without copying any
+// content: every new file references the blob of its source. All new records
+// are persisted in a single transaction. It returns the path of the copy.
+func (ufs *UserFileSystem) Copy(src, dst string, opts CopyOptions) (string, error) {
+	srcPath := ufs.resolvePath(src)
+	dstPath := ufs.resolvePath(dst)
+
+	ufs.fsMutex.Lock()
+	defer ufs.fsMutex.Unlock()
+
+	records, err := ufs.loadTree(srcPath)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := relativeTo(srcPath, dstPath); ok {
+		return "", &os.PathError{Op: "copy", Path: dstPath, Err: os.ErrInvalid}
+	}
+	if dstPath, err = ufs.copyTarget(dstPath, opts.Policy); err != nil {
+		return "", err
+	}
+
+	entries, err := ufs.copyEntries(records, srcPath, dstPath, opts.Policy)
+	if err != nil {
+		return "", err
+	}
+	if err := ufs.persistor.PersistEntries(entries); err != nil {
+		return "", fmt.Errorf("failed to persist copy: %v", err)
+	}
+	return dstPath, ufs.applyEntries(entries)
+}
+
+// loadTree returns the records of the tree at absPath that are loaded in
+// memory, orphans are left out. The caller must hold fsMutex.
+func (ufs *UserFileSystem) loadTree(absPath string) ([]FileSystem, error) {
+	if _, err := ufs.fs.Stat(absPath); err != nil {
+		return nil, err
+	}
+	records, err := ufs.persistor.LoadRecords(absPath)
+	if err != nil {
+		return nil, err
+	}
+	loaded := records[:0]
+	for _, record := range records {
+		if _, err := ufs.fs.Stat(record.Path); err == nil {
+			loaded = append(loaded, record)
+		}
+	}
+	return loaded, nil
+}
+
+// copyTarget resolves a conflict at the root of a copy to dstPath. With
+// ConflictSkip and ConflictOverwrite directories are merged entry by entry
+// instead, see copyEntries. The caller must hold fsMutex.
+func (ufs *UserFileSystem) copyTarget(dstPath string, policy ConflictPolicy) (string, error) {
+	if policy == ConflictRename || policy == ConflictFail || policy == "" {
+		return ufs.resolveConflict(dstPath, policy)
+	}
+	return dstPath, nil
+}
+
+// applyEntries mirrors persisted entries in memory, the caller must hold fsMutex.
+func (ufs *UserFileSystem) applyEntries(entries []Entry) error {
+	for _, entry := range entries {
+		var err error
+		if entry.IsDir {
+			err = ufs.mkdirAll(entry.Path, 0755)
+		} else {
+			err = ufs.linkInMemory(entry.Path, entry.Ref)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyEntries plans the entries that copying records from srcPath to dstPath
+// creates, the caller must hold fsMutex.
+func (ufs *UserFileSystem) copyEntries(records []FileSystem, srcPath, dstPath string, policy ConflictPolicy) ([]Entry, error) {
+	var entries []Entry
+	var skipped []string
+	for _, record := range records {
+		rel, ok := relativeTo(srcPath, record.Path)
+		if !ok || isBelowAny(skipped, record.Path) {
+			continue
+		}
+		target := filepath.Join(dstPath, rel)
+
+		if existing, err := ufs.fs.Stat(target); err == nil {
+			switch {
+			case record.IsDirectory && existing.IsDir():
+				// Merge into the existing directory
+				continue
+			case policy == ConflictSkip:
+				skipped = append(skipped, record.Path)
+				continue
+			case policy != ConflictOverwrite:
+				return nil, &os.PathError{Op: "copy", Path: target, Err: os.ErrExist}
+			case existing.IsDir():
+				return nil, &os.PathError{Op: "copy", Path: target, Err: ErrIsDirectory}
+			case record.IsDirectory:
+				return nil, &os.PathError{Op: "copy", Path: target, Err: ErrNotDirectory}
+			}
+		}
+
+		entry := Entry{Path: target, IsDir: record.IsDirectory}
+		if !record.IsDirectory {
+			entry.Ref = record.blobRef()
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// isBelowAny reports whether path is one of roots or lies below one of them.
+func isBelowAny(roots []string, path string) bool {
+	for _, root := range roots {
+		if _, ok := relativeTo(root, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Blob returns the blob referenced by the file at name.
+func (ufs *UserFileSystem) Blob(name string) (BlobRef, error) {
+	absPath := ufs.resolvePath(name)
+	record, found, err := ufs.persistor.FindRecord(absPath)
+	if err != nil {
+		return BlobRef{}, err
+	}
+	if !found {
+		return BlobRef{}, &os.PathError{Op: "blob", Path: absPath, Err: os.ErrNotExist}
+	}
+	if record.IsDirectory {
+		return BlobRef{}, &os.PathError{Op: "blob", Path: absPath, Err: ErrIsDirectory}
+	}
+
+	return record.blobRef(), nil
+}
+
+// FileInfo describes an entry of a UserFileSystem. It is built from the
+// persisted record alone, so it never touches blob storage.
+type FileInfo struct {
+	Name       string
+	Path       string
+	IsDir      bool
+	Size       int64
+	CreateTime time.Time
+	ModTime    time.Time
+	Digest     string
+	MimeType   string
+	// Children is the number of direct entries of a directory.
+	Children int
+}
+
+// Stat returns the FileInfo of the file or directory at name.
+func (ufs *UserFileSystem) Stat(name string) (FileInfo, error) {
+	absPath := ufs.resolvePath(name)
+	if absPath == "/" {
+		ufs.fsMutex.RLock()
+		defer ufs.fsMutex.RUnlock()
+		return FileInfo{Name: "/", Path: "/", IsDir: true, Children: len(ufs.dirMap["/"])}, nil
+	}
+
+	record, found, err := ufs.persistor.FindRecord(absPath)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !found {
+		return FileInfo{}, &os.PathError{Op: "stat", Path: absPath, Err: os.ErrNotExist}
+	}
+
+	ufs.fsMutex.RLock()
+	defer ufs.fsMutex.RUnlock()
+	return ufs.fileInfo(record), nil
+}
+
+// ListDetailed returns the FileInfo of every entry of the directory at name, ordered by name.
+func (ufs *UserFileSystem) ListDetailed(name string) ([]FileInfo, error) {
+	absPath := ufs.resolvePath(name)
+	info, err := ufs.Stat(absPath)
+	if err != nil {
+		return nil, err
 	}
+	if !info.IsDir {
+		return nil, &os.PathError{Op: "ls", Path: absPath, Err: ErrNotDirectory}
+	}
+
+	records, err := ufs.persistor.LoadChildren(absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ufs.fsMutex.RLock()
+	defer ufs.fsMutex.RUnlock()
+	infos := make([]FileInfo, 0, len(records))
+	for _, record := range records {
+		infos = append(infos, ufs.fileInfo(record))
+	}
+	return infos, nil
+}
+
+// Walk calls fn with the FileInfo of name and of everything below it, parents
+// before their children, so name itself is visited first. The root directory
+// / has no record and is the only exception. The tree is read up front, so fn
+// may use the file system, but it does not see changes made while walking.
+// Walk stops at the first error fn returns.
+func (ufs *UserFileSystem) Walk(name string, fn func(info FileInfo) error) error {
+	absPath := ufs.resolvePath(name)
 
+	ufs.fsMutex.RLock()
+	records, err := ufs.loadTree(absPath)
+	infos := make([]FileInfo, 0, len(records))
+	for _, record := range records {
+		infos = append(infos, ufs.fileInfo(record))
+	}
+	ufs.fsMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// fileInfo converts a record into a FileInfo, the caller must hold fsMutex.
+func (ufs *UserFileSystem) fileInfo(record FileSystem) FileInfo {
+	info := FileInfo{
+		Name:       record.Name,
+		Path:       record.Path,
+		IsDir:      record.IsDirectory,
+		Size:       record.Size,
+		CreateTime: record.CTime,
+		ModTime:    record.ModTime,
+		Digest:     record.Digest,
+		MimeType:   record.MimeType,
+	}
+	if record.IsDirectory {
+		info.Children = len(ufs.dirMap[record.Path])
+	} else if record.Digest == "" {
+		// Records written before blob references existed hold the md5 as their content
+		info.Digest = string(record.Content)
+	}
+	return info
+}
+
 // Create creates a new file and updates the in-memory directory map.
 func (ufs *UserFileSystem) Create(name string) (afero.File, error) {
 	absPath := ufs.resolvePath(name)
@@ -172,11 +678,10 @@ func (ufs *UserFileSystem) Create(name string) (afero.File, error) {
 	defer ufs.fsMutex.Unlock()
 
 	// Update the in-memory directory map
-	dirPath := filepath.Dir(absPath)
-	ufs.dirMap[dirPath] = append(ufs.dirMap[dirPath], filepath.Base(absPath))
+	ufs.addEntry(filepath.Dir(absPath), filepath.Base(absPath))
 
-	// Persist the changes for the parent directory
-	return file, ufs.persistFile(dirPath)
+	// Persist the new, still empty file
+	return file, ufs.persistor.PersistFile(absPath, false, nil)
 }
 
 // Remove removes a file or directory.
@@ -187,104 +692,66 @@ func (ufs *UserFileSystem) Remove(name string) error {
 	defer ufs.fsMutex.Unlock()
 
 	// Check if the path exists
-	info, err := ufs.fs.Stat(absPath)
-	if err != nil {
+	if _, err := ufs.fs.Stat(absPath); err != nil {
 		return err
 	}
+	if absPath == "/" {
+		return fmt.Errorf("cannot remove root directory")
+	}
 
-	if info.IsDir() {
-		// Use a stack-based approach to delete directories iteratively
-		stack := []string{absPath}
-		for len(stack) > 0 {
-			dir := stack[len(stack)-1]
-			stack = stack[:len(stack)-1]
-
-			entries, err := afero.ReadDir(ufs.fs, dir)
-			if err != nil {
-				return err
-			}
-
-			// Collect all entries to remove
-			for _, entry := range entries {
-				entryPath := filepath.Join(dir, entry.Name())
-				if entry.IsDir() {
-					stack = append(stack, entryPath)
-				}
-				if err := ufs.fs.Remove(entryPath); err != nil {
-					return err
-				}
-
-				// Remove from in-memory directory map
-				dirPath := filepath.Dir(entryPath)
-				if entries := ufs.dirMap[dirPath]; entries != nil {
-					newEntries := []string{}
-					for _, e := range entries {
-						if e != filepath.Base(entryPath) {
-							newEntries = append(newEntries, e)
-						}
-					}
-					if len(newEntries) > 0 {
-						ufs.dirMap[dirPath] = newEntries
-					} else {
-						delete(ufs.dirMap, dirPath)
-					}
-				}
-
-				// Remove the persisted data
-				if err := ufs.persistor.RemovePersistedFile(entryPath); err != nil {
-					return err
-				}
-			}
+	if err := ufs.forget(absPath); err != nil {
+		return err
+	}
 
-			// Remove the now-empty directory itself
-			if err := ufs.fs.Remove(dir); err != nil {
-				return err
-			}
+	// Remove the persisted data
+	return ufs.persistor.RemovePersistedFile(absPath)
+}
 
-			// Remove the directory from the in-memory map
-			dirPath := filepath.Dir(dir)
-			if entries := ufs.dirMap[dirPath]; entries != nil {
-				newEntries := []string{}
-				for _, e := range entries {
-					if e != filepath.Base(dir) {
-						newEntries = append(newEntries, e)
-					}
-				}
-				if len(newEntries) > 0 {
-					ufs.dirMap[dirPath] = newEntries
-				} else {
-					delete(ufs.dirMap, dirPath)
-				}
-			}
-		}
-	} else {
-		// Remove a file
-		if err := ufs.fs.Remove(absPath); err != nil {
-			return err
-		}
+// forget removes the file or directory tree at absPath from memory only, the caller must hold fsMutex.
+func (ufs *UserFileSystem) forget(absPath string) error {
+	// Remove the file or the whole directory tree
+	if err := ufs.fs.RemoveAll(absPath); err != nil {
+		return err
+	}
 
-		// Update the in-memory directory map
-		dirPath := filepath.Dir(absPath)
-		entries := ufs.dirMap[dirPath]
-		newEntries := []string{}
-		for _, entry := range entries {
-			if entry != filepath.Base(absPath) {
-				newEntries = append(newEntries, entry)
-			}
+	// Update the in-memory directory map
+	ufs.removeEntry(filepath.Dir(absPath), filepath.Base(absPath))
+	for dir := range ufs.dirMap {
+		if _, ok := relativeTo(absPath, dir); ok {
+			delete(ufs.dirMap, dir)
 		}
+	}
+	return nil
+}
 
-		ufs.dirMap[dirPath] = newEntries
-
-		// Remove the file from the in-memory map
-		delete(ufs.dirMap, absPath)
-
-		// Remove the persisted data
-		if err := ufs.persistor.RemovePersistedFile(name); err != nil {
-			return err
+// removeEntry drops name from the children of dir in the in-memory directory map.
+func (ufs *UserFileSystem) removeEntry(dir, name string) {
+	entries := ufs.dirMap[dir]
+	newEntries := []string{}
+	for _, entry := range entries {
+		if entry != name {
+			newEntries = append(newEntries, entry)
 		}
 	}
+	if _, ok := ufs.dirMap[dir]; ok {
+		ufs.dirMap[dir] = newEntries
+	}
+}
 
-	return nil
+// relativeTo reports whether path is root itself or lies below it, returning
+// the path relative to root.
+func relativeTo(root, path string) (string, bool) {
+	if path == root {
+		return ".", true
+	}
+	prefix := root
+	if prefix != "/" {
+		prefix += "/"
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, prefix), true
 }
 
 // resolvePath resolves a relative path to an absolute path based on the current working directory.
@@ -1,23 +1,41 @@
 package ufs
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/lvow2022/udisk/internel/pkg/blob"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
-func TestUfs(t *testing.T) {
-	// Open an SQLite database in memory for testing purposes
-	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{}) // Use in-memory database for faster tests
+// newTestDB opens an SQLite database in memory, shared by all connections of the pool.
+func newTestDB(t *testing.T) *gorm.DB {
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{}) // Use in-memory database for faster tests
 	if err != nil {
 		t.Fatalf("Failed to open database: %v", err)
 	}
-	err = db.AutoMigrate(&FileSystem{})
+	err = InitTables(db)
 	if err != nil {
 		t.Fatalf("Failed to migrate database: %v", err)
 	}
-	fs := NewUserFileSystem(db)
+	return db
+}
+
+func TestUfs(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewUserFileSystem(db, "alice")
 
 	// Test MkdirAll
 	if err := fs.Mkdir("/testdir/parent/subdir", 0755); err != nil {
@@ -110,3 +128,908 @@ func TestUfs(t *testing.T) {
 
 	fmt.Println("All tests passed successfully!")
 }
+
+func TestUfsRestore(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewUserFileSystem(db, "alice")
+
+	if err := fs.Mkdir("/docs/empty", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if err := fs.WriteFile("/docs/a.txt", []byte("md5-a"), 0644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := fs.WriteFile("/docs/b.txt", []byte("md5-b"), 0644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := fs.Mv("/docs", "/archive"); err != nil {
+		t.Fatalf("Error moving directory: %v", err)
+	}
+	if err := fs.Remove("/archive/b.txt"); err != nil {
+		t.Fatalf("Error removing file: %v", err)
+	}
+
+	// Simulate a restart by building a new file system on the same database
+	restored := NewUserFileSystem(db, "alice")
+
+	files, err := restored.Ls("/archive")
+	if err != nil {
+		t.Fatalf("Error listing restored directory: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Restored directory mismatch: expected [a.txt empty], got %v", files)
+	}
+	data, err := restored.ReadFile("/archive/a.txt")
+	if err != nil {
+		t.Fatalf("Error reading restored file: %v", err)
+	}
+	if string(data) != "md5-a" {
+		t.Fatalf("Restored content mismatch: expected 'md5-a', got '%s'", string(data))
+	}
+	if _, err := restored.Ls("/archive/empty"); err != nil {
+		t.Fatalf("Error listing restored empty directory: %v", err)
+	}
+
+	// A record whose parent is gone must be reported and skipped
+	if err := db.Create(&FileSystem{Owner: "alice", Name: "lost.txt", Path: "/gone/lost.txt", ParentID: 9999}).Error; err != nil {
+		t.Fatalf("Error inserting orphan: %v", err)
+	}
+	report, err := restored.Restore()
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].Path != "/gone/lost.txt" {
+		t.Fatalf("Expected one orphan at /gone/lost.txt, got %v", report.Orphans)
+	}
+	if report.Dirs != 2 || report.Files != 1 {
+		t.Fatalf("Expected 2 dirs and 1 file, got %d dirs and %d files", report.Dirs, report.Files)
+	}
+}
+
+func TestUfsOwnerScope(t *testing.T) {
+	db := newTestDB(t)
+	alice := NewUserFileSystem(db, "alice")
+	bob := NewUserFileSystem(db, "bob")
+
+	// Both users can own the same path without colliding
+	if err := alice.Mkdir("/docs", 0755); err != nil {
+		t.Fatalf("Error creating directory for alice: %v", err)
+	}
+	if err := bob.Mkdir("/docs", 0755); err != nil {
+		t.Fatalf("Error creating directory for bob: %v", err)
+	}
+	if err := alice.WriteFile("/docs/alice.txt", []byte("a"), 0644); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := bob.Remove("/docs"); err != nil {
+		t.Fatalf("Error removing bob's directory: %v", err)
+	}
+
+	files, err := NewUserFileSystem(db, "alice").Ls("/docs")
+	if err != nil {
+		t.Fatalf("Error listing alice's directory: %v", err)
+	}
+	if len(files) != 1 || files[0] != "alice.txt" {
+		t.Fatalf("Directory contents mismatch: expected ['alice.txt'], got %v", files)
+	}
+	if _, err := NewUserFileSystem(db, "bob").Ls("/docs"); err == nil {
+		t.Fatalf("Expected bob's directory to be gone")
+	}
+}
+
+func TestInitTablesMigratesLegacyRows(t *testing.T) {
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	type legacyFileSystem struct {
+		ID          uint   `gorm:"column:id;primaryKey;autoIncrement"`
+		Name        string `gorm:"column:name"`
+		Path        string `gorm:"column:path;uniqueIndex:idx_file_systems_path"`
+		IsDirectory bool   `gorm:"column:is_directory"`
+	}
+	legacy := db.Table("file_systems")
+	if err := legacy.AutoMigrate(&legacyFileSystem{}); err != nil {
+		t.Fatalf("Failed to create legacy table: %v", err)
+	}
+	if err := legacy.Create(&legacyFileSystem{Name: "docs", Path: "/docs", IsDirectory: true}).Error; err != nil {
+		t.Fatalf("Failed to insert legacy row: %v", err)
+	}
+
+	if err := InitTables(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+
+	if _, err := NewUserFileSystem(db, LegacyOwner).Ls("/docs"); err != nil {
+		t.Fatalf("Expected legacy row to belong to %s: %v", LegacyOwner, err)
+	}
+	if err := NewUserFileSystem(db, "bob").Mkdir("/docs", 0755); err != nil {
+		t.Fatalf("Expected /docs to be free for another owner: %v", err)
+	}
+}
+
+func TestUfsLinkBlob(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewUserFileSystem(db, "alice")
+
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	ref := BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 13, MimeType: "text/plain", ModTime: mtime}
+	if err := fs.LinkBlob("/docs/hello.txt", ref); err != nil {
+		t.Fatalf("Error linking blob: %v", err)
+	}
+	if err := NewUserFileSystem(db, "bob").LinkBlob("/hello.txt", ref); err != nil {
+		t.Fatalf("Error linking the same blob for another user: %v", err)
+	}
+
+	restored := NewUserFileSystem(db, "alice")
+	got, err := restored.Blob("/docs/hello.txt")
+	if err != nil {
+		t.Fatalf("Error reading blob reference: %v", err)
+	}
+	if got.Digest != ref.Digest || got.Size != ref.Size || got.MimeType != ref.MimeType || !got.ModTime.Equal(mtime) {
+		t.Fatalf("Blob reference mismatch: expected %v, got %v", ref, got)
+	}
+	data, err := restored.ReadFile("/docs/hello.txt")
+	if err != nil || string(data) != ref.Digest {
+		t.Fatalf("Expected file content to be the digest, got '%s' (%v)", string(data), err)
+	}
+	if _, err := restored.Blob("/docs"); err == nil {
+		t.Fatalf("Expected error when reading the blob of a directory")
+	}
+}
+
+func TestUfsRefCounts(t *testing.T) {
+	db := newTestDB(t)
+	refs := NewGormRefCounter(db)
+	alice := NewUserFileSystem(db, "alice")
+	bob := NewUserFileSystem(db, "bob")
+
+	ref := BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 13}
+	other := BlobRef{Digest: "0123456789abcdef0123456789abcdef", Size: 7}
+	assertRefs := func(digest string, expected int64) {
+		t.Helper()
+		count, _, err := refs.Refs(digest)
+		if err != nil {
+			t.Fatalf("Error reading refs: %v", err)
+		}
+		if count.Refs != expected {
+			t.Fatalf("Refs of %s mismatch: expected %d, got %d", digest, expected, count.Refs)
+		}
+	}
+
+	for _, path := range []string{"/a/one.txt", "/a/two.txt"} {
+		if err := alice.LinkBlob(path, ref); err != nil {
+			t.Fatalf("Error linking blob: %v", err)
+		}
+	}
+	if err := bob.LinkBlob("/one.txt", ref); err != nil {
+		t.Fatalf("Error linking blob: %v", err)
+	}
+	assertRefs(ref.Digest, 3)
+
+	// Moving keeps the reference, replacing the content references the new
+	// blob while the old content is kept as a version referencing the old one
+	if err := alice.Mv("/a/one.txt", "/a/moved.txt"); err != nil {
+		t.Fatalf("Error moving file: %v", err)
+	}
+	if err := bob.LinkBlob("/one.txt", other); err != nil {
+		t.Fatalf("Error relinking blob: %v", err)
+	}
+	assertRefs(ref.Digest, 3)
+	assertRefs(other.Digest, 1)
+
+	// Removing a directory releases every file below it
+	if err := alice.Remove("/a"); err != nil {
+		t.Fatalf("Error removing directory: %v", err)
+	}
+	assertRefs(ref.Digest, 1)
+
+	// Pruning the version releases the last reference
+	if pruned, err := NewGormVersionPruner(db).Prune(0, time.Now().Add(time.Minute)); err != nil || pruned != 1 {
+		t.Fatalf("Expected 1 pruned version, got %d (%v)", pruned, err)
+	}
+	assertRefs(ref.Digest, 0)
+	if forgotten, err := refs.Forget(other.Digest); err != nil || forgotten {
+		t.Fatalf("Expected a referenced blob not to be forgotten, got %v (%v)", forgotten, err)
+	}
+	if forgotten, err := refs.Forget(ref.Digest); err != nil || !forgotten {
+		t.Fatalf("Expected an unreferenced blob to be forgotten, got %v (%v)", forgotten, err)
+	}
+}
+
+func TestRebuildRefCounts(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewUserFileSystem(db, "alice")
+
+	// shared is referenced by a file and by the version left by replacing
+	// another file, the other digests make the counts grow while rebuilding
+	shared := BlobRef{Digest: "00000000000000000000000000000000", Size: 1}
+	digests := []string{
+		"11111111111111111111111111111111",
+		"22222222222222222222222222222222",
+		"33333333333333333333333333333333",
+	}
+	if err := fs.LinkBlob("/shared.txt", shared); err != nil {
+		t.Fatalf("Error linking blob: %v", err)
+	}
+	if err := fs.LinkBlob("/replaced.txt", shared); err != nil {
+		t.Fatalf("Error linking blob: %v", err)
+	}
+	if err := fs.LinkBlob("/replaced.txt", BlobRef{Digest: digests[0], Size: 2}); err != nil {
+		t.Fatalf("Error relinking blob: %v", err)
+	}
+	for i, digest := range digests[1:] {
+		if err := fs.LinkBlob(fmt.Sprintf("/%d.txt", i), BlobRef{Digest: digest, Size: 3}); err != nil {
+			t.Fatalf("Error linking blob: %v", err)
+		}
+	}
+
+	if err := rebuildRefCounts(db); err != nil {
+		t.Fatalf("Error rebuilding refs: %v", err)
+	}
+	refs := NewGormRefCounter(db)
+	expected := map[string]int64{shared.Digest: 2, digests[0]: 1, digests[1]: 1, digests[2]: 1}
+	for digest, want := range expected {
+		count, _, err := refs.Refs(digest)
+		if err != nil {
+			t.Fatalf("Error reading refs: %v", err)
+		}
+		if count.Refs != want {
+			t.Fatalf("Refs of %s mismatch: expected %d, got %d", digest, want, count.Refs)
+		}
+	}
+}
+
+func TestUfsCommit(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewUserFileSystem(db, "alice")
+
+	first := BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 13}
+	second := BlobRef{Digest: "0123456789abcdef0123456789abcdef", Size: 7}
+	if path, err := fs.Commit("/docs/report.pdf", first, ConflictFail); err != nil || path != "/docs/report.pdf" {
+		t.Fatalf("Error committing file: %s (%v)", path, err)
+	}
+
+	if _, err := fs.Commit("/docs/report.pdf", second, ConflictFail); !os.IsExist(err) {
+		t.Fatalf("Expected an exists error with ConflictFail, got %v", err)
+	}
+
+	path, err := fs.Commit("/docs/report.pdf", second, ConflictRename)
+	if err != nil || path != "/docs/report (1).pdf" {
+		t.Fatalf("Expected rename to /docs/report (1).pdf, got %s (%v)", path, err)
+	}
+
+	if _, err := fs.Commit("/docs/report.pdf", second, ConflictOverwrite); err != nil {
+		t.Fatalf("Error overwriting file: %v", err)
+	}
+	if ref, _ := fs.Blob("/docs/report.pdf"); ref.Digest != second.Digest {
+		t.Fatalf("Expected overwritten file to reference %s, got %s", second.Digest, ref.Digest)
+	}
+	if _, err := fs.Commit("/docs", second, ConflictOverwrite); err == nil {
+		t.Fatalf("Expected error when overwriting a directory")
+	}
+
+	files, _ := fs.Ls("/docs")
+	if len(files) != 2 {
+		t.Fatalf("Directory contents mismatch: expected 2 files, got %v", files)
+	}
+}
+
+func TestUfsStat(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewUserFileSystem(db, "alice")
+
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ref := BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 13, MimeType: "text/plain", ModTime: mtime}
+	if err := fs.LinkBlob("/docs/b.txt", ref); err != nil {
+		t.Fatalf("Error linking blob: %v", err)
+	}
+	if err := fs.Mkdir("/docs/a", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+
+	info, err := fs.Stat("/docs/b.txt")
+	if err != nil {
+		t.Fatalf("Error getting file info: %v", err)
+	}
+	if info.IsDir || info.Size != ref.Size || info.Digest != ref.Digest || info.MimeType != ref.MimeType ||
+		!info.ModTime.Equal(mtime) || info.CreateTime.IsZero() {
+		t.Fatalf("File info mismatch: %+v", info)
+	}
+
+	root, err := fs.Stat("/")
+	if err != nil || !root.IsDir || root.Children != 1 {
+		t.Fatalf("Root info mismatch: %+v (%v)", root, err)
+	}
+	if _, err := fs.Stat("/missing"); !os.IsNotExist(err) {
+		t.Fatalf("Expected a not exist error, got %v", err)
+	}
+
+	// Restored file systems see the same entries, in name order
+	infos, err := NewUserFileSystem(db, "alice").ListDetailed("/docs")
+	if err != nil {
+		t.Fatalf("Error listing directory: %v", err)
+	}
+	if len(infos) != 2 || infos[0].Name != "a" || !infos[0].IsDir || infos[1].Name != "b.txt" || infos[1].Size != ref.Size {
+		t.Fatalf("Directory listing mismatch: %+v", infos)
+	}
+	if _, err := fs.ListDetailed("/docs/b.txt"); !errors.Is(err, ErrNotDirectory) {
+		t.Fatalf("Expected ErrNotDirectory when listing a file, got %v", err)
+	}
+
+	// Walk visits parents before their children
+	var walked []string
+	if err := fs.Walk("/docs", func(info FileInfo) error {
+		walked = append(walked, info.Path)
+		return nil
+	}); err != nil {
+		t.Fatalf("Error walking directory: %v", err)
+	}
+	if fmt.Sprint(walked) != "[/docs /docs/a /docs/b.txt]" {
+		t.Fatalf("Walk mismatch: %v", walked)
+	}
+	if err := fs.Walk("/missing", func(FileInfo) error { return nil }); !os.IsNotExist(err) {
+		t.Fatalf("Expected a not exist error, got %v", err)
+	}
+}
+
+func TestUfsCopy(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewUserFileSystem(db, "alice")
+
+	a := BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 13}
+	b := BlobRef{Digest: "0123456789abcdef0123456789abcdef", Size: 7}
+	for path, ref := range map[string]BlobRef{"/src/a.txt": a, "/src/sub/b.txt": b, "/dst/src/a.txt": b} {
+		if err := fs.LinkBlob(path, ref); err != nil {
+			t.Fatalf("Error linking blob: %v", err)
+		}
+	}
+
+	if _, err := fs.Copy("/src", "/src/sub/copy", CopyOptions{}); !errors.Is(err, os.ErrInvalid) {
+		t.Fatalf("Expected an invalid error when copying into itself, got %v", err)
+	}
+	if _, err := fs.Copy("/src", "/dst/src", CopyOptions{Policy: ConflictFail}); !os.IsExist(err) {
+		t.Fatalf("Expected an exists error with ConflictFail, got %v", err)
+	}
+
+	// Skip merges directories and keeps the existing file
+	if _, err := fs.Copy("/src", "/dst/src", CopyOptions{Policy: ConflictSkip}); err != nil {
+		t.Fatalf("Error copying with ConflictSkip: %v", err)
+	}
+	if ref, _ := fs.Blob("/dst/src/a.txt"); ref.Digest != b.Digest {
+		t.Fatalf("Expected skipped file to keep %s, got %s", b.Digest, ref.Digest)
+	}
+	if ref, _ := fs.Blob("/dst/src/sub/b.txt"); ref.Digest != b.Digest {
+		t.Fatalf("Expected merged file to reference %s, got %s", b.Digest, ref.Digest)
+	}
+
+	if _, err := fs.Copy("/src", "/dst/src", CopyOptions{Policy: ConflictOverwrite}); err != nil {
+		t.Fatalf("Error copying with ConflictOverwrite: %v", err)
+	}
+	if ref, _ := fs.Blob("/dst/src/a.txt"); ref.Digest != a.Digest {
+		t.Fatalf("Expected overwritten file to reference %s, got %s", a.Digest, ref.Digest)
+	}
+
+	path, err := fs.Copy("/src", "/dst/src", CopyOptions{Policy: ConflictRename})
+	if err != nil || path != "/dst/src (1)" {
+		t.Fatalf("Expected rename to /dst/src (1), got %s (%v)", path, err)
+	}
+
+	// The copies reference the same blobs and survive a restore
+	refs := NewGormRefCounter(db)
+	if count, _, _ := refs.Refs(a.Digest); count.Refs != 3 {
+		t.Fatalf("Expected 3 references to %s, got %d", a.Digest, count.Refs)
+	}
+	files, err := NewUserFileSystem(db, "alice").Ls("/dst/src (1)/sub")
+	if err != nil || len(files) != 1 || files[0] != "b.txt" {
+		t.Fatalf("Restored copy mismatch: %v (%v)", files, err)
+	}
+}
+
+func TestUfsTrash(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewUserFileSystem(db, "alice")
+	refs := NewGormRefCounter(db)
+
+	a := BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 13}
+	b := BlobRef{Digest: "0123456789abcdef0123456789abcdef", Size: 7}
+	if err := fs.LinkBlob("/docs/a.txt", a); err != nil {
+		t.Fatalf("Error linking blob: %v", err)
+	}
+	if err := fs.LinkBlob("/docs/sub/b.txt", b); err != nil {
+		t.Fatalf("Error linking blob: %v", err)
+	}
+
+	item, err := fs.Trash("/docs")
+	if err != nil {
+		t.Fatalf("Error moving to trash: %v", err)
+	}
+	if item.OriginalPath != "/docs" || !item.IsDirectory || item.Size != a.Size+b.Size {
+		t.Fatalf("Trash item mismatch: %+v", item)
+	}
+	if _, err := fs.Stat("/docs"); !os.IsNotExist(err) {
+		t.Fatalf("Expected trashed directory to be gone, got %v", err)
+	}
+	if files, _ := NewUserFileSystem(db, "alice").Ls("/"); len(files) != 0 {
+		t.Fatalf("Expected trashed records not to be restored, got %v", files)
+	}
+	// Trashed files keep their blobs alive
+	if count, _, _ := refs.Refs(a.Digest); count.Refs != 1 {
+		t.Fatalf("Expected trash to keep the reference to %s, got %d", a.Digest, count.Refs)
+	}
+
+	// Restoring onto a taken path fails unless a policy resolves the conflict
+	if err := fs.Mkdir("/docs", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if _, err := fs.RestoreTrash(item.ID, ConflictFail); !os.IsExist(err) {
+		t.Fatalf("Expected an exists error with ConflictFail, got %v", err)
+	}
+	path, err := fs.RestoreTrash(item.ID, ConflictRename)
+	if err != nil || path != "/docs (1)" {
+		t.Fatalf("Expected restore to /docs (1), got %s (%v)", path, err)
+	}
+	if ref, err := NewUserFileSystem(db, "alice").Blob("/docs (1)/sub/b.txt"); err != nil || ref.Digest != b.Digest {
+		t.Fatalf("Restored file mismatch: %+v (%v)", ref, err)
+	}
+	if items, _ := fs.ListTrash(); len(items) != 0 {
+		t.Fatalf("Expected restored item to leave the trash, got %+v", items)
+	}
+
+	// Purging drops the references
+	item, err = fs.Trash("/docs (1)/a.txt")
+	if err != nil {
+		t.Fatalf("Error moving to trash: %v", err)
+	}
+	if err := fs.PurgeTrash(item.ID); err != nil {
+		t.Fatalf("Error purging trash: %v", err)
+	}
+	if count, _, _ := refs.Refs(a.Digest); count.Refs != 0 {
+		t.Fatalf("Expected purge to release %s, got %d references", a.Digest, count.Refs)
+	}
+	if err := fs.PurgeTrash(item.ID); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Fatalf("Expected ErrTrashItemNotFound, got %v", err)
+	}
+}
+
+func TestUfsVersions(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewUserFileSystem(db, "alice")
+
+	first := BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 13}
+	second := BlobRef{Digest: "0123456789abcdef0123456789abcdef", Size: 7}
+	for _, ref := range []BlobRef{first, second} {
+		if _, err := fs.Commit("/report.pdf", ref, ConflictOverwrite); err != nil {
+			t.Fatalf("Error committing file: %v", err)
+		}
+	}
+
+	versions, err := fs.Versions("/report.pdf")
+	if err != nil || len(versions) != 1 || versions[0].Digest != first.Digest || versions[0].Uploader != "alice" {
+		t.Fatalf("Versions mismatch: %+v (%v)", versions, err)
+	}
+
+	// Restoring swaps the current content and the version
+	ref, err := fs.RestoreVersion("/report.pdf", versions[0].ID)
+	if err != nil || ref.Digest != first.Digest {
+		t.Fatalf("Error restoring version: %+v (%v)", ref, err)
+	}
+	if current, _ := NewUserFileSystem(db, "alice").Blob("/report.pdf"); current.Digest != first.Digest {
+		t.Fatalf("Expected restored content %s, got %s", first.Digest, current.Digest)
+	}
+	versions, _ = fs.Versions("/report.pdf")
+	if len(versions) != 1 || versions[0].Digest != second.Digest {
+		t.Fatalf("Expected the replaced content to become a version, got %+v", versions)
+	}
+	if _, err := fs.RestoreVersion("/report.pdf", 9999); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("Expected ErrVersionNotFound, got %v", err)
+	}
+
+	// Removing the file releases its versions
+	refs := NewGormRefCounter(db)
+	if err := fs.Remove("/report.pdf"); err != nil {
+		t.Fatalf("Error removing file: %v", err)
+	}
+	for _, digest := range []string{first.Digest, second.Digest} {
+		if count, _, _ := refs.Refs(digest); count.Refs != 0 {
+			t.Fatalf("Expected %s to be released, got %d references", digest, count.Refs)
+		}
+	}
+}
+
+func TestUfsQuota(t *testing.T) {
+	db := newTestDB(t)
+	fs := NewUserFileSystem(db, "alice")
+
+	expect := func(step string, bytes, files int64) {
+		t.Helper()
+		quota, err := fs.Quota()
+		if err != nil || quota.UsedBytes != bytes || quota.UsedFiles != files {
+			t.Fatalf("%s: expected %d bytes in %d files, got %+v (%v)", step, bytes, files, quota, err)
+		}
+	}
+
+	first := BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 13}
+	second := BlobRef{Digest: "0123456789abcdef0123456789abcdef", Size: 7}
+	if _, err := fs.Commit("/docs/a.txt", first, ConflictFail); err != nil {
+		t.Fatalf("Error committing file: %v", err)
+	}
+	expect("commit", 13, 1)
+
+	// The replaced content is kept as a version and keeps counting
+	if _, err := fs.Commit("/docs/a.txt", second, ConflictOverwrite); err != nil {
+		t.Fatalf("Error committing file: %v", err)
+	}
+	expect("overwrite", 20, 1)
+
+	if _, err := fs.Copy("/docs", "/backup", CopyOptions{}); err != nil {
+		t.Fatalf("Error copying directory: %v", err)
+	}
+	expect("copy", 27, 2)
+
+	// Trashed files count until they are purged
+	item, err := fs.Trash("/docs")
+	if err != nil {
+		t.Fatalf("Error trashing directory: %v", err)
+	}
+	expect("trash", 27, 2)
+	if err := fs.PurgeTrash(item.ID); err != nil {
+		t.Fatalf("Error purging trash: %v", err)
+	}
+	expect("purge", 7, 1)
+
+	// The usage survives a rebuild from the records
+	if err := db.Where("1 = 1").Delete(&Quota{}).Error; err != nil {
+		t.Fatalf("Error dropping quotas: %v", err)
+	}
+	if err := rebuildQuotas(db); err != nil {
+		t.Fatalf("Error rebuilding quotas: %v", err)
+	}
+	expect("rebuild", 7, 1)
+}
+
+func TestUfsImport(t *testing.T) {
+	db := newTestDB(t)
+	alice := NewUserFileSystem(db, "alice")
+	bob := NewUserFileSystem(db, "bob")
+
+	a := BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 13}
+	b := BlobRef{Digest: "0123456789abcdef0123456789abcdef", Size: 7}
+	for path, ref := range map[string]BlobRef{"/shared/a.txt": a, "/shared/sub/b.txt": b} {
+		if err := alice.LinkBlob(path, ref); err != nil {
+			t.Fatalf("Error linking blob: %v", err)
+		}
+	}
+
+	// A failing check aborts before anything is persisted
+	quotaErr := errors.New("over quota")
+	_, err := bob.Import(alice, "/shared", "/saved", ImportOptions{Check: func(bytes, files int64) error {
+		if bytes != 20 || files != 2 {
+			t.Fatalf("Expected 20 bytes in 2 files, got %d in %d", bytes, files)
+		}
+		return quotaErr
+	}})
+	if !errors.Is(err, quotaErr) {
+		t.Fatalf("Expected the check error, got %v", err)
+	}
+	if _, err := bob.Stat("/saved"); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing to be imported, got %v", err)
+	}
+
+	var progress []int
+	path, err := bob.Import(alice, "/shared", "/saved", ImportOptions{BatchSize: 2, Progress: func(done, total int) {
+		progress = append(progress, done, total)
+	}})
+	if err != nil || path != "/saved" {
+		t.Fatalf("Error importing: %s (%v)", path, err)
+	}
+	if fmt.Sprint(progress) != "[2 4 4 4]" {
+		t.Fatalf("Unexpected progress %v", progress)
+	}
+
+	// The copy belongs to bob and references the blobs of alice
+	if ref, err := NewUserFileSystem(db, "bob").Blob("/saved/sub/b.txt"); err != nil || ref.Digest != b.Digest {
+		t.Fatalf("Imported file mismatch: %+v (%v)", ref, err)
+	}
+	if count, _, _ := NewGormRefCounter(db).Refs(a.Digest); count.Refs != 2 {
+		t.Fatalf("Expected 2 references to %s, got %d", a.Digest, count.Refs)
+	}
+
+	path, err = bob.Import(alice, "/shared", "/saved", ImportOptions{Policy: ConflictRename})
+	if err != nil || path != "/saved (1)" {
+		t.Fatalf("Expected rename to /saved (1), got %s (%v)", path, err)
+	}
+}
+
+func TestUfsReadOnlyFS(t *testing.T) {
+	db := newTestDB(t)
+	ufs := NewUserFileSystem(db, "alice")
+	store, err := blob.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating blob store: %v", err)
+	}
+
+	link := func(name, content string) {
+		sum := md5.Sum([]byte(content))
+		digest := hex.EncodeToString(sum[:])
+		if _, err := store.Put(digest, strings.NewReader(content)); err != nil {
+			t.Fatalf("Error storing blob: %v", err)
+		}
+		if err := ufs.LinkBlob(name, BlobRef{Digest: digest, Size: int64(len(content)), ModTime: time.Now()}); err != nil {
+			t.Fatalf("Error linking blob: %v", err)
+		}
+	}
+	link("/docs/hello.txt", "Hello, World!")
+	link("/docs/b/nested.txt", "nested")
+	link("/top.txt", "top")
+	if err := ufs.Mkdir("/docs/empty", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	file, err := ufs.Create("/docs/b/new.txt")
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	file.Close()
+
+	fsys := ufs.ReadOnly(store)
+	if err := fstest.TestFS(fsys, "docs/hello.txt", "docs/b/nested.txt", "docs/b/new.txt", "docs/empty", "top.txt"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := fs.Sub(fsys, "docs")
+	if err != nil {
+		t.Fatalf("Error creating sub file system: %v", err)
+	}
+	if err := fstest.TestFS(sub, "hello.txt", "b/nested.txt", "b/new.txt", "empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := fs.ReadFile(sub, "hello.txt")
+	if err != nil || string(data) != "Hello, World!" {
+		t.Fatalf("Expected the blob content, got '%s' (%v)", string(data), err)
+	}
+	if _, err := fs.Stat(fsys, "docs/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected a not exist error, got %v", err)
+	}
+	if _, err := fsys.Open("/top.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("Expected an invalid path error, got %v", err)
+	}
+
+	// http.FS serves the files directly
+	rec := httptest.NewRecorder()
+	http.FileServer(http.FS(fsys)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/docs/b/nested.txt", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "nested" {
+		t.Fatalf("Expected the file to be served, got %d '%s'", rec.Code, rec.Body.String())
+	}
+}
+
+// persistorBackend is a named Backend under test.
+type persistorBackend struct {
+	name string
+	Backend
+}
+
+func persistorBackends(t *testing.T) []persistorBackend {
+	db := newTestDB(t)
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "ufs.db"))
+	if err != nil {
+		t.Fatalf("Failed to open bolt store: %v", err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+
+	return []persistorBackend{
+		{"gorm", GormBackend(db)},
+		{"bolt", KVBackend(bolt)},
+		{"memory", KVBackend(NewMemoryStore())},
+	}
+}
+
+// TestPersistorConformance runs the same scenario against every Persistor
+// implementation, each must keep records, versions, trash, reference counts
+// and quotas in the same way.
+func TestPersistorConformance(t *testing.T) {
+	for _, backend := range persistorBackends(t) {
+		t.Run(backend.name, func(t *testing.T) {
+			testPersistor(t, backend)
+		})
+	}
+}
+
+func testPersistor(t *testing.T, b persistorBackend) {
+	alice := NewPersistedFileSystem(b.Persistors("alice"))
+	bob := NewPersistedFileSystem(b.Persistors("bob"))
+	reopen := func() *UserFileSystem { return NewPersistedFileSystem(b.Persistors("alice")) }
+	refs := func(digest string) int64 {
+		count, _, err := b.Refs.Refs(digest)
+		if err != nil {
+			t.Fatalf("Error reading references of %s: %v", digest, err)
+		}
+		return count.Refs
+	}
+	usage := func(want string) {
+		quota, err := alice.Quota()
+		if err != nil {
+			t.Fatalf("Error reading quota: %v", err)
+		}
+		if got := fmt.Sprintf("%d bytes %d files", quota.UsedBytes, quota.UsedFiles); got != want {
+			t.Fatalf("Usage mismatch: expected %s, got %s", want, got)
+		}
+	}
+
+	a := BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 10, MimeType: "text/plain", ModTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	c := BlobRef{Digest: "0123456789abcdef0123456789abcdef", Size: 20}
+	d := BlobRef{Digest: "fedcba9876543210fedcba9876543210", Size: 30, Uploader: "carol"}
+
+	// Records, parents persisted along, survive a restore in name order
+	if err := alice.Mkdir("/docs/sub", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	for name, ref := range map[string]BlobRef{"/docs/b.txt": a, "/docs/c.txt": c} {
+		if err := alice.LinkBlob(name, ref); err != nil {
+			t.Fatalf("Error linking blob: %v", err)
+		}
+	}
+	file, err := alice.Create("/docs/a-empty.txt")
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	file.Close()
+	if err := bob.LinkBlob("/docs/b.txt", a); err != nil {
+		t.Fatalf("Error linking blob: %v", err)
+	}
+
+	restored := reopen()
+	report, err := restored.Restore()
+	if err != nil || report.Dirs != 2 || report.Files != 3 || len(report.Orphans) != 0 {
+		t.Fatalf("Restore mismatch: %+v (%v)", report, err)
+	}
+	infos, err := restored.ListDetailed("/docs")
+	if err != nil {
+		t.Fatalf("Error listing directory: %v", err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	if fmt.Sprint(names) != "[a-empty.txt b.txt c.txt sub]" {
+		t.Fatalf("Listing mismatch: %v", names)
+	}
+	info, err := restored.Stat("/docs/b.txt")
+	if err != nil || info.Digest != a.Digest || info.Size != a.Size || info.MimeType != a.MimeType ||
+		!info.ModTime.Equal(a.ModTime) || info.CreateTime.IsZero() {
+		t.Fatalf("File info mismatch: %+v (%v)", info, err)
+	}
+	if root, _ := bob.ListDetailed("/docs"); len(root) != 1 {
+		t.Fatalf("Expected bob to see only his own records, got %+v", root)
+	}
+	if refs(a.Digest) != 2 || refs(c.Digest) != 1 {
+		t.Fatalf("Reference count mismatch: %d %d", refs(a.Digest), refs(c.Digest))
+	}
+	usage("30 bytes 3 files")
+
+	// Replaced content is kept as a version of its own uploader, restoring it keeps the replacement
+	if err := alice.LinkBlob("/docs/b.txt", d); err != nil {
+		t.Fatalf("Error replacing blob: %v", err)
+	}
+	usage("60 bytes 3 files")
+	versions, err := alice.Versions("/docs/b.txt")
+	if err != nil || len(versions) != 1 || versions[0].Digest != a.Digest || versions[0].Uploader != "alice" {
+		t.Fatalf("Versions mismatch: %+v (%v)", versions, err)
+	}
+	if _, err := alice.RestoreVersion("/docs/b.txt", versions[0].ID); err != nil {
+		t.Fatalf("Error restoring version: %v", err)
+	}
+	if versions, _ = alice.Versions("/docs/b.txt"); len(versions) != 1 || versions[0].Digest != d.Digest ||
+		versions[0].Uploader != "carol" {
+		t.Fatalf("Versions after restore mismatch: %+v", versions)
+	}
+	if _, err := alice.Version("/docs/b.txt", versions[0].ID+100); !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("Expected ErrVersionNotFound, got %v", err)
+	}
+	if refs(a.Digest) != 2 || refs(d.Digest) != 1 {
+		t.Fatalf("Reference count after restore mismatch: %d %d", refs(a.Digest), refs(d.Digest))
+	}
+	usage("60 bytes 3 files")
+
+	// Moved records keep their versions
+	if err := alice.Mv("/docs", "/moved"); err != nil {
+		t.Fatalf("Error moving directory: %v", err)
+	}
+	if versions, _ := reopen().Versions("/moved/b.txt"); len(versions) != 1 {
+		t.Fatalf("Expected the moved file to keep its version, got %+v", versions)
+	}
+	if _, err := reopen().Stat("/docs"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the old path to be gone, got %v", err)
+	}
+
+	// Trashed records keep counting until they are purged
+	item, err := alice.Trash("/moved/c.txt")
+	if err != nil {
+		t.Fatalf("Error moving to trash: %v", err)
+	}
+	if item.Owner != "alice" || item.OriginalPath != "/moved/c.txt" || item.Size != c.Size {
+		t.Fatalf("Trash item mismatch: %+v", item)
+	}
+	usage("60 bytes 3 files")
+	if path, err := alice.RestoreTrash(item.ID, ConflictFail); err != nil || path != "/moved/c.txt" {
+		t.Fatalf("Expected restore to /moved/c.txt, got %s (%v)", path, err)
+	}
+	if item, err = alice.Trash("/moved/c.txt"); err != nil {
+		t.Fatalf("Error moving to trash: %v", err)
+	}
+	if err := bob.PurgeTrash(item.ID); !errors.Is(err, ErrTrashItemNotFound) {
+		t.Fatalf("Expected bob not to purge the trash of alice, got %v", err)
+	}
+	if err := alice.PurgeTrash(item.ID); err != nil {
+		t.Fatalf("Error purging trash: %v", err)
+	}
+	if refs(c.Digest) != 0 {
+		t.Fatalf("Expected purge to release %s, got %d references", c.Digest, refs(c.Digest))
+	}
+	usage("40 bytes 2 files")
+
+	item, err = alice.Trash("/moved/sub")
+	if err != nil {
+		t.Fatalf("Error moving to trash: %v", err)
+	}
+	expired, err := b.Trash.Expired(time.Now().Add(time.Second), 10)
+	if err != nil || len(expired) != 1 || expired[0].ID != item.ID {
+		t.Fatalf("Expired trash mismatch: %+v (%v)", expired, err)
+	}
+
+	// Pruning drops the version and what it holds
+	pruned, err := b.Versions.Prune(0, time.Now().Add(time.Second))
+	if err != nil || pruned != 1 {
+		t.Fatalf("Expected 1 version to be pruned, got %d (%v)", pruned, err)
+	}
+	if refs(d.Digest) != 0 {
+		t.Fatalf("Expected prune to release %s, got %d references", d.Digest, refs(d.Digest))
+	}
+	usage("10 bytes 2 files")
+
+	// Importing from another owner references the same blobs
+	if _, err := alice.Import(bob, "/docs", "/imported", ImportOptions{Policy: ConflictFail}); err != nil {
+		t.Fatalf("Error importing: %v", err)
+	}
+	if refs(a.Digest) != 3 {
+		t.Fatalf("Expected import to reference %s, got %d references", a.Digest, refs(a.Digest))
+	}
+	usage("20 bytes 3 files")
+
+	// Removing everything releases every reference and all usage
+	for _, name := range []string{"/moved", "/imported"} {
+		if err := alice.Remove(name); err != nil {
+			t.Fatalf("Error removing %s: %v", name, err)
+		}
+	}
+	usage("0 bytes 0 files")
+	if refs(a.Digest) != 1 {
+		t.Fatalf("Expected only bob to reference %s, got %d references", a.Digest, refs(a.Digest))
+	}
+	if forgotten, err := b.Refs.Forget(a.Digest); err != nil || forgotten {
+		t.Fatalf("Expected a referenced blob not to be forgotten, got %v (%v)", forgotten, err)
+	}
+	if forgotten, err := b.Refs.Forget(d.Digest); err != nil || !forgotten {
+		t.Fatalf("Expected an unreferenced blob to be forgotten, got %v (%v)", forgotten, err)
+	}
+	if _, found, _ := b.Refs.Refs(d.Digest); found {
+		t.Fatalf("Expected the forgotten count to be gone")
+	}
+	if files, _ := reopen().Ls("/"); len(files) != 0 {
+		t.Fatalf("Expected no records to be restored, got %v", files)
+	}
+
+	// A failed update leaves no trace, paths stay unique per owner
+	p := b.Persistors("carol")
+	for _, path := range []string{"/x/a.txt", "/y"} {
+		if err := p.PersistBlob(path, c); err != nil {
+			t.Fatalf("Error persisting blob: %v", err)
+		}
+	}
+	if err := p.UpdatePaths("/x/a.txt", "/y"); err == nil {
+		t.Fatalf("Expected moving onto an existing path to fail")
+	}
+	if !p.PathExists("/x/a.txt") || refs(c.Digest) != 2 {
+		t.Fatalf("Expected the failed move to be rolled back, got %d references", refs(c.Digest))
+	}
+}
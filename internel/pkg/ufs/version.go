@@ -0,0 +1,194 @@
+package ufs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrVersionNotFound is returned when a file has no version with the requested ID.
+var ErrVersionNotFound = errors.New("version not found")
+
+// FileVersion is content a file held before it was replaced. A version holds
+// a reference to its blob until it is pruned or its file is removed.
+type FileVersion struct {
+	ID        uint        `gorm:"column:id;primaryKey;autoIncrement"`                              // 自动递增主键，列名为 "id"
+	FileID    uint        `gorm:"column:file_id;not null;index"`                                   // 所属文件的记录ID，列名为 "file_id"
+	Digest    string      `gorm:"column:digest;size:64;not null;index"`                            // 引用的 blob 摘要，列名为 "digest"
+	Size      int64       `gorm:"column:size;not null;default:0"`                                  // 文件大小 (字节)，列名为 "size"
+	MimeType  string      `gorm:"column:mime_type;size:255"`                                       // 文件类型，列名为 "mime_type"
+	Uploader  string      `gorm:"column:uploader;size:64"`                                         // 上传这个版本的用户，列名为 "uploader"
+	ModTime   time.Time   `gorm:"column:mtime"`                                                    // 这个版本的修改时间，列名为 "mtime"
+	CreatedAt time.Time   `gorm:"column:created_at;index"`                                         // 被新内容替换的时间，列名为 "created_at"
+	File      *FileSystem `gorm:"foreignKey:FileID;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"` // 外键，所属文件，级联更新和删除
+}
+
+// Ref returns the blob reference of the version.
+func (v FileVersion) Ref() BlobRef {
+	return BlobRef{Digest: v.Digest, Size: v.Size, MimeType: v.MimeType, ModTime: v.ModTime, Uploader: v.Uploader}
+}
+
+// LoadVersions returns the versions of the file at path, most recent first.
+func (p *GormPersistor) LoadVersions(path string) ([]FileVersion, error) {
+	absPath := filepath.Clean(path)
+	file, err := p.findFile(p.db, absPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []FileVersion
+	if err := p.db.Where("file_id = ?", file.ID).Order("created_at DESC, id DESC").
+		Find(&versions).Error; err != nil {
+		return nil, fmt.Errorf("failed to load versions of %s: %v", absPath, err)
+	}
+	return versions, nil
+}
+
+// FindVersion returns the version with id of the file at path.
+func (p *GormPersistor) FindVersion(path string, id uint) (FileVersion, error) {
+	return p.findVersion(p.db, filepath.Clean(path), id)
+}
+
+// RestoreVersion makes the version with id the current content of the file
+// at path. The replaced content is kept as a version in turn, so a restore
+// can itself be undone.
+func (p *GormPersistor) RestoreVersion(path string, id uint) (version FileVersion, err error) {
+	absPath := filepath.Clean(path)
+	err = p.db.Transaction(func(tx *gorm.DB) error {
+		if version, err = p.findVersion(tx, absPath, id); err != nil {
+			return err
+		}
+		return restoreVersion(gormRecords{tx}, p.owner, absPath, version)
+	})
+	return version, err
+}
+
+func (p *GormPersistor) findVersion(tx *gorm.DB, absPath string, id uint) (version FileVersion, err error) {
+	file, err := p.findFile(tx, absPath)
+	if err != nil {
+		return version, err
+	}
+	res := tx.Where("id = ? AND file_id = ?", id, file.ID).Limit(1).Find(&version)
+	if res.Error != nil {
+		return version, fmt.Errorf("failed to query version %d: %v", id, res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return version, ErrVersionNotFound
+	}
+	return version, nil
+}
+
+// findFile returns the record of the file at absPath, failing for directories and missing paths.
+func (p *GormPersistor) findFile(tx *gorm.DB, absPath string) (FileSystem, error) {
+	file, found, err := p.find(tx, absPath)
+	if err != nil {
+		return file, err
+	}
+	if !found {
+		return file, &os.PathError{Op: "versions", Path: absPath, Err: os.ErrNotExist}
+	}
+	if file.IsDirectory {
+		return file, &os.PathError{Op: "versions", Path: absPath, Err: ErrIsDirectory}
+	}
+	return file, nil
+}
+
+// VersionPruner applies the version retention of every owner.
+type VersionPruner interface {
+	// Prune keeps at most keep versions of every file and drops the versions
+	// replaced before the given time, a zero keep or time disables that rule.
+	// It returns the number of versions dropped.
+	Prune(keep int, before time.Time) (int, error)
+}
+
+type GormVersionPruner struct {
+	db *gorm.DB
+}
+
+func NewGormVersionPruner(db *gorm.DB) VersionPruner {
+	return &GormVersionPruner{db: db}
+}
+
+func (v *GormVersionPruner) Prune(keep int, before time.Time) (int, error) {
+	var expired []FileVersion
+	if !before.IsZero() {
+		if err := v.db.Where("created_at < ?", before).Find(&expired).Error; err != nil {
+			return 0, fmt.Errorf("failed to find expired versions: %v", err)
+		}
+	}
+
+	if keep > 0 {
+		var fileIDs []uint
+		if err := v.db.Model(&FileVersion{}).Select("file_id").Group("file_id").
+			Having("COUNT(*) > ?", keep).Scan(&fileIDs).Error; err != nil {
+			return 0, fmt.Errorf("failed to find files with too many versions: %v", err)
+		}
+		for _, fileID := range fileIDs {
+			var versions []FileVersion
+			if err := v.db.Where("file_id = ?", fileID).Order("created_at DESC, id DESC").
+				Find(&versions).Error; err != nil {
+				return 0, fmt.Errorf("failed to find versions of file %d: %v", fileID, err)
+			}
+			expired = append(expired, versions[keep:]...)
+		}
+	}
+
+	pruned := 0
+	seen := make(map[uint]bool, len(expired))
+	for _, version := range expired {
+		if seen[version.ID] {
+			continue
+		}
+		seen[version.ID] = true
+		err := v.db.Transaction(func(tx *gorm.DB) error {
+			// The version counted toward the quota of whoever owns its file now
+			var owner string
+			if err := tx.Model(&FileSystem{}).Select("owner").Where("id = ?", version.FileID).
+				Scan(&owner).Error; err != nil {
+				return err
+			}
+			released, err := releaseVersion(gormRecords{tx}, owner, version)
+			if released && err == nil {
+				pruned++
+			}
+			return err
+		})
+		if err != nil {
+			return pruned, fmt.Errorf("failed to prune version %d: %v", version.ID, err)
+		}
+	}
+	return pruned, nil
+}
+
+// Versions returns the previous versions of the file at name, most recent first.
+func (ufs *UserFileSystem) Versions(name string) ([]FileVersion, error) {
+	return ufs.persistor.LoadVersions(ufs.resolvePath(name))
+}
+
+// Version returns the version with id of the file at name.
+func (ufs *UserFileSystem) Version(name string, id uint) (FileVersion, error) {
+	return ufs.persistor.FindVersion(ufs.resolvePath(name), id)
+}
+
+// RestoreVersion makes the version with id the current content of the file
+// at name, keeping the replaced content as a new version.
+func (ufs *UserFileSystem) RestoreVersion(name string, id uint) (BlobRef, error) {
+	absPath := ufs.resolvePath(name)
+
+	ufs.fsMutex.Lock()
+	defer ufs.fsMutex.Unlock()
+
+	if _, err := ufs.persistor.RestoreVersion(absPath, id); err != nil {
+		return BlobRef{}, err
+	}
+	record, _, err := ufs.persistor.FindRecord(absPath)
+	if err != nil {
+		return BlobRef{}, err
+	}
+	ref := record.blobRef()
+	return ref, ufs.linkInMemory(absPath, ref)
+}
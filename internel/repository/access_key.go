@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/repository/dao"
+	"time"
+)
+
+var ErrAccessKeyNotFound = dao.ErrRecordNotFound
+
+type AccessKeyRepository interface {
+	Create(ctx context.Context, k domain.AccessKey) error
+	FindById(ctx context.Context, id string) (domain.AccessKey, error)
+	FindByUserId(ctx context.Context, userId string) ([]domain.AccessKey, error)
+	Delete(ctx context.Context, userId string, id string) error
+}
+
+type accessKeyRepository struct {
+	dao dao.AccessKeyDAO
+}
+
+func NewAccessKeyRepository(dao dao.AccessKeyDAO) AccessKeyRepository {
+	return &accessKeyRepository{
+		dao: dao,
+	}
+}
+
+func (repo *accessKeyRepository) Create(ctx context.Context, k domain.AccessKey) error {
+	return repo.dao.Insert(ctx, dao.AccessKey{
+		Id:     k.Id,
+		Secret: k.Secret,
+		UserId: k.UserId,
+	})
+}
+
+func (repo *accessKeyRepository) FindById(ctx context.Context, id string) (domain.AccessKey, error) {
+	k, err := repo.dao.FindById(ctx, id)
+	if err != nil {
+		return domain.AccessKey{}, err
+	}
+	return repo.toDomain(k), nil
+}
+
+func (repo *accessKeyRepository) FindByUserId(ctx context.Context, userId string) ([]domain.AccessKey, error) {
+	keys, err := repo.dao.FindByUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]domain.AccessKey, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, repo.toDomain(k))
+	}
+	return res, nil
+}
+
+func (repo *accessKeyRepository) Delete(ctx context.Context, userId string, id string) error {
+	return repo.dao.Delete(ctx, userId, id)
+}
+
+func (repo *accessKeyRepository) toDomain(k dao.AccessKey) domain.AccessKey {
+	return domain.AccessKey{
+		Id:     k.Id,
+		Secret: k.Secret,
+		UserId: k.UserId,
+		Ctime:  time.UnixMilli(k.Ctime),
+	}
+}
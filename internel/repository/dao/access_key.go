@@ -0,0 +1,63 @@
+package dao
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"time"
+)
+
+type AccessKeyDAO interface {
+	Insert(ctx context.Context, k AccessKey) error
+	FindById(ctx context.Context, id string) (AccessKey, error)
+	FindByUserId(ctx context.Context, userId string) ([]AccessKey, error)
+	// Delete 删除用户的一个密钥，密钥不存在或者属于别人时返回 ErrRecordNotFound
+	Delete(ctx context.Context, userId string, id string) error
+}
+
+// AccessKey S3 接口的访问密钥
+type AccessKey struct {
+	Id     string `gorm:"primaryKey;type:varchar(32)"`
+	Secret string `gorm:"type:varchar(64)"`
+	UserId string `gorm:"type:varchar(64);index"`
+
+	Ctime int64
+}
+
+type accessKeyDAO struct {
+	db *gorm.DB
+}
+
+func NewAccessKeyDAO(db *gorm.DB) AccessKeyDAO {
+	return &accessKeyDAO{
+		db: db,
+	}
+}
+
+func (dao *accessKeyDAO) Insert(ctx context.Context, k AccessKey) error {
+	k.Ctime = time.Now().UnixMilli()
+	return dao.db.WithContext(ctx).Create(&k).Error
+}
+
+func (dao *accessKeyDAO) FindById(ctx context.Context, id string) (AccessKey, error) {
+	var k AccessKey
+	err := dao.db.WithContext(ctx).Where("id = ?", id).First(&k).Error
+	return k, err
+}
+
+func (dao *accessKeyDAO) FindByUserId(ctx context.Context, userId string) ([]AccessKey, error) {
+	var keys []AccessKey
+	err := dao.db.WithContext(ctx).Where("user_id = ?", userId).
+		Order("ctime").Find(&keys).Error
+	return keys, err
+}
+
+func (dao *accessKeyDAO) Delete(ctx context.Context, userId string, id string) error {
+	res := dao.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userId).Delete(&AccessKey{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
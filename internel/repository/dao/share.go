@@ -0,0 +1,101 @@
+package dao
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"time"
+)
+
+type ShareDAO interface {
+	Insert(ctx context.Context, s Share) (Share, error)
+	FindByToken(ctx context.Context, token string) (Share, error)
+	FindByUserId(ctx context.Context, userId string) ([]Share, error)
+	// Delete 删除用户的一个分享，分享不存在或者属于别人时返回 ErrRecordNotFound
+	Delete(ctx context.Context, userId string, id int64) error
+	// IncrDownloads 增加一次下载次数，已经达到上限时不增加并返回 false
+	IncrDownloads(ctx context.Context, id int64) (bool, error)
+	// DecrDownloads 退还一次 IncrDownloads 计入的下载次数，不会小于 0
+	DecrDownloads(ctx context.Context, id int64) error
+}
+
+// Share 一个分享链接
+type Share struct {
+	Id     int64  `gorm:"primaryKey,autoIncrement"`
+	Token  string `gorm:"type:varchar(32);unique"`
+	UserId string `gorm:"type:varchar(64);index"`
+	Path   string `gorm:"type:varchar(1024)"`
+	IsDir  bool
+	// 提取码的 bcrypt 哈希，为空时不需要提取码
+	Code string `gorm:"type:varchar(64)"`
+	Mode string `gorm:"type:varchar(16)"`
+	// 过期时间，毫秒数，0 表示永不过期
+	Expire int64
+	// 最多下载次数，0 表示不限制
+	MaxDownloads int64
+	Downloads    int64
+
+	Ctime int64
+	Utime int64
+}
+
+type shareDAO struct {
+	db *gorm.DB
+}
+
+func NewShareDAO(db *gorm.DB) ShareDAO {
+	return &shareDAO{
+		db: db,
+	}
+}
+
+func (dao *shareDAO) Insert(ctx context.Context, s Share) (Share, error) {
+	now := time.Now().UnixMilli()
+	s.Ctime = now
+	s.Utime = now
+	err := dao.db.WithContext(ctx).Create(&s).Error
+	return s, err
+}
+
+func (dao *shareDAO) FindByToken(ctx context.Context, token string) (Share, error) {
+	var s Share
+	err := dao.db.WithContext(ctx).Where("token = ?", token).First(&s).Error
+	return s, err
+}
+
+func (dao *shareDAO) FindByUserId(ctx context.Context, userId string) ([]Share, error) {
+	var shares []Share
+	err := dao.db.WithContext(ctx).Where("user_id = ?", userId).
+		Order("ctime DESC").Find(&shares).Error
+	return shares, err
+}
+
+func (dao *shareDAO) Delete(ctx context.Context, userId string, id int64) error {
+	res := dao.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userId).Delete(&Share{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (dao *shareDAO) IncrDownloads(ctx context.Context, id int64) (bool, error) {
+	// 在一条 UPDATE 里检查上限，并发下载也不会超出
+	res := dao.db.WithContext(ctx).Model(&Share{}).
+		Where("id = ? AND (max_downloads = 0 OR downloads < max_downloads)", id).
+		Updates(map[string]interface{}{
+			"downloads": gorm.Expr("downloads + 1"),
+			"utime":     time.Now().UnixMilli(),
+		})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (dao *shareDAO) DecrDownloads(ctx context.Context, id int64) error {
+	return dao.db.WithContext(ctx).Model(&Share{}).
+		Where("id = ? AND downloads > 0", id).
+		Updates(map[string]interface{}{
+			"downloads": gorm.Expr("downloads - 1"),
+			"utime":     time.Now().UnixMilli(),
+		}).Error
+}
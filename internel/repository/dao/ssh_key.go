@@ -0,0 +1,65 @@
+package dao
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"time"
+)
+
+type SSHKeyDAO interface {
+	Insert(ctx context.Context, k SSHKey) error
+	FindByFingerprint(ctx context.Context, fingerprint string) (SSHKey, error)
+	FindByUserId(ctx context.Context, userId string) ([]SSHKey, error)
+	// Delete 删除用户的一个公钥，公钥不存在或者属于别人时返回 ErrRecordNotFound
+	Delete(ctx context.Context, userId string, id int64) error
+}
+
+// SSHKey SFTP 登录用的公钥，一个公钥只能属于一个用户
+type SSHKey struct {
+	Id          int64  `gorm:"primaryKey,autoIncrement"`
+	Name        string `gorm:"type:varchar(128)"`
+	Fingerprint string `gorm:"type:varchar(64);unique"`
+	PublicKey   string `gorm:"type:varchar(4096)"`
+	UserId      string `gorm:"type:varchar(64);index"`
+
+	Ctime int64
+}
+
+type sshKeyDAO struct {
+	db *gorm.DB
+}
+
+func NewSSHKeyDAO(db *gorm.DB) SSHKeyDAO {
+	return &sshKeyDAO{
+		db: db,
+	}
+}
+
+func (dao *sshKeyDAO) Insert(ctx context.Context, k SSHKey) error {
+	k.Ctime = time.Now().UnixMilli()
+	return dao.db.WithContext(ctx).Create(&k).Error
+}
+
+func (dao *sshKeyDAO) FindByFingerprint(ctx context.Context, fingerprint string) (SSHKey, error) {
+	var k SSHKey
+	err := dao.db.WithContext(ctx).Where("fingerprint = ?", fingerprint).First(&k).Error
+	return k, err
+}
+
+func (dao *sshKeyDAO) FindByUserId(ctx context.Context, userId string) ([]SSHKey, error) {
+	var keys []SSHKey
+	err := dao.db.WithContext(ctx).Where("user_id = ?", userId).
+		Order("ctime").Find(&keys).Error
+	return keys, err
+}
+
+func (dao *sshKeyDAO) Delete(ctx context.Context, userId string, id int64) error {
+	res := dao.db.WithContext(ctx).Where("id = ? AND user_id = ?", id, userId).Delete(&SSHKey{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
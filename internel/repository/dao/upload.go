@@ -0,0 +1,92 @@
+package dao
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+type UploadSessionDAO interface {
+	Insert(ctx context.Context, s UploadSession) error
+	FindById(ctx context.Context, id string) (UploadSession, error)
+	// InsertChunk 记录一个已收到的分片，重复上传同一分片时覆盖其 md5
+	InsertChunk(ctx context.Context, c UploadChunk) error
+	FindChunks(ctx context.Context, sessionId string) ([]UploadChunk, error)
+	// Delete 删除会话及其分片记录
+	Delete(ctx context.Context, id string) error
+}
+
+// UploadSession 一次分片上传的会话
+type UploadSession struct {
+	Id          string `gorm:"primaryKey;type:varchar(36)"`
+	UserId      string `gorm:"type:varchar(64);index"`
+	Path        string `gorm:"type:varchar(1024)"`
+	Digest      string `gorm:"type:varchar(64)"`
+	Size        int64
+	ChunkSize   int64
+	TotalChunks int
+	Conflict    string `gorm:"type:varchar(16)"`
+	// 过期时间，毫秒数
+	Expire int64 `gorm:"index"`
+
+	Ctime int64
+	Utime int64
+}
+
+// UploadChunk 会话中一个已收到的分片
+type UploadChunk struct {
+	Id         int64  `gorm:"primaryKey,autoIncrement"`
+	SessionId  string `gorm:"type:varchar(36);uniqueIndex:idx_session_chunk"`
+	ChunkIndex int    `gorm:"uniqueIndex:idx_session_chunk"`
+	Md5        string `gorm:"type:varchar(32)"`
+
+	Ctime int64
+}
+
+type uploadSessionDAO struct {
+	db *gorm.DB
+}
+
+func NewUploadSessionDAO(db *gorm.DB) UploadSessionDAO {
+	return &uploadSessionDAO{
+		db: db,
+	}
+}
+
+func (dao *uploadSessionDAO) Insert(ctx context.Context, s UploadSession) error {
+	now := time.Now().UnixMilli()
+	s.Ctime = now
+	s.Utime = now
+	return dao.db.WithContext(ctx).Create(&s).Error
+}
+
+func (dao *uploadSessionDAO) FindById(ctx context.Context, id string) (UploadSession, error) {
+	var s UploadSession
+	err := dao.db.WithContext(ctx).Where("id = ?", id).First(&s).Error
+	return s, err
+}
+
+func (dao *uploadSessionDAO) InsertChunk(ctx context.Context, c UploadChunk) error {
+	c.Ctime = time.Now().UnixMilli()
+	return dao.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_id"}, {Name: "chunk_index"}},
+		DoUpdates: clause.AssignmentColumns([]string{"md5", "ctime"}),
+	}).Create(&c).Error
+}
+
+func (dao *uploadSessionDAO) FindChunks(ctx context.Context, sessionId string) ([]UploadChunk, error) {
+	var chunks []UploadChunk
+	err := dao.db.WithContext(ctx).Where("session_id = ?", sessionId).
+		Order("chunk_index").Find(&chunks).Error
+	return chunks, err
+}
+
+func (dao *uploadSessionDAO) Delete(ctx context.Context, id string) error {
+	return dao.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session_id = ?", id).Delete(&UploadChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("id = ?", id).Delete(&UploadSession{}).Error
+	})
+}
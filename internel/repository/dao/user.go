@@ -59,8 +59,9 @@ func (dao *userDAO) Insert(ctx context.Context, u User) error {
 }
 
 func (dao *userDAO) FindByEmail(ctx context.Context, email string) (User, error) {
-	//TODO implement me
-	panic("implement me")
+	var u User
+	err := dao.db.WithContext(ctx).Where("email = ?", email).First(&u).Error
+	return u, err
 }
 
 func (dao *userDAO) UpdateById(ctx context.Context, entity User) error {
@@ -69,13 +70,15 @@ func (dao *userDAO) UpdateById(ctx context.Context, entity User) error {
 }
 
 func (dao *userDAO) FindById(ctx context.Context, uid int64) (User, error) {
-	//TODO implement me
-	panic("implement me")
+	var u User
+	err := dao.db.WithContext(ctx).Where("id = ?", uid).First(&u).Error
+	return u, err
 }
 
 func (dao *userDAO) FindByPhone(ctx context.Context, phone string) (User, error) {
-	//TODO implement me
-	panic("implement me")
+	var u User
+	err := dao.db.WithContext(ctx).Where("phone = ?", phone).First(&u).Error
+	return u, err
 }
 
 func NewUserDAO(db *gorm.DB) UserDAO {
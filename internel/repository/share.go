@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/repository/dao"
+	"time"
+)
+
+var ErrShareNotFound = dao.ErrRecordNotFound
+
+type ShareRepository interface {
+	Create(ctx context.Context, s domain.Share) (domain.Share, error)
+	FindByToken(ctx context.Context, token string) (domain.Share, error)
+	FindByUserId(ctx context.Context, userId string) ([]domain.Share, error)
+	Delete(ctx context.Context, userId string, id int64) error
+	// IncrDownloads 增加一次下载次数，已经达到上限时返回 false
+	IncrDownloads(ctx context.Context, id int64) (bool, error)
+	// DecrDownloads 退还一次下载次数
+	DecrDownloads(ctx context.Context, id int64) error
+}
+
+type shareRepository struct {
+	dao dao.ShareDAO
+}
+
+func NewShareRepository(dao dao.ShareDAO) ShareRepository {
+	return &shareRepository{
+		dao: dao,
+	}
+}
+
+func (repo *shareRepository) Create(ctx context.Context, s domain.Share) (domain.Share, error) {
+	entity, err := repo.dao.Insert(ctx, repo.toEntity(s))
+	if err != nil {
+		return domain.Share{}, err
+	}
+	return repo.toDomain(entity), nil
+}
+
+func (repo *shareRepository) FindByToken(ctx context.Context, token string) (domain.Share, error) {
+	s, err := repo.dao.FindByToken(ctx, token)
+	if err != nil {
+		return domain.Share{}, err
+	}
+	return repo.toDomain(s), nil
+}
+
+func (repo *shareRepository) FindByUserId(ctx context.Context, userId string) ([]domain.Share, error) {
+	shares, err := repo.dao.FindByUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]domain.Share, 0, len(shares))
+	for _, s := range shares {
+		res = append(res, repo.toDomain(s))
+	}
+	return res, nil
+}
+
+func (repo *shareRepository) Delete(ctx context.Context, userId string, id int64) error {
+	return repo.dao.Delete(ctx, userId, id)
+}
+
+func (repo *shareRepository) IncrDownloads(ctx context.Context, id int64) (bool, error) {
+	return repo.dao.IncrDownloads(ctx, id)
+}
+
+func (repo *shareRepository) DecrDownloads(ctx context.Context, id int64) error {
+	return repo.dao.DecrDownloads(ctx, id)
+}
+
+func (repo *shareRepository) toEntity(s domain.Share) dao.Share {
+	var expire int64
+	if !s.Expire.IsZero() {
+		expire = s.Expire.UnixMilli()
+	}
+	return dao.Share{
+		Id:           s.Id,
+		Token:        s.Token,
+		UserId:       s.UserId,
+		Path:         s.Path,
+		IsDir:        s.IsDir,
+		Code:         s.Code,
+		Mode:         s.Mode,
+		Expire:       expire,
+		MaxDownloads: s.MaxDownloads,
+		Downloads:    s.Downloads,
+	}
+}
+
+func (repo *shareRepository) toDomain(s dao.Share) domain.Share {
+	var expire time.Time
+	if s.Expire > 0 {
+		expire = time.UnixMilli(s.Expire)
+	}
+	return domain.Share{
+		Id:           s.Id,
+		Token:        s.Token,
+		UserId:       s.UserId,
+		Path:         s.Path,
+		IsDir:        s.IsDir,
+		Code:         s.Code,
+		HasCode:      s.Code != "",
+		Mode:         s.Mode,
+		Expire:       expire,
+		MaxDownloads: s.MaxDownloads,
+		Downloads:    s.Downloads,
+		Ctime:        time.UnixMilli(s.Ctime),
+	}
+}
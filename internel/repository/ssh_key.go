@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/repository/dao"
+	"time"
+)
+
+var ErrSSHKeyNotFound = dao.ErrRecordNotFound
+
+type SSHKeyRepository interface {
+	Create(ctx context.Context, k domain.SSHKey) error
+	FindByFingerprint(ctx context.Context, fingerprint string) (domain.SSHKey, error)
+	FindByUserId(ctx context.Context, userId string) ([]domain.SSHKey, error)
+	Delete(ctx context.Context, userId string, id int64) error
+}
+
+type sshKeyRepository struct {
+	dao dao.SSHKeyDAO
+}
+
+func NewSSHKeyRepository(dao dao.SSHKeyDAO) SSHKeyRepository {
+	return &sshKeyRepository{
+		dao: dao,
+	}
+}
+
+func (repo *sshKeyRepository) Create(ctx context.Context, k domain.SSHKey) error {
+	return repo.dao.Insert(ctx, dao.SSHKey{
+		Name:        k.Name,
+		Fingerprint: k.Fingerprint,
+		PublicKey:   k.PublicKey,
+		UserId:      k.UserId,
+	})
+}
+
+func (repo *sshKeyRepository) FindByFingerprint(ctx context.Context, fingerprint string) (domain.SSHKey, error) {
+	k, err := repo.dao.FindByFingerprint(ctx, fingerprint)
+	if err != nil {
+		return domain.SSHKey{}, err
+	}
+	return repo.toDomain(k), nil
+}
+
+func (repo *sshKeyRepository) FindByUserId(ctx context.Context, userId string) ([]domain.SSHKey, error) {
+	keys, err := repo.dao.FindByUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]domain.SSHKey, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, repo.toDomain(k))
+	}
+	return res, nil
+}
+
+func (repo *sshKeyRepository) Delete(ctx context.Context, userId string, id int64) error {
+	return repo.dao.Delete(ctx, userId, id)
+}
+
+func (repo *sshKeyRepository) toDomain(k dao.SSHKey) domain.SSHKey {
+	return domain.SSHKey{
+		Id:          k.Id,
+		Name:        k.Name,
+		Fingerprint: k.Fingerprint,
+		PublicKey:   k.PublicKey,
+		UserId:      k.UserId,
+		Ctime:       time.UnixMilli(k.Ctime),
+	}
+}
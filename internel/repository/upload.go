@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/repository/dao"
+	"time"
+)
+
+var ErrUploadSessionNotFound = dao.ErrRecordNotFound
+
+type UploadSessionRepository interface {
+	Create(ctx context.Context, s domain.UploadSession) error
+	// FindById 返回会话及其分片接收情况
+	FindById(ctx context.Context, id string) (domain.UploadSession, error)
+	MarkChunkReceived(ctx context.Context, id string, index int, md5 string) error
+	Delete(ctx context.Context, id string) error
+}
+
+type uploadSessionRepository struct {
+	dao dao.UploadSessionDAO
+}
+
+func NewUploadSessionRepository(dao dao.UploadSessionDAO) UploadSessionRepository {
+	return &uploadSessionRepository{
+		dao: dao,
+	}
+}
+
+func (repo *uploadSessionRepository) Create(ctx context.Context, s domain.UploadSession) error {
+	return repo.dao.Insert(ctx, repo.toEntity(s))
+}
+
+func (repo *uploadSessionRepository) FindById(ctx context.Context, id string) (domain.UploadSession, error) {
+	s, err := repo.dao.FindById(ctx, id)
+	if err != nil {
+		return domain.UploadSession{}, err
+	}
+	chunks, err := repo.dao.FindChunks(ctx, id)
+	if err != nil {
+		return domain.UploadSession{}, err
+	}
+	return repo.toDomain(s, chunks), nil
+}
+
+func (repo *uploadSessionRepository) MarkChunkReceived(ctx context.Context, id string, index int, md5 string) error {
+	return repo.dao.InsertChunk(ctx, dao.UploadChunk{
+		SessionId:  id,
+		ChunkIndex: index,
+		Md5:        md5,
+	})
+}
+
+func (repo *uploadSessionRepository) Delete(ctx context.Context, id string) error {
+	return repo.dao.Delete(ctx, id)
+}
+
+func (repo *uploadSessionRepository) toEntity(s domain.UploadSession) dao.UploadSession {
+	return dao.UploadSession{
+		Id:          s.Id,
+		UserId:      s.UserId,
+		Path:        s.Path,
+		Digest:      s.Digest,
+		Size:        s.Size,
+		ChunkSize:   s.ChunkSize,
+		TotalChunks: s.TotalChunks,
+		Conflict:    s.Conflict,
+		Expire:      s.Expire.UnixMilli(),
+	}
+}
+
+func (repo *uploadSessionRepository) toDomain(s dao.UploadSession, chunks []dao.UploadChunk) domain.UploadSession {
+	received := make([]bool, s.TotalChunks)
+	md5s := make([]string, s.TotalChunks)
+	for _, c := range chunks {
+		if c.ChunkIndex >= 0 && c.ChunkIndex < s.TotalChunks {
+			received[c.ChunkIndex] = true
+			md5s[c.ChunkIndex] = c.Md5
+		}
+	}
+	return domain.UploadSession{
+		Id:          s.Id,
+		UserId:      s.UserId,
+		Path:        s.Path,
+		Digest:      s.Digest,
+		Size:        s.Size,
+		ChunkSize:   s.ChunkSize,
+		TotalChunks: s.TotalChunks,
+		Conflict:    s.Conflict,
+		Received:    received,
+		ChunkMd5s:   md5s,
+		Expire:      time.UnixMilli(s.Expire),
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"github.com/lvow2022/udisk/internel/domain"
 	"github.com/lvow2022/udisk/internel/repository/dao"
+	"time"
 )
 
 var (
@@ -34,18 +35,38 @@ func (repo *userRepository) Create(ctx context.Context, u domain.User) error {
 }
 
 func (repo *userRepository) FindByEmail(ctx context.Context, email string) (domain.User, error) {
-	//TODO implement me
-	panic("implement me")
+	u, err := repo.dao.FindByEmail(ctx, email)
+	if err != nil {
+		return domain.User{}, err
+	}
+	return repo.toDomain(u), nil
 }
 
 func (repo *userRepository) FindByPhone(ctx context.Context, phone string) (domain.User, error) {
-	//TODO implement me
-	panic("implement me")
+	u, err := repo.dao.FindByPhone(ctx, phone)
+	if err != nil {
+		return domain.User{}, err
+	}
+	return repo.toDomain(u), nil
 }
 
 func (repo *userRepository) FindById(ctx context.Context, uid int64) (domain.User, error) {
-	//TODO implement me
-	panic("implement me")
+	u, err := repo.dao.FindById(ctx, uid)
+	if err != nil {
+		return domain.User{}, err
+	}
+	return repo.toDomain(u), nil
+}
+
+func (repo *userRepository) toDomain(u dao.User) domain.User {
+	return domain.User{
+		Id:       u.Id,
+		Email:    u.Email.String,
+		Phone:    u.Phone.String,
+		Password: u.Password,
+		Nickname: u.Nickname,
+		Ctime:    time.UnixMilli(u.Ctime),
+	}
 }
 
 func (repo *userRepository) toEntity(u domain.User) dao.User {
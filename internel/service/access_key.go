@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/repository"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+)
+
+// AccessKeyService 管理用户访问 S3 接口的密钥
+type AccessKeyService interface {
+	// Create 创建一个密钥，只有这一次返回密钥原文
+	Create(ctx context.Context, userId string) (domain.AccessKey, error)
+	// List 列出用户的密钥，不包含密钥原文
+	List(ctx context.Context, userId string) ([]domain.AccessKey, error)
+	Delete(ctx context.Context, userId string, id string) error
+	// Find 返回校验签名用的密钥，包含密钥原文
+	Find(ctx context.Context, id string) (domain.AccessKey, error)
+}
+
+const (
+	// maxAccessKeys 每个用户最多可以创建的密钥数
+	maxAccessKeys = 10
+	// accessKeyIdPrefix 与 AWS 的 AKIA 类似，方便一眼认出密钥的来源
+	accessKeyIdPrefix = "UDSK"
+)
+
+type accessKeyService struct {
+	repo repository.AccessKeyRepository
+}
+
+func NewAccessKeyService(repo repository.AccessKeyRepository) AccessKeyService {
+	return &accessKeyService{
+		repo: repo,
+	}
+}
+
+func (s *accessKeyService) Create(ctx context.Context, userId string) (domain.AccessKey, error) {
+	keys, err := s.repo.FindByUserId(ctx, userId)
+	if err != nil {
+		return domain.AccessKey{}, err
+	}
+	if len(keys) >= maxAccessKeys {
+		return domain.AccessKey{}, ierrors.WithCode(code.ErrAccessKeyLimit, "每个用户最多创建 %d 个密钥", maxAccessKeys)
+	}
+
+	// 与 AWS 的格式相同: 20 个字符的 ID 和 40 个字符的密钥
+	b := make([]byte, 10+30)
+	if _, err := rand.Read(b); err != nil {
+		return domain.AccessKey{}, err
+	}
+	key := domain.AccessKey{
+		Id:     accessKeyIdPrefix + base32.StdEncoding.EncodeToString(b[:10]),
+		Secret: base64.StdEncoding.EncodeToString(b[10:]),
+		UserId: userId,
+	}
+	if err := s.repo.Create(ctx, key); err != nil {
+		return domain.AccessKey{}, err
+	}
+	return s.repo.FindById(ctx, key.Id)
+}
+
+func (s *accessKeyService) List(ctx context.Context, userId string) ([]domain.AccessKey, error) {
+	keys, err := s.repo.FindByUserId(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		keys[i].Secret = ""
+	}
+	return keys, nil
+}
+
+func (s *accessKeyService) Delete(ctx context.Context, userId string, id string) error {
+	err := s.repo.Delete(ctx, userId, id)
+	if errors.Is(err, repository.ErrAccessKeyNotFound) {
+		return ierrors.WithCode(code.ErrAccessKeyNotFound, "密钥不存在: %s", id)
+	}
+	return err
+}
+
+func (s *accessKeyService) Find(ctx context.Context, id string) (domain.AccessKey, error) {
+	key, err := s.repo.FindById(ctx, id)
+	if errors.Is(err, repository.ErrAccessKeyNotFound) {
+		return domain.AccessKey{}, ierrors.WithCode(code.ErrAccessKeyNotFound, "密钥不存在: %s", id)
+	}
+	return key, err
+}
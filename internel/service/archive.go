@@ -0,0 +1,227 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+)
+
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+// Archive 打包下载的一组文件和目录。条目在创建时确定，文件内容在 WriteTo
+// 时才逐个从 blob 存储读取，不生成临时文件
+type Archive struct {
+	// Name 建议客户端保存的文件名，含扩展名
+	Name     string
+	MimeType string
+
+	format  string
+	entries []archiveEntry
+	open    func(digest string) (io.ReadSeekCloser, error)
+}
+
+// archiveEntry 归档中的一项，name 是归档内的相对路径
+type archiveEntry struct {
+	name string
+	info ufs.FileInfo
+}
+
+// Archive 把 paths 指向的文件和目录树打包，format 为 zip (默认) 或 tar.gz。
+// 每个路径以其名称出现在归档的顶层，根目录的内容直接放在顶层
+func (f *fileService) Archive(ctx context.Context, userId string, paths []string, format string) (*Archive, error) {
+	archive := &Archive{format: format, open: f.openBlob}
+	switch format {
+	case "", ArchiveZip:
+		archive.format, archive.MimeType = ArchiveZip, "application/zip"
+	case ArchiveTarGz:
+		archive.MimeType = "application/gzip"
+	default:
+		return nil, ierrors.WithCode(code.ErrValidation, "不支持的归档格式: %s", format)
+	}
+	if len(paths) == 0 {
+		return nil, ierrors.WithCode(code.ErrValidation, "没有要下载的文件")
+	}
+
+	fs := f.um.User(userId)
+	used := map[string]bool{}
+	for _, path := range paths {
+		absPath := filepath.Join("/", path)
+		prefix := ""
+		if absPath != "/" {
+			prefix = uniqueName(used, filepath.Base(absPath))
+		}
+		err := fs.Walk(absPath, func(info ufs.FileInfo) error {
+			rel := strings.TrimPrefix(strings.TrimPrefix(info.Path, absPath), "/")
+			name := strings.TrimPrefix(prefix+"/"+rel, "/")
+			name = strings.TrimSuffix(name, "/")
+			// 旧的记录没有保存文件大小，从 blob 存储中获取
+			if !info.IsDir && info.Size == 0 && info.Digest != "" {
+				blobInfo, err := f.blobs.Stat(info.Digest)
+				if err != nil {
+					return f.blobError(info.Digest, err)
+				}
+				info.Size = blobInfo.Size
+			}
+			archive.entries = append(archive.entries, archiveEntry{name: name, info: info})
+			return nil
+		})
+		if err != nil {
+			return nil, pathError(absPath, err)
+		}
+	}
+
+	archive.Name = "download"
+	if len(paths) == 1 && len(used) == 1 {
+		for name := range used {
+			archive.Name = name
+		}
+	}
+	archive.Name += "." + archive.format
+	return archive, nil
+}
+
+// WriteTo 把归档写入 w，出错时 w 中是不完整的归档
+func (a *Archive) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	var err error
+	if a.format == ArchiveTarGz {
+		err = a.writeTarGz(cw)
+	} else {
+		err = a.writeZip(cw)
+	}
+	return cw.n, err
+}
+
+// writeZip 写出 zip 归档。archive/zip 在文件或条目数超出限制时自动使用
+// ZIP64，文件名不是 ASCII 时设置 UTF-8 标志位
+func (a *Archive) writeZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range a.entries {
+		header := &zip.FileHeader{
+			Name:     entry.name,
+			Modified: entry.info.ModTime,
+		}
+		if entry.info.IsDir {
+			header.Name += "/"
+			if _, err := zw.CreateHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+		header.Method = zipMethod(entry.info.MimeType)
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := a.copyContent(fw, entry); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTarGz 写出 tar.gz 归档，需要时使用 PAX 扩展头保存 UTF-8 文件名和超大文件
+func (a *Archive) writeTarGz(w io.Writer) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, entry := range a.entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Mode:     0644,
+			Size:     entry.info.Size,
+			ModTime:  entry.info.ModTime.Truncate(time.Second),
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatPAX,
+		}
+		if entry.info.IsDir {
+			header.Name += "/"
+			header.Mode = 0755
+			header.Size = 0
+			header.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !entry.info.IsDir {
+			if err := a.copyContent(tw, entry); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// copyContent 把条目引用的 blob 写入 w，内容长度必须与记录的大小一致。
+// 空文件不读 blob，旧的空文件记录没有 Digest
+func (a *Archive) copyContent(w io.Writer, entry archiveEntry) error {
+	if entry.info.Size == 0 {
+		return nil
+	}
+	r, err := a.open(entry.info.Digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	n, err := io.Copy(w, io.LimitReader(r, entry.info.Size))
+	if err != nil {
+		return err
+	}
+	if n != entry.info.Size {
+		return fmt.Errorf("%s: 文件内容只有 %d 字节，应为 %d 字节", entry.name, n, entry.info.Size)
+	}
+	return nil
+}
+
+// zipMethod 已经压缩过的内容直接存储，其余的用 deflate 压缩
+func zipMethod(mimeType string) uint16 {
+	switch {
+	case strings.HasPrefix(mimeType, "image/") && mimeType != "image/svg+xml" && mimeType != "image/bmp",
+		strings.HasPrefix(mimeType, "video/"),
+		strings.HasPrefix(mimeType, "audio/"),
+		mimeType == "application/zip",
+		mimeType == "application/gzip",
+		mimeType == "application/x-7z-compressed",
+		mimeType == "application/vnd.rar":
+		return zip.Store
+	default:
+		return zip.Deflate
+	}
+}
+
+// uniqueName 返回在 used 中还没有出现过的名字，重名时在扩展名前加上 " (n)"
+func uniqueName(used map[string]bool, name string) string {
+	ext := filepath.Ext(name)
+	candidate := name
+	for i := 1; used[candidate]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+)
+
+func newTestArchiveEnv(t *testing.T) *testEnv {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	env.put(t, "u1", "/文档/报告.txt", "report")
+	env.put(t, "u1", "/文档/sub/b.txt", "bbb")
+	env.put(t, "u1", "/x/报告.txt", "another report")
+	if err := env.um.User("u1").Mkdir("/文档/empty", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	return env
+}
+
+func TestArchiveZip(t *testing.T) {
+	env := newTestArchiveEnv(t)
+	archive, err := env.files.Archive(context.Background(), "u1", []string{"/文档", "/x/报告.txt", "/文档/报告.txt"}, "")
+	if err != nil {
+		t.Fatalf("Error creating archive: %v", err)
+	}
+	if archive.Name != "download.zip" || archive.MimeType != "application/zip" {
+		t.Fatalf("Archive mismatch: %s %s", archive.Name, archive.MimeType)
+	}
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("Error writing archive: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("Error reading zip: %v", err)
+	}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		// 非 ASCII 的文件名必须带 UTF-8 标志位，否则解压工具会按本地编码解释
+		if f.Flags&0x800 == 0 {
+			t.Fatalf("Expected the UTF-8 flag on %s, got flags %x", f.Name, f.Flags)
+		}
+		if f.FileInfo().IsDir() {
+			got[f.Name] = "dir"
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("Error opening %s: %v", f.Name, err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Error reading %s: %v", f.Name, err)
+		}
+		got[f.Name] = string(content)
+	}
+	// 同名的路径按顺序改名，目录原样保留，包括空目录
+	want := map[string]string{
+		"文档/":          "dir",
+		"文档/报告.txt":    "report",
+		"文档/sub/":      "dir",
+		"文档/sub/b.txt": "bbb",
+		"文档/empty/":    "dir",
+		"报告.txt":       "another report",
+		"报告 (1).txt":   "report",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Entries mismatch:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestArchiveTarGz(t *testing.T) {
+	env := newTestArchiveEnv(t)
+	archive, err := env.files.Archive(context.Background(), "u1", []string{"/文档"}, ArchiveTarGz)
+	if err != nil {
+		t.Fatalf("Error creating archive: %v", err)
+	}
+	if archive.Name != "文档.tar.gz" || archive.MimeType != "application/gzip" {
+		t.Fatalf("Archive mismatch: %s %s", archive.Name, archive.MimeType)
+	}
+	var buf bytes.Buffer
+	if _, err := archive.WriteTo(&buf); err != nil {
+		t.Fatalf("Error writing archive: %v", err)
+	}
+
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Error reading gzip: %v", err)
+	}
+	tr := tar.NewReader(gr)
+	got := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading tar: %v", err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			got[header.Name] = "dir"
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("Error reading %s: %v", header.Name, err)
+		}
+		if header.Size != int64(len(content)) {
+			t.Fatalf("Size mismatch for %s: %d", header.Name, header.Size)
+		}
+		got[header.Name] = string(content)
+	}
+	want := map[string]string{
+		"文档/":          "dir",
+		"文档/报告.txt":    "report",
+		"文档/sub/":      "dir",
+		"文档/sub/b.txt": "bbb",
+		"文档/empty/":    "dir",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Entries mismatch:\n got %v\nwant %v", got, want)
+	}
+}
+
+func TestArchiveErrors(t *testing.T) {
+	env := newTestArchiveEnv(t)
+	ctx := context.Background()
+	if _, err := env.files.Archive(ctx, "u1", []string{"/文档"}, "rar"); !isCode(err, code.ErrValidation) {
+		t.Fatalf("Expected ErrValidation for an unknown format, got %v", err)
+	}
+	if _, err := env.files.Archive(ctx, "u1", nil, ""); !isCode(err, code.ErrValidation) {
+		t.Fatalf("Expected ErrValidation without paths, got %v", err)
+	}
+	if _, err := env.files.Archive(ctx, "u1", []string{"/missing"}, ""); !isCode(err, code.ErrFileNotFound) {
+		t.Fatalf("Expected ErrFileNotFound, got %v", err)
+	}
+
+	// 条目已经确定之后内容丢失，WriteTo 中途失败
+	archive, err := env.files.Archive(ctx, "u1", []string{"/x"}, "")
+	if err != nil {
+		t.Fatalf("Error creating archive: %v", err)
+	}
+	if err := env.blobs.Delete(md5Hex("another report")); err != nil {
+		t.Fatalf("Error deleting blob: %v", err)
+	}
+	if _, err := archive.WriteTo(io.Discard); err == nil {
+		t.Fatal("Expected writing the archive to fail")
+	}
+}
+
+func TestArchiveEmptyFile(t *testing.T) {
+	// 旧的空文件记录没有 Digest，不能去读 blob
+	open := func(digest string) (io.ReadSeekCloser, error) {
+		return nil, fmt.Errorf("unexpected blob %q", digest)
+	}
+	for _, format := range []string{ArchiveZip, ArchiveTarGz} {
+		archive := &Archive{
+			format:  format,
+			entries: []archiveEntry{{name: "empty.txt", info: ufs.FileInfo{Name: "empty.txt"}}},
+			open:    open,
+		}
+		if _, err := archive.WriteTo(io.Discard); err != nil {
+			t.Fatalf("%s: error writing an empty file: %v", format, err)
+		}
+	}
+}
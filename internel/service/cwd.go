@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cwdTTL 工作目录的有效期，与刷新 token 的有效期相同，每次访问都会续期
+const cwdTTL = 7 * 24 * time.Hour
+
+// ChangeDirectory 切换会话 session 的工作目录，path 可以是相对路径
+func (f *fileService) ChangeDirectory(ctx context.Context, userId string, session string, path string) (string, error) {
+	dir := filepath.Clean(f.Abs(ctx, userId, session, path))
+	if err := requireDir(f.um.User(userId), dir); err != nil {
+		return "", err
+	}
+	f.cwds.Set(cwdKey(userId, session), dir, cwdTTL)
+	return dir, nil
+}
+
+// WorkingDirectory 返回会话 session 的工作目录。工作目录被移动或删除后，
+// 退回到仍然存在的最近一级上级目录
+func (f *fileService) WorkingDirectory(ctx context.Context, userId string, session string) string {
+	key := cwdKey(userId, session)
+	val, ok := f.cwds.Get(key)
+	if !ok {
+		return "/"
+	}
+	fs := f.um.User(userId)
+	dir := val.(string)
+	for dir != "/" {
+		if isDir, err := fs.IsDir(dir); err == nil && isDir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	f.cwds.Set(key, dir, cwdTTL)
+	return dir
+}
+
+// Abs 按会话 session 的工作目录把 path 解析成绝对路径，保留结尾的 /，
+// 以便目标路径仍然表示 "放到该目录下"。空路径表示工作目录本身
+func (f *fileService) Abs(ctx context.Context, userId string, session string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if path == "" {
+		path = "./"
+	}
+	abs := filepath.Join(f.WorkingDirectory(ctx, userId, session), path)
+	if strings.HasSuffix(path, "/") && abs != "/" {
+		abs += "/"
+	}
+	return abs
+}
+
+func cwdKey(userId, session string) string {
+	return fmt.Sprintf("cwd:%s:%s", userId, session)
+}
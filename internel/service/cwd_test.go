@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+)
+
+func TestChangeDirectorySessions(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	ctx := context.Background()
+	for _, dir := range []string{"/a/b", "/c"} {
+		if err := env.um.User("u1").Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Error creating %s: %v", dir, err)
+		}
+	}
+
+	if dir := env.files.WorkingDirectory(ctx, "u1", "s1"); dir != "/" {
+		t.Fatalf("Expected a new session to start at /, got %s", dir)
+	}
+	if _, err := env.files.ChangeDirectory(ctx, "u1", "s1", "/a"); err != nil {
+		t.Fatalf("Error changing directory: %v", err)
+	}
+	if _, err := env.files.ChangeDirectory(ctx, "u1", "s2", "/c"); err != nil {
+		t.Fatalf("Error changing directory: %v", err)
+	}
+
+	// 同一用户的两个会话各自保留工作目录，别的用户不受影响
+	for _, tt := range []struct{ user, session, want string }{
+		{"u1", "s1", "/a"},
+		{"u1", "s2", "/c"},
+		{"u2", "s1", "/"},
+	} {
+		if dir := env.files.WorkingDirectory(ctx, tt.user, tt.session); dir != tt.want {
+			t.Fatalf("Expected %s:%s to be in %s, got %s", tt.user, tt.session, tt.want, dir)
+		}
+	}
+}
+
+func TestChangeDirectoryRejected(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	ctx := context.Background()
+	if err := env.um.User("u1").Mkdir("/a", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	env.put(t, "u1", "/a/f.txt", "file")
+	if _, err := env.files.ChangeDirectory(ctx, "u1", "s1", "/a"); err != nil {
+		t.Fatalf("Error changing directory: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{path: "/missing", code: code.ErrFileNotFound},
+		{path: "missing", code: code.ErrFileNotFound},
+		{path: "/a/f.txt", code: code.ErrNotADirectory},
+		{path: "f.txt", code: code.ErrNotADirectory},
+	}
+	for _, tt := range tests {
+		if _, err := env.files.ChangeDirectory(ctx, "u1", "s1", tt.path); !isCode(err, tt.code) {
+			t.Fatalf("%s: expected code %d, got %v", tt.path, tt.code, err)
+		}
+	}
+
+	// 失败的切换不改变工作目录
+	if dir := env.files.WorkingDirectory(ctx, "u1", "s1"); dir != "/a" {
+		t.Fatalf("Expected to stay in /a, got %s", dir)
+	}
+}
+
+func TestAbsRelative(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	ctx := context.Background()
+	if err := env.um.User("u1").Mkdir("/a/b/c", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if _, err := env.files.ChangeDirectory(ctx, "u1", "s1", "/a/b"); err != nil {
+		t.Fatalf("Error changing directory: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "", want: "/a/b/"},
+		{path: ".", want: "/a/b"},
+		{path: "f.txt", want: "/a/b/f.txt"},
+		{path: "c/f.txt", want: "/a/b/c/f.txt"},
+		{path: "c/", want: "/a/b/c/"},
+		{path: "../f.txt", want: "/a/f.txt"},
+		{path: "../../../..", want: "/"},
+		{path: "/x/y", want: "/x/y"},
+	}
+	for _, tt := range tests {
+		if got := env.files.Abs(ctx, "u1", "s1", tt.path); got != tt.want {
+			t.Fatalf("%q: expected %s, got %s", tt.path, tt.want, got)
+		}
+	}
+
+	// 相对路径的切换也基于工作目录
+	if dir, err := env.files.ChangeDirectory(ctx, "u1", "s1", "c"); err != nil || dir != "/a/b/c" {
+		t.Fatalf("Expected /a/b/c, got %s (%v)", dir, err)
+	}
+	if dir, err := env.files.ChangeDirectory(ctx, "u1", "s1", "../.."); err != nil || dir != "/a" {
+		t.Fatalf("Expected /a, got %s (%v)", dir, err)
+	}
+	if dir := env.files.WorkingDirectory(ctx, "u1", "s2"); dir != "/" {
+		t.Fatalf("Expected the other session to stay in /, got %s", dir)
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/net/webdav"
+)
+
+// DavService 把用户的文件暴露为 golang.org/x/net/webdav 的文件系统和锁
+type DavService interface {
+	// FileSystem 返回 userId 的文件系统
+	FileSystem(userId string) webdav.FileSystem
+	// LockSystem 返回 userId 的锁，同一个用户的所有请求共用
+	LockSystem(userId string) webdav.LockSystem
+}
+
+type davService struct {
+	files FileSystemService
+
+	mutex sync.Mutex
+	// locks 每个用户各自的锁，锁只保存在内存中，重启后客户端需要重新加锁
+	locks map[string]webdav.LockSystem
+}
+
+// NewDavService 创建 WebDAV 服务，文件通过 files 读写
+func NewDavService(files FileSystemService) DavService {
+	return &davService{
+		files: files,
+		locks: make(map[string]webdav.LockSystem),
+	}
+}
+
+func (s *davService) FileSystem(userId string) webdav.FileSystem {
+	return davFS{fs: s.files.FileSystem(userId)}
+}
+
+func (s *davService) LockSystem(userId string) webdav.LockSystem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ls, ok := s.locks[userId]
+	if !ok {
+		ls = webdav.NewMemLS()
+		s.locks[userId] = ls
+	}
+	return ls
+}
+
+// davOffsetKey 是 context 中部分写入的起始位置
+type davOffsetKey struct{}
+
+// WithWriteOffset 让随后的 PUT 从 offset 处覆盖文件已有的内容，而不是替换
+// 整个文件。webdav.Handler 本身不支持 Content-Range，由调用方解析后传入
+func WithWriteOffset(ctx context.Context, offset int64) context.Context {
+	return context.WithValue(ctx, davOffsetKey{}, offset)
+}
+
+func writeOffset(ctx context.Context) (int64, bool) {
+	offset, ok := ctx.Value(davOffsetKey{}).(int64)
+	return offset, ok
+}
+
+// davCloseErrKey 是 context 中接收提交结果的位置
+type davCloseErrKey struct{}
+
+// WithCloseError 让随后的 PUT 把提交内容时的错误写入 err。webdav.Handler 对
+// 这类错误一律返回 405，调用方据此返回更准确的状态码，例如超出限额时的 507
+func WithCloseError(ctx context.Context, err *error) context.Context {
+	return context.WithValue(ctx, davCloseErrKey{}, err)
+}
+
+// davFS 把 FileSystem 适配为 webdav.FileSystem，文件信息附带 ETag 和 Content-Type
+type davFS struct {
+	fs FileSystem
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return d.fs.Mkdir(ctx, name, perm)
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := d.fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return davFile{File: f}, nil
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	return d.fs.RemoveAll(ctx, name)
+}
+
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return d.fs.Rename(ctx, oldName, newName)
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := d.fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return davInfoOf(info), nil
+}
+
+// davFile 实现 webdav.File
+type davFile struct {
+	File
+}
+
+// WriteTo 在 COPY 时由 io.Copy 调用，目标是 davFile 时交给原来的文件，
+// 以便直接引用同一个 blob
+func (f davFile) WriteTo(w io.Writer) (int64, error) {
+	if dst, ok := w.(davFile); ok {
+		w = dst.File
+	}
+	return io.Copy(w, f.File)
+}
+
+func (f davFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	for i, info := range infos {
+		infos[i] = davInfoOf(info)
+	}
+	return infos, err
+}
+
+func (f davFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davInfoOf(info), nil
+}
+
+// davInfo 提供 blob 的摘要作为 ETag
+type davInfo struct {
+	fsInfo
+}
+
+func davInfoOf(info os.FileInfo) os.FileInfo {
+	if fi, ok := info.(fsInfo); ok {
+		return davInfo{fsInfo: fi}
+	}
+	return info
+}
+
+// ETag 内容相同的文件 ETag 相同，没有摘要时由 webdav 根据修改时间和大小生成
+func (i davInfo) ETag(ctx context.Context) (string, error) {
+	if i.info.IsDir || i.info.Digest == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + i.info.Digest + `"`, nil
+}
+
+func (i davInfo) ContentType(ctx context.Context) (string, error) {
+	if i.info.MimeType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return i.info.MimeType, nil
+}
@@ -0,0 +1,284 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+)
+
+const (
+	// defaultPageSize 未指定分页大小时每页返回的条目数
+	defaultPageSize = 100
+	// maxPageSize 每页最多返回的条目数
+	maxPageSize = 1000
+)
+
+// ListOptions 控制目录列表的分页和排序
+type ListOptions struct {
+	// Page 从 1 开始，PageSize 为 0 时使用默认的分页大小
+	Page     int
+	PageSize int
+	// SortBy 排序字段: name (默认)、size 或 mtime，目录总是排在文件前面
+	SortBy string
+	Desc   bool
+}
+
+// ListDirectory 列出目录内容
+func (f *fileService) ListDirectory(ctx context.Context, userId string, path string, opts ListOptions) (domain.FileList, error) {
+	fs := f.um.User(userId)
+	dirPath := filepath.Join("/", path)
+	infos, err := fs.ListDetailed(dirPath)
+	if err != nil {
+		return domain.FileList{}, pathError(dirPath, err)
+	}
+	files := make([]domain.FileMetadata, 0, len(infos))
+	for _, info := range infos {
+		files = append(files, toMetadata(userId, info))
+	}
+
+	if err := sortFiles(files, opts.SortBy, opts.Desc); err != nil {
+		return domain.FileList{}, err
+	}
+	return domain.FileList{Total: len(files), Files: paginate(files, opts.Page, opts.PageSize)}, nil
+}
+
+// FileStat 获取用户目录树中 path 的元数据
+func (f *fileService) FileStat(ctx context.Context, userId string, path string) (domain.FileMetadata, error) {
+	return f.metadata(f.um.User(userId), userId, filepath.Join("/", path))
+}
+
+// MakeDirectory 创建目录及其缺失的上级目录
+func (f *fileService) MakeDirectory(ctx context.Context, userId string, path string) (domain.FileMetadata, error) {
+	fs := f.um.User(userId)
+	dirPath := filepath.Join("/", path)
+	if _, err := fs.IsDir(dirPath); err == nil {
+		return domain.FileMetadata{}, ierrors.WithCode(code.ErrFileExists, "已存在: %s", dirPath)
+	}
+	if err := requireAncestor(fs, dirPath); err != nil {
+		return domain.FileMetadata{}, err
+	}
+
+	if err := fs.Mkdir(dirPath, 0755); err != nil {
+		return domain.FileMetadata{}, err
+	}
+	return f.metadata(fs, userId, dirPath)
+}
+
+// Remove 把文件或目录移入回收站，非空目录只有在 recursive 时才会删除
+func (f *fileService) Remove(ctx context.Context, userId string, path string, recursive bool) error {
+	fs := f.um.User(userId)
+	absPath := filepath.Join("/", path)
+	if absPath == "/" {
+		return ierrors.WithCode(code.ErrValidation, "不能删除根目录")
+	}
+
+	isDir, err := fs.IsDir(absPath)
+	if err != nil {
+		return pathError(absPath, err)
+	}
+	if isDir && !recursive {
+		names, err := fs.Ls(absPath)
+		if err != nil {
+			return pathError(absPath, err)
+		}
+		if len(names) > 0 {
+			return ierrors.WithCode(code.ErrDirectoryNotEmpty, "目录不为空: %s", absPath)
+		}
+	}
+	if _, err := fs.Trash(absPath); err != nil {
+		return pathError(absPath, err)
+	}
+	return nil
+}
+
+// Move 移动或重命名 src，dst 以 / 结尾时移动到该目录下
+func (f *fileService) Move(ctx context.Context, userId string, src, dst string) (domain.FileMetadata, error) {
+	fs := f.um.User(userId)
+	srcPath, dstPath, err := f.checkTransfer(fs, src, dst)
+	if err != nil {
+		return domain.FileMetadata{}, err
+	}
+
+	if err := fs.Mv(srcPath, dstPath); err != nil {
+		return domain.FileMetadata{}, err
+	}
+	return f.metadata(fs, userId, dstPath)
+}
+
+// Copy 复制文件或整个目录，新的文件引用相同的 blob，不复制任何内容。
+// conflict 决定目标已存在时的处理方式: fail (默认)、skip、overwrite 或 rename
+func (f *fileService) Copy(ctx context.Context, userId string, src, dst string, conflict string) (domain.FileMetadata, error) {
+	policy, err := ufs.ParseConflictPolicy(conflict)
+	if err != nil {
+		return domain.FileMetadata{}, ierrors.WrapC(err, code.ErrValidation, "不支持的冲突处理方式: %s", conflict)
+	}
+	fs := f.um.User(userId)
+	dstPath := filepath.Join("/", targetPath(src, dst))
+	if err := requireDir(fs, filepath.Dir(dstPath)); err != nil {
+		return domain.FileMetadata{}, err
+	}
+
+	path, err := fs.Copy(filepath.Join("/", src), dstPath, ufs.CopyOptions{Policy: policy})
+	if err != nil {
+		return domain.FileMetadata{}, pathError(dstPath, err)
+	}
+	return f.metadata(fs, userId, path)
+}
+
+// checkTransfer 检查移动的源和目标，返回两者的绝对路径
+func (f *fileService) checkTransfer(fs *ufs.UserFileSystem, src, dst string) (string, string, error) {
+	srcPath := filepath.Join("/", src)
+	dstPath := filepath.Join("/", targetPath(src, dst))
+	if srcPath == "/" {
+		return "", "", ierrors.WithCode(code.ErrValidation, "不能移动根目录")
+	}
+	if _, err := fs.IsDir(srcPath); err != nil {
+		return "", "", pathError(srcPath, err)
+	}
+	if dstPath == srcPath || strings.HasPrefix(dstPath, srcPath+"/") {
+		return "", "", ierrors.WithCode(code.ErrValidation, "不能移动到自身: %s", dstPath)
+	}
+	if _, err := fs.IsDir(dstPath); err == nil {
+		return "", "", ierrors.WithCode(code.ErrFileExists, "已存在: %s", dstPath)
+	}
+	if err := requireDir(fs, filepath.Dir(dstPath)); err != nil {
+		return "", "", err
+	}
+	return srcPath, dstPath, nil
+}
+
+// metadata 返回 absPath 的元数据，只读取目录树中的记录，不访问 blob 存储
+func (f *fileService) metadata(fs *ufs.UserFileSystem, userId string, absPath string) (domain.FileMetadata, error) {
+	info, err := fs.Stat(absPath)
+	if err != nil {
+		return domain.FileMetadata{}, pathError(absPath, err)
+	}
+	return toMetadata(userId, info), nil
+}
+
+func toMetadata(userId string, info ufs.FileInfo) domain.FileMetadata {
+	return domain.FileMetadata{
+		Name:     info.Name,
+		Path:     info.Path,
+		IsDir:    info.IsDir,
+		Size:     info.Size,
+		Type:     info.MimeType,
+		OwnerID:  userId,
+		Digest:   info.Digest,
+		CTime:    info.CreateTime,
+		ModTime:  info.ModTime,
+		Children: info.Children,
+	}
+}
+
+// requireDir 检查 dir 存在并且是目录
+func requireDir(fs *ufs.UserFileSystem, dir string) error {
+	isDir, err := fs.IsDir(dir)
+	if err != nil {
+		return pathError(dir, err)
+	}
+	if !isDir {
+		return ierrors.WithCode(code.ErrNotADirectory, "不是目录: %s", dir)
+	}
+	return nil
+}
+
+// requireAncestor 检查 absPath 最近的已存在的上级是目录，缺少的上级目录
+// 可以自动创建，但不能在文件下面创建
+func requireAncestor(fs *ufs.UserFileSystem, absPath string) error {
+	for dir := filepath.Dir(absPath); dir != "/"; dir = filepath.Dir(dir) {
+		isDir, err := fs.IsDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !isDir {
+			return ierrors.WithCode(code.ErrNotADirectory, "不是目录: %s", dir)
+		}
+		break
+	}
+	return nil
+}
+
+// pathError 把 ufs 返回的路径错误转换成对应的错误码，优先使用错误中的路径
+func pathError(path string, err error) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		path = pe.Path
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ierrors.WithCode(code.ErrFileNotFound, "文件不存在: %s", path)
+	case errors.Is(err, os.ErrInvalid):
+		return ierrors.WithCode(code.ErrValidation, "路径不合法: %s", path)
+	case errors.Is(err, os.ErrExist):
+		return ierrors.WithCode(code.ErrFileExists, "已存在: %s", path)
+	case errors.Is(err, ufs.ErrIsDirectory):
+		return ierrors.WithCode(code.ErrNotAFile, "不是文件: %s", path)
+	case errors.Is(err, ufs.ErrNotDirectory):
+		return ierrors.WithCode(code.ErrNotADirectory, "不是目录: %s", path)
+	default:
+		return err
+	}
+}
+
+// sortFiles 按 sortBy 排序，目录总是排在文件前面，相同时按名称排序
+func sortFiles(files []domain.FileMetadata, sortBy string, desc bool) error {
+	var less func(a, b domain.FileMetadata) bool
+	switch sortBy {
+	case "", "name":
+		less = func(a, b domain.FileMetadata) bool { return a.Name < b.Name }
+	case "size":
+		less = func(a, b domain.FileMetadata) bool { return a.Size < b.Size }
+	case "mtime":
+		less = func(a, b domain.FileMetadata) bool { return a.ModTime.Before(b.ModTime) }
+	default:
+		return ierrors.WithCode(code.ErrValidation, "不支持的排序字段: %s", sortBy)
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if desc {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.Name < b.Name
+	})
+	return nil
+}
+
+// paginate 返回 files 中第 page 页的条目
+func paginate(files []domain.FileMetadata, page, pageSize int) []domain.FileMetadata {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	offset := (page - 1) * pageSize
+	if offset >= len(files) {
+		return []domain.FileMetadata{}
+	}
+	return files[offset:min(offset+pageSize, len(files))]
+}
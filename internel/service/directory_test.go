@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+)
+
+// newTestListEnv 创建 /d，其中有一个子目录和三个大小、修改时间各不相同的文件
+func newTestListEnv(t *testing.T) *testEnv {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	if err := env.um.User("u1").Mkdir("/d/sub", 0755); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	base := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, f := range []struct {
+		name    string
+		content string
+		mtime   time.Time
+	}{
+		{"a.txt", "aaa", base.Add(2 * time.Hour)},
+		{"b.txt", "b", base.Add(time.Hour)},
+		{"c.txt", "cc", base.Add(3 * time.Hour)},
+	} {
+		info := env.put(t, "u1", "/d/"+f.name, f.content)
+		ref := ufs.BlobRef{Digest: info.Digest, Size: info.Size, ModTime: f.mtime}
+		if _, err := env.um.User("u1").Commit("/d/"+f.name, ref, ufs.ConflictOverwrite); err != nil {
+			t.Fatalf("Error committing %s: %v", f.name, err)
+		}
+	}
+	return env
+}
+
+func names(files []domain.FileMetadata) string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestListDirectorySort(t *testing.T) {
+	env := newTestListEnv(t)
+
+	tests := []struct {
+		sortBy string
+		desc   bool
+		want   string
+	}{
+		{sortBy: "", want: "sub a.txt b.txt c.txt"},
+		{sortBy: "name", want: "sub a.txt b.txt c.txt"},
+		{sortBy: "name", desc: true, want: "sub c.txt b.txt a.txt"},
+		{sortBy: "size", want: "sub b.txt c.txt a.txt"},
+		{sortBy: "size", desc: true, want: "sub a.txt c.txt b.txt"},
+		{sortBy: "mtime", want: "sub b.txt a.txt c.txt"},
+		{sortBy: "mtime", desc: true, want: "sub c.txt a.txt b.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s desc=%v", tt.sortBy, tt.desc), func(t *testing.T) {
+			list, err := env.files.ListDirectory(context.Background(), "u1", "/d", ListOptions{SortBy: tt.sortBy, Desc: tt.desc})
+			if err != nil || list.Total != 4 || names(list.Files) != tt.want {
+				t.Fatalf("Expected %s, got %s of %d (%v)", tt.want, names(list.Files), list.Total, err)
+			}
+		})
+	}
+
+	if _, err := env.files.ListDirectory(context.Background(), "u1", "/d", ListOptions{SortBy: "owner"}); !isCode(err, code.ErrValidation) {
+		t.Fatalf("Expected ErrValidation for an unknown sort key, got %v", err)
+	}
+	if _, err := env.files.ListDirectory(context.Background(), "u1", "/missing", ListOptions{}); !isCode(err, code.ErrFileNotFound) {
+		t.Fatalf("Expected ErrFileNotFound, got %v", err)
+	}
+}
+
+func TestListDirectoryPage(t *testing.T) {
+	env := newTestListEnv(t)
+
+	tests := []struct {
+		page     int
+		pageSize int
+		want     string
+	}{
+		{page: 1, pageSize: 2, want: "sub a.txt"},
+		{page: 2, pageSize: 2, want: "b.txt c.txt"},
+		{page: 3, pageSize: 2, want: ""},
+		{page: 2, pageSize: 3, want: "c.txt"},
+		{page: 1, pageSize: 4, want: "sub a.txt b.txt c.txt"},
+		{page: 0, pageSize: 1, want: "sub"},
+		{page: 1, pageSize: 0, want: "sub a.txt b.txt c.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("page %d size %d", tt.page, tt.pageSize), func(t *testing.T) {
+			list, err := env.files.ListDirectory(context.Background(), "u1", "/d", ListOptions{Page: tt.page, PageSize: tt.pageSize})
+			if err != nil || list.Total != 4 || names(list.Files) != tt.want || list.Files == nil {
+				t.Fatalf("Expected %q, got %q of %d (%v)", tt.want, names(list.Files), list.Total, err)
+			}
+		})
+	}
+}
+
+func TestPaginateLimits(t *testing.T) {
+	files := make([]domain.FileMetadata, maxPageSize+defaultPageSize+1)
+	for i := range files {
+		files[i].Name = fmt.Sprint(i)
+	}
+
+	if got := paginate(files, 1, 0); len(got) != defaultPageSize {
+		t.Fatalf("Expected the default page size %d, got %d", defaultPageSize, len(got))
+	}
+	if got := paginate(files, 1, maxPageSize+1); len(got) != maxPageSize {
+		t.Fatalf("Expected pages capped at %d, got %d", maxPageSize, len(got))
+	}
+	if got := paginate(files, 2, maxPageSize+1); len(got) != defaultPageSize+1 || got[0].Name != fmt.Sprint(maxPageSize) {
+		t.Fatalf("Expected the capped second page to start at %d, got %d entries", maxPageSize, len(got))
+	}
+	if got := paginate(files, -1, 1); len(got) != 1 || got[0].Name != "0" {
+		t.Fatalf("Expected a negative page to be the first, got %v", got)
+	}
+}
+
+func TestRemoveDirectory(t *testing.T) {
+	env := newTestListEnv(t)
+	ctx := context.Background()
+
+	if err := env.files.Remove(ctx, "u1", "/d", false); !isCode(err, code.ErrDirectoryNotEmpty) {
+		t.Fatalf("Expected ErrDirectoryNotEmpty, got %v", err)
+	}
+	if _, err := env.files.FileStat(ctx, "u1", "/d/a.txt"); err != nil {
+		t.Fatalf("Expected the directory to be kept, got %v", err)
+	}
+
+	// 空目录和文件不需要 recursive
+	for _, path := range []string{"/d/sub", "/d/a.txt"} {
+		if err := env.files.Remove(ctx, "u1", path, false); err != nil {
+			t.Fatalf("Error removing %s: %v", path, err)
+		}
+	}
+	if err := env.files.Remove(ctx, "u1", "/d", true); err != nil {
+		t.Fatalf("Error removing recursively: %v", err)
+	}
+	if _, err := env.files.FileStat(ctx, "u1", "/d"); !isCode(err, code.ErrFileNotFound) {
+		t.Fatalf("Expected the directory to be removed, got %v", err)
+	}
+
+	if err := env.files.Remove(ctx, "u1", "/", true); !isCode(err, code.ErrValidation) {
+		t.Fatalf("Expected ErrValidation for the root, got %v", err)
+	}
+	if err := env.files.Remove(ctx, "u1", "/missing", false); !isCode(err, code.ErrFileNotFound) {
+		t.Fatalf("Expected ErrFileNotFound, got %v", err)
+	}
+}
+
+func TestPathError(t *testing.T) {
+	other := errors.New("disk on fire")
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{name: "not exist", err: &os.PathError{Op: "stat", Path: "/a/b", Err: os.ErrNotExist}, code: code.ErrFileNotFound},
+		{name: "wrapped not exist", err: fmt.Errorf("open: %w", os.ErrNotExist), code: code.ErrFileNotFound},
+		{name: "exist", err: &os.PathError{Op: "mkdir", Path: "/a", Err: os.ErrExist}, code: code.ErrFileExists},
+		{name: "invalid", err: &os.PathError{Op: "open", Path: "/a", Err: os.ErrInvalid}, code: code.ErrValidation},
+		{name: "is directory", err: &os.PathError{Op: "open", Path: "/a", Err: ufs.ErrIsDirectory}, code: code.ErrNotAFile},
+		{name: "not directory", err: &os.PathError{Op: "readdir", Path: "/a", Err: ufs.ErrNotDirectory}, code: code.ErrNotADirectory},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := pathError("/given", tt.err)
+			if !isCode(err, tt.code) {
+				t.Fatalf("Expected code %d, got %v", tt.code, ierrors.ParseCoder(err).Code())
+			}
+		})
+	}
+
+	if err := pathError("/given", other); err != other {
+		t.Fatalf("Expected other errors to pass through, got %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+)
+
+// ValidateDownload 返回 src 的摘要和分片数，分片大小与上传时相同
+func (f *fileService) ValidateDownload(ctx context.Context, userId string, src, dst string) (md5 string, chunkCount int, err error) {
+	// 检查 src 是否存在
+	ref, err := f.resolveBlob(userId, src)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return ref.Digest, int((ref.Size + ChunkSize - 1) / ChunkSize), nil
+}
+
+// Download 返回 filePath 第 chunkIndex 个分片的内容，即合并后对象中的一段
+func (f *fileService) Download(ctx context.Context, userId string, filePath string, chunkIndex int) (content io.ReadCloser, length int64, err error) {
+	ref, err := f.resolveBlob(userId, filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	offset := int64(chunkIndex) * ChunkSize
+	if chunkIndex < 0 || offset >= ref.Size && !(chunkIndex == 0 && ref.Size == 0) {
+		return nil, 0, ierrors.WithCode(code.ErrChunkOutOfRange, "分片序号超出范围: %d", chunkIndex)
+	}
+	length = ref.Size - offset
+	if length > ChunkSize {
+		length = ChunkSize
+	}
+
+	r, err := f.openBlob(ref.Digest)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(r, length), Closer: r}, length, nil
+}
+
+// FileContent 是可以随机读取的文件内容及其元数据
+type FileContent struct {
+	io.ReadSeekCloser
+	Name     string
+	Size     int64
+	MimeType string
+	Digest   string
+	ModTime  time.Time
+}
+
+// Open 打开 filePath 引用的整个 blob，供按 HTTP Range 读取
+func (f *fileService) Open(ctx context.Context, userId string, filePath string) (*FileContent, error) {
+	ref, err := f.resolveBlob(userId, filePath)
+	if err != nil {
+		return nil, err
+	}
+	r, err := f.openBlob(ref.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return &FileContent{
+		ReadSeekCloser: r,
+		Name:           filepath.Base(filePath),
+		Size:           ref.Size,
+		MimeType:       ref.MimeType,
+		Digest:         ref.Digest,
+		ModTime:        ref.ModTime,
+	}, nil
+}
+
+// resolveBlob 通过用户的目录树找到 path 引用的 blob
+func (f *fileService) resolveBlob(userId string, path string) (ufs.BlobRef, error) {
+	ref, err := f.um.User(userId).Blob(path)
+	if err != nil {
+		return ufs.BlobRef{}, pathError(path, err)
+	}
+
+	// 旧的记录没有保存文件大小，从 blob 存储中获取
+	if ref.Size == 0 {
+		info, err := f.blobs.Stat(ref.Digest)
+		if err != nil {
+			return ufs.BlobRef{}, f.blobError(ref.Digest, err)
+		}
+		ref.Size = info.Size
+	}
+	return ref, nil
+}
+
+// openBlob 打开 blob，对象缺失时返回 ErrFileNotFound
+func (f *fileService) openBlob(digest string) (io.ReadSeekCloser, error) {
+	r, err := f.blobs.Get(digest)
+	if err != nil {
+		return nil, f.blobError(digest, err)
+	}
+	return r, nil
+}
+
+func (f *fileService) blobError(digest string, err error) error {
+	if errors.Is(err, blob.ErrNotFound) || errors.Is(err, blob.ErrInvalidDigest) {
+		return ierrors.WrapC(err, code.ErrFileNotFound, "文件内容不存在: %s", digest)
+	}
+	return err
+}
+
+// limitedReadCloser 只读取 blob 中的一段，关闭时关闭整个 blob
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+)
+
+func TestDownloadChunks(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	ctx := context.Background()
+	content := make([]byte, 2*ChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(content)
+	env.put(t, "u1", "/big.bin", string(content))
+	env.put(t, "u1", "/empty.txt", "")
+
+	digest, chunkCount, err := env.files.ValidateDownload(ctx, "u1", "/big.bin", "")
+	if err != nil || digest != md5Hex(string(content)) || chunkCount != 3 {
+		t.Fatalf("Expected 3 chunks of %s, got %d of %s (%v)", md5Hex(string(content)), chunkCount, digest, err)
+	}
+
+	// 每个分片是合并后内容中的一段，最后一个分片不满
+	for i, want := range [][]byte{content[:ChunkSize], content[ChunkSize : 2*ChunkSize], content[2*ChunkSize:]} {
+		r, length, err := env.files.Download(ctx, "u1", "/big.bin", i)
+		if err != nil {
+			t.Fatalf("Error downloading chunk %d: %v", i, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || length != int64(len(want)) || !bytes.Equal(got, want) {
+			t.Fatalf("Chunk %d mismatch: length %d, read %d bytes (%v)", i, length, len(got), err)
+		}
+	}
+
+	for _, index := range []int{-1, 3} {
+		if _, _, err := env.files.Download(ctx, "u1", "/big.bin", index); !isCode(err, code.ErrChunkOutOfRange) {
+			t.Fatalf("Expected ErrChunkOutOfRange for chunk %d, got %v", index, err)
+		}
+	}
+
+	// 空文件只有一个空的分片
+	r, length, err := env.files.Download(ctx, "u1", "/empty.txt", 0)
+	if err != nil || length != 0 {
+		t.Fatalf("Expected an empty chunk, got %d bytes (%v)", length, err)
+	}
+	r.Close()
+	if _, _, err := env.files.Download(ctx, "u1", "/empty.txt", 1); !isCode(err, code.ErrChunkOutOfRange) {
+		t.Fatalf("Expected ErrChunkOutOfRange, got %v", err)
+	}
+}
+
+func TestDownloadOtherUser(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	ctx := context.Background()
+	env.put(t, "u1", "/secret.txt", "secret")
+
+	// 即使知道路径和摘要，别的用户的目录树中也找不到这个文件
+	if _, _, err := env.files.ValidateDownload(ctx, "u2", "/secret.txt", ""); !isCode(err, code.ErrFileNotFound) {
+		t.Fatalf("Expected ErrFileNotFound, got %v", err)
+	}
+	if _, _, err := env.files.Download(ctx, "u2", "/secret.txt", 0); !isCode(err, code.ErrFileNotFound) {
+		t.Fatalf("Expected ErrFileNotFound, got %v", err)
+	}
+	if _, err := env.files.Open(ctx, "u2", "/secret.txt"); !isCode(err, code.ErrFileNotFound) {
+		t.Fatalf("Expected ErrFileNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,512 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+)
+
+// FileSystemService 按路径读写用户的文件，WebDAV 和 SFTP 都通过它访问文件
+type FileSystemService interface {
+	// FileSystem 返回 userId 的文件系统
+	FileSystem(userId string) FileSystem
+}
+
+// FileSystem 是一个用户的目录树。name 都相对于用户的根，返回的错误保持 os 包的
+// 语义，调用方根据 os.IsNotExist 等转换成各自协议的状态码
+type FileSystem interface {
+	Mkdir(ctx context.Context, name string, perm os.FileMode) error
+	// OpenFile 以写方式打开的文件在关闭时存入 blob 存储、检查限额并提交，覆盖的
+	// 旧内容作为历史版本保留。ctx 在关闭之前取消时丢弃写入的内容
+	OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error)
+	// RemoveAll 和网页上删除一样移入回收站
+	RemoveAll(ctx context.Context, name string) error
+	Rename(ctx context.Context, oldName, newName string) error
+	Stat(ctx context.Context, name string) (os.FileInfo, error)
+}
+
+// File 是 FileSystem 打开的文件或目录。写入时不允许在文件中留下空洞
+type File interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Readdir(count int) ([]os.FileInfo, error)
+	Stat() (os.FileInfo, error)
+}
+
+type fileSystemService struct {
+	um     ufs.UserManager
+	blobs  blob.BlobStore
+	quotas QuotaService
+}
+
+// NewFileSystemService 写入的内容存入 blobs 后再提交到用户的文件系统
+func NewFileSystemService(um ufs.UserManager, blobs blob.BlobStore, quotas QuotaService) FileSystemService {
+	return &fileSystemService{
+		um:     um,
+		blobs:  blobs,
+		quotas: quotas,
+	}
+}
+
+func (s *fileSystemService) FileSystem(userId string) FileSystem {
+	return &userFS{s: s, userId: userId, fs: s.um.User(userId)}
+}
+
+// userFS 实现 FileSystem
+type userFS struct {
+	s      *fileSystemService
+	userId string
+	fs     *ufs.UserFileSystem
+}
+
+func (u *userFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	absPath := filepath.Join("/", name)
+	if _, err := u.fs.Stat(absPath); err == nil {
+		return &os.PathError{Op: "mkdir", Path: absPath, Err: os.ErrExist}
+	}
+	// MKCOL 不创建缺少的父目录
+	if err := u.requireDir(filepath.Dir(absPath)); err != nil {
+		return err
+	}
+	return u.fs.Mkdir(absPath, 0755)
+}
+
+func (u *userFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (File, error) {
+	absPath := filepath.Join("/", name)
+	info, err := u.stat(absPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	exists := err == nil
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		if !exists {
+			return nil, err
+		}
+		return &fsFile{u: u, info: info}, nil
+	}
+
+	switch {
+	case exists && info.IsDir:
+		return nil, &os.PathError{Op: "open", Path: absPath, Err: ufs.ErrIsDirectory}
+	case exists && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: absPath, Err: os.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, err
+	case !exists:
+		if err := u.requireDir(filepath.Dir(absPath)); err != nil {
+			return nil, err
+		}
+	}
+
+	spool, err := os.CreateTemp("", "udisk-dav-*")
+	if err != nil {
+		return nil, err
+	}
+	offset, partial := writeOffset(ctx)
+	// 新建和截断的文件即使没有写入也要提交
+	w := &fsWriter{u: u, ctx: ctx, path: absPath, spool: spool, dirty: !exists || flag&os.O_TRUNC != 0 && !partial}
+	if exists && info.Digest != "" && (flag&os.O_TRUNC == 0 || partial) {
+		// 在已有内容的基础上修改
+		w.ref = &ufs.BlobRef{Digest: info.Digest, Size: info.Size, MimeType: info.MimeType}
+	}
+	if partial {
+		if _, err := w.Seek(offset, io.SeekStart); err != nil {
+			w.discard()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (u *userFS) RemoveAll(ctx context.Context, name string) error {
+	absPath := filepath.Join("/", name)
+	if absPath == "/" {
+		return &os.PathError{Op: "remove", Path: absPath, Err: os.ErrInvalid}
+	}
+	// 和网页上删除一样移入回收站
+	_, err := u.fs.Trash(absPath)
+	return err
+}
+
+func (u *userFS) Rename(ctx context.Context, oldName, newName string) error {
+	srcPath := filepath.Join("/", oldName)
+	dstPath := filepath.Join("/", newName)
+	if srcPath == "/" || dstPath == srcPath || isBelow(srcPath, dstPath) {
+		return &os.PathError{Op: "rename", Path: dstPath, Err: os.ErrInvalid}
+	}
+	if _, err := u.fs.Stat(srcPath); err != nil {
+		return err
+	}
+	if _, err := u.fs.Stat(dstPath); err == nil {
+		return &os.PathError{Op: "rename", Path: dstPath, Err: os.ErrExist}
+	}
+	if err := u.requireDir(filepath.Dir(dstPath)); err != nil {
+		return err
+	}
+	return u.fs.Mv(srcPath, dstPath)
+}
+
+func (u *userFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := u.stat(filepath.Join("/", name))
+	if err != nil {
+		return nil, err
+	}
+	return fsInfo{info: info}, nil
+}
+
+// stat 返回 absPath 的信息，旧的记录没有保存文件大小，从 blob 存储中获取
+func (u *userFS) stat(absPath string) (ufs.FileInfo, error) {
+	info, err := u.fs.Stat(absPath)
+	if err != nil {
+		return info, err
+	}
+	return u.fillSize(info)
+}
+
+func (u *userFS) fillSize(info ufs.FileInfo) (ufs.FileInfo, error) {
+	if !info.IsDir && info.Size == 0 && info.Digest != "" {
+		blobInfo, err := u.s.blobs.Stat(info.Digest)
+		if err != nil {
+			return info, err
+		}
+		info.Size = blobInfo.Size
+	}
+	return info, nil
+}
+
+// requireDir 检查 dir 存在并且是目录，否则返回 os.ErrNotExist，
+// WebDAV 据此返回 409 Conflict
+func (u *userFS) requireDir(dir string) error {
+	info, err := u.fs.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return &os.PathError{Op: "stat", Path: dir, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+// isBelow 判断 path 是否在目录 root 之下
+func isBelow(root, path string) bool {
+	return root == "/" || len(path) > len(root) && path[:len(root)] == root && path[len(root)] == '/'
+}
+
+// fsInfo 实现 os.FileInfo，WebDAV 用其中 blob 的摘要作为 ETag
+type fsInfo struct {
+	info ufs.FileInfo
+}
+
+func (i fsInfo) Name() string {
+	return filepath.Base(i.info.Path)
+}
+
+func (i fsInfo) Size() int64 {
+	return i.info.Size
+}
+
+func (i fsInfo) Mode() os.FileMode {
+	if i.info.IsDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i fsInfo) ModTime() time.Time {
+	return i.info.ModTime
+}
+
+func (i fsInfo) IsDir() bool {
+	return i.info.IsDir
+}
+
+func (i fsInfo) Sys() interface{} {
+	return nil
+}
+
+// fsFile 是以只读方式打开的文件或目录，文件内容在第一次读取时才打开
+type fsFile struct {
+	u    *userFS
+	info ufs.FileInfo
+	r    io.ReadSeekCloser
+
+	// children 目录中还没有被 Readdir 返回的条目，nil 表示还没有读取
+	children []os.FileInfo
+}
+
+func (f *fsFile) open() error {
+	if f.r != nil {
+		return nil
+	}
+	if f.info.IsDir {
+		return &os.PathError{Op: "read", Path: f.info.Path, Err: ufs.ErrIsDirectory}
+	}
+	r, err := f.u.s.blobs.Get(f.info.Digest)
+	if err != nil {
+		return err
+	}
+	f.r = r
+	return nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.r.Read(p)
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.r.Seek(offset, whence)
+}
+
+func (f *fsFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.info.Path, Err: os.ErrPermission}
+}
+
+// WriteTo 在 COPY 时由 io.Copy 调用。目标是新打开的 fsWriter 时直接引用
+// 同一个 blob，不复制任何内容
+func (f *fsFile) WriteTo(w io.Writer) (int64, error) {
+	if dw, ok := w.(*fsWriter); ok && f.r == nil && !f.info.IsDir && dw.link(f.info) {
+		return f.info.Size, nil
+	}
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, f.r)
+}
+
+func (f *fsFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.IsDir {
+		return nil, &os.PathError{Op: "readdir", Path: f.info.Path, Err: ufs.ErrNotDirectory}
+	}
+	if f.children == nil {
+		infos, err := f.u.fs.ListDetailed(f.info.Path)
+		if err != nil {
+			return nil, err
+		}
+		f.children = make([]os.FileInfo, 0, len(infos))
+		for _, info := range infos {
+			if info, err = f.u.fillSize(info); err != nil {
+				return nil, err
+			}
+			f.children = append(f.children, fsInfo{info: info})
+		}
+	}
+
+	if count <= 0 {
+		res := f.children
+		f.children = f.children[len(f.children):]
+		return res, nil
+	}
+	if len(f.children) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.children))
+	res := f.children[:n]
+	f.children = f.children[n:]
+	return res, nil
+}
+
+func (f *fsFile) Stat() (os.FileInfo, error) {
+	return fsInfo{info: f.info}, nil
+}
+
+func (f *fsFile) Close() error {
+	if f.r == nil {
+		return nil
+	}
+	return f.r.Close()
+}
+
+// fsWriter 是以写方式打开的文件。内容先写入临时文件，关闭时存入 blob
+// 存储并提交到文件系统，覆盖的旧内容作为历史版本保留
+type fsWriter struct {
+	u     *userFS
+	ctx   context.Context
+	path  string
+	spool *os.File
+
+	// ref 还没有读入 spool 的内容，打开已有的文件或者 COPY 时引用原来的
+	// blob，直到第一次读写才复制到 spool，没有读写时直接提交这个引用
+	ref *ufs.BlobRef
+	// dirty 有需要提交的改动，以读写方式打开但没有写入的文件关闭时不提交
+	dirty bool
+}
+
+// link 让还没有写入任何内容的文件直接引用 info 的 blob
+func (w *fsWriter) link(info ufs.FileInfo) bool {
+	if w.ref != nil || info.Digest == "" {
+		return false
+	}
+	if size, err := w.spool.Seek(0, io.SeekEnd); err != nil || size != 0 {
+		return false
+	}
+	w.ref = &ufs.BlobRef{Digest: info.Digest, Size: info.Size, MimeType: info.MimeType}
+	w.dirty = true
+	return true
+}
+
+// materialize 把 ref 引用的内容读入 spool，读写位置在内容的开头
+func (w *fsWriter) materialize() error {
+	if w.ref == nil {
+		return nil
+	}
+	r, err := w.u.s.blobs.Get(w.ref.Digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(w.spool, r); err != nil {
+		return err
+	}
+	w.ref = nil
+	_, err = w.spool.Seek(0, io.SeekStart)
+	return err
+}
+
+func (w *fsWriter) Read(p []byte) (int, error) {
+	if err := w.materialize(); err != nil {
+		return 0, err
+	}
+	return w.spool.Read(p)
+}
+
+func (w *fsWriter) Write(p []byte) (int, error) {
+	if err := w.materialize(); err != nil {
+		return 0, err
+	}
+	w.dirty = true
+	return w.spool.Write(p)
+}
+
+func (w *fsWriter) Seek(offset int64, whence int) (int64, error) {
+	if err := w.materialize(); err != nil {
+		return 0, err
+	}
+	cur, err := w.spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size, err := w.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	// 不允许在文件中留下空洞
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos = cur + offset
+	case io.SeekEnd:
+		pos = size + offset
+	}
+	if pos < 0 || pos > size {
+		return 0, &os.PathError{Op: "seek", Path: w.path, Err: os.ErrInvalid}
+	}
+	return w.spool.Seek(pos, io.SeekStart)
+}
+
+func (w *fsWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: w.path, Err: ufs.ErrNotDirectory}
+}
+
+func (w *fsWriter) Stat() (os.FileInfo, error) {
+	info := ufs.FileInfo{Name: filepath.Base(w.path), Path: w.path, ModTime: time.Now()}
+	if w.ref != nil {
+		info.Size, info.Digest, info.MimeType = w.ref.Size, w.ref.Digest, w.ref.MimeType
+		return fsInfo{info: info}, nil
+	}
+	stat, err := w.spool.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info.Size = stat.Size()
+	return fsInfo{info: info}, nil
+}
+
+// Close 提交写入的内容，并把结果告诉 WithCloseError 登记的调用方
+func (w *fsWriter) Close() error {
+	err := w.commit()
+	if p, ok := w.ctx.Value(davCloseErrKey{}).(*error); ok {
+		*p = err
+	}
+	return err
+}
+
+// commit 提交写入的内容。ctx 已经取消时说明客户端中途断开，内容不完整，
+// 只删除临时文件。配额按 spool 的大小在存入 blob 之前检查
+func (w *fsWriter) commit() error {
+	defer w.discard()
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if !w.dirty {
+		return nil
+	}
+	ref := w.ref
+	size := int64(0)
+	if ref != nil {
+		size = ref.Size
+	} else {
+		stat, err := w.spool.Stat()
+		if err != nil {
+			return err
+		}
+		size = stat.Size()
+	}
+
+	var files int64 = 1
+	if _, err := w.u.fs.Stat(w.path); err == nil {
+		files = 0
+	}
+	if err := w.u.s.quotas.Check(w.ctx, w.u.userId, size, files); err != nil {
+		return err
+	}
+
+	if ref == nil {
+		info, err := w.store()
+		if err != nil {
+			return err
+		}
+		mimeType, err := detectMimeType(w.u.s.blobs, w.path, info.Digest)
+		if err != nil {
+			return err
+		}
+		ref = &ufs.BlobRef{Digest: info.Digest, Size: info.Size, MimeType: mimeType}
+	}
+	ref.ModTime = time.Now()
+	_, err := w.u.fs.Commit(w.path, *ref, ufs.ConflictOverwrite)
+	return err
+}
+
+// store 计算 spool 的摘要并存入 blob 存储
+func (w *fsWriter) store() (blob.Info, error) {
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return blob.Info{}, err
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, w.spool); err != nil {
+		return blob.Info{}, err
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return blob.Info{}, err
+	}
+	return w.u.s.blobs.Put(hex.EncodeToString(h.Sum(nil)), w.spool)
+}
+
+// discard 删除临时文件
+func (w *fsWriter) discard() {
+	_ = w.spool.Close()
+	_ = os.Remove(w.spool.Name())
+}
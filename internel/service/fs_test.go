@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+)
+
+func TestFileSystemUnwritten(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	ctx := context.Background()
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	info := env.put(t, "u1", "/a.txt", "hello")
+	if _, err := env.um.User("u1").Commit("/a.txt", ufs.BlobRef{Digest: info.Digest, Size: info.Size, ModTime: mtime},
+		ufs.ConflictOverwrite); err != nil {
+		t.Fatalf("Error committing: %v", err)
+	}
+	fs := NewFileSystemService(env.um, env.blobs, env.quotas).FileSystem("u1")
+
+	// 以读写方式打开，只读取和移动位置，关闭时不提交
+	f, err := fs.OpenFile(ctx, "/a.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "hello" {
+		t.Fatalf("Expected hello, got %q (%v)", b, err)
+	}
+	if _, err := f.Seek(1, io.SeekStart); err != nil {
+		t.Fatalf("Error seeking: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	stat, err := env.um.User("u1").Stat("/a.txt")
+	if err != nil || !stat.ModTime.Equal(mtime) || stat.Digest != info.Digest {
+		t.Fatalf("Expected /a.txt to be unchanged, got %+v (%v)", stat, err)
+	}
+	if versions, err := env.um.User("u1").Versions("/a.txt"); err != nil || len(versions) != 0 {
+		t.Fatalf("Expected no versions, got %d (%v)", len(versions), err)
+	}
+
+	// 新建和截断的文件即使没有写入也提交
+	for _, name := range []string{"/a.txt", "/new.txt"} {
+		f, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatalf("Error opening %s: %v", name, err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Error closing %s: %v", name, err)
+		}
+		if stat, err := env.um.User("u1").Stat(name); err != nil || stat.Size != 0 {
+			t.Fatalf("Expected %s to be empty, got %+v (%v)", name, stat, err)
+		}
+	}
+}
+
+func TestFileSystemQuota(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 10, MaxFiles: 1000})
+	ctx := context.Background()
+	fs := NewFileSystemService(env.um, env.blobs, env.quotas).FileSystem("u1")
+
+	content := "more than ten bytes"
+	f, err := fs.OpenFile(ctx, "/big.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	if _, err := io.WriteString(f, content); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := f.Close(); !isCode(err, code.ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+	}
+
+	// 超出配额的内容不进入 blob 存储
+	if exists, err := env.blobs.Exists(md5Hex(content)); err != nil || exists {
+		t.Fatalf("Expected the rejected content not to be stored, got %v (%v)", exists, err)
+	}
+	if _, err := env.um.User("u1").Stat("/big.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Expected /big.txt not to exist, got %v", err)
+	}
+}
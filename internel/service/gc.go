@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/pkg/log"
+)
+
+// GCReport 描述一次垃圾回收的结果，DryRun 时只列出将被删除的对象
+type GCReport struct {
+	DryRun     bool          `json:"dry_run"`
+	Blobs      []blob.Info   `json:"blobs"`
+	ChunkDirs  []string      `json:"chunk_dirs"`
+	FreedBytes int64         `json:"freed_bytes"`
+	Errors     []string      `json:"errors,omitempty"`
+	StartedAt  time.Time     `json:"started_at"`
+	Duration   time.Duration `json:"duration"`
+}
+
+type GCService interface {
+	// Collect 删除引用计数为 0 且超过宽限期的 blob，以及被放弃的分片目录
+	Collect(ctx context.Context, dryRun bool) (GCReport, error)
+	// Start 在后台周期性执行 Collect，直到 ctx 结束
+	Start(ctx context.Context, interval time.Duration)
+}
+
+type gcService struct {
+	blobs    blob.BlobStore
+	refs     ufs.RefCounter
+	chunkDir string
+	grace    time.Duration
+}
+
+// NewGCService 创建垃圾回收服务，grace 内写入或失去引用的对象不会被回收，
+// 以免删除正在上传或正在被链接的数据
+func NewGCService(blobs blob.BlobStore, refs ufs.RefCounter, chunkDir string, grace time.Duration) GCService {
+	return &gcService{
+		blobs:    blobs,
+		refs:     refs,
+		chunkDir: chunkDir,
+		grace:    grace,
+	}
+}
+
+func (g *gcService) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := g.Collect(ctx, false)
+			if err != nil {
+				log.Errorf("gc failed: %v", err)
+				continue
+			}
+			log.Infof("gc removed %d blobs and %d chunk directories, freed %d bytes",
+				len(report.Blobs), len(report.ChunkDirs), report.FreedBytes)
+		}
+	}
+}
+
+func (g *gcService) Collect(ctx context.Context, dryRun bool) (GCReport, error) {
+	report := GCReport{DryRun: dryRun, StartedAt: time.Now()}
+	deadline := report.StartedAt.Add(-g.grace)
+
+	// 找出没有引用的 blob
+	var candidates []blob.Info
+	err := g.blobs.Walk(func(info blob.Info) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.ModTime.After(deadline) {
+			return nil
+		}
+		count, found, err := g.refs.Refs(info.Digest)
+		if err != nil {
+			return err
+		}
+		if found && (count.Refs > 0 || count.UpdatedAt.After(deadline)) {
+			return nil
+		}
+		candidates = append(candidates, info)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, info := range candidates {
+		if !dryRun {
+			if err := g.removeBlob(info.Digest); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+		}
+		report.Blobs = append(report.Blobs, info)
+		report.FreedBytes += info.Size
+	}
+
+	// 找出被放弃的分片目录
+	dirs, err := g.abandonedChunkDirs(deadline)
+	if err != nil {
+		return report, err
+	}
+	for _, dir := range dirs {
+		size := dirSize(dir)
+		if !dryRun {
+			if err := os.RemoveAll(dir); err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+		}
+		report.ChunkDirs = append(report.ChunkDirs, dir)
+		report.FreedBytes += size
+	}
+
+	report.Duration = time.Since(report.StartedAt)
+	return report, nil
+}
+
+// removeBlob 再次确认 blob 没有被引用后将其删除
+func (g *gcService) removeBlob(digest string) error {
+	count, found, err := g.refs.Refs(digest)
+	if err != nil {
+		return err
+	}
+	if found {
+		if count.Refs > 0 {
+			return nil
+		}
+		if forgotten, err := g.refs.Forget(digest); err != nil || !forgotten {
+			return err
+		}
+	}
+	return g.blobs.Delete(digest)
+}
+
+// abandonedChunkDirs 返回宽限期内没有新分片写入的分片目录
+func (g *gcService) abandonedChunkDirs(deadline time.Time) ([]string, error) {
+	entries, err := os.ReadDir(g.chunkDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(g.chunkDir, entry.Name())
+		if latestModTime(dir).Before(deadline) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+func latestModTime(dir string) time.Time {
+	var latest time.Time
+	_ = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
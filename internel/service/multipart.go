@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+)
+
+const (
+	// MaxParts 分段上传最多的分段数，与 S3 相同
+	MaxParts = 10000
+	// MinPartSize 除最后一个分段外每个分段的最小长度，与 S3 相同
+	MinPartSize = 5 * 1024 * 1024
+	// MaxPartSize 单个分段的最大长度
+	MaxPartSize = 5 * 1024 * 1024 * 1024
+)
+
+// CreateMultipart 为 S3 的分段上传创建上传会话。分段就是会话的分片，但长度
+// 不固定，整个文件的摘要在完成时才计算，完成时覆盖 path 上已有的文件
+func (f *fileService) CreateMultipart(ctx context.Context, userId string, path string) (domain.UploadSession, error) {
+	fs := f.um.User(userId)
+	absPath := filepath.Join("/", path)
+	if absPath == "/" {
+		return domain.UploadSession{}, ierrors.WithCode(code.ErrValidation, "路径不合法: %s", path)
+	}
+	if err := requireAncestor(fs, absPath); err != nil {
+		return domain.UploadSession{}, err
+	}
+	if isDir, err := fs.IsDir(absPath); err == nil && isDir {
+		return domain.UploadSession{}, ierrors.WithCode(code.ErrNotAFile, "不是文件: %s", absPath)
+	}
+
+	session := domain.UploadSession{
+		Id:          uuid.New().String(),
+		UserId:      userId,
+		Path:        absPath,
+		TotalChunks: MaxParts,
+		Conflict:    string(ufs.ConflictOverwrite),
+		Expire:      time.Now().Add(uploadSessionTTL),
+	}
+	if err := f.sessions.Create(ctx, session); err != nil {
+		return domain.UploadSession{}, err
+	}
+	return session, nil
+}
+
+// UploadPart 接收分段上传的第 index 个分段，size 为 -1 表示长度未知，返回分段的 md5。
+// 重复上传同一个分段时覆盖之前的内容
+func (f *fileService) UploadPart(ctx context.Context, userId string, sessionId string, index int, r io.Reader,
+	size int64) (string, error) {
+	session, err := f.findMultipart(ctx, userId, sessionId)
+	if err != nil {
+		return "", err
+	}
+	if index < 0 || index >= MaxParts {
+		return "", ierrors.WithCode(code.ErrChunkOutOfRange, "分段序号超出范围: %d", index+1)
+	}
+	if size > MaxPartSize {
+		return "", ierrors.WithCode(code.ErrValidation, "分段太大: %d 字节", size)
+	}
+	// 只是粗略检查，完成时再按整个文件检查
+	if err := f.quotas.Check(ctx, userId, max(size, 0), 0); err != nil {
+		return "", err
+	}
+
+	partMd5, err := f.saveChunk(session.Id, index, r, MaxPartSize+1, func(n int64, md5 string) error {
+		if n > MaxPartSize {
+			return ierrors.WithCode(code.ErrValidation, "分段太大: 超过 %d 字节", int64(MaxPartSize))
+		}
+		if size >= 0 && n != size {
+			return ierrors.WithCode(code.ErrValidation, "分段长度不对: 收到 %d 字节，应为 %d 字节", n, size)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return partMd5, f.sessions.MarkChunkReceived(ctx, session.Id, index, partMd5)
+}
+
+// CompleteMultipart 按 parts 的顺序合并分段，分段序号必须递增，md5 必须与收到的
+// 分段一致。没有列出的分段被丢弃
+func (f *fileService) CompleteMultipart(ctx context.Context, userId string, sessionId string,
+	parts []domain.UploadPart) (domain.FileMetadata, error) {
+	session, err := f.findMultipart(ctx, userId, sessionId)
+	if err != nil {
+		return domain.FileMetadata{}, err
+	}
+	if len(parts) == 0 {
+		return domain.FileMetadata{}, ierrors.WithCode(code.ErrValidation, "至少需要一个分段")
+	}
+
+	indices := make([]int, 0, len(parts))
+	var size int64
+	for i, part := range parts {
+		if i > 0 && part.Index <= parts[i-1].Index {
+			return domain.FileMetadata{}, ierrors.WithCode(code.ErrValidation, "分段序号必须递增: %d", part.Index+1)
+		}
+		if part.Index < 0 || part.Index >= session.TotalChunks || !session.Received[part.Index] ||
+			session.ChunkMd5s[part.Index] != part.Md5 {
+			return domain.FileMetadata{}, ierrors.WithCode(code.ErrChunkOutOfRange, "分段不存在或者 md5 不一致: %d", part.Index+1)
+		}
+		stat, err := os.Stat(chunkPath(sessionId, part.Index))
+		if err != nil {
+			return domain.FileMetadata{}, err
+		}
+		if i < len(parts)-1 && stat.Size() < MinPartSize {
+			return domain.FileMetadata{}, ierrors.WithCode(code.ErrValidation, "分段 %d 太小: %d 字节", part.Index+1, stat.Size())
+		}
+		indices = append(indices, part.Index)
+		size += stat.Size()
+	}
+
+	fs := f.um.User(userId)
+	files := int64(1)
+	if _, err := fs.Stat(session.Path); err == nil {
+		files = 0
+	}
+	if err := f.quotas.Check(ctx, userId, size, files); err != nil {
+		return domain.FileMetadata{}, err
+	}
+
+	// 先计算整个文件的 md5，再合并写入 blob 存储并校验
+	digest, err := f.digestChunks(sessionId, indices)
+	if err != nil {
+		return domain.FileMetadata{}, err
+	}
+	chunks := &chunkReader{directory: chunkDir(sessionId), indices: indices}
+	defer chunks.Close()
+	info, err := f.blobs.Put(digest, chunks)
+	if err != nil {
+		return domain.FileMetadata{}, err
+	}
+	meta, err := f.commitObject(fs, userId, session.Path, info)
+	if err != nil {
+		return domain.FileMetadata{}, err
+	}
+
+	// 文件已经提交，会话和分段都不再需要
+	return meta, f.discardSession(ctx, sessionId)
+}
+
+// AbortMultipart 放弃分段上传，删除已经收到的分段
+func (f *fileService) AbortMultipart(ctx context.Context, userId string, sessionId string) error {
+	if _, err := f.findMultipart(ctx, userId, sessionId); err != nil {
+		return err
+	}
+	return f.discardSession(ctx, sessionId)
+}
+
+// findMultipart 查找属于 userId 的分段上传会话
+func (f *fileService) findMultipart(ctx context.Context, userId string, sessionId string) (domain.UploadSession, error) {
+	session, err := f.findSession(ctx, userId, sessionId)
+	if err != nil {
+		return domain.UploadSession{}, ierrors.WrapC(err, code.ErrFileNotFound, "分段上传不存在: %s", sessionId)
+	}
+	if !session.Multipart() {
+		return domain.UploadSession{}, ierrors.WithCode(code.ErrFileNotFound, "分段上传不存在: %s", sessionId)
+	}
+	return session, nil
+}
+
+func (f *fileService) digestChunks(sessionId string, indices []int) (string, error) {
+	chunks := &chunkReader{directory: chunkDir(sessionId), indices: indices}
+	defer chunks.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, chunks); err != nil {
+		return "", fmt.Errorf("failed to read parts: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// discardSession 删除会话及其分片
+func (f *fileService) discardSession(ctx context.Context, sessionId string) error {
+	if err := f.sessions.Delete(ctx, sessionId); err != nil {
+		return err
+	}
+	return os.RemoveAll(chunkDir(sessionId))
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+)
+
+// MaxObjectKeys ListObjects 每页最多返回的 key 数，与 S3 相同
+const MaxObjectKeys = 1000
+
+// ObjectListOptions 对应 ListObjectsV2 的参数
+type ObjectListOptions struct {
+	Prefix string
+	// Delimiter 为空时列出 Prefix 下的所有文件，为 / 时把子目录折叠成公共前缀
+	Delimiter string
+	// StartAfter 只返回排在它之后的 key
+	StartAfter string
+	MaxKeys    int
+}
+
+// ListObjects 把用户的目录树当作一个 S3 bucket 列出，key 按字节序排列
+func (f *fileService) ListObjects(ctx context.Context, userId string, opts ObjectListOptions) (domain.ObjectList, error) {
+	if opts.Delimiter != "" && opts.Delimiter != "/" {
+		return domain.ObjectList{}, ierrors.WithCode(code.ErrValidation, "只支持以 / 作为分隔符: %s", opts.Delimiter)
+	}
+	if opts.MaxKeys <= 0 || opts.MaxKeys > MaxObjectKeys {
+		opts.MaxKeys = MaxObjectKeys
+	}
+
+	// 只需要看 prefix 中最后一个 / 之前的目录
+	fs := f.um.User(userId)
+	dirPath := filepath.Join("/", opts.Prefix[:strings.LastIndex(opts.Prefix, "/")+1])
+	if isDir, err := fs.IsDir(dirPath); err != nil || !isDir {
+		return domain.ObjectList{}, nil
+	}
+
+	type entry struct {
+		key    string
+		prefix bool
+		info   ufs.FileInfo
+	}
+	var entries []entry
+	add := func(info ufs.FileInfo) {
+		key := objectKey(info)
+		if strings.HasPrefix(key, opts.Prefix) && key > opts.StartAfter {
+			entries = append(entries, entry{key: key, info: info})
+		}
+	}
+	if opts.Delimiter == "" {
+		err := fs.Walk(dirPath, func(info ufs.FileInfo) error {
+			// 目录只有为空时才作为对象出现，否则由其中的文件隐含
+			if !info.IsDir || info.Children == 0 {
+				add(info)
+			}
+			return nil
+		})
+		if err != nil {
+			return domain.ObjectList{}, pathError(dirPath, err)
+		}
+	} else {
+		infos, err := fs.ListDetailed(dirPath)
+		if err != nil {
+			return domain.ObjectList{}, pathError(dirPath, err)
+		}
+		for _, info := range infos {
+			add(info)
+		}
+		for i := range entries {
+			entries[i].prefix = entries[i].info.IsDir
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	var list domain.ObjectList
+	if len(entries) > opts.MaxKeys {
+		entries = entries[:opts.MaxKeys]
+		list.Truncated = true
+		list.Next = entries[len(entries)-1].key
+	}
+	for _, e := range entries {
+		if e.prefix {
+			list.Prefixes = append(list.Prefixes, e.key)
+			continue
+		}
+		// 旧的记录没有保存文件大小，从 blob 存储中获取
+		if !e.info.IsDir && e.info.Size == 0 && e.info.Digest != "" {
+			blobInfo, err := f.blobs.Stat(e.info.Digest)
+			if err != nil {
+				return domain.ObjectList{}, f.blobError(e.info.Digest, err)
+			}
+			e.info.Size = blobInfo.Size
+		}
+		list.Objects = append(list.Objects, toMetadata(userId, e.info))
+	}
+	return list, nil
+}
+
+// objectKey 返回文件或目录作为 S3 对象的 key
+func objectKey(info ufs.FileInfo) string {
+	key := strings.TrimPrefix(info.Path, "/")
+	if info.IsDir {
+		key += "/"
+	}
+	return key
+}
+
+// PutObject 把 r 的全部内容写入 path，已存在的文件被覆盖，旧的内容成为历史版本，
+// 缺少的上级目录自动创建。digest 是内容的 md5 或 sha256，这时直接写入 blob 存储
+// 并由 blob 存储校验；为空时先写入临时文件计算 md5。size 为 -1 表示大小未知
+func (f *fileService) PutObject(ctx context.Context, userId string, path string, r io.Reader, size int64,
+	digest string) (domain.FileMetadata, error) {
+	fs := f.um.User(userId)
+	absPath := filepath.Join("/", path)
+	if absPath == "/" {
+		return domain.FileMetadata{}, ierrors.WithCode(code.ErrValidation, "路径不合法: %s", path)
+	}
+	if err := requireAncestor(fs, absPath); err != nil {
+		return domain.FileMetadata{}, err
+	}
+	files := int64(1)
+	if isDir, err := fs.IsDir(absPath); err == nil {
+		if isDir {
+			return domain.FileMetadata{}, ierrors.WithCode(code.ErrNotAFile, "不是文件: %s", absPath)
+		}
+		files = 0
+	}
+	if err := f.quotas.Check(ctx, userId, max(size, 0), files); err != nil {
+		return domain.FileMetadata{}, err
+	}
+
+	if digest == "" {
+		spool, err := os.CreateTemp("", "udisk-put-*")
+		if err != nil {
+			return domain.FileMetadata{}, err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		hash := md5.New()
+		if _, err := io.Copy(io.MultiWriter(spool, hash), r); err != nil {
+			return domain.FileMetadata{}, err
+		}
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return domain.FileMetadata{}, err
+		}
+		digest, r = hex.EncodeToString(hash.Sum(nil)), spool
+	}
+	info, err := f.blobs.Put(digest, r)
+	if err != nil {
+		return domain.FileMetadata{}, err
+	}
+	if size < 0 {
+		if err := f.quotas.Check(ctx, userId, info.Size, files); err != nil {
+			return domain.FileMetadata{}, err
+		}
+	}
+	return f.commitObject(fs, userId, absPath, info)
+}
+
+// CopyObject 把文件 src 复制到 dst，与 PutObject 一样覆盖已有的文件并自动创建
+// 缺少的上级目录。新的文件引用相同的 blob，src 与 dst 相同时什么也不做
+func (f *fileService) CopyObject(ctx context.Context, userId string, src, dst string) (domain.FileMetadata, error) {
+	fs := f.um.User(userId)
+	srcPath, dstPath := filepath.Join("/", src), filepath.Join("/", dst)
+	info, err := fs.Stat(srcPath)
+	if err != nil {
+		return domain.FileMetadata{}, pathError(srcPath, err)
+	}
+	if info.IsDir {
+		return domain.FileMetadata{}, ierrors.WithCode(code.ErrNotAFile, "不是文件: %s", srcPath)
+	}
+	if srcPath == dstPath {
+		return toMetadata(userId, info), nil
+	}
+	if dstPath == "/" {
+		return domain.FileMetadata{}, ierrors.WithCode(code.ErrValidation, "路径不合法: %s", dst)
+	}
+	if err := requireAncestor(fs, dstPath); err != nil {
+		return domain.FileMetadata{}, err
+	}
+	files := int64(1)
+	if isDir, err := fs.IsDir(dstPath); err == nil {
+		if isDir {
+			return domain.FileMetadata{}, ierrors.WithCode(code.ErrNotAFile, "不是文件: %s", dstPath)
+		}
+		files = 0
+	}
+
+	blobInfo, err := f.blobs.Stat(info.Digest)
+	if err != nil {
+		return domain.FileMetadata{}, f.blobError(info.Digest, err)
+	}
+	if err := f.quotas.Check(ctx, userId, blobInfo.Size, files); err != nil {
+		return domain.FileMetadata{}, err
+	}
+	return f.commitObject(fs, userId, dstPath, blobInfo)
+}
+
+// commitObject 把 blob 链接到 absPath，覆盖已有的文件
+func (f *fileService) commitObject(fs *ufs.UserFileSystem, userId string, absPath string, info blob.Info) (domain.FileMetadata, error) {
+	mimeType, err := detectMimeType(f.blobs, absPath, info.Digest)
+	if err != nil {
+		return domain.FileMetadata{}, err
+	}
+	ref := ufs.BlobRef{
+		Digest:   info.Digest,
+		Size:     info.Size,
+		MimeType: mimeType,
+		ModTime:  time.Now(),
+	}
+	if _, err := fs.Commit(absPath, ref, ufs.ConflictOverwrite); err != nil {
+		return domain.FileMetadata{}, pathError(absPath, err)
+	}
+	return f.metadata(fs, userId, absPath)
+}
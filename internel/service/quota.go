@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+)
+
+type QuotaService interface {
+	// Quota 返回用户的限额及用量
+	Quota(ctx context.Context, userId string) (domain.Quota, error)
+	// Check 检查用户再存入 files 个共 bytes 字节的文件后是否超出限额
+	Check(ctx context.Context, userId string, bytes, files int64) error
+}
+
+type quotaService struct {
+	um       ufs.UserManager
+	defaults domain.Quota
+}
+
+// NewQuotaService 创建限额服务，没有单独设置限额的用户使用 defaults 中的限额
+func NewQuotaService(um ufs.UserManager, defaults domain.Quota) QuotaService {
+	return &quotaService{
+		um:       um,
+		defaults: defaults,
+	}
+}
+
+func (q *quotaService) Quota(ctx context.Context, userId string) (domain.Quota, error) {
+	quota, err := q.um.User(userId).Quota()
+	if err != nil {
+		return domain.Quota{}, err
+	}
+	res := domain.Quota{
+		MaxBytes:  quota.MaxBytes,
+		MaxFiles:  quota.MaxFiles,
+		UsedBytes: quota.UsedBytes,
+		UsedFiles: quota.UsedFiles,
+	}
+	if res.MaxBytes == 0 {
+		res.MaxBytes = q.defaults.MaxBytes
+	}
+	if res.MaxFiles == 0 {
+		res.MaxFiles = q.defaults.MaxFiles
+	}
+	return res, nil
+}
+
+func (q *quotaService) Check(ctx context.Context, userId string, bytes, files int64) error {
+	quota, err := q.Quota(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if quota.UsedBytes+bytes > quota.MaxBytes {
+		return ierrors.WithCode(code.ErrQuotaExceeded, "存储空间不足: 已用 %d 字节，限额 %d 字节", quota.UsedBytes, quota.MaxBytes)
+	}
+	if quota.UsedFiles+files > quota.MaxFiles {
+		return ierrors.WithCode(code.ErrQuotaExceeded, "文件数超出限额: 已有 %d 个，限额 %d 个", quota.UsedFiles, quota.MaxFiles)
+	}
+	return nil
+}
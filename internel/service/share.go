@@ -0,0 +1,434 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/internel/repository"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+	"github.com/lvow2022/udisk/pkg/log"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ShareService 管理分享链接，并以分享者的身份代访客访问分享的目录树。
+// 访客看到的路径都相对于分享的根，无法访问分享之外的任何文件
+type ShareService interface {
+	Create(ctx context.Context, userId string, opts ShareOptions) (domain.Share, error)
+	List(ctx context.Context, userId string) ([]domain.Share, error)
+	Revoke(ctx context.Context, userId string, id int64) error
+	// Open 校验 token 和提取码，返回仍然有效的分享。下载次数用完的分享和过期的一样被拒绝，
+	// 访客不能再浏览、下载、上传或转存
+	Open(ctx context.Context, token string, code string) (domain.Share, error)
+	Stat(ctx context.Context, share domain.Share, path string) (domain.FileMetadata, error)
+	ListDirectory(ctx context.Context, share domain.Share, path string, opts ListOptions) (domain.FileList, error)
+	// Visitor 返回访客在分享中的标识。visitor 是之前为这个分享签发的标识时原样返回，
+	// 否则签发一个新的。只应在 Open 校验过提取码之后调用，访客不能自己指定标识
+	Visitor(ctx context.Context, share domain.Share, visitor string) (string, error)
+	// Download 打开分享中的文件，count 为 true 时计入下载次数，
+	// 同一个访客 (visitor，由 Visitor 签发) 对同一个文件的多次请求 (例如断点续传)
+	// 在 shareDownloadWindow 内只计一次
+	Download(ctx context.Context, share domain.Share, path string, visitor string, count bool) (*FileContent, error)
+	ValidateUpload(ctx context.Context, share domain.Share, src, dst string, digest string, size int64, conflict string) (domain.UploadPlan, error)
+	Upload(ctx *gin.Context, share domain.Share, sessionId string, chunkIndex int, chunkMd5 string) error
+	CompleteUpload(ctx *gin.Context, share domain.Share, sessionId string) (string, error)
+	// Save 在后台把分享中 path 指向的文件或目录树转存到 userId 的 dst，
+	// 只引用相同的 blob，不复制内容。conflict 与 Copy 相同
+	Save(ctx context.Context, userId string, share domain.Share, path, dst string, conflict string) (domain.SaveJob, error)
+	// SaveStatus 返回转存任务的进度
+	SaveStatus(ctx context.Context, userId string, jobId string) (domain.SaveJob, error)
+}
+
+// ShareOptions 创建分享的参数
+type ShareOptions struct {
+	Path string
+	// Code 提取码，为空时不需要提取码
+	Code string
+	// ExpireIn 为 0 时永不过期
+	ExpireIn time.Duration
+	// MaxDownloads 为 0 时不限制下载次数
+	MaxDownloads int64
+	// Mode read (默认) 或 upload，只有目录可以允许上传
+	Mode string
+}
+
+const (
+	// shareTokenBytes 分享 token 的随机字节数
+	shareTokenBytes = 12
+	// saveBatchSize 转存时每个事务创建的文件和目录数
+	saveBatchSize = 500
+	// saveJobTTL 转存任务结束后还可以查询进度的时长
+	saveJobTTL = 24 * time.Hour
+	// shareDownloadWindow 同一个访客对同一个文件的请求在这段时间内算作一次下载
+	shareDownloadWindow = time.Hour
+	// shareVisitorTTL 访客标识在最后一次使用后的有效期
+	shareVisitorTTL = 24 * time.Hour
+	// shareVisitorBytes 访客标识的随机字节数
+	shareVisitorBytes = 16
+)
+
+type shareService struct {
+	repo   repository.ShareRepository
+	files  FileService
+	um     ufs.UserManager
+	quotas QuotaService
+	jobs   *cache.Cache
+	// downloads 记录已经计入下载次数的访客和文件
+	downloads *cache.Cache
+	// visitors 记录签发给每个分享的访客标识
+	visitors *cache.Cache
+}
+
+func NewShareService(repo repository.ShareRepository, files FileService, um ufs.UserManager, quotas QuotaService) ShareService {
+	return &shareService{
+		repo:      repo,
+		files:     files,
+		um:        um,
+		quotas:    quotas,
+		jobs:      cache.New(saveJobTTL, time.Hour),
+		downloads: cache.New(shareDownloadWindow, 10*time.Minute),
+		visitors:  cache.New(shareVisitorTTL, time.Hour),
+	}
+}
+
+func (s *shareService) Create(ctx context.Context, userId string, opts ShareOptions) (domain.Share, error) {
+	if opts.Mode == "" {
+		opts.Mode = domain.ShareModeRead
+	}
+	if opts.Mode != domain.ShareModeRead && opts.Mode != domain.ShareModeUpload {
+		return domain.Share{}, ierrors.WithCode(code.ErrValidation, "不支持的分享模式: %s", opts.Mode)
+	}
+	if opts.ExpireIn < 0 || opts.MaxDownloads < 0 {
+		return domain.Share{}, ierrors.WithCode(code.ErrValidation, "有效期和下载次数不能为负数")
+	}
+	meta, err := s.files.FileStat(ctx, userId, opts.Path)
+	if err != nil {
+		return domain.Share{}, err
+	}
+	if opts.Mode == domain.ShareModeUpload && !meta.IsDir {
+		return domain.Share{}, ierrors.WithCode(code.ErrNotADirectory, "只有目录可以允许上传: %s", meta.Path)
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		return domain.Share{}, err
+	}
+	share := domain.Share{
+		Token:        token,
+		UserId:       userId,
+		Path:         meta.Path,
+		IsDir:        meta.IsDir,
+		Mode:         opts.Mode,
+		MaxDownloads: opts.MaxDownloads,
+	}
+	if opts.Code != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(opts.Code), bcrypt.DefaultCost)
+		if err != nil {
+			return domain.Share{}, err
+		}
+		share.Code = string(hash)
+	}
+	if opts.ExpireIn > 0 {
+		share.Expire = time.Now().Add(opts.ExpireIn)
+	}
+	return s.repo.Create(ctx, share)
+}
+
+func (s *shareService) List(ctx context.Context, userId string) ([]domain.Share, error) {
+	return s.repo.FindByUserId(ctx, userId)
+}
+
+func (s *shareService) Revoke(ctx context.Context, userId string, id int64) error {
+	err := s.repo.Delete(ctx, userId, id)
+	if errors.Is(err, repository.ErrShareNotFound) {
+		return ierrors.WithCode(code.ErrShareNotFound, "分享不存在: %d", id)
+	}
+	return err
+}
+
+func (s *shareService) Open(ctx context.Context, token string, shareCode string) (domain.Share, error) {
+	share, err := s.repo.FindByToken(ctx, token)
+	if errors.Is(err, repository.ErrShareNotFound) {
+		return domain.Share{}, ierrors.WithCode(code.ErrShareNotFound, "分享不存在: %s", token)
+	}
+	if err != nil {
+		return domain.Share{}, err
+	}
+	if share.Expired(time.Now()) {
+		return domain.Share{}, ierrors.WithCode(code.ErrShareExpired, "分享已过期: %s", token)
+	}
+	if share.Code != "" && bcrypt.CompareHashAndPassword([]byte(share.Code), []byte(shareCode)) != nil {
+		return domain.Share{}, ierrors.WithCode(code.ErrShareCodeIncorrect, "提取码不正确")
+	}
+	if share.Exhausted() {
+		return domain.Share{}, ierrors.WithCode(code.ErrShareExhausted, "分享的下载次数已用完")
+	}
+	return share, nil
+}
+
+func (s *shareService) Stat(ctx context.Context, share domain.Share, path string) (domain.FileMetadata, error) {
+	absPath, err := sharePath(share, path)
+	if err != nil {
+		return domain.FileMetadata{}, err
+	}
+	meta, err := s.files.FileStat(ctx, share.UserId, absPath)
+	if err != nil {
+		return domain.FileMetadata{}, err
+	}
+	return shareMetadata(share, meta), nil
+}
+
+func (s *shareService) ListDirectory(ctx context.Context, share domain.Share, path string, opts ListOptions) (domain.FileList, error) {
+	absPath, err := sharePath(share, path)
+	if err != nil {
+		return domain.FileList{}, err
+	}
+	list, err := s.files.ListDirectory(ctx, share.UserId, absPath, opts)
+	if err != nil {
+		return domain.FileList{}, err
+	}
+	for i, meta := range list.Files {
+		list.Files[i] = shareMetadata(share, meta)
+	}
+	return list, nil
+}
+
+func (s *shareService) Visitor(ctx context.Context, share domain.Share, visitor string) (string, error) {
+	if visitor != "" {
+		key := shareVisitorKey(share, visitor)
+		if _, ok := s.visitors.Get(key); ok {
+			s.visitors.SetDefault(key, struct{}{})
+			return visitor, nil
+		}
+	}
+	b := make([]byte, shareVisitorBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	visitor = base64.RawURLEncoding.EncodeToString(b)
+	s.visitors.SetDefault(shareVisitorKey(share, visitor), struct{}{})
+	return visitor, nil
+}
+
+func shareVisitorKey(share domain.Share, visitor string) string {
+	return fmt.Sprintf("visitor:%d:%s", share.Id, visitor)
+}
+
+func (s *shareService) Download(ctx context.Context, share domain.Share, path string, visitor string,
+	count bool) (*FileContent, error) {
+	absPath, err := sharePath(share, path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := s.files.Open(ctx, share.UserId, absPath)
+	if err != nil {
+		return nil, err
+	}
+	if !count {
+		return content, nil
+	}
+
+	// Add 在 key 已存在时失败，同一个访客的并发请求也只有一个计数
+	key := fmt.Sprintf("download:%d:%s:%s", share.Id, absPath, visitor)
+	if s.downloads.Add(key, struct{}{}, cache.DefaultExpiration) != nil {
+		return content, nil
+	}
+	ok, err := s.repo.IncrDownloads(ctx, share.Id)
+	if err == nil && !ok {
+		err = ierrors.WithCode(code.ErrShareExhausted, "分享的下载次数已用完")
+	}
+	if err != nil {
+		s.downloads.Delete(key)
+		content.Close()
+		return nil, err
+	}
+	return content, nil
+}
+
+// ValidateUpload 访客向分享的目录上传文件，为了不改动分享者已有的文件，不支持覆盖。
+// dst 为空时上传到分享的根目录下，目标不能是分享的根本身
+func (s *shareService) ValidateUpload(ctx context.Context, share domain.Share, src, dst string, digest string, size int64,
+	conflict string) (domain.UploadPlan, error) {
+	if share.Mode != domain.ShareModeUpload {
+		return domain.UploadPlan{}, ierrors.WithCode(code.ErrShareReadOnly, "分享不允许上传")
+	}
+	if conflict == string(ufs.ConflictOverwrite) {
+		return domain.UploadPlan{}, ierrors.WithCode(code.ErrValidation, "分享上传不能覆盖已有文件")
+	}
+	if dst == "" {
+		dst = "/"
+	}
+	rel := filepath.Join("/", targetPath(src, dst))
+	if rel == "/" {
+		return domain.UploadPlan{}, ierrors.WithCode(code.ErrValidation, "上传的目标不能是分享的根: %s", dst)
+	}
+	absPath, err := sharePath(share, rel)
+	if err != nil {
+		return domain.UploadPlan{}, err
+	}
+	return s.files.ValidateUpload(ctx, share.UserId, src, absPath, digest, size, conflict)
+}
+
+func (s *shareService) Upload(ctx *gin.Context, share domain.Share, sessionId string, chunkIndex int, chunkMd5 string) error {
+	if err := s.checkSession(ctx, share, sessionId); err != nil {
+		return err
+	}
+	return s.files.Upload(ctx, share.UserId, sessionId, chunkIndex, chunkMd5)
+}
+
+func (s *shareService) CompleteUpload(ctx *gin.Context, share domain.Share, sessionId string) (string, error) {
+	if err := s.checkSession(ctx, share, sessionId); err != nil {
+		return "", err
+	}
+	path, err := s.files.CompleteUpload(ctx, share.UserId, sessionId)
+	if err != nil {
+		return "", err
+	}
+	return shareRelative(share, path), nil
+}
+
+func (s *shareService) Save(ctx context.Context, userId string, share domain.Share, path, dst string,
+	conflict string) (domain.SaveJob, error) {
+	policy, err := ufs.ParseConflictPolicy(conflict)
+	if err != nil {
+		return domain.SaveJob{}, ierrors.WrapC(err, code.ErrValidation, "不支持的冲突处理方式: %s", conflict)
+	}
+	srcPath, err := sharePath(share, path)
+	if err != nil {
+		return domain.SaveJob{}, err
+	}
+	if _, err := s.files.FileStat(ctx, share.UserId, srcPath); err != nil {
+		return domain.SaveJob{}, err
+	}
+	fs := s.um.User(userId)
+	dstPath := filepath.Join("/", targetPath(srcPath, dst))
+	if err := requireDir(fs, filepath.Dir(dstPath)); err != nil {
+		return domain.SaveJob{}, err
+	}
+	// 转存和下载一样计入下载次数。先占用一次，并发的转存也不会超出上限，失败时在 save 中退还
+	ok, err := s.repo.IncrDownloads(ctx, share.Id)
+	if err != nil {
+		return domain.SaveJob{}, err
+	}
+	if !ok {
+		return domain.SaveJob{}, ierrors.WithCode(code.ErrShareExhausted, "分享的下载次数已用完")
+	}
+
+	job := domain.SaveJob{
+		Id:        uuid.New().String(),
+		UserId:    userId,
+		State:     domain.SaveJobRunning,
+		Path:      dstPath,
+		StartedAt: time.Now(),
+	}
+	s.jobs.SetDefault(saveJobKey(userId, job.Id), job)
+
+	// 大的目录树可能需要很久，请求返回后在后台继续，进度通过 SaveStatus 查询
+	go s.save(job, share, srcPath, policy)
+	return job, nil
+}
+
+func (s *shareService) save(job domain.SaveJob, share domain.Share, srcPath string, policy ufs.ConflictPolicy) {
+	key := saveJobKey(job.UserId, job.Id)
+	path, err := s.um.User(job.UserId).Import(s.um.User(share.UserId), srcPath, job.Path, ufs.ImportOptions{
+		Policy:    policy,
+		BatchSize: saveBatchSize,
+		Check: func(bytes, files int64) error {
+			return s.quotas.Check(context.Background(), job.UserId, bytes, files)
+		},
+		Progress: func(done, total int) {
+			job.Done, job.Total = done, total
+			s.jobs.SetDefault(key, job)
+		},
+	})
+
+	job.FinishedAt = time.Now()
+	if err != nil {
+		job.State = domain.SaveJobFailed
+		err = pathError(job.Path, err)
+		if coder := ierrors.ParseCoder(err); coder.HTTPStatus() != http.StatusInternalServerError {
+			job.Code, job.Error = coder.Code(), coder.String()
+		} else {
+			job.Error = err.Error()
+		}
+		log.Errorf("save %s to %s for user %s failed: %s", srcPath, job.Path, job.UserId, job.Error)
+		// 没有转存成功，退还 Save 占用的下载次数，访客可以重试
+		if err := s.repo.DecrDownloads(context.Background(), share.Id); err != nil {
+			log.Errorf("return the download of share %d failed: %v", share.Id, err)
+		}
+	} else {
+		job.State = domain.SaveJobDone
+		job.Path = path
+	}
+	s.jobs.SetDefault(key, job)
+}
+
+func (s *shareService) SaveStatus(ctx context.Context, userId string, jobId string) (domain.SaveJob, error) {
+	val, ok := s.jobs.Get(saveJobKey(userId, jobId))
+	if !ok {
+		return domain.SaveJob{}, ierrors.WithCode(code.ErrValidation, "转存任务不存在: %s", jobId)
+	}
+	return val.(domain.SaveJob), nil
+}
+
+func saveJobKey(userId, jobId string) string {
+	return fmt.Sprintf("save:%s:%s", userId, jobId)
+}
+
+// checkSession 检查上传会话是通过这个分享创建的，即目标路径在分享的目录树中
+func (s *shareService) checkSession(ctx context.Context, share domain.Share, sessionId string) error {
+	if share.Mode != domain.ShareModeUpload {
+		return ierrors.WithCode(code.ErrShareReadOnly, "分享不允许上传")
+	}
+	session, err := s.files.UploadStatus(ctx, share.UserId, sessionId)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(session.Path, strings.TrimSuffix(share.Path, "/")+"/") {
+		return ierrors.WithCode(code.ErrPermissionDenied, "上传会话不属于这个分享")
+	}
+	return nil
+}
+
+// sharePath 把访客给出的相对于分享根的路径转换成分享者目录树中的绝对路径。
+// 路径先在 / 下清理，.. 无法越过分享的根；分享的是文件时只能访问文件本身
+func sharePath(share domain.Share, path string) (string, error) {
+	rel := filepath.Join("/", path)
+	if !share.IsDir && rel != "/" {
+		return "", ierrors.WithCode(code.ErrFileNotFound, "文件不存在: %s", rel)
+	}
+	return filepath.Join(share.Path, rel), nil
+}
+
+// shareRelative 返回 absPath 相对于分享根的路径，分享的根是 /
+func shareRelative(share domain.Share, absPath string) string {
+	rel := strings.TrimPrefix(absPath, share.Path)
+	return filepath.Join("/", rel)
+}
+
+// shareMetadata 隐藏分享者的身份和分享之外的路径
+func shareMetadata(share domain.Share, meta domain.FileMetadata) domain.FileMetadata {
+	meta.Path = shareRelative(share, meta.Path)
+	meta.OwnerID = ""
+	return meta
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, shareTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
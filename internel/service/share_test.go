@@ -0,0 +1,386 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/internel/repository"
+	"github.com/lvow2022/udisk/internel/repository/dao"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testEnv 测试用的服务，数据库在内存中，blob 在临时目录中
+type testEnv struct {
+	db     *gorm.DB
+	um     ufs.UserManager
+	blobs  blob.BlobStore
+	quotas QuotaService
+	files  FileService
+}
+
+func newTestEnv(t *testing.T, quota domain.Quota) *testEnv {
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := ufs.InitTables(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	if err := dao.InitTables(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	blobs, err := blob.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create blob store: %v", err)
+	}
+
+	um := ufs.NewUserManager(ufs.GormPersistors(db))
+	quotas := NewQuotaService(um, quota)
+	sessions := repository.NewUploadSessionRepository(dao.NewUploadSessionDAO(db))
+	return &testEnv{
+		db:     db,
+		um:     um,
+		blobs:  blobs,
+		quotas: quotas,
+		files:  NewFileService(nil, um, blobs, sessions, quotas),
+	}
+}
+
+// put 把 content 存为 blob 并链接到 owner 的 path
+func (e *testEnv) put(t *testing.T, owner, path, content string) blob.Info {
+	info, err := e.blobs.Put(md5Hex(content), strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Error storing blob: %v", err)
+	}
+	ref := ufs.BlobRef{Digest: info.Digest, Size: info.Size}
+	if _, err := e.um.User(owner).Commit(path, ref, ufs.ConflictOverwrite); err != nil {
+		t.Fatalf("Error committing %s: %v", path, err)
+	}
+	return info
+}
+
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// isCode 判断 err 是否带有错误码 c
+func isCode(err error, c int) bool {
+	return err != nil && ierrors.ParseCoder(err).Code() == c
+}
+
+func newTestShareService(t *testing.T) (ShareService, repository.ShareRepository, *testEnv) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	repo := repository.NewShareRepository(dao.NewShareDAO(env.db))
+	return NewShareService(repo, env.files, env.um, env.quotas), repo, env
+}
+
+func TestSharePath(t *testing.T) {
+	dir := domain.Share{Path: "/docs", IsDir: true}
+	file := domain.Share{Path: "/docs/a.txt"}
+
+	tests := []struct {
+		name  string
+		share domain.Share
+		path  string
+		want  string
+		code  int
+	}{
+		{name: "dir root", share: dir, path: "", want: "/docs"},
+		{name: "dir child", share: dir, path: "sub/a.txt", want: "/docs/sub/a.txt"},
+		{name: "dir parent", share: dir, path: "../secret.txt", want: "/docs/secret.txt"},
+		{name: "dir parent of root", share: dir, path: "/../../etc/passwd", want: "/docs/etc/passwd"},
+		{name: "dir inner parent", share: dir, path: "sub/../../a.txt", want: "/docs/a.txt"},
+		{name: "file root", share: file, path: "", want: "/docs/a.txt"},
+		{name: "file slash", share: file, path: "/", want: "/docs/a.txt"},
+		{name: "file dot dot", share: file, path: "..", want: "/docs/a.txt"},
+		{name: "file subpath", share: file, path: "b.txt", code: code.ErrFileNotFound},
+		{name: "file sibling", share: file, path: "../b.txt", code: code.ErrFileNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sharePath(tt.share, tt.path)
+			if tt.code != 0 {
+				if !isCode(err, tt.code) {
+					t.Fatalf("Expected code %d, got %s (%v)", tt.code, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("Expected %s, got %s (%v)", tt.want, got, err)
+			}
+		})
+	}
+}
+
+func TestShareOpen(t *testing.T) {
+	shares, repo, env := newTestShareService(t)
+	ctx := context.Background()
+	env.put(t, "u1", "/docs/a.txt", "hello")
+
+	share, err := shares.Create(ctx, "u1", ShareOptions{Path: "/docs", Code: "1234"})
+	if err != nil {
+		t.Fatalf("Error creating share: %v", err)
+	}
+	if _, err := shares.Open(ctx, share.Token, "4321"); !isCode(err, code.ErrShareCodeIncorrect) {
+		t.Fatalf("Expected ErrShareCodeIncorrect, got %v", err)
+	}
+	if _, err := shares.Open(ctx, share.Token, ""); !isCode(err, code.ErrShareCodeIncorrect) {
+		t.Fatalf("Expected ErrShareCodeIncorrect without a code, got %v", err)
+	}
+	if opened, err := shares.Open(ctx, share.Token, "1234"); err != nil || opened.Id != share.Id {
+		t.Fatalf("Error opening share: %+v (%v)", opened, err)
+	}
+	if _, err := shares.Open(ctx, "unknown", ""); !isCode(err, code.ErrShareNotFound) {
+		t.Fatalf("Expected ErrShareNotFound, got %v", err)
+	}
+
+	// 过期的分享即使提取码正确也打不开
+	expired, err := repo.Create(ctx, domain.Share{Token: "expired", UserId: "u1", Path: "/docs", IsDir: true,
+		Mode: domain.ShareModeRead, Expire: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatalf("Error creating share: %v", err)
+	}
+	if _, err := shares.Open(ctx, expired.Token, ""); !isCode(err, code.ErrShareExpired) {
+		t.Fatalf("Expected ErrShareExpired, got %v", err)
+	}
+	if err := shares.Revoke(ctx, "u1", share.Id); err != nil {
+		t.Fatalf("Error revoking share: %v", err)
+	}
+	if _, err := shares.Open(ctx, share.Token, "1234"); !isCode(err, code.ErrShareNotFound) {
+		t.Fatalf("Expected a revoked share to be gone, got %v", err)
+	}
+}
+
+func TestShareDownloadLimit(t *testing.T) {
+	shares, _, env := newTestShareService(t)
+	ctx := context.Background()
+	env.put(t, "u1", "/docs/a.txt", "hello")
+	env.put(t, "u1", "/secret.txt", "secret")
+
+	created, err := shares.Create(ctx, "u1", ShareOptions{Path: "/docs", MaxDownloads: 2})
+	if err != nil {
+		t.Fatalf("Error creating share: %v", err)
+	}
+	open := func() domain.Share {
+		share, err := shares.Open(ctx, created.Token, "")
+		if err != nil {
+			t.Fatalf("Error opening share: %v", err)
+		}
+		return share
+	}
+	download := func(visitor string, count bool) error {
+		content, err := shares.Download(ctx, open(), "a.txt", visitor, count)
+		if err == nil {
+			content.Close()
+		}
+		return err
+	}
+
+	if _, err := shares.Download(ctx, open(), "../secret.txt", "alice", true); err == nil {
+		t.Fatal("Expected the share not to reach outside its root")
+	}
+	if err := download("alice", true); err != nil {
+		t.Fatalf("Error downloading: %v", err)
+	}
+	// 同一个访客续传不再计数，HEAD 不计数
+	if err := download("alice", true); err != nil {
+		t.Fatalf("Error resuming download: %v", err)
+	}
+	if err := download("bob", false); err != nil {
+		t.Fatalf("Error probing download: %v", err)
+	}
+	if downloads := open().Downloads; downloads != 1 {
+		t.Fatalf("Expected 1 download, got %d", downloads)
+	}
+	if err := download("bob", true); err != nil {
+		t.Fatalf("Error downloading: %v", err)
+	}
+
+	// 次数用完后分享不能再打开，浏览、下载 (包括 HEAD 和已经计过数的访客)、上传和转存都被拒绝
+	if _, err := shares.Open(ctx, created.Token, ""); !isCode(err, code.ErrShareExhausted) {
+		t.Fatalf("Expected ErrShareExhausted when opening, got %v", err)
+	}
+	listed, err := shares.List(ctx, "u1")
+	if err != nil || len(listed) != 1 || listed[0].Downloads != 2 {
+		t.Fatalf("Expected 2 downloads, got %v (%v)", listed, err)
+	}
+}
+
+func TestShareSaveFailed(t *testing.T) {
+	shares, _, env := newTestShareService(t)
+	ctx := context.Background()
+	env.put(t, "u1", "/docs/a.txt", "hello")
+	env.put(t, "u2", "/a.txt", "mine")
+
+	created, err := shares.Create(ctx, "u1", ShareOptions{Path: "/docs", MaxDownloads: 1})
+	if err != nil {
+		t.Fatalf("Error creating share: %v", err)
+	}
+	save := func(conflict string) (domain.SaveJob, domain.Share) {
+		share, err := shares.Open(ctx, created.Token, "")
+		if err != nil {
+			t.Fatalf("Error opening share: %v", err)
+		}
+		job, err := shares.Save(ctx, "u2", share, "a.txt", "/", conflict)
+		if err != nil {
+			t.Fatalf("Error saving: %v", err)
+		}
+		for job.State == domain.SaveJobRunning {
+			time.Sleep(time.Millisecond)
+			if job, err = shares.SaveStatus(ctx, "u2", job.Id); err != nil {
+				t.Fatalf("Error reading the job: %v", err)
+			}
+		}
+		listed, err := shares.List(ctx, "u1")
+		if err != nil || len(listed) != 1 {
+			t.Fatalf("Error listing shares: %v (%v)", listed, err)
+		}
+		return job, listed[0]
+	}
+
+	// 目标已存在，转存失败，不占用下载次数
+	job, share := save("fail")
+	if job.State != domain.SaveJobFailed || job.Code != code.ErrFileExists {
+		t.Fatalf("Expected the job to fail with code %d, got %+v", code.ErrFileExists, job)
+	}
+	if share.Downloads != 0 {
+		t.Fatalf("Expected a failed save not to count, got %d downloads", share.Downloads)
+	}
+
+	// 唯一的一次下载仍然可以用来重试
+	job, share = save("rename")
+	if job.State != domain.SaveJobDone || share.Downloads != 1 {
+		t.Fatalf("Expected the retry to succeed and count, got %+v with %d downloads", job, share.Downloads)
+	}
+	if data, err := env.um.User("u2").Blob(job.Path); err != nil || data.Digest != md5Hex("hello") {
+		t.Fatalf("Expected the saved file at %s, got %+v (%v)", job.Path, data, err)
+	}
+}
+
+func TestShareVisitor(t *testing.T) {
+	shares, _, _ := newTestShareService(t)
+	ctx := context.Background()
+	docs := domain.Share{Id: 1}
+	other := domain.Share{Id: 2}
+
+	visitor, err := shares.Visitor(ctx, docs, "")
+	if err != nil || visitor == "" {
+		t.Fatalf("Expected a new visitor, got %q (%v)", visitor, err)
+	}
+	if again, err := shares.Visitor(ctx, docs, visitor); err != nil || again != visitor {
+		t.Fatalf("Expected %s to be kept, got %q (%v)", visitor, again, err)
+	}
+	// 访客不能自己指定标识，也不能拿到别的分享中使用
+	for _, tt := range []struct {
+		share   domain.Share
+		visitor string
+	}{{docs, "alice"}, {other, visitor}} {
+		if got, err := shares.Visitor(ctx, tt.share, tt.visitor); err != nil || got == tt.visitor || got == "" {
+			t.Fatalf("Expected a new visitor instead of %q, got %q (%v)", tt.visitor, got, err)
+		}
+	}
+}
+
+func TestShareUploadTarget(t *testing.T) {
+	shares, _, env := newTestShareService(t)
+	ctx := context.Background()
+	env.put(t, "u1", "/docs/a.txt", "hello")
+	docs, err := shares.Create(ctx, "u1", ShareOptions{Path: "/docs", Mode: domain.ShareModeUpload})
+	if err != nil {
+		t.Fatalf("Error creating share: %v", err)
+	}
+
+	content := "new"
+	// dst 为空时上传到分享的根目录下
+	plan, err := shares.ValidateUpload(ctx, docs, "new.txt", "", md5Hex(content), int64(len(content)), "")
+	if err != nil {
+		t.Fatalf("Error validating upload: %v", err)
+	}
+	session, err := env.files.UploadStatus(ctx, "u1", plan.SessionId)
+	if err != nil || session.Path != "/docs/new.txt" {
+		t.Fatalf("Expected /docs/new.txt, got %+v (%v)", session, err)
+	}
+
+	// 目标不能是分享的根本身
+	for _, dst := range []string{"/", ".", "/..", "../", "/a/.."} {
+		src := "new.txt"
+		if dst == "/" || dst == "../" {
+			src = ""
+		}
+		if _, err := shares.ValidateUpload(ctx, docs, src, dst, md5Hex(content), int64(len(content)),
+			string(ufs.ConflictRename)); !isCode(err, code.ErrValidation) {
+			t.Fatalf("Expected ErrValidation for %q, got %v", dst, err)
+		}
+	}
+}
+
+func TestShareCheckSession(t *testing.T) {
+	shares, _, env := newTestShareService(t)
+	ctx := context.Background()
+	env.put(t, "u1", "/docs/a.txt", "hello")
+	env.put(t, "u1", "/docs2/b.txt", "world")
+
+	docs, err := shares.Create(ctx, "u1", ShareOptions{Path: "/docs", Mode: domain.ShareModeUpload})
+	if err != nil {
+		t.Fatalf("Error creating share: %v", err)
+	}
+	docs2, err := shares.Create(ctx, "u1", ShareOptions{Path: "/docs2", Mode: domain.ShareModeUpload})
+	if err != nil {
+		t.Fatalf("Error creating share: %v", err)
+	}
+	read, err := shares.Create(ctx, "u1", ShareOptions{Path: "/docs"})
+	if err != nil {
+		t.Fatalf("Error creating share: %v", err)
+	}
+
+	content := "new"
+	plan, err := shares.ValidateUpload(ctx, docs2, "new.txt", "/../in/", md5Hex(content), int64(len(content)), "")
+	if err != nil {
+		t.Fatalf("Error validating upload: %v", err)
+	}
+	session, err := env.files.UploadStatus(ctx, "u1", plan.SessionId)
+	if err != nil || session.Path != "/docs2/in/new.txt" {
+		t.Fatalf("Expected the session to stay inside the share, got %+v (%v)", session, err)
+	}
+
+	s := shares.(*shareService)
+	if err := s.checkSession(ctx, docs2, plan.SessionId); err != nil {
+		t.Fatalf("Expected the session to belong to its share, got %v", err)
+	}
+	// /docs 是 /docs2 的前缀，但不是它的上级目录
+	if err := s.checkSession(ctx, docs, plan.SessionId); !isCode(err, code.ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied for a sibling share, got %v", err)
+	}
+	if err := s.checkSession(ctx, read, plan.SessionId); !isCode(err, code.ErrShareReadOnly) {
+		t.Fatalf("Expected ErrShareReadOnly, got %v", err)
+	}
+
+	// 分享者在分享之外创建的上传会话不能通过分享使用
+	own, err := env.files.ValidateUpload(ctx, "u1", "x.txt", "/x.txt", md5Hex(content), int64(len(content)), "")
+	if err != nil {
+		t.Fatalf("Error validating upload: %v", err)
+	}
+	if err := s.checkSession(ctx, docs, own.SessionId); !isCode(err, code.ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied for a session outside the share, got %v", err)
+	}
+
+	// 分享上传不能覆盖已有文件
+	if _, err := shares.ValidateUpload(ctx, docs, "a.txt", "/", md5Hex(content), int64(len(content)),
+		string(ufs.ConflictOverwrite)); !isCode(err, code.ErrValidation) {
+		t.Fatalf("Expected ErrValidation for overwrite, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/repository"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHKeyService 管理用户登录 SFTP 用的公钥
+type SSHKeyService interface {
+	// Add 登记一个 authorized_keys 格式的公钥，name 为空时使用公钥的注释
+	Add(ctx context.Context, userId string, name string, publicKey string) (domain.SSHKey, error)
+	List(ctx context.Context, userId string) ([]domain.SSHKey, error)
+	Delete(ctx context.Context, userId string, id int64) error
+	// Find 返回与 key 相同的已登记公钥
+	Find(ctx context.Context, key ssh.PublicKey) (domain.SSHKey, error)
+}
+
+type sshKeyService struct {
+	repo repository.SSHKeyRepository
+}
+
+func NewSSHKeyService(repo repository.SSHKeyRepository) SSHKeyService {
+	return &sshKeyService{
+		repo: repo,
+	}
+}
+
+func (s *sshKeyService) Add(ctx context.Context, userId string, name string, publicKey string) (domain.SSHKey, error) {
+	key, comment, _, rest, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return domain.SSHKey{}, ierrors.WrapC(err, code.ErrSSHKeyInvalid, "公钥格式不对")
+	}
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return domain.SSHKey{}, ierrors.WithCode(code.ErrSSHKeyInvalid, "一次只能登记一个公钥")
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	if _, err := s.repo.FindByFingerprint(ctx, fingerprint); err == nil {
+		return domain.SSHKey{}, ierrors.WithCode(code.ErrSSHKeyExists, "公钥已经登记过: %s", fingerprint)
+	} else if !errors.Is(err, repository.ErrSSHKeyNotFound) {
+		return domain.SSHKey{}, err
+	}
+
+	if name == "" {
+		name = comment
+	}
+	k := domain.SSHKey{
+		Name:        name,
+		Fingerprint: fingerprint,
+		// 只保存公钥本身，去掉选项和注释
+		PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		UserId:    userId,
+	}
+	if err := s.repo.Create(ctx, k); err != nil {
+		return domain.SSHKey{}, err
+	}
+	return s.repo.FindByFingerprint(ctx, fingerprint)
+}
+
+func (s *sshKeyService) List(ctx context.Context, userId string) ([]domain.SSHKey, error) {
+	return s.repo.FindByUserId(ctx, userId)
+}
+
+func (s *sshKeyService) Delete(ctx context.Context, userId string, id int64) error {
+	err := s.repo.Delete(ctx, userId, id)
+	if errors.Is(err, repository.ErrSSHKeyNotFound) {
+		return ierrors.WithCode(code.ErrSSHKeyNotFound, "公钥不存在: %d", id)
+	}
+	return err
+}
+
+func (s *sshKeyService) Find(ctx context.Context, key ssh.PublicKey) (domain.SSHKey, error) {
+	fingerprint := ssh.FingerprintSHA256(key)
+	k, err := s.repo.FindByFingerprint(ctx, fingerprint)
+	if errors.Is(err, repository.ErrSSHKeyNotFound) {
+		return domain.SSHKey{}, ierrors.WithCode(code.ErrSSHKeyNotFound, "公钥不存在: %s", fingerprint)
+	}
+	return k, err
+}
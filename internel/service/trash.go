@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+	"github.com/lvow2022/udisk/pkg/log"
+)
+
+// ListTrash 列出回收站，最近删除的排在前面
+func (f *fileService) ListTrash(ctx context.Context, userId string) ([]domain.TrashItem, error) {
+	items, err := f.um.User(userId).ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]domain.TrashItem, 0, len(items))
+	for _, item := range items {
+		res = append(res, domain.TrashItem{
+			Id:           item.ID,
+			Name:         item.Name,
+			OriginalPath: item.OriginalPath,
+			IsDir:        item.IsDirectory,
+			Size:         item.Size,
+			DeletedAt:    item.DeletedAt,
+		})
+	}
+	return res, nil
+}
+
+// RestoreTrash 把回收站中的一项放回原来的位置，conflict 决定原路径已被占用时的
+// 处理方式: fail (默认)、rename 或 overwrite，被覆盖的文件会进入回收站
+func (f *fileService) RestoreTrash(ctx context.Context, userId string, id uint, conflict string) (domain.FileMetadata, error) {
+	policy, err := ufs.ParseConflictPolicy(conflict)
+	if err != nil || policy == ufs.ConflictSkip {
+		return domain.FileMetadata{}, ierrors.WithCode(code.ErrValidation, "不支持的冲突处理方式: %s", conflict)
+	}
+	fs := f.um.User(userId)
+	path, err := fs.RestoreTrash(id, policy)
+	if err != nil {
+		return domain.FileMetadata{}, trashError(id, err)
+	}
+	return f.metadata(fs, userId, path)
+}
+
+// PurgeTrash 彻底删除回收站中的一项，之后它引用的 blob 才会失去引用
+func (f *fileService) PurgeTrash(ctx context.Context, userId string, id uint) error {
+	return trashError(id, f.um.User(userId).PurgeTrash(id))
+}
+
+// EmptyTrash 清空回收站，返回删除的项数
+func (f *fileService) EmptyTrash(ctx context.Context, userId string) (int, error) {
+	fs := f.um.User(userId)
+	items, err := fs.ListTrash()
+	if err != nil {
+		return 0, err
+	}
+	for i, item := range items {
+		if err := fs.PurgeTrash(item.ID); err != nil && !errors.Is(err, ufs.ErrTrashItemNotFound) {
+			return i, err
+		}
+	}
+	return len(items), nil
+}
+
+func trashError(id uint, err error) error {
+	if errors.Is(err, ufs.ErrTrashItemNotFound) {
+		return ierrors.WithCode(code.ErrFileNotFound, "回收站中没有 %d", id)
+	}
+	if err != nil {
+		return pathError("", err)
+	}
+	return nil
+}
+
+// TrashReport 描述一次回收站清理的结果
+type TrashReport struct {
+	Purged    int           `json:"purged"`
+	Errors    []string      `json:"errors,omitempty"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+}
+
+type TrashService interface {
+	// Purge 彻底删除在回收站中超过保留期的项
+	Purge(ctx context.Context) (TrashReport, error)
+	// Start 在后台周期性执行 Purge，直到 ctx 结束
+	Start(ctx context.Context, interval time.Duration)
+}
+
+// trashPurgeBatch 每次查询的过期项数
+const trashPurgeBatch = 100
+
+type trashService struct {
+	um        ufs.UserManager
+	trash     ufs.TrashCollector
+	retention time.Duration
+}
+
+// NewTrashService 创建回收站清理服务，删除超过 retention 的项会被彻底删除
+func NewTrashService(um ufs.UserManager, trash ufs.TrashCollector, retention time.Duration) TrashService {
+	return &trashService{
+		um:        um,
+		trash:     trash,
+		retention: retention,
+	}
+}
+
+func (t *trashService) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := t.Purge(ctx)
+			if err != nil {
+				log.Errorf("trash purge failed: %v", err)
+				continue
+			}
+			log.Infof("trash purge removed %d items", report.Purged)
+		}
+	}
+}
+
+func (t *trashService) Purge(ctx context.Context) (TrashReport, error) {
+	report := TrashReport{StartedAt: time.Now()}
+	before := report.StartedAt.Add(-t.retention)
+	// 清理失败的项留在原处，下一轮查询从它们之后开始，避免反复重试同一批
+	failed := map[uint]bool{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		items, err := t.trash.Expired(before, trashPurgeBatch+len(failed))
+		if err != nil {
+			return report, err
+		}
+
+		purged := 0
+		for _, item := range items {
+			if failed[item.ID] {
+				continue
+			}
+			err := t.um.User(item.Owner).PurgeTrash(item.ID)
+			if err != nil && !errors.Is(err, ufs.ErrTrashItemNotFound) {
+				failed[item.ID] = true
+				report.Errors = append(report.Errors, err.Error())
+				continue
+			}
+			purged++
+		}
+		report.Purged += purged
+		if purged == 0 {
+			break
+		}
+	}
+	report.Duration = time.Since(report.StartedAt)
+	return report, nil
+}
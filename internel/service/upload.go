@@ -0,0 +1,446 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/internel/repository"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+	"io"
+	"math/big"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadSessionTTL 上传会话的有效期
+const uploadSessionTTL = 24 * time.Hour
+
+// ValidateUpload 创建上传会话，conflict 决定目标路径已存在时的处理方式:
+// fail (默认) 拒绝上传，overwrite 覆盖，rename 自动改名
+func (f *fileService) ValidateUpload(ctx context.Context, userId string, src, dst string, digest string, size int64,
+	conflict string) (domain.UploadPlan, error) {
+	path := targetPath(src, dst)
+	policy, err := ufs.ParseConflictPolicy(conflict)
+	if err != nil {
+		return domain.UploadPlan{}, err
+	}
+	if policy == ufs.ConflictSkip {
+		return domain.UploadPlan{}, ierrors.WithCode(code.ErrValidation, "上传不支持 skip")
+	}
+	_, err = f.CheckIfFileExists(userId, path)
+	exists := err == nil
+	if exists && policy == ufs.ConflictFail {
+		return domain.UploadPlan{}, ierrors.WithCode(code.ErrFileExists, "存在同名文件: %s", path)
+	}
+
+	if _, err := blob.NewHash(digest); err != nil {
+		return domain.UploadPlan{}, fmt.Errorf("文件摘要必须是 md5 或 sha256: %w", err)
+	}
+	if size < 0 {
+		return domain.UploadPlan{}, fmt.Errorf("文件大小不合法: %d", size)
+	}
+	if err := f.checkQuota(ctx, userId, path, policy, size); err != nil {
+		return domain.UploadPlan{}, err
+	}
+
+	// 创建上传会话，即使可以秒传，客户端也可以退回到分片上传
+	session := domain.UploadSession{
+		Id:          uuid.New().String(),
+		UserId:      userId,
+		Path:        path,
+		Digest:      digest,
+		Size:        size,
+		ChunkSize:   ChunkSize,
+		TotalChunks: int((size + ChunkSize - 1) / ChunkSize),
+		Conflict:    string(policy),
+		Expire:      time.Now().Add(uploadSessionTTL),
+	}
+	if err := f.sessions.Create(ctx, session); err != nil {
+		return domain.UploadPlan{}, err
+	}
+	// 无论服务端是否已有相同内容都发出挑战，否则只凭摘要就能探测别人有没有某个文件。
+	// 没有该内容或大小不一致时，挑战不可能被回答正确
+	info, err := f.blobs.Stat(digest)
+	if err != nil || info.Size != size {
+		info = blob.Info{Size: size}
+	}
+	challenge, err := f.newChallenge(session, info)
+	if err != nil {
+		return domain.UploadPlan{}, err
+	}
+	return domain.UploadPlan{SessionId: session.Id, ChunkSize: ChunkSize, Challenge: &challenge}, nil
+}
+
+// InstantUpload 校验客户端对挑战的回答，通过后直接把已有内容链接到目标路径
+func (f *fileService) InstantUpload(ctx context.Context, userId string, challengeId, proof string) (path string, err error) {
+	value, ok := f.challenges.Get(challengeId)
+	if !ok {
+		return "", fmt.Errorf("挑战不存在或已过期")
+	}
+	// 每个挑战只能回答一次
+	f.challenges.Delete(challengeId)
+	c := value.(instantChallenge)
+	if c.userId != userId {
+		return "", fmt.Errorf("挑战不属于当前用户")
+	}
+
+	// 服务端没有该内容时 digest 为空，和回答错误一样处理
+	var expected string
+	if c.digest != "" {
+		if expected, err = f.answerChallenge(c); err != nil {
+			return "", err
+		}
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(proof)) != 1 {
+		return "", fmt.Errorf("挑战回答错误")
+	}
+
+	path, err = f.commit(ctx, c.session, blob.Info{Digest: c.digest, Size: c.size})
+	if err != nil {
+		return "", err
+	}
+	return path, f.sessions.Delete(ctx, c.session.Id)
+}
+
+// instantChallenge 是服务端保存的挑战及其上下文
+type instantChallenge struct {
+	domain.UploadChallenge
+	userId  string
+	session domain.UploadSession
+	digest  string
+	size    int64
+}
+
+// challengeLength 是挑战要求证明的字节数
+const challengeLength = 64 * 1024
+
+func (f *fileService) newChallenge(session domain.UploadSession, info blob.Info) (domain.UploadChallenge, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return domain.UploadChallenge{}, err
+	}
+
+	// 随机选取文件中的一段，小文件则是整个文件
+	length := int64(challengeLength)
+	if info.Size < length {
+		length = info.Size
+	}
+	var offset int64
+	if info.Size > length {
+		n, err := rand.Int(rand.Reader, big.NewInt(info.Size-length+1))
+		if err != nil {
+			return domain.UploadChallenge{}, err
+		}
+		offset = n.Int64()
+	}
+
+	c := instantChallenge{
+		UploadChallenge: domain.UploadChallenge{
+			Id:     uuid.New().String(),
+			Nonce:  hex.EncodeToString(nonce),
+			Offset: offset,
+			Length: length,
+		},
+		userId:  session.UserId,
+		session: session,
+		digest:  info.Digest,
+		size:    info.Size,
+	}
+	f.challenges.SetDefault(c.Id, c)
+	return c.UploadChallenge, nil
+}
+
+// answerChallenge 用服务端保存的内容计算挑战的正确回答
+func (f *fileService) answerChallenge(c instantChallenge) (string, error) {
+	r, err := f.blobs.Get(c.digest)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	if _, err := r.Seek(c.Offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write([]byte(c.Nonce))
+	if _, err := io.CopyN(hash, r, c.Length); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// detectMimeType 优先根据扩展名判断文件类型，否则根据内容的前 512 字节判断
+func detectMimeType(blobs blob.BlobStore, path, digest string) (string, error) {
+	if mimeType := mime.TypeByExtension(filepath.Ext(path)); mimeType != "" {
+		return mimeType, nil
+	}
+
+	r, err := blobs.Get(digest)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// targetPath 返回上传、移动或复制的目标路径，dst 以 / 结尾时表示目录，文件名沿用 src 的文件名
+func targetPath(src, dst string) string {
+	if strings.HasSuffix(dst, "/") {
+		return filepath.Join(dst, filepath.Base(src))
+	}
+	return filepath.Clean(dst)
+}
+
+// Upload 接收会话中的一个分片并持久化到 OS 文件系统
+func (f *fileService) Upload(ctx *gin.Context, userId string, sessionId string, chunkIndex int, chunkMd5 string) error {
+	session, err := f.findSession(ctx, userId, sessionId)
+	if err != nil {
+		return err
+	}
+	if session.Multipart() {
+		return fmt.Errorf("分段上传的会话只能通过 S3 接口上传")
+	}
+	if chunkIndex < 0 || chunkIndex >= session.TotalChunks {
+		return fmt.Errorf("分片序号超出范围: %d", chunkIndex)
+	}
+
+	// 最多读取分片应有的长度多一个字节
+	calculatedMd5, err := f.saveChunk(sessionId, chunkIndex, ctx.Request.Body, session.ChunkLength(chunkIndex)+1,
+		func(n int64, calculatedMd5 string) error {
+			if n != session.ChunkLength(chunkIndex) {
+				return fmt.Errorf("分片长度不对: 收到 %d 字节，应为 %d 字节", n, session.ChunkLength(chunkIndex))
+			}
+			// 比较计算的 MD5 值与传入的 MD5 值
+			if calculatedMd5 != chunkMd5 {
+				return fmt.Errorf("MD5 mismatch: calculated %s, expected %s", calculatedMd5, chunkMd5)
+			}
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	return f.sessions.MarkChunkReceived(ctx, sessionId, chunkIndex, calculatedMd5)
+}
+
+// saveChunk 把 r 中最多 limit 个字节保存为会话的第 index 个分片，返回分片的 md5。
+// 先写入临时文件，check 通过后再改名，避免留下不完整的分片
+func (f *fileService) saveChunk(sessionId string, index int, r io.Reader, limit int64,
+	check func(n int64, md5 string) error) (string, error) {
+	filePath := chunkPath(sessionId, index)
+
+	// 创建目录
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		fmt.Println("Failed to create directory:", err)
+		return "", err
+	}
+
+	file, err := os.CreateTemp(dir, fmt.Sprintf(".%d-*", index))
+	if err != nil {
+		fmt.Println("Failed to create file:", err)
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// 创建 MD5 哈希计算器
+	hash := md5.New()
+
+	// 将数据复制到文件中，同时计算 MD5
+	writer := io.MultiWriter(file, hash)
+	n, err := io.Copy(writer, io.LimitReader(r, limit))
+	if err != nil {
+		fmt.Println("Failed to copy data:", err)
+		return "", err
+	}
+
+	// 计算最终的 MD5 哈希值
+	calculatedMd5 := hex.EncodeToString(hash.Sum(nil))
+	if err := check(n, calculatedMd5); err != nil {
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return "", err
+	}
+	return calculatedMd5, nil
+}
+
+// UploadStatus 返回会话的分片接收情况，客户端断线重连后据此续传
+func (f *fileService) UploadStatus(ctx context.Context, userId string, sessionId string) (domain.UploadSession, error) {
+	return f.findSession(ctx, userId, sessionId)
+}
+
+// CompleteUpload 确认所有分片都已收到后合并分片，校验整个文件的摘要，
+// 然后把文件提交到用户的目录树中，返回文件最终所在的路径
+func (f *fileService) CompleteUpload(ctx *gin.Context, userId string, sessionId string) (string, error) {
+	session, err := f.findSession(ctx, userId, sessionId)
+	if err != nil {
+		return "", err
+	}
+	if missing := session.Missing(); len(missing) > 0 {
+		return "", fmt.Errorf("还有 %d 个分片没有上传", len(missing))
+	}
+	if _, err := f.CheckIfFileExists(userId, session.Path); err == nil && session.Conflict == string(ufs.ConflictFail) {
+		return "", ierrors.WithCode(code.ErrFileExists, "存在同名文件: %s", session.Path)
+	}
+
+	// 合并分片，写入 blob 存储时校验整个文件的摘要
+	chunks := newChunkReader(chunkDir(sessionId), session.TotalChunks)
+	defer chunks.Close()
+	info, err := f.blobs.Put(session.Digest, chunks)
+	if err != nil {
+		fmt.Println("Failed to merge chunks:", err)
+		return "", err
+	}
+
+	path, err := f.commit(ctx, session, info)
+	if err != nil {
+		return "", err
+	}
+
+	// 文件已经提交，会话和分片都不再需要
+	if err := f.sessions.Delete(ctx, sessionId); err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(chunkDir(sessionId)); err != nil {
+		return "", err
+	}
+	fmt.Println("File merge completed successfully:", path, info.Digest, info.Size)
+	return path, nil
+}
+
+// commit 按会话的冲突策略把 blob 链接到会话的目标路径。创建会话时按客户端声明的大小检查过配额，
+// 这期间用量可能已经变化，声明的大小也不可信，所以按实际大小再检查一次
+func (f *fileService) commit(ctx context.Context, session domain.UploadSession, info blob.Info) (string, error) {
+	if err := f.checkQuota(ctx, session.UserId, session.Path, ufs.ConflictPolicy(session.Conflict), info.Size); err != nil {
+		return "", err
+	}
+	mimeType, err := detectMimeType(f.blobs, session.Path, info.Digest)
+	if err != nil {
+		return "", err
+	}
+	ref := ufs.BlobRef{
+		Digest:   info.Digest,
+		Size:     info.Size,
+		MimeType: mimeType,
+		ModTime:  time.Now(),
+		Uploader: session.UserId,
+	}
+	return f.um.User(session.UserId).Commit(session.Path, ref, ufs.ConflictPolicy(session.Conflict))
+}
+
+// checkQuota 检查把 size 字节上传到 path 之后是否超出配额。
+// 覆盖时原来的内容成为历史版本，仍然计入用量，只是不多占一个文件
+func (f *fileService) checkQuota(ctx context.Context, userId string, path string, policy ufs.ConflictPolicy, size int64) error {
+	files := int64(1)
+	if _, err := f.CheckIfFileExists(userId, path); err == nil && policy == ufs.ConflictOverwrite {
+		files = 0
+	}
+	return f.quotas.Check(ctx, userId, size, files)
+}
+
+// findSession 查找属于 userId 且没有过期的上传会话
+func (f *fileService) findSession(ctx context.Context, userId string, sessionId string) (domain.UploadSession, error) {
+	session, err := f.sessions.FindById(ctx, sessionId)
+	if errors.Is(err, repository.ErrUploadSessionNotFound) {
+		return domain.UploadSession{}, fmt.Errorf("上传会话不存在: %s", sessionId)
+	}
+	if err != nil {
+		return domain.UploadSession{}, err
+	}
+	if session.UserId != userId {
+		return domain.UploadSession{}, fmt.Errorf("上传会话不属于当前用户")
+	}
+	if time.Now().After(session.Expire) {
+		return domain.UploadSession{}, fmt.Errorf("上传会话已过期")
+	}
+	return session, nil
+}
+
+// chunkDir 返回会话存放分片的目录
+func chunkDir(sessionId string) string {
+	return fmt.Sprintf("./tmp/%s", sessionId)
+}
+
+func chunkPath(sessionId string, chunkIndex int) string {
+	return fmt.Sprintf("%s/%d", chunkDir(sessionId), chunkIndex)
+}
+
+// chunkReader 按顺序读取 directory 下编号为 indices 的分片，
+// 每次只打开一个分片文件
+type chunkReader struct {
+	directory string
+	indices   []int
+	next      int
+	current   *os.File
+}
+
+// newChunkReader 读取编号为 0..totalChunks-1 的分片
+func newChunkReader(directory string, totalChunks int) *chunkReader {
+	indices := make([]int, totalChunks)
+	for i := range indices {
+		indices[i] = i
+	}
+	return &chunkReader{directory: directory, indices: indices}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.next >= len(r.indices) {
+				return 0, io.EOF
+			}
+			chunkFilePath := fmt.Sprintf("%s/%d", r.directory, r.indices[r.next])
+			chunkFile, err := os.Open(chunkFilePath)
+			if err != nil {
+				return 0, fmt.Errorf("Failed to open chunk file %s: %v", chunkFilePath, err)
+			}
+			r.current = chunkFile
+			r.next++
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			// 当前分片读完，继续读下一个分片
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
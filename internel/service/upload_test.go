@@ -0,0 +1,271 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+)
+
+// chdirTemp 切换到临时目录，分片保存在工作目录下的 ./tmp 中
+func chdirTemp(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Error getting working directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Error changing working directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// answer 按客户端的方式回答挑战
+func answer(c *domain.UploadChallenge, content string) string {
+	hash := sha256.New()
+	hash.Write([]byte(c.Nonce))
+	hash.Write([]byte(content[c.Offset : c.Offset+c.Length]))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func TestInstantUpload(t *testing.T) {
+	chdirTemp(t)
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	ctx := context.Background()
+	const content = "content somebody else uploaded"
+	env.put(t, "u2", "/theirs.txt", content)
+
+	// 服务端有该内容，回答正确时不上传任何分片就能提交
+	plan, err := env.files.ValidateUpload(ctx, "u1", "a.txt", "/docs/", md5Hex(content), int64(len(content)), "")
+	if err != nil {
+		t.Fatalf("Error validating upload: %v", err)
+	}
+	if plan.Challenge == nil || plan.Challenge.Length != int64(len(content)) {
+		t.Fatalf("Expected a challenge over the whole file, got %+v", plan.Challenge)
+	}
+	path, err := env.files.InstantUpload(ctx, "u1", plan.Challenge.Id, answer(plan.Challenge, content))
+	if err != nil || path != "/docs/a.txt" {
+		t.Fatalf("Expected an instant upload to /docs/a.txt, got %s (%v)", path, err)
+	}
+	info, err := env.files.FileStat(ctx, "u1", "/docs/a.txt")
+	if err != nil || info.Digest != md5Hex(content) || info.Size != int64(len(content)) {
+		t.Fatalf("File metadata mismatch: %+v (%v)", info, err)
+	}
+	if _, err := env.files.UploadStatus(ctx, "u1", plan.SessionId); err == nil {
+		t.Fatalf("Expected the upload session to be gone")
+	}
+	if _, err := os.Stat(chunkDir(plan.SessionId)); !os.IsNotExist(err) {
+		t.Fatalf("Expected no chunk to be stored, got %v", err)
+	}
+
+	// 每个挑战只能回答一次
+	if _, err := env.files.InstantUpload(ctx, "u1", plan.Challenge.Id, answer(plan.Challenge, content)); err == nil {
+		t.Fatalf("Expected an answered challenge to be rejected")
+	}
+}
+
+func TestInstantUploadRejected(t *testing.T) {
+	chdirTemp(t)
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	ctx := context.Background()
+	const content = "content somebody else uploaded"
+	env.put(t, "u2", "/theirs.txt", content)
+
+	// 服务端没有的内容同样发出挑战，无论怎样回答都不会通过
+	const unknown = "content nobody uploaded"
+	plan, err := env.files.ValidateUpload(ctx, "u1", "b.txt", "/", md5Hex(unknown), int64(len(unknown)), "")
+	if err != nil {
+		t.Fatalf("Error validating upload: %v", err)
+	}
+	if plan.Challenge == nil || plan.SessionId == "" {
+		t.Fatalf("Expected an unknown digest to get a challenge and a session, got %+v", plan)
+	}
+	if _, err := env.files.InstantUpload(ctx, "u1", plan.Challenge.Id, answer(plan.Challenge, unknown)); err == nil {
+		t.Fatalf("Expected an unknown digest not to be uploaded instantly")
+	}
+	// 会话仍然可以用于分片上传
+	if _, err := env.files.UploadStatus(ctx, "u1", plan.SessionId); err != nil {
+		t.Fatalf("Expected the upload session to remain, got %v", err)
+	}
+
+	// 回答错误或由别的用户回答都被拒绝
+	plan, err = env.files.ValidateUpload(ctx, "u1", "c.txt", "/", md5Hex(content), int64(len(content)), "")
+	if err != nil {
+		t.Fatalf("Error validating upload: %v", err)
+	}
+	if _, err := env.files.InstantUpload(ctx, "u1", plan.Challenge.Id, answer(plan.Challenge, "content somebody else uploadeD")); err == nil {
+		t.Fatalf("Expected a wrong proof to be rejected")
+	}
+	plan, err = env.files.ValidateUpload(ctx, "u1", "c.txt", "/", md5Hex(content), int64(len(content)), "")
+	if err != nil {
+		t.Fatalf("Error validating upload: %v", err)
+	}
+	if _, err := env.files.InstantUpload(ctx, "u3", plan.Challenge.Id, answer(plan.Challenge, content)); err == nil {
+		t.Fatalf("Expected a challenge of another user to be rejected")
+	}
+	if _, err := env.files.FileStat(ctx, "u1", "/c.txt"); !isCode(err, code.ErrFileNotFound) {
+		t.Fatalf("Expected no file to be committed, got %v", err)
+	}
+
+	// 声明的大小和已有内容不一致时也不能秒传
+	plan, err = env.files.ValidateUpload(ctx, "u1", "d.txt", "/", md5Hex(content), int64(len(content))+1, "")
+	if err != nil {
+		t.Fatalf("Error validating upload: %v", err)
+	}
+	if _, err := env.files.InstantUpload(ctx, "u1", plan.Challenge.Id, answer(plan.Challenge, content+"x")); err == nil {
+		t.Fatalf("Expected a size mismatch not to be uploaded instantly")
+	}
+}
+
+func TestInstantUploadQuota(t *testing.T) {
+	chdirTemp(t)
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 2})
+	ctx := context.Background()
+	const content = "content somebody else uploaded"
+	env.put(t, "u2", "/theirs.txt", content)
+	env.put(t, "u1", "/one.txt", "one")
+
+	plan, err := env.files.ValidateUpload(ctx, "u1", "a.txt", "/", md5Hex(content), int64(len(content)), "")
+	if err != nil {
+		t.Fatalf("Error validating upload: %v", err)
+	}
+	// 创建会话之后用量变化，秒传提交时按当时的用量再检查一次
+	env.put(t, "u1", "/two.txt", "two")
+	_, err = env.files.InstantUpload(ctx, "u1", plan.Challenge.Id, answer(plan.Challenge, content))
+	if !isCode(err, code.ErrQuotaExceeded) {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if _, err := env.files.FileStat(ctx, "u1", "/a.txt"); !isCode(err, code.ErrFileNotFound) {
+		t.Fatalf("Expected no file to be committed, got %v", err)
+	}
+}
+
+// uploadChunk 以 HTTP 请求体的形式上传一个分片
+func uploadChunk(files FileService, userId, sessionId string, index int, chunk []byte, chunkMd5 string) error {
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/file/upload", bytes.NewReader(chunk))
+	return files.Upload(ctx, userId, sessionId, index, chunkMd5)
+}
+
+// newChunkedUpload 创建一个有三个分片的上传会话，最后一个分片不满
+func newChunkedUpload(t *testing.T, env *testEnv) (domain.UploadPlan, [][]byte) {
+	content := make([]byte, 2*ChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(content)
+	plan, err := env.files.ValidateUpload(context.Background(), "u1", "big.bin", "/", md5Hex(string(content)),
+		int64(len(content)), "")
+	if err != nil {
+		t.Fatalf("Error validating upload: %v", err)
+	}
+	return plan, [][]byte{content[:ChunkSize], content[ChunkSize : 2*ChunkSize], content[2*ChunkSize:]}
+}
+
+func TestUploadResume(t *testing.T) {
+	chdirTemp(t)
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	ctx := context.Background()
+	plan, chunks := newChunkedUpload(t, env)
+
+	// 乱序上传，缺失的分片按序号排列
+	for _, i := range []int{2, 0} {
+		if err := uploadChunk(env.files, "u1", plan.SessionId, i, chunks[i], md5Hex(string(chunks[i]))); err != nil {
+			t.Fatalf("Error uploading chunk %d: %v", i, err)
+		}
+	}
+	session, err := env.files.UploadStatus(ctx, "u1", plan.SessionId)
+	if err != nil {
+		t.Fatalf("Error reading upload status: %v", err)
+	}
+	if session.TotalChunks != 3 || session.Bitmap() != "101" || fmt.Sprint(session.Missing()) != "[1]" {
+		t.Fatalf("Status mismatch: %d chunks, bitmap %s, missing %v", session.TotalChunks, session.Bitmap(), session.Missing())
+	}
+	gctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if _, err := env.files.CompleteUpload(gctx, "u1", plan.SessionId); err == nil {
+		t.Fatalf("Expected completing with a missing chunk to fail")
+	}
+
+	// 重复上传同一分片只记一次
+	if err := uploadChunk(env.files, "u1", plan.SessionId, 0, chunks[0], md5Hex(string(chunks[0]))); err != nil {
+		t.Fatalf("Error uploading chunk 0 again: %v", err)
+	}
+	if session, _ := env.files.UploadStatus(ctx, "u1", plan.SessionId); session.Bitmap() != "101" {
+		t.Fatalf("Expected a duplicate chunk not to change the bitmap, got %s", session.Bitmap())
+	}
+
+	// 断线之后按状态补传缺失的分片
+	session, _ = env.files.UploadStatus(ctx, "u1", plan.SessionId)
+	for _, i := range session.Missing() {
+		if err := uploadChunk(env.files, "u1", plan.SessionId, i, chunks[i], md5Hex(string(chunks[i]))); err != nil {
+			t.Fatalf("Error uploading chunk %d: %v", i, err)
+		}
+	}
+	path, err := env.files.CompleteUpload(gctx, "u1", plan.SessionId)
+	if err != nil || path != "/big.bin" {
+		t.Fatalf("Expected the upload to complete at /big.bin, got %s (%v)", path, err)
+	}
+	info, err := env.files.FileStat(ctx, "u1", "/big.bin")
+	if err != nil || info.Size != 2*ChunkSize+100 {
+		t.Fatalf("File metadata mismatch: %+v (%v)", info, err)
+	}
+	if _, err := os.Stat(chunkDir(plan.SessionId)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the chunks to be removed, got %v", err)
+	}
+}
+
+func TestUploadChunkRejected(t *testing.T) {
+	chdirTemp(t)
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	ctx := context.Background()
+	plan, chunks := newChunkedUpload(t, env)
+	if err := uploadChunk(env.files, "u1", plan.SessionId, 0, chunks[0], md5Hex(string(chunks[0]))); err != nil {
+		t.Fatalf("Error uploading chunk 0: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		index int
+		chunk []byte
+		md5   string
+	}{
+		{name: "negative index", index: -1, chunk: chunks[0], md5: md5Hex(string(chunks[0]))},
+		{name: "index past the end", index: 3, chunk: chunks[2], md5: md5Hex(string(chunks[2]))},
+		{name: "short chunk", index: 1, chunk: chunks[1][1:], md5: md5Hex(string(chunks[1][1:]))},
+		{name: "long last chunk", index: 2, chunk: append(bytes.Clone(chunks[2]), 'x'), md5: md5Hex(string(chunks[2]) + "x")},
+		{name: "full chunk as last", index: 2, chunk: chunks[0], md5: md5Hex(string(chunks[0]))},
+		{name: "md5 mismatch", index: 1, chunk: chunks[1], md5: md5Hex(string(chunks[0]))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := uploadChunk(env.files, "u1", plan.SessionId, tt.index, tt.chunk, tt.md5); err == nil {
+				t.Fatalf("Expected the chunk to be rejected")
+			}
+		})
+	}
+
+	// 被拒绝的分片不会记录，也不会替换已收到的分片
+	session, err := env.files.UploadStatus(ctx, "u1", plan.SessionId)
+	if err != nil || session.Bitmap() != "100" || session.ChunkMd5s[0] != md5Hex(string(chunks[0])) {
+		t.Fatalf("Expected only chunk 0 to be received, got %s %v (%v)", session.Bitmap(), session.ChunkMd5s, err)
+	}
+	stored, err := os.ReadFile(chunkPath(plan.SessionId, 0))
+	if err != nil || !bytes.Equal(stored, chunks[0]) {
+		t.Fatalf("Expected chunk 0 to be kept (%v)", err)
+	}
+	entries, _ := os.ReadDir(chunkDir(plan.SessionId))
+	if len(entries) != 1 {
+		t.Fatalf("Expected no partial chunk to be left, got %d files", len(entries))
+	}
+
+	// 别的用户不能向会话上传
+	if err := uploadChunk(env.files, "u2", plan.SessionId, 1, chunks[1], md5Hex(string(chunks[1]))); err == nil {
+		t.Fatalf("Expected another user not to upload into the session")
+	}
+}
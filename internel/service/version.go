@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+	"github.com/lvow2022/udisk/pkg/log"
+)
+
+// ListVersions 列出文件的历史版本，最近的排在前面
+func (f *fileService) ListVersions(ctx context.Context, userId string, path string) ([]domain.FileVersion, error) {
+	versions, err := f.um.User(userId).Versions(path)
+	if err != nil {
+		return nil, pathError(path, err)
+	}
+	res := make([]domain.FileVersion, 0, len(versions))
+	for _, version := range versions {
+		res = append(res, domain.FileVersion{
+			Id:         version.ID,
+			Digest:     version.Digest,
+			Size:       version.Size,
+			Type:       version.MimeType,
+			Uploader:   version.Uploader,
+			ModTime:    version.ModTime,
+			ReplacedAt: version.CreatedAt,
+		})
+	}
+	return res, nil
+}
+
+// OpenVersion 打开文件的一个历史版本，供下载
+func (f *fileService) OpenVersion(ctx context.Context, userId string, path string, id uint) (*FileContent, error) {
+	version, err := f.um.User(userId).Version(path, id)
+	if err != nil {
+		return nil, versionError(path, id, err)
+	}
+	r, err := f.openBlob(version.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return &FileContent{
+		ReadSeekCloser: r,
+		Name:           filepath.Base(path),
+		Size:           version.Size,
+		MimeType:       version.MimeType,
+		Digest:         version.Digest,
+		ModTime:        version.ModTime,
+	}, nil
+}
+
+// RestoreVersion 把历史版本恢复为文件的当前内容，被替换的内容成为新的历史版本
+func (f *fileService) RestoreVersion(ctx context.Context, userId string, path string, id uint) (domain.FileMetadata, error) {
+	fs := f.um.User(userId)
+	if _, err := fs.RestoreVersion(path, id); err != nil {
+		return domain.FileMetadata{}, versionError(path, id, err)
+	}
+	return f.metadata(fs, userId, filepath.Join("/", path))
+}
+
+func versionError(path string, id uint, err error) error {
+	if errors.Is(err, ufs.ErrVersionNotFound) {
+		return ierrors.WithCode(code.ErrFileNotFound, "%s 没有版本 %d", path, id)
+	}
+	return pathError(path, err)
+}
+
+// VersionReport 描述一次历史版本清理的结果
+type VersionReport struct {
+	Pruned    int           `json:"pruned"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+}
+
+type VersionService interface {
+	// Prune 按保留策略删除多余和过期的历史版本
+	Prune(ctx context.Context) (VersionReport, error)
+	// Start 在后台周期性执行 Prune，直到 ctx 结束
+	Start(ctx context.Context, interval time.Duration)
+}
+
+type versionService struct {
+	pruner    ufs.VersionPruner
+	keep      int
+	retention time.Duration
+}
+
+// NewVersionService 创建历史版本清理服务，每个文件最多保留 keep 个历史版本，
+// 被替换超过 retention 的版本会被删除，为 0 时不按该条件清理
+func NewVersionService(pruner ufs.VersionPruner, keep int, retention time.Duration) VersionService {
+	return &versionService{
+		pruner:    pruner,
+		keep:      keep,
+		retention: retention,
+	}
+}
+
+func (v *versionService) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := v.Prune(ctx)
+			if err != nil {
+				log.Errorf("version prune failed: %v", err)
+				continue
+			}
+			log.Infof("version prune removed %d versions", report.Pruned)
+		}
+	}
+}
+
+func (v *versionService) Prune(ctx context.Context) (VersionReport, error) {
+	report := VersionReport{StartedAt: time.Now()}
+	var before time.Time
+	if v.retention > 0 {
+		before = report.StartedAt.Add(-v.retention)
+	}
+	pruned, err := v.pruner.Prune(v.keep, before)
+	report.Pruned = pruned
+	report.Duration = time.Since(report.StartedAt)
+	return report, err
+}
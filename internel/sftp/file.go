@@ -0,0 +1,138 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/lvow2022/udisk/internel/service"
+)
+
+// maxPendingBytes 最多缓存的乱序写入。github.com/pkg/sftp 用多个 goroutine 并发
+// 处理读写请求，客户端流水线发出的写请求可能乱序到达，而 service.File 不允许
+// 留下空洞，超过结尾的写入先缓存，前面的内容到达后再写入。OpenSSH 最多同时
+// 发出 64 个 32KiB 的写请求
+const maxPendingBytes = 16 << 20
+
+// file 把 service.File 适配为 io.ReaderAt 和 io.WriterAt
+type file struct {
+	mu     sync.Mutex
+	f      service.File
+	cancel context.CancelFunc
+	// append 为 true 时每次都写到文件末尾，忽略请求中的偏移量
+	append bool
+	// offset 是 f 当前的读写位置，与请求的偏移量相同时不需要 Seek
+	offset int64
+	// size 是 f 中内容的长度
+	size int64
+	// pending 是超过 size 的写入，按偏移量保存
+	pending      map[int64][]byte
+	pendingBytes int
+}
+
+func newFile(f service.File, size int64, append bool, cancel context.CancelFunc) *file {
+	return &file{
+		f:       f,
+		cancel:  cancel,
+		append:  append,
+		size:    size,
+		pending: make(map[int64][]byte),
+	}
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.seek(off); err != nil {
+		return 0, statusError(err)
+	}
+	n, err := io.ReadFull(f.f, p)
+	f.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, statusError(err)
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.append {
+		off = f.size
+	}
+	if off > f.size {
+		if f.pendingBytes+len(p) > maxPendingBytes {
+			return 0, fmt.Errorf("sftp: too many writes ahead of offset %d", f.size)
+		}
+		// p 在请求处理完之后会被复用
+		f.pending[off] = append([]byte(nil), p...)
+		f.pendingBytes += len(p)
+		return len(p), nil
+	}
+	if err := f.write(p, off); err != nil {
+		return 0, statusError(err)
+	}
+	return len(p), statusError(f.flush())
+}
+
+func (f *file) write(p []byte, off int64) error {
+	if err := f.seek(off); err != nil {
+		return err
+	}
+	n, err := f.f.Write(p)
+	f.offset += int64(n)
+	f.size = max(f.size, f.offset)
+	return err
+}
+
+// flush 写入已经和前面的内容相接的缓存
+func (f *file) flush() error {
+	for written := true; written; {
+		written = false
+		for off, p := range f.pending {
+			if off > f.size {
+				continue
+			}
+			delete(f.pending, off)
+			f.pendingBytes -= len(p)
+			if err := f.write(p, off); err != nil {
+				return err
+			}
+			written = true
+		}
+	}
+	return nil
+}
+
+func (f *file) seek(off int64) error {
+	if off == f.offset {
+		return nil
+	}
+	pos, err := f.f.Seek(off, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	f.offset = pos
+	return nil
+}
+
+// Close 提交写入的内容，限额不足等错误在这时返回。还有缓存的写入时
+// 文件中有空洞，丢弃写入的内容
+func (f *file) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.cancel()
+	if len(f.pending) > 0 {
+		f.cancel()
+		_ = f.f.Close()
+		return fmt.Errorf("sftp: missing data at offset %d", f.size)
+	}
+	return statusError(f.f.Close())
+}
+
+// TransferError 在连接意外断开、文件还没有关闭时调用。只写了一部分的文件不应该
+// 被提交，先取消 ctx，随后关闭时就不会提交
+func (f *file) TransferError(err error) {
+	f.cancel()
+}
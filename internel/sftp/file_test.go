@@ -0,0 +1,138 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// memFile 是内存中的 service.File，和 service 一样不允许写出空洞
+type memFile struct {
+	data   []byte
+	offset int64
+	closed bool
+}
+
+func (m *memFile) Read(p []byte) (int, error) {
+	if m.offset >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[m.offset:])
+	m.offset += int64(n)
+	return n, nil
+}
+
+func (m *memFile) Write(p []byte) (int, error) {
+	if m.offset > int64(len(m.data)) {
+		return 0, errors.New("hole")
+	}
+	end := m.offset + int64(len(p))
+	if end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	copy(m.data[m.offset:], p)
+	m.offset = end
+	return len(p), nil
+}
+
+func (m *memFile) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, errors.New("unsupported whence")
+	}
+	m.offset = offset
+	return offset, nil
+}
+
+func (m *memFile) Close() error {
+	m.closed = true
+	return nil
+}
+
+func (m *memFile) Readdir(int) ([]os.FileInfo, error) { return nil, nil }
+
+func (m *memFile) Stat() (os.FileInfo, error) { return nil, nil }
+
+func TestFileWriteOutOfOrder(t *testing.T) {
+	m := &memFile{}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := newFile(m, 0, false, cancel)
+
+	// 按 2、0、3、1 的顺序到达
+	chunks := [][]byte{[]byte("aaa"), []byte("bbb"), []byte("ccc"), []byte("ddd")}
+	for _, i := range []int{2, 0, 3, 1} {
+		if n, err := f.WriteAt(chunks[i], int64(i*3)); err != nil || n != 3 {
+			t.Fatalf("Error writing chunk %d: %d (%v)", i, n, err)
+		}
+		// 调用方会复用缓冲区
+		copy(chunks[i], "xxx")
+	}
+	if f.pendingBytes != 0 || len(f.pending) != 0 {
+		t.Fatalf("Expected nothing pending, got %d bytes", f.pendingBytes)
+	}
+	if got := string(m.data); got != "aaabbbcccddd" {
+		t.Fatalf("Expected aaabbbcccddd, got %s", got)
+	}
+	b := make([]byte, 4)
+	if n, err := f.ReadAt(b, 10); err != io.EOF || string(b[:n]) != "dd" {
+		t.Fatalf("Expected dd and EOF, got %q (%v)", b[:n], err)
+	}
+	if err := f.Close(); err != nil || !m.closed {
+		t.Fatalf("Error closing: %v", err)
+	}
+	if ctx.Err() == nil {
+		t.Fatal("Expected the context to be canceled after close")
+	}
+}
+
+func TestFileWriteAppend(t *testing.T) {
+	m := &memFile{data: []byte("head")}
+	f := newFile(m, 4, true, func() {})
+	// 追加模式忽略偏移量
+	if _, err := f.WriteAt([]byte("tail"), 100); err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("!"), 0); err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	if got := string(m.data); got != "headtail!" {
+		t.Fatalf("Expected headtail!, got %s", got)
+	}
+}
+
+func TestFileMissingData(t *testing.T) {
+	m := &memFile{}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := newFile(m, 0, false, cancel)
+	if _, err := f.WriteAt([]byte("later"), 10); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if len(m.data) != 0 {
+		t.Fatalf("Expected the write to be held back, got %q", m.data)
+	}
+	// 提交之前取消，文件不会被提交
+	if err := f.Close(); err == nil {
+		t.Fatal("Expected closing with a hole to fail")
+	}
+	if ctx.Err() == nil || !m.closed {
+		t.Fatal("Expected the file to be closed with a canceled context")
+	}
+}
+
+func TestFilePendingLimit(t *testing.T) {
+	f := newFile(&memFile{}, 0, false, func() {})
+	p := bytes.Repeat([]byte("x"), 1<<20)
+	for off := int64(1); ; off += int64(len(p)) {
+		if _, err := f.WriteAt(p, off); err != nil {
+			break
+		}
+		if f.pendingBytes > maxPendingBytes {
+			t.Fatalf("Expected at most %d pending bytes, got %d", maxPendingBytes, f.pendingBytes)
+		}
+	}
+	if f.pendingBytes != maxPendingBytes {
+		t.Fatalf("Expected the limit to be reached, got %d", f.pendingBytes)
+	}
+}
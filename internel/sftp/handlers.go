@@ -0,0 +1,183 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/internel/service"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+	pkgsftp "github.com/pkg/sftp"
+)
+
+// handlers 实现 github.com/pkg/sftp 的 Handlers，把请求转给用户的 service.FileSystem。
+// 请求中的路径已经在 / 下清理过，用户的目录树就是根
+type handlers struct {
+	fs service.FileSystem
+}
+
+func newHandlers(fs service.FileSystem) pkgsftp.Handlers {
+	h := &handlers{fs: fs}
+	return pkgsftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+func (h *handlers) Fileread(r *pkgsftp.Request) (io.ReaderAt, error) {
+	f, err := h.open(r, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (h *handlers) Filewrite(r *pkgsftp.Request) (io.WriterAt, error) {
+	f, err := h.open(r, os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenFile 打开同时读写的文件
+func (h *handlers) OpenFile(r *pkgsftp.Request) (pkgsftp.WriterAtReaderAt, error) {
+	f, err := h.open(r, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (h *handlers) open(r *pkgsftp.Request, flag int) (*file, error) {
+	pflags := r.Pflags()
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	// 写入的文件关闭之前取消 ctx 就不会提交，见 file.TransferError
+	ctx, cancel := context.WithCancel(r.Context())
+	f, err := h.fs.OpenFile(ctx, r.Filepath, flag, 0644)
+	if err != nil {
+		cancel()
+		return nil, statusError(err)
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = &os.PathError{Op: "open", Path: r.Filepath, Err: ufs.ErrIsDirectory}
+	}
+	if err != nil {
+		cancel()
+		_ = f.Close()
+		return nil, statusError(err)
+	}
+	return newFile(f, info.Size(), pflags.Append, cancel), nil
+}
+
+func (h *handlers) Filecmd(r *pkgsftp.Request) error {
+	ctx := r.Context()
+	switch r.Method {
+	case "Setstat":
+		// 权限和时间由服务器决定，客户端的设置被忽略，否则 put -p 等会失败
+		return nil
+	case "Rename":
+		return statusError(h.fs.Rename(ctx, r.Filepath, r.Target))
+	case "Mkdir":
+		return statusError(h.fs.Mkdir(ctx, r.Filepath, 0755))
+	case "Remove":
+		return statusError(h.remove(ctx, r.Filepath, false))
+	case "Rmdir":
+		return statusError(h.remove(ctx, r.Filepath, true))
+	}
+	// 不支持链接
+	return pkgsftp.ErrSSHFxOpUnsupported
+}
+
+// remove 删除文件或空目录，和网页上删除一样移入回收站
+func (h *handlers) remove(ctx context.Context, name string, dir bool) error {
+	info, err := h.fs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case dir && !info.IsDir():
+		return &os.PathError{Op: "rmdir", Path: name, Err: ufs.ErrNotDirectory}
+	case !dir && info.IsDir():
+		return &os.PathError{Op: "remove", Path: name, Err: ufs.ErrIsDirectory}
+	case dir:
+		f, err := h.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		children, err := f.Readdir(1)
+		_ = f.Close()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(children) > 0 {
+			return &os.PathError{Op: "rmdir", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	return h.fs.RemoveAll(ctx, name)
+}
+
+func (h *handlers) Filelist(r *pkgsftp.Request) (pkgsftp.ListerAt, error) {
+	ctx := r.Context()
+	switch r.Method {
+	case "List":
+		f, err := h.fs.OpenFile(ctx, r.Filepath, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		defer f.Close()
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		// 没有符号链接，Lstat 也按 Stat 处理
+		info, err := h.fs.Stat(ctx, r.Filepath)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		return listerAt{info}, nil
+	}
+	return nil, pkgsftp.ErrSSHFxOpUnsupported
+}
+
+// listerAt 是一次读出的目录
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// statusError 把错误转换成 github.com/pkg/sftp 能识别的错误。它只用 os.IsNotExist
+// 判断文件不存在，不会解开用 %w 包装的错误。带错误码的错误没有消息，使用错误码的
+// 说明，例如限额不足
+func statusError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist):
+		return pkgsftp.ErrSSHFxNoSuchFile
+	case errors.Is(err, fs.ErrPermission):
+		return pkgsftp.ErrSSHFxPermissionDenied
+	case err.Error() == "":
+		return errors.New(ierrors.ParseCoder(err).String())
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/service"
+	"github.com/lvow2022/udisk/pkg/ginx/errors"
+	"github.com/lvow2022/udisk/pkg/log"
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// userIdExtension 认证通过后在 ssh.Permissions 中保存用户 ID
+const userIdExtension = "udisk-user-id"
+
+// Server 是内嵌的 SSH 服务器，只提供 sftp 子系统，协议由 github.com/pkg/sftp
+// 处理。用户名是邮箱，用密码或者登记过的公钥登录，每个用户看到的是自己的整个
+// 目录树。文件操作和 WebDAV 使用同一个 service.FileSystem，写入的内容同样存入
+// blob 存储并检查限额
+type Server struct {
+	addr   string
+	files  service.FileSystemService
+	usrSvc service.UserService
+	keySvc service.SSHKeyService
+	config *ssh.ServerConfig
+}
+
+func NewServer(addr string, hostKey ssh.Signer, files service.FileSystemService, usrSvc service.UserService,
+	keySvc service.SSHKeyService) *Server {
+	s := &Server{
+		addr:   addr,
+		files:  files,
+		usrSvc: usrSvc,
+		keySvc: keySvc,
+	}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback:  s.checkPassword,
+		PublicKeyCallback: s.checkPublicKey,
+	}
+	s.config.AddHostKey(hostKey)
+	return s
+}
+
+func (s *Server) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	u, err := s.usrSvc.Login(context.Background(), conn.User(), string(password))
+	if err != nil {
+		return nil, err
+	}
+	return permissions(u.Id)
+}
+
+// checkPublicKey 公钥必须登记在用户名对应的用户下
+func (s *Server) checkPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	ctx := context.Background()
+	k, err := s.keySvc.Find(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseInt(k.UserId, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	u, err := s.usrSvc.FindById(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if u.Email != conn.User() {
+		return nil, fmt.Errorf("公钥 %s 不属于 %s", k.Fingerprint, conn.User())
+	}
+	return permissions(u.Id)
+}
+
+func permissions(uid int64) (*ssh.Permissions, error) {
+	if uid <= 0 {
+		return nil, errors.WithCode(code.ErrPermissionDenied, "用户 %d 无权访问文件", uid)
+	}
+	return &ssh.Permissions{
+		Extensions: map[string]string{userIdExtension: strconv.FormatInt(uid, 10)},
+	}, nil
+}
+
+// ListenAndServe 监听 addr 并处理连接，直到监听出错
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		// 认证失败或者客户端中途断开，很常见，不记录
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	userId := sconn.Permissions.Extensions[userIdExtension]
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			_ = newChan.Reject(ssh.UnknownChannelType, "只支持 session")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			log.Errorf("sftp: failed to accept channel for user %s: %v", userId, err)
+			continue
+		}
+		go s.serveChannel(userId, ch, requests)
+	}
+}
+
+// serveChannel 只接受 sftp 子系统，不提供 shell 和命令执行
+func (s *Server) serveChannel(userId string, ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range requests {
+		var subsystem struct {
+			Name string
+		}
+		ok := req.Type == "subsystem" && ssh.Unmarshal(req.Payload, &subsystem) == nil && subsystem.Name == "sftp"
+		if req.WantReply {
+			_ = req.Reply(ok, nil)
+		}
+		if !ok {
+			continue
+		}
+
+		go ssh.DiscardRequests(requests)
+		// 连接断开时没有关闭的文件被丢弃而不是提交，见 file.TransferError
+		srv := pkgsftp.NewRequestServer(ch, newHandlers(s.files.FileSystem(userId)))
+		status := uint32(0)
+		if err := srv.Serve(); err != nil && err != io.EOF {
+			log.Errorf("sftp: session for user %s failed: %v", userId, err)
+			status = 1
+		}
+		_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
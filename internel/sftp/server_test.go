@@ -0,0 +1,495 @@
+package sftp
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/internel/repository"
+	"github.com/lvow2022/udisk/internel/repository/dao"
+	"github.com/lvow2022/udisk/internel/service"
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testServer 是监听本地端口的 Server 和它使用的服务
+type testServer struct {
+	addr  string
+	um    ufs.UserManager
+	users service.UserService
+	keys  service.SSHKeyService
+	// spool 是写入的文件使用的临时目录
+	spool string
+}
+
+func newTestServer(t *testing.T, quota domain.Quota) *testServer {
+	// 写入的文件先保存在 os.TempDir 下，据此判断连接断开后是否已经清理
+	spool := t.TempDir()
+	t.Setenv("TMPDIR", spool)
+
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := ufs.InitTables(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	if err := dao.InitTables(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	blobs, err := blob.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create blob store: %v", err)
+	}
+	um := ufs.NewUserManager(ufs.GormPersistors(db))
+	quotas := service.NewQuotaService(um, quota)
+	users := service.NewUserService(repository.NewUserRepository(dao.NewUserDAO(db)))
+	keys := service.NewSSHKeyService(repository.NewSSHKeyRepository(dao.NewSSHKeyDAO(db)))
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("Error creating host key: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go NewServer("", signer, service.NewFileSystemService(um, blobs, quotas), users, keys).Serve(l)
+	return &testServer{addr: l.Addr().String(), um: um, users: users, keys: keys, spool: spool}
+}
+
+// signup 注册一个用户并返回它的 ID
+func (s *testServer) signup(t *testing.T, email, password string) string {
+	ctx := context.Background()
+	if err := s.users.Signup(ctx, domain.User{Email: email, Password: password}); err != nil {
+		t.Fatalf("Error signing up %s: %v", email, err)
+	}
+	u, err := s.users.Login(ctx, email, password)
+	if err != nil {
+		t.Fatalf("Error logging in %s: %v", email, err)
+	}
+	return strconv.FormatInt(u.Id, 10)
+}
+
+func (s *testServer) dial(user string, auth ssh.AuthMethod) (*ssh.Client, error) {
+	return ssh.Dial("tcp", s.addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// connect 用密码登录并打开 sftp 子系统
+func (s *testServer) connect(t *testing.T, email, password string, opts ...pkgsftp.ClientOption) *pkgsftp.Client {
+	conn, err := s.dial(email, ssh.Password(password))
+	if err != nil {
+		t.Fatalf("Error connecting as %s: %v", email, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c, err := pkgsftp.NewClient(conn, opts...)
+	if err != nil {
+		t.Fatalf("Error starting sftp: %v", err)
+	}
+	return c
+}
+
+// waitSpool 等待服务器删除所有临时文件，即所有打开的文件都已经关闭
+func (s *testServer) waitSpool(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := os.ReadDir(s.spool)
+		if err != nil {
+			t.Fatalf("Error reading spool: %v", err)
+		}
+		if len(entries) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the spool to be cleaned up, got %d files", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// isStatus 判断 err 是否是错误码为 code 的 SSH_FXP_STATUS
+func isStatus(err error, code uint32) bool {
+	var se *pkgsftp.StatusError
+	return errors.As(err, &se) && se.Code == code
+}
+
+// 客户端把 SSH_FX_NO_SUCH_FILE 转换成 os.ErrNotExist，其他错误保留错误码
+const fxFailure = 4
+
+// writeFile 创建或者截断文件，每次写入 chunk 个字节
+func writeFile(c *pkgsftp.Client, name, content string, chunk int) error {
+	f, err := c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(content); offset += chunk {
+		end := min(offset+chunk, len(content))
+		if _, err := f.Write([]byte(content[offset:end])); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func readFile(c *pkgsftp.Client, name string) (string, error) {
+	f, err := c.Open(name)
+	if err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	return string(b), f.Close()
+}
+
+// readdir 列出目录中的文件名，按名称排序
+func readdir(c *pkgsftp.Client, name string) ([]string, error) {
+	infos, err := c.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func TestServerAuth(t *testing.T) {
+	s := newTestServer(t, domain.Quota{MaxBytes: 1 << 20, MaxFiles: 100})
+	uid := s.signup(t, "alice@example.com", "secret")
+	s.signup(t, "bob@example.com", "secret")
+
+	if _, err := s.dial("alice@example.com", ssh.Password("wrong")); err == nil {
+		t.Fatal("Expected a wrong password to be rejected")
+	}
+	if _, err := s.dial("carol@example.com", ssh.Password("secret")); err == nil {
+		t.Fatal("Expected an unknown user to be rejected")
+	}
+
+	// 公钥只能用来登录登记它的用户
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("Error creating key: %v", err)
+	}
+	if _, err := s.dial("alice@example.com", ssh.PublicKeys(signer)); err == nil {
+		t.Fatal("Expected an unregistered key to be rejected")
+	}
+	if _, err := s.keys.Add(context.Background(), uid, "laptop", string(ssh.MarshalAuthorizedKey(signer.PublicKey()))); err != nil {
+		t.Fatalf("Error adding key: %v", err)
+	}
+	if _, err := s.dial("bob@example.com", ssh.PublicKeys(signer)); err == nil {
+		t.Fatal("Expected alice's key to be rejected for bob")
+	}
+	conn, err := s.dial("alice@example.com", ssh.PublicKeys(signer))
+	if err != nil {
+		t.Fatalf("Error logging in with a key: %v", err)
+	}
+	defer conn.Close()
+
+	// 只提供 sftp 子系统
+	sess, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("Error opening session: %v", err)
+	}
+	if err := sess.Shell(); err == nil {
+		t.Fatal("Expected a shell to be refused")
+	}
+	if err := sess.RequestSubsystem("other"); err == nil {
+		t.Fatal("Expected an unknown subsystem to be refused")
+	}
+	c, err := pkgsftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Error starting sftp: %v", err)
+	}
+	if names, err := readdir(c, "/"); err != nil || len(names) != 0 {
+		t.Fatalf("Expected an empty root, got %v (%v)", names, err)
+	}
+}
+
+func TestServerFiles(t *testing.T) {
+	s := newTestServer(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 100})
+	uid := s.signup(t, "alice@example.com", "secret")
+	c := s.connect(t, "alice@example.com", "secret")
+
+	if err := c.Mkdir("/docs"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	// 大于一次读写请求的长度
+	large := strings.Repeat("0123456789", 30000)
+	if err := writeFile(c, "/docs/large.txt", large, 32<<10); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if got, err := readFile(c, "/docs/large.txt"); err != nil || got != large {
+		t.Fatalf("Content mismatch: %d bytes (%v)", len(got), err)
+	}
+	if info, err := c.Stat("/docs/large.txt"); err != nil || info.Size() != int64(len(large)) || !info.Mode().IsRegular() {
+		t.Fatalf("Stat mismatch: %+v (%v)", info, err)
+	}
+	if info, err := c.Stat("/docs"); err != nil || !info.IsDir() {
+		t.Fatalf("Expected a directory, got %+v (%v)", info, err)
+	}
+	info, err := s.um.User(uid).Stat("/docs/large.txt")
+	if err != nil || info.Size != int64(len(large)) {
+		t.Fatalf("Expected the file to be committed, got %+v (%v)", info, err)
+	}
+
+	// 覆盖已有文件的一部分，再追加
+	f, err := c.OpenFile("/docs/large.txt", os.O_WRONLY)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	if _, err := f.Write([]byte("ABC")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	f, err = c.OpenFile("/docs/large.txt", os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("END"), 0); err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	want := "ABC" + large[3:] + "END"
+	if got, err := readFile(c, "/docs/large.txt"); err != nil || got != want {
+		t.Fatalf("Content mismatch after partial writes: %d bytes (%v)", len(got), err)
+	}
+
+	// 同时读写
+	f, err = c.OpenFile("/docs/large.txt", os.O_RDWR)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	b := make([]byte, 3)
+	if _, err := f.ReadAt(b, 0); err != nil || string(b) != "ABC" {
+		t.Fatalf("Expected ABC, got %q (%v)", b, err)
+	}
+	if _, err := f.WriteAt([]byte("xyz"), 0); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	want = "xyz" + want[3:]
+	if got, err := readFile(c, "/docs/large.txt"); err != nil || got != want {
+		t.Fatalf("Content mismatch after reading and writing: %d bytes (%v)", len(got), err)
+	}
+
+	// 不能在文件中留下空洞，关闭时失败并保留原来的内容
+	f, err = c.OpenFile("/docs/large.txt", os.O_WRONLY)
+	if err != nil {
+		t.Fatalf("Error opening: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("x"), int64(len(want))+10); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := f.Close(); !isStatus(err, fxFailure) {
+		t.Fatalf("Expected a file with a hole to fail, got %v", err)
+	}
+	if got, err := readFile(c, "/docs/large.txt"); err != nil || got != want {
+		t.Fatalf("Expected the content to be kept, got %d bytes (%v)", len(got), err)
+	}
+
+	if err := writeFile(c, "/docs/a.txt", "hello", 2); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if _, err := c.OpenFile("/docs/a.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL); !isStatus(err, fxFailure) {
+		t.Fatalf("Expected O_EXCL to fail on an existing file, got %v", err)
+	}
+	if err := c.Rename("/docs/a.txt", "/docs/b.txt"); err != nil {
+		t.Fatalf("Error renaming: %v", err)
+	}
+	if got, err := readFile(c, "/docs/b.txt"); err != nil || got != "hello" {
+		t.Fatalf("Content mismatch after rename: %q (%v)", got, err)
+	}
+	if _, err := c.Open("/docs/a.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the old name to be gone, got %v", err)
+	}
+	if err := c.Mkdir("/docs/sub"); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+	if names, err := readdir(c, "/docs"); err != nil || strings.Join(names, ",") != "b.txt,large.txt,sub" {
+		t.Fatalf("Listing mismatch: %v (%v)", names, err)
+	}
+
+	// 目录和文件不能混用
+	if _, err := c.Open("/docs"); !isStatus(err, fxFailure) {
+		t.Fatalf("Expected opening a directory to fail, got %v", err)
+	}
+	if _, err := c.ReadDir("/docs/b.txt"); !isStatus(err, fxFailure) {
+		t.Fatalf("Expected listing a file to fail, got %v", err)
+	}
+	if err := c.RemoveDirectory("/docs/b.txt"); !isStatus(err, fxFailure) {
+		t.Fatalf("Expected removing a file as a directory to fail, got %v", err)
+	}
+	if err := c.Remove("/docs"); !isStatus(err, fxFailure) {
+		t.Fatalf("Expected removing a non-empty directory to fail, got %v", err)
+	}
+
+	if err := c.Remove("/docs/b.txt"); err != nil {
+		t.Fatalf("Error removing: %v", err)
+	}
+	if err := c.RemoveDirectory("/docs/sub"); err != nil {
+		t.Fatalf("Error removing directory: %v", err)
+	}
+	if _, err := c.Stat("/docs/b.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the file to be removed, got %v", err)
+	}
+	if err := c.Remove("/docs/b.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected removing a missing file to fail, got %v", err)
+	}
+	if names, err := readdir(c, "/docs"); err != nil || strings.Join(names, ",") != "large.txt" {
+		t.Fatalf("Listing mismatch after remove: %v (%v)", names, err)
+	}
+	if _, err := c.ReadLink("/docs/large.txt"); err == nil {
+		t.Fatal("Expected links to be unsupported")
+	}
+}
+
+// TestServerConcurrentWrites 客户端并发发出的写请求在服务器上乱序到达
+func TestServerConcurrentWrites(t *testing.T) {
+	s := newTestServer(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 100})
+	uid := s.signup(t, "alice@example.com", "secret")
+	c := s.connect(t, "alice@example.com", "secret", pkgsftp.UseConcurrentWrites(true), pkgsftp.MaxPacket(4<<10))
+
+	content := make([]byte, 3<<20)
+	mrand.New(mrand.NewSource(1)).Read(content)
+	f, err := c.Create("/random.bin")
+	if err != nil {
+		t.Fatalf("Error creating: %v", err)
+	}
+	if _, err := f.ReadFrom(strings.NewReader(string(content))); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	if got, err := readFile(c, "/random.bin"); err != nil || got != string(content) {
+		t.Fatalf("Content mismatch: %d bytes (%v)", len(got), err)
+	}
+	if info, err := s.um.User(uid).Stat("/random.bin"); err != nil || info.Size != int64(len(content)) {
+		t.Fatalf("Expected the file to be committed, got %+v (%v)", info, err)
+	}
+	s.waitSpool(t)
+}
+
+func TestServerQuota(t *testing.T) {
+	s := newTestServer(t, domain.Quota{MaxBytes: 100, MaxFiles: 100})
+	uid := s.signup(t, "alice@example.com", "secret")
+	c := s.connect(t, "alice@example.com", "secret")
+
+	if err := writeFile(c, "/small.txt", strings.Repeat("x", 60), 16); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	// 限额在关闭文件时检查
+	err := writeFile(c, "/big.txt", strings.Repeat("y", 200), 64)
+	if !isStatus(err, fxFailure) || !strings.Contains(err.Error(), "quota") {
+		t.Fatalf("Expected a quota error, got %v", err)
+	}
+	if err := writeFile(c, "/small.txt", strings.Repeat("z", 120), 64); !isStatus(err, fxFailure) {
+		t.Fatalf("Expected overwriting over quota to fail, got %v", err)
+	}
+	if _, err := c.Stat("/big.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the rejected file not to exist, got %v", err)
+	}
+	if got, err := readFile(c, "/small.txt"); err != nil || got != strings.Repeat("x", 60) {
+		t.Fatalf("Expected the old content to be kept, got %q (%v)", got, err)
+	}
+
+	quota, err := s.um.User(uid).Quota()
+	if err != nil {
+		t.Fatalf("Error loading quota: %v", err)
+	}
+	if quota.UsedBytes != 60 || quota.UsedFiles != 1 {
+		t.Fatalf("Expected rejected uploads not to count, got %+v", quota)
+	}
+	s.waitSpool(t)
+}
+
+func TestServerDisconnect(t *testing.T) {
+	s := newTestServer(t, domain.Quota{MaxBytes: 1 << 20, MaxFiles: 100})
+	uid := s.signup(t, "alice@example.com", "secret")
+	conn, err := s.dial("alice@example.com", ssh.Password("secret"))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	c, err := pkgsftp.NewClient(conn)
+	if err != nil {
+		t.Fatalf("Error starting sftp: %v", err)
+	}
+	if err := writeFile(c, "/old.txt", "old content", 64); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+
+	// 新文件和覆盖已有文件都写到一半，然后断开连接
+	for _, name := range []string{"/new.txt", "/old.txt"} {
+		f, err := c.Create(name)
+		if err != nil {
+			t.Fatalf("Error opening %s: %v", name, err)
+		}
+		if _, err := f.Write([]byte("partial")); err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+	if entries, err := os.ReadDir(s.spool); err != nil || len(entries) != 2 {
+		t.Fatalf("Expected the open files to be spooled, got %d (%v)", len(entries), err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Error disconnecting: %v", err)
+	}
+	s.waitSpool(t)
+
+	fs := s.um.User(uid)
+	if _, err := fs.Stat("/new.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Expected the partial file not to be committed, got %v", err)
+	}
+	info, err := fs.Stat("/old.txt")
+	if err != nil || info.Size != int64(len("old content")) {
+		t.Fatalf("Expected the old content to be kept, got %+v (%v)", info, err)
+	}
+	c = s.connect(t, "alice@example.com", "secret")
+	if got, err := readFile(c, "/old.txt"); err != nil || got != "old content" {
+		t.Fatalf("Content mismatch after disconnect: %q (%v)", got, err)
+	}
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/service"
+	"github.com/lvow2022/udisk/internel/web/middleware"
+	"github.com/lvow2022/udisk/pkg/ginx"
+)
+
+type AdminHandler struct {
+	gcSvc      service.GCService
+	trashSvc   service.TrashService
+	versionSvc service.VersionService
+	admin      *middleware.AdminMiddlewareBuilder
+}
+
+func NewAdminHandler(gcSvc service.GCService, trashSvc service.TrashService, versionSvc service.VersionService,
+	admin *middleware.AdminMiddlewareBuilder) *AdminHandler {
+	return &AdminHandler{
+		gcSvc:      gcSvc,
+		trashSvc:   trashSvc,
+		versionSvc: versionSvc,
+		admin:      admin,
+	}
+}
+
+// RegisterRoutes 管理接口跨越所有用户，只有管理员可以访问
+func (h *AdminHandler) RegisterRoutes(server *gin.Engine) {
+	g := server.Group("/admin", h.admin.CheckAdmin())
+	g.GET("/gc", h.GC)
+	g.POST("/trash/purge", h.PurgeTrash)
+	g.POST("/versions/prune", h.PruneVersions)
+}
+
+// GC 只做试运行，报告当前会被回收的 blob 和分片目录
+func (h *AdminHandler) GC(ctx *gin.Context) {
+	report, err := h.gcSvc.Collect(ctx, true)
+	ginx.WriteResponse(ctx, err, report)
+}
+
+// PurgeTrash 立即彻底删除所有用户回收站中超过保留期的项
+func (h *AdminHandler) PurgeTrash(ctx *gin.Context) {
+	report, err := h.trashSvc.Purge(ctx)
+	ginx.WriteResponse(ctx, err, report)
+}
+
+// PruneVersions 立即按保留策略清理所有用户的历史版本
+func (h *AdminHandler) PruneVersions(ctx *gin.Context) {
+	report, err := h.versionSvc.Prune(ctx)
+	ginx.WriteResponse(ctx, err, report)
+}
@@ -0,0 +1,235 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/service"
+	ijwt "github.com/lvow2022/udisk/internel/web/jwt"
+	"github.com/lvow2022/udisk/pkg/ginx/errors"
+	"github.com/lvow2022/udisk/pkg/log"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/net/webdav"
+)
+
+const davPrefix = "/dav"
+
+// davMethods WebDAV 用到的所有方法
+var davMethods = []string{
+	"OPTIONS", "GET", "HEAD", "POST", "DELETE", "PUT",
+	"MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "PROPFIND", "PROPPATCH",
+}
+
+// DavHandler 通过 WebDAV 访问当前用户的文件。客户端用邮箱和密码进行
+// HTTP Basic 认证，或者和其他接口一样携带 Bearer JWT
+type DavHandler struct {
+	ijwt.Handler
+	davSvc   service.DavService
+	usrSvc   service.UserService
+	quotaSvc service.QuotaService
+	// logins 最近通过 Basic 认证的凭据，客户端每个请求都会携带密码，
+	// 避免每次都计算 bcrypt。修改密码后旧密码最多还能使用 davLoginTTL
+	logins *cache.Cache
+}
+
+const davLoginTTL = 5 * time.Minute
+
+func NewDavHandler(davSvc service.DavService, usrSvc service.UserService, quotaSvc service.QuotaService,
+	jwtHdl ijwt.Handler) *DavHandler {
+	return &DavHandler{
+		Handler:  jwtHdl,
+		davSvc:   davSvc,
+		usrSvc:   usrSvc,
+		quotaSvc: quotaSvc,
+		logins:   cache.New(davLoginTTL, 10*time.Minute),
+	}
+}
+
+// RegisterRoutes 注册 /dav 下的所有路径，认证由 Serve 完成，见 middleware.CheckLogin
+func (h *DavHandler) RegisterRoutes(server *gin.Engine) {
+	for _, method := range davMethods {
+		server.Handle(method, davPrefix, h.Serve)
+		server.Handle(method, davPrefix+"/*path", h.Serve)
+	}
+}
+
+func (h *DavHandler) Serve(ctx *gin.Context) {
+	userId, err := h.authenticate(ctx)
+	if err != nil {
+		ctx.Header("WWW-Authenticate", `Basic realm="udisk", charset="UTF-8"`)
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	fs := h.davSvc.FileSystem(userId)
+	req := ctx.Request
+	var w http.ResponseWriter = ctx.Writer
+	if req.Method == http.MethodPut {
+		if req, err = h.preparePut(ctx, userId, fs); err != nil {
+			return
+		}
+		// 没有 Content-Length 的上传在提交时才知道是否超出限额
+		pw := &davPutWriter{ResponseWriter: ctx.Writer}
+		req = req.WithContext(service.WithCloseError(req.Context(), &pw.closeErr))
+		w = pw
+	}
+
+	handler := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: fs,
+		LockSystem: h.davSvc.LockSystem(userId),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && err != webdav.ErrLocked && !os.IsNotExist(err) {
+				log.Errorf("webdav %s %s for user %s failed: %v", r.Method, r.URL.Path, userId, err)
+			}
+		},
+	}
+	handler.ServeHTTP(w, req)
+}
+
+// davPutWriter 把提交时超出限额导致的 405 改成 507 Insufficient Storage
+type davPutWriter struct {
+	http.ResponseWriter
+	closeErr  error
+	rewritten bool
+}
+
+func (w *davPutWriter) WriteHeader(status int) {
+	if status == http.StatusMethodNotAllowed && errors.IsCode(w.closeErr, code.ErrQuotaExceeded) {
+		w.rewritten = true
+		w.ResponseWriter.WriteHeader(http.StatusInsufficientStorage)
+		w.ResponseWriter.Write([]byte(http.StatusText(http.StatusInsufficientStorage)))
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write 丢弃 webdav.Handler 为原来的状态码写出的说明
+func (w *davPutWriter) Write(p []byte) (int, error) {
+	if w.rewritten {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// preparePut 在交给 webdav.Handler 之前检查限额，并把 Content-Range 转换成
+// 写入的起始位置。出错时已经写好响应
+func (h *DavHandler) preparePut(ctx *gin.Context, userId string, fs webdav.FileSystem) (*http.Request, error) {
+	req := ctx.Request
+	if req.ContentLength > 0 {
+		if err := h.quotaSvc.Check(ctx, userId, req.ContentLength, 0); err != nil {
+			if errors.IsCode(err, code.ErrQuotaExceeded) {
+				ctx.AbortWithStatus(http.StatusInsufficientStorage)
+			} else {
+				ctx.AbortWithStatus(http.StatusInternalServerError)
+			}
+			return nil, err
+		}
+	}
+
+	contentRange := req.Header.Get("Content-Range")
+	if contentRange == "" {
+		return req, nil
+	}
+	start, err := parseContentRange(contentRange, req.ContentLength)
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return nil, err
+	}
+	// 只能覆盖或者追加，不能在文件中留下空洞
+	var size int64
+	if info, err := fs.Stat(ctx, strings.TrimPrefix(req.URL.Path, davPrefix)); err == nil {
+		size = info.Size()
+	}
+	if start > size {
+		ctx.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+		ctx.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+		return nil, fmt.Errorf("写入位置 %d 超出文件大小 %d", start, size)
+	}
+	return req.WithContext(service.WithWriteOffset(req.Context(), start)), nil
+}
+
+// parseContentRange 解析 "bytes start-end/total" 形式的 Content-Range，
+// total 可以是 *，返回写入的起始位置
+func parseContentRange(contentRange string, length int64) (int64, error) {
+	spec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, fmt.Errorf("不支持的 Content-Range: %s", contentRange)
+	}
+	rng, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, fmt.Errorf("不合法的 Content-Range: %s", contentRange)
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, fmt.Errorf("不合法的 Content-Range: %s", contentRange)
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, fmt.Errorf("不合法的 Content-Range: %s", contentRange)
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, fmt.Errorf("不合法的 Content-Range: %s", contentRange)
+	}
+	if length >= 0 && end-start+1 != length {
+		return 0, fmt.Errorf("Content-Range %s 与内容长度 %d 不符", contentRange, length)
+	}
+	if total != "*" {
+		if n, err := strconv.ParseInt(total, 10, 64); err != nil || n <= end {
+			return 0, fmt.Errorf("不合法的 Content-Range: %s", contentRange)
+		}
+	}
+	return start, nil
+}
+
+// authenticate 返回通过 Basic 认证或 JWT 认证的用户
+func (h *DavHandler) authenticate(ctx *gin.Context) (string, error) {
+	if email, password, ok := ctx.Request.BasicAuth(); ok {
+		return h.login(ctx, email, password)
+	}
+
+	var uc ijwt.UserClaims
+	token, err := jwt.ParseWithClaims(h.ExtractToken(ctx), &uc, func(token *jwt.Token) (interface{}, error) {
+		return ijwt.JWTKey, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if token == nil || !token.Valid {
+		return "", errors.WithCode(code.ErrTokenInvalid, "登录信息无效")
+	}
+	if err := h.CheckSession(ctx, uc.Ssid); err != nil {
+		return "", err
+	}
+	ctx.Set("user", uc)
+	return currentUser(ctx)
+}
+
+func (h *DavHandler) login(ctx context.Context, email, password string) (string, error) {
+	sum := sha256.Sum256([]byte(email + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+	if userId, ok := h.logins.Get(key); ok {
+		return userId.(string), nil
+	}
+	u, err := h.usrSvc.Login(ctx, email, password)
+	if err != nil {
+		return "", err
+	}
+	if u.Id <= 0 {
+		return "", errors.WithCode(code.ErrPermissionDenied, "用户 %d 无权访问文件", u.Id)
+	}
+	userId := strconv.FormatInt(u.Id, 10)
+	h.logins.Set(key, userId, cache.DefaultExpiration)
+	return userId, nil
+}
@@ -0,0 +1,278 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/service"
+	ijwt "github.com/lvow2022/udisk/internel/web/jwt"
+	"github.com/lvow2022/udisk/internel/web/middleware"
+)
+
+// davClient 以同一个身份向测试服务器发送 WebDAV 请求
+type davClient struct {
+	t    *testing.T
+	url  string
+	auth func(req *http.Request)
+}
+
+type davResponse struct {
+	code   int
+	body   string
+	header http.Header
+}
+
+// do 发送请求，headers 是成对的头部名称和值
+func (c *davClient) do(method, path, body string, headers ...string) davResponse {
+	req, err := http.NewRequest(method, c.url+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatalf("Error creating request: %v", err)
+	}
+	if c.auth != nil {
+		c.auth(req)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("Error sending %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("Error reading %s %s: %v", method, path, err)
+	}
+	return davResponse{code: resp.StatusCode, body: string(b), header: resp.Header}
+}
+
+// expect 发送请求并检查状态码
+func (c *davClient) expect(code int, method, path, body string, headers ...string) davResponse {
+	resp := c.do(method, path, body, headers...)
+	if resp.code != code {
+		c.t.Fatalf("%s %s: expected %d, got %d %s", method, path, code, resp.code, resp.body)
+	}
+	return resp
+}
+
+func newTestDavServer(t *testing.T, quota domain.Quota) (*testEnv, *httptest.Server, ijwt.Handler) {
+	env := newTestEnv(t, quota)
+	jwtHdl := ijwt.NewLocalJWTHandler()
+	h := NewDavHandler(service.NewDavService(service.NewFileSystemService(env.um, env.blobs, env.quotas)), env.users, env.quotas, jwtHdl)
+
+	server := gin.New()
+	server.Use(middleware.Recovery(), middleware.NewLoginJWTMiddlewareBuilder(jwtHdl).CheckLogin())
+	h.RegisterRoutes(server)
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+	return env, srv, jwtHdl
+}
+
+// basicAuth 返回用邮箱和密码认证的 davClient
+func basicAuth(t *testing.T, url, email, password string) *davClient {
+	return &davClient{t: t, url: url, auth: func(req *http.Request) {
+		req.SetBasicAuth(email, password)
+	}}
+}
+
+func TestDavAuth(t *testing.T) {
+	env, srv, jwtHdl := newTestDavServer(t, domain.Quota{MaxBytes: 1 << 20, MaxFiles: 100})
+	uid := env.signup(t, "alice@example.com", "secret")
+	env.put(t, strconv.FormatInt(uid, 10), "/a.txt", "hello")
+
+	anonymous := &davClient{t: t, url: srv.URL}
+	resp := anonymous.expect(http.StatusUnauthorized, "PROPFIND", "/dav/", "", "Depth", "1")
+	if !strings.HasPrefix(resp.header.Get("WWW-Authenticate"), "Basic") {
+		t.Fatalf("Expected a Basic challenge, got %q", resp.header.Get("WWW-Authenticate"))
+	}
+	basicAuth(t, srv.URL, "alice@example.com", "wrong").expect(http.StatusUnauthorized, "GET", "/dav/a.txt", "")
+	basicAuth(t, srv.URL, "bob@example.com", "secret").expect(http.StatusUnauthorized, "GET", "/dav/a.txt", "")
+
+	alice := basicAuth(t, srv.URL, "alice@example.com", "secret")
+	resp = alice.expect(http.StatusMultiStatus, "PROPFIND", "/dav/", "", "Depth", "1")
+	if !strings.Contains(resp.body, "a.txt") {
+		t.Fatalf("Expected a.txt in the listing, got %s", resp.body)
+	}
+	if resp := alice.expect(http.StatusOK, "GET", "/dav/a.txt", ""); resp.body != "hello" {
+		t.Fatalf("Content mismatch: %q", resp.body)
+	}
+
+	// Bearer JWT 和其他接口一样，会话必须仍然有效
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/users/login", nil)
+	if err := jwtHdl.SetLoginToken(ctx, uid); err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+	token := w.Header().Get("x-jwt-token")
+	bearer := func(token string) *davClient {
+		return &davClient{t: t, url: srv.URL, auth: func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}}
+	}
+	if resp := bearer(token).expect(http.StatusOK, "GET", "/dav/a.txt", ""); resp.body != "hello" {
+		t.Fatalf("Content mismatch: %q", resp.body)
+	}
+	bearer(token+"x").expect(http.StatusUnauthorized, "GET", "/dav/a.txt", "")
+	bearer("garbage").expect(http.StatusUnauthorized, "GET", "/dav/a.txt", "")
+	if err := jwtHdl.SetJWTToken(ctx, uid, "expired-session"); err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+	bearer(w.Header().Get("x-jwt-token")).expect(http.StatusUnauthorized, "GET", "/dav/a.txt", "")
+}
+
+func TestDavPartialPut(t *testing.T) {
+	env, srv, _ := newTestDavServer(t, domain.Quota{MaxBytes: 1 << 20, MaxFiles: 100})
+	env.signup(t, "alice@example.com", "secret")
+	alice := basicAuth(t, srv.URL, "alice@example.com", "secret")
+
+	alice.expect(http.StatusCreated, "MKCOL", "/dav/docs", "")
+	alice.expect(http.StatusCreated, "PUT", "/dav/docs/x.txt", "hello world")
+
+	// 覆盖已有文件中的一段
+	alice.expect(http.StatusCreated, "PUT", "/dav/docs/x.txt", "WORLD", "Content-Range", "bytes 6-10/11")
+	if resp := alice.expect(http.StatusOK, "GET", "/dav/docs/x.txt", ""); resp.body != "hello WORLD" {
+		t.Fatalf("Content mismatch after partial put: %q", resp.body)
+	}
+	// 从文件末尾追加
+	alice.expect(http.StatusCreated, "PUT", "/dav/docs/x.txt", "!!", "Content-Range", "bytes 11-12/*")
+	if resp := alice.expect(http.StatusOK, "GET", "/dav/docs/x.txt", ""); resp.body != "hello WORLD!!" {
+		t.Fatalf("Content mismatch after append: %q", resp.body)
+	}
+
+	// 不能在文件中留下空洞
+	resp := alice.expect(http.StatusRequestedRangeNotSatisfiable, "PUT", "/dav/docs/x.txt", "zz",
+		"Content-Range", "bytes 20-21/*")
+	if resp.header.Get("Content-Range") != "bytes */13" {
+		t.Fatalf("Expected the current size in Content-Range, got %q", resp.header.Get("Content-Range"))
+	}
+	for _, contentRange := range []string{"bytes 0-9/*", "bytes 3-1/*", "items 0-1/2", "bytes 0-1/1"} {
+		alice.expect(http.StatusBadRequest, "PUT", "/dav/docs/x.txt", "zz", "Content-Range", contentRange)
+	}
+	if resp := alice.expect(http.StatusOK, "GET", "/dav/docs/x.txt", ""); resp.body != "hello WORLD!!" {
+		t.Fatalf("Expected rejected writes to leave the file alone, got %q", resp.body)
+	}
+}
+
+func TestDavCopyMove(t *testing.T) {
+	env, srv, _ := newTestDavServer(t, domain.Quota{MaxBytes: 1 << 20, MaxFiles: 100})
+	uid := strconv.FormatInt(env.signup(t, "alice@example.com", "secret"), 10)
+	alice := basicAuth(t, srv.URL, "alice@example.com", "secret")
+
+	alice.expect(http.StatusCreated, "MKCOL", "/dav/a", "")
+	alice.expect(http.StatusCreated, "PUT", "/dav/a/x.txt", "hello")
+	alice.expect(http.StatusCreated, "PUT", "/dav/b.txt", "other")
+	countBlobs := func() int {
+		n := 0
+		if err := env.blobs.Walk(func(blob.Info) error { n++; return nil }); err != nil {
+			t.Fatalf("Error walking blobs: %v", err)
+		}
+		return n
+	}
+	blobs := countBlobs()
+
+	// COPY 只链接相同的 blob，不复制内容
+	alice.expect(http.StatusCreated, "COPY", "/dav/a/x.txt", "", "Destination", srv.URL+"/dav/y.txt")
+	alice.expect(http.StatusCreated, "COPY", "/dav/a", "", "Destination", srv.URL+"/dav/c")
+	fs := env.um.User(uid)
+	src, err := fs.Blob("/a/x.txt")
+	if err != nil {
+		t.Fatalf("Error reading blob: %v", err)
+	}
+	for _, path := range []string{"/y.txt", "/c/x.txt"} {
+		if ref, err := fs.Blob(path); err != nil || ref.Digest != src.Digest {
+			t.Fatalf("Expected %s to link %s, got %+v (%v)", path, src.Digest, ref, err)
+		}
+	}
+	if n := countBlobs(); n != blobs {
+		t.Fatalf("Expected COPY not to store content, got %d blobs instead of %d", n, blobs)
+	}
+
+	// MOVE 到已存在的目标，Overwrite: F 时拒绝
+	alice.expect(http.StatusPreconditionFailed, "MOVE", "/dav/y.txt", "",
+		"Destination", srv.URL+"/dav/b.txt", "Overwrite", "F")
+	if resp := alice.expect(http.StatusOK, "GET", "/dav/b.txt", ""); resp.body != "other" {
+		t.Fatalf("Expected the target to be unchanged, got %q", resp.body)
+	}
+	alice.expect(http.StatusNoContent, "MOVE", "/dav/y.txt", "",
+		"Destination", srv.URL+"/dav/b.txt", "Overwrite", "T")
+	if resp := alice.expect(http.StatusOK, "GET", "/dav/b.txt", ""); resp.body != "hello" {
+		t.Fatalf("Content mismatch after move: %q", resp.body)
+	}
+	alice.expect(http.StatusNotFound, "GET", "/dav/y.txt", "")
+	alice.expect(http.StatusCreated, "MOVE", "/dav/c", "", "Destination", srv.URL+"/dav/d")
+	if resp := alice.expect(http.StatusOK, "GET", "/dav/d/x.txt", ""); resp.body != "hello" {
+		t.Fatalf("Content mismatch after moving a directory: %q", resp.body)
+	}
+	alice.expect(http.StatusNotFound, "PROPFIND", "/dav/c", "", "Depth", "0")
+}
+
+func TestDavLock(t *testing.T) {
+	env, srv, _ := newTestDavServer(t, domain.Quota{MaxBytes: 1 << 20, MaxFiles: 100})
+	env.signup(t, "alice@example.com", "secret")
+	alice := basicAuth(t, srv.URL, "alice@example.com", "secret")
+	alice.expect(http.StatusCreated, "PUT", "/dav/x.txt", "hello")
+
+	lockInfo := `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+	resp := alice.expect(http.StatusOK, "LOCK", "/dav/x.txt", lockInfo, "Timeout", "Second-600")
+	token := resp.header.Get("Lock-Token")
+	if token == "" {
+		t.Fatalf("Expected a Lock-Token, got %v", resp.header)
+	}
+	alice.expect(http.StatusLocked, "LOCK", "/dav/x.txt", lockInfo)
+
+	// 加锁后只有携带锁的请求可以修改文件
+	alice.expect(http.StatusLocked, "PUT", "/dav/x.txt", "nope")
+	alice.expect(http.StatusLocked, "DELETE", "/dav/x.txt", "")
+	alice.expect(http.StatusCreated, "PUT", "/dav/x.txt", "mine", "If", "("+token+")")
+	if resp := alice.expect(http.StatusOK, "GET", "/dav/x.txt", ""); resp.body != "mine" {
+		t.Fatalf("Content mismatch: %q", resp.body)
+	}
+
+	alice.expect(http.StatusNoContent, "UNLOCK", "/dav/x.txt", "", "Lock-Token", token)
+	alice.expect(http.StatusCreated, "PUT", "/dav/x.txt", "free")
+	alice.expect(http.StatusNoContent, "DELETE", "/dav/x.txt", "")
+}
+
+func TestDavQuota(t *testing.T) {
+	env, srv, _ := newTestDavServer(t, domain.Quota{MaxBytes: 100, MaxFiles: 100})
+	uid := strconv.FormatInt(env.signup(t, "alice@example.com", "secret"), 10)
+	alice := basicAuth(t, srv.URL, "alice@example.com", "secret")
+
+	alice.expect(http.StatusCreated, "PUT", "/dav/small.txt", strings.Repeat("x", 60))
+	alice.expect(http.StatusInsufficientStorage, "PUT", "/dav/big.txt", strings.Repeat("x", 200))
+	alice.expect(http.StatusInsufficientStorage, "PUT", "/dav/more.txt", strings.Repeat("y", 50))
+	alice.expect(http.StatusNotFound, "GET", "/dav/big.txt", "")
+
+	// 没有 Content-Length 时在写入过程中检查
+	req, err := http.NewRequest("PUT", srv.URL+"/dav/chunked.txt", io.MultiReader(strings.NewReader(strings.Repeat("z", 200))))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.SetBasicAuth("alice@example.com", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("Expected 507 for a chunked upload over quota, got %d", resp.StatusCode)
+	}
+	alice.expect(http.StatusNotFound, "GET", "/dav/chunked.txt", "")
+
+	quota, err := env.um.User(uid).Quota()
+	if err != nil {
+		t.Fatalf("Error loading quota: %v", err)
+	}
+	if quota.UsedBytes != 60 || quota.UsedFiles != 1 {
+		t.Fatalf("Expected rejected uploads not to count, got %+v", quota)
+	}
+}
@@ -3,9 +3,12 @@ package web
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/pkg/code"
 	"github.com/lvow2022/udisk/internel/service"
 	"github.com/lvow2022/udisk/pkg/ginx"
+	"github.com/lvow2022/udisk/pkg/ginx/errors"
 	"github.com/lvow2022/udisk/pkg/log"
+	"mime"
 	"net/http"
 	"strconv"
 )
@@ -25,17 +28,42 @@ func (h *FileHandler) RegisterRoutes(server *gin.Engine) {
 	g.POST("/validate/upload", h.ValidateUpload)
 	g.POST("/validate/download", h.ValidateDownload)
 	g.POST("/upload", h.Upload)
+	g.POST("/upload/instant", h.InstantUpload)
+	g.GET("/upload/:session", h.UploadStatus)
 	g.GET("/download", h.Download)
+	g.HEAD("/download", h.Download)
+	g.GET("/archive", h.Archive)
 	g.POST("/adduser", h.AddUser)
 	g.POST("/complete", h.Complete)
+
+	g.GET("/list", h.List)
+	g.GET("/stat", h.Stat)
+	g.POST("/mkdir", h.Mkdir)
+	g.POST("/remove", h.Remove)
+	g.POST("/move", h.Move)
+	g.POST("/copy", h.Copy)
+	g.GET("/pwd", h.Pwd)
+	g.POST("/cd", h.Cd)
+
+	g.GET("/trash", h.ListTrash)
+	g.POST("/trash/restore", h.RestoreTrash)
+	g.POST("/trash/purge", h.PurgeTrash)
+
+	g.GET("/versions", h.ListVersions)
+	g.POST("/versions/restore", h.RestoreVersion)
 }
 
 // download from remote_src to local_dst
 func (h *FileHandler) ValidateDownload(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
 	src := ctx.Query("src")
 	dst := ctx.Query("dst")
 
-	md5, chunkCount, err := h.fileSvc.ValidateDownload(ctx, "123", src, dst)
+	md5, chunkCount, err := h.fileSvc.ValidateDownload(ctx, userId, h.abs(ctx, userId, src), dst)
 	if err != nil {
 		ginx.WriteResponse(ctx, err, nil)
 		return // 确保在错误时返回
@@ -49,28 +77,63 @@ func (h *FileHandler) ValidateDownload(ctx *gin.Context) {
 
 // upload from local_src to remote_dst
 func (h *FileHandler) ValidateUpload(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
 	src := ctx.Query("src")
 	dst := ctx.Query("dst")
+	// 文件摘要可以是 md5 或 sha256，旧客户端通过 file_md5 传 md5
+	digest := ctx.DefaultQuery("digest", ctx.Query("file_md5"))
+	size, _ := strconv.ParseInt(ctx.Query("size"), 10, 64)
+
+	// 目标路径已存在时的处理方式: fail (默认)、overwrite 或 rename
+	conflict := ctx.Query("conflict")
 
-	chunkSize, err := h.fileSvc.ValidateUpload(ctx, "123", src, dst)
+	plan, err := h.fileSvc.ValidateUpload(ctx, userId, src, h.abs(ctx, userId, dst), digest, size, conflict)
+	ginx.WriteResponse(ctx, err, plan)
+}
 
-	type Response struct {
-		ChunkSize int `json:"chunk_size"`
+// InstantUpload 回答秒传挑战，成功后文件直接出现在目标路径
+func (h *FileHandler) InstantUpload(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
 	}
-	response := Response{
-		ChunkSize: chunkSize, // Example chunk size
+	type request struct {
+		ChallengeId string `json:"challenge_id"`
+		Proof       string `json:"proof"`
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
 	}
-	ginx.WriteResponse(ctx, err, response)
+
+	path, err := h.fileSvc.InstantUpload(ctx, userId, req.ChallengeId, req.Proof)
+	ginx.WriteResponse(ctx, err, gin.H{
+		"path": path,
+	})
 }
 
 func (h *FileHandler) Upload(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	sessionId := ctx.GetHeader("Upload-Session")
 	chunkIndex := ctx.GetHeader("Chunk-Index")
 	ChunkMd5 := ctx.GetHeader("Chunk-Md5")
-	FileMd5 := ctx.GetHeader("File-Md5")
 
 	index, err := strconv.Atoi(chunkIndex)
+	if err != nil {
+		ctx.String(http.StatusOK, fmt.Sprintf("分片序号不合法: %s", chunkIndex))
+		return
+	}
 
-	err = h.fileSvc.Upload(ctx, index, ChunkMd5, FileMd5)
+	err = h.fileSvc.Upload(ctx, userId, sessionId, index, ChunkMd5)
 	if err != nil {
 		ctx.String(http.StatusOK, fmt.Sprintf("获取上传文件失败: %s", err.Error()))
 		return
@@ -80,49 +143,430 @@ func (h *FileHandler) Upload(ctx *gin.Context) {
 	return
 }
 
+// UploadStatus 返回上传会话已收到的分片，供断线后续传
+func (h *FileHandler) UploadStatus(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	session, err := h.fileSvc.UploadStatus(ctx, userId, ctx.Param("session"))
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+
+	ginx.WriteResponse(ctx, nil, gin.H{
+		"session": session,
+		"bitmap":  session.Bitmap(),
+		"missing": session.Missing(),
+	})
+}
+
 func (h *FileHandler) Complete(ctx *gin.Context) {
-	fileMd5 := ctx.Query("file_md5")
-	chunk_num := ctx.Query("chunk_num")
-	totalChunks, err := strconv.Atoi(chunk_num)
+	userId, err := currentUser(ctx)
 	if err != nil {
-		log.Logger.Debug("param chunk_num atoi fail")
+		ginx.WriteResponse(ctx, err, nil)
+		return
 	}
-	err = h.fileSvc.CompleteUpload(ctx, fileMd5, totalChunks)
+	sessionId := ctx.Query("session")
+	path, err := h.fileSvc.CompleteUpload(ctx, userId, sessionId)
 	if err != nil {
 		ctx.String(http.StatusOK, fmt.Sprintf("文件合并失败: %s", err.Error()))
 		return
 	}
 
-	ginx.WriteResponse(ctx, err, nil)
+	ginx.WriteResponse(ctx, err, gin.H{
+		"path": path,
+	})
 	return
 }
 
+// Download 下载 File-Path (或查询参数 path) 指向的文件。带 Chunk-Index 时按
+// udisk 的分片协议返回一个分片，否则按标准 HTTP 语义返回，支持 Range、
+// If-Range、ETag 以及 If-None-Match/If-Modified-Since 等条件请求。
+// 查询参数 version 指定下载文件的某个历史版本
 func (h *FileHandler) Download(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
 	filePath := ctx.GetHeader("File-Path")
+	if filePath == "" {
+		filePath = ctx.Query("path")
+	}
+	filePath = h.abs(ctx, userId, filePath)
 	chunkIndex := ctx.GetHeader("Chunk-Index")
-	path, err := h.fileSvc.Download(ctx, filePath, chunkIndex)
+	if chunkIndex == "" {
+		h.serveContent(ctx, userId, filePath)
+		return
+	}
+
+	index, err := strconv.Atoi(chunkIndex)
 	if err != nil {
+		ginx.WriteResponse(ctx, errors.WithCode(code.ErrValidation, "分片序号不合法: %s", chunkIndex), nil)
+		return
+	}
+
+	content, length, err := h.fileSvc.Download(ctx, userId, filePath, index)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
 	}
-	ctx.File(path)
-	//ginx.WriteResponse(ctx, nil, nil)
+	defer content.Close()
+
+	ctx.DataFromReader(http.StatusOK, length, "application/octet-stream", content, nil)
+}
+
+func (h *FileHandler) serveContent(ctx *gin.Context, userId, filePath string) {
+	var content *service.FileContent
+	var err error
+	if version := ctx.Query("version"); version != "" {
+		id, perr := strconv.ParseUint(version, 10, 64)
+		if perr != nil {
+			ginx.WriteResponse(ctx, errors.WithCode(code.ErrValidation, "版本号不合法: %s", version), nil)
+			return
+		}
+		content, err = h.fileSvc.OpenVersion(ctx, userId, filePath, uint(id))
+	} else {
+		content, err = h.fileSvc.Open(ctx, userId, filePath)
+	}
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	writeContent(ctx, content)
 }
 
+// Archive 把一个或多个 path 打包成 zip 流式下载，format=tar.gz 时打包成 tar.gz
+func (h *FileHandler) Archive(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	paths := ctx.QueryArray("path")
+	for i, path := range paths {
+		paths[i] = h.abs(ctx, userId, path)
+	}
+
+	archive, err := h.fileSvc.Archive(ctx, userId, paths, ctx.Query("format"))
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	ctx.Header("Content-Type", archive.MimeType)
+	ctx.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": archive.Name}))
+	ctx.Status(http.StatusOK)
+	// 响应头已经发出，出错时只能中断连接，客户端会发现归档不完整，见 middleware.Recovery
+	if _, err := archive.WriteTo(ctx.Writer); err != nil {
+		log.Errorf("archive for user %s failed: %v", userId, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// AddUser 为登录用户分配文件系统。user_id 可以省略，给出时必须是登录用户，
+// 不能替别人分配
 func (h *FileHandler) AddUser(ctx *gin.Context) {
 	type request struct {
 		UserId string `json:"user_id"`
 	}
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
 	var req request
 	if err := ctx.Bind(&req); err != nil {
 		return
 	}
+	if req.UserId != "" && req.UserId != userId {
+		ginx.WriteResponse(ctx, errors.WithCode(code.ErrPermissionDenied, "不能为用户 %s 分配文件系统", req.UserId), nil)
+		return
+	}
+
+	err = h.fileSvc.AddUser(ctx, userId)
+	ginx.WriteResponse(ctx, err, nil)
+}
+
+// writeContent 按标准 HTTP 语义返回文件内容并关闭它
+func writeContent(ctx *gin.Context, content *service.FileContent) {
+	defer content.Close()
 
-	err := h.fileSvc.AddUser(ctx, req.UserId)
+	// 内容不可变，摘要就是强 ETag
+	ctx.Header("ETag", fmt.Sprintf("%q", content.Digest))
+	if content.MimeType != "" {
+		ctx.Header("Content-Type", content.MimeType)
+	}
+	disposition := "attachment"
+	if ctx.Query("inline") != "" {
+		disposition = "inline"
+	}
+	// 非 ASCII 文件名按 RFC 2231 编码为 filename*=utf-8''...
+	ctx.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": content.Name}))
+
+	http.ServeContent(ctx.Writer, ctx.Request, content.Name, content.ModTime, content)
+}
+
+// List 分页列出目录内容，page 从 1 开始，sort 可以是 name、size 或 mtime，order=desc 时倒序
+func (h *FileHandler) List(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
 	if err != nil {
 		ginx.WriteResponse(ctx, err, nil)
 		return
 	}
+	page, err := strconv.Atoi(ctx.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		ginx.WriteResponse(ctx, errors.WithCode(code.ErrValidation, "页码不合法: %s", ctx.Query("page")), nil)
+		return
+	}
+	pageSize, err := strconv.Atoi(ctx.DefaultQuery("page_size", "0"))
+	if err != nil || pageSize < 0 {
+		ginx.WriteResponse(ctx, errors.WithCode(code.ErrValidation, "分页大小不合法: %s", ctx.Query("page_size")), nil)
+		return
+	}
 
-	ginx.WriteResponse(ctx, nil, nil)
+	list, err := h.fileSvc.ListDirectory(ctx, userId, h.abs(ctx, userId, ctx.Query("path")), service.ListOptions{
+		Page:     page,
+		PageSize: pageSize,
+		SortBy:   ctx.Query("sort"),
+		Desc:     ctx.Query("order") == "desc",
+	})
+	ginx.WriteResponse(ctx, err, list)
+}
 
-	return
+func (h *FileHandler) Stat(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	meta, err := h.fileSvc.FileStat(ctx, userId, h.abs(ctx, userId, ctx.Query("path")))
+	ginx.WriteResponse(ctx, err, meta)
+}
+
+func (h *FileHandler) Mkdir(ctx *gin.Context) {
+	type request struct {
+		Path string `json:"path"`
+	}
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+
+	meta, err := h.fileSvc.MakeDirectory(ctx, userId, h.abs(ctx, userId, req.Path))
+	ginx.WriteResponse(ctx, err, meta)
+}
+
+// Remove 删除文件或目录。递归删除非空目录时 confirm 必须和 path 相同，
+// 防止客户端误删整个目录树
+func (h *FileHandler) Remove(ctx *gin.Context) {
+	type request struct {
+		Path      string `json:"path"`
+		Recursive bool   `json:"recursive"`
+		Confirm   string `json:"confirm"`
+	}
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+	if req.Path == "" {
+		ginx.WriteResponse(ctx, errors.WithCode(code.ErrValidation, "缺少要删除的路径"), nil)
+		return
+	}
+	if req.Recursive && req.Confirm != req.Path {
+		ginx.WriteResponse(ctx, errors.WithCode(code.ErrValidation, "递归删除需要确认路径: %s", req.Path), nil)
+		return
+	}
+
+	err = h.fileSvc.Remove(ctx, userId, h.abs(ctx, userId, req.Path), req.Recursive)
+	ginx.WriteResponse(ctx, err, nil)
+}
+
+type transferRequest struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+// Move 移动或重命名，dst 以 / 结尾时移动到该目录下
+func (h *FileHandler) Move(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	var req transferRequest
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+
+	meta, err := h.fileSvc.Move(ctx, userId, h.abs(ctx, userId, req.Src), h.abs(ctx, userId, req.Dst))
+	ginx.WriteResponse(ctx, err, meta)
+}
+
+// Copy 复制文件或目录，dst 以 / 结尾时复制到该目录下。只增加对 blob 的引用，
+// 再大的目录也可以立即复制完成
+func (h *FileHandler) Copy(ctx *gin.Context) {
+	type request struct {
+		transferRequest
+		// 目标已存在时的处理方式: fail (默认)、skip、overwrite 或 rename
+		Conflict string `json:"conflict"`
+	}
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+
+	meta, err := h.fileSvc.Copy(ctx, userId, h.abs(ctx, userId, req.Src), h.abs(ctx, userId, req.Dst), req.Conflict)
+	ginx.WriteResponse(ctx, err, meta)
+}
+
+// Pwd 返回当前会话的工作目录
+func (h *FileHandler) Pwd(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	ginx.WriteResponse(ctx, nil, gin.H{
+		"path": h.fileSvc.WorkingDirectory(ctx, userId, currentSession(ctx)),
+	})
+}
+
+// Cd 切换当前会话的工作目录，之后各接口中的相对路径都相对于它解析。
+// 工作目录按登录会话保存，同一用户的多个会话互不影响
+func (h *FileHandler) Cd(ctx *gin.Context) {
+	type request struct {
+		Path string `json:"path"`
+	}
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+
+	path, err := h.fileSvc.ChangeDirectory(ctx, userId, currentSession(ctx), req.Path)
+	ginx.WriteResponse(ctx, err, gin.H{
+		"path": path,
+	})
+}
+
+// abs 按当前会话的工作目录把 path 解析成绝对路径
+func (h *FileHandler) abs(ctx *gin.Context, userId string, path string) string {
+	return h.fileSvc.Abs(ctx, userId, currentSession(ctx), path)
+}
+
+func (h *FileHandler) ListTrash(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	items, err := h.fileSvc.ListTrash(ctx, userId)
+	ginx.WriteResponse(ctx, err, gin.H{
+		"items": items,
+	})
+}
+
+// RestoreTrash 把回收站中的一项放回原路径，原路径被占用时按 conflict 处理:
+// fail (默认)、rename 或 overwrite
+func (h *FileHandler) RestoreTrash(ctx *gin.Context) {
+	type request struct {
+		Id       uint   `json:"id"`
+		Conflict string `json:"conflict"`
+	}
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+
+	meta, err := h.fileSvc.RestoreTrash(ctx, userId, req.Id, req.Conflict)
+	ginx.WriteResponse(ctx, err, meta)
+}
+
+// PurgeTrash 彻底删除回收站中的一项，all 为 true 时清空回收站
+func (h *FileHandler) PurgeTrash(ctx *gin.Context) {
+	type request struct {
+		Id  uint `json:"id"`
+		All bool `json:"all"`
+	}
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+
+	if req.All {
+		purged, err := h.fileSvc.EmptyTrash(ctx, userId)
+		ginx.WriteResponse(ctx, err, gin.H{
+			"purged": purged,
+		})
+		return
+	}
+	err = h.fileSvc.PurgeTrash(ctx, userId, req.Id)
+	ginx.WriteResponse(ctx, err, gin.H{
+		"purged": 1,
+	})
+}
+
+// ListVersions 列出文件的历史版本，下载某个版本时把它的 id 作为 version 传给 /file/download
+func (h *FileHandler) ListVersions(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	versions, err := h.fileSvc.ListVersions(ctx, userId, h.abs(ctx, userId, ctx.Query("path")))
+	ginx.WriteResponse(ctx, err, gin.H{
+		"versions": versions,
+	})
+}
+
+// RestoreVersion 把历史版本恢复为当前内容，当前内容成为新的历史版本
+func (h *FileHandler) RestoreVersion(ctx *gin.Context) {
+	type request struct {
+		Path string `json:"path"`
+		Id   uint   `json:"id"`
+	}
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+
+	meta, err := h.fileSvc.RestoreVersion(ctx, userId, h.abs(ctx, userId, req.Path), req.Id)
+	ginx.WriteResponse(ctx, err, meta)
 }
@@ -0,0 +1,206 @@
+package web
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/internel/repository"
+	"github.com/lvow2022/udisk/internel/repository/dao"
+	"github.com/lvow2022/udisk/internel/service"
+	ijwt "github.com/lvow2022/udisk/internel/web/jwt"
+	"github.com/lvow2022/udisk/internel/web/middleware"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testEnv 测试用的服务，数据库在内存中，blob 在临时目录中
+type testEnv struct {
+	db     *gorm.DB
+	um     ufs.UserManager
+	blobs  blob.BlobStore
+	quotas service.QuotaService
+	files  service.FileService
+	users  service.UserService
+}
+
+func newTestEnv(t *testing.T, quota domain.Quota) *testEnv {
+	gin.SetMode(gin.TestMode)
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := ufs.InitTables(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	if err := dao.InitTables(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	blobs, err := blob.NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create blob store: %v", err)
+	}
+
+	um := ufs.NewUserManager(ufs.GormPersistors(db))
+	quotas := service.NewQuotaService(um, quota)
+	sessions := repository.NewUploadSessionRepository(dao.NewUploadSessionDAO(db))
+	return &testEnv{
+		db:     db,
+		um:     um,
+		blobs:  blobs,
+		quotas: quotas,
+		files:  service.NewFileService(nil, um, blobs, sessions, quotas),
+		users:  service.NewUserService(repository.NewUserRepository(dao.NewUserDAO(db))),
+	}
+}
+
+// signup 注册一个用户并返回它的 ID
+func (e *testEnv) signup(t *testing.T, email, password string) int64 {
+	ctx := context.Background()
+	if err := e.users.Signup(ctx, domain.User{Email: email, Password: password}); err != nil {
+		t.Fatalf("Error signing up %s: %v", email, err)
+	}
+	u, err := e.users.Login(ctx, email, password)
+	if err != nil {
+		t.Fatalf("Error logging in %s: %v", email, err)
+	}
+	return u.Id
+}
+
+// put 把 content 存为 blob 并链接到 owner 的 path
+func (e *testEnv) put(t *testing.T, owner, path, content string) blob.Info {
+	info, err := e.blobs.Put(md5Hex(content), strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Error storing blob: %v", err)
+	}
+	ref := ufs.BlobRef{Digest: info.Digest, Size: info.Size}
+	if _, err := e.um.User(owner).Commit(path, ref, ufs.ConflictOverwrite); err != nil {
+		t.Fatalf("Error committing %s: %v", path, err)
+	}
+	return info
+}
+
+func md5Hex(content string) string {
+	sum := md5.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// loginAs 代替 CheckLogin，把 uid 作为已登录的用户
+func loginAs(uid int64) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Set("user", ijwt.UserClaims{Uid: uid, Ssid: "test"})
+	}
+}
+
+func TestArchiveAbortsOnError(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	// 第一个文件不可压缩，并且大于 net/http 的缓冲区，保证响应头和部分内容已经发给客户端
+	large := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(large)
+	env.put(t, "1", "/docs/a.bin", string(large))
+	env.put(t, "1", "/docs/b.txt", "bbb")
+
+	server := gin.New()
+	server.Use(middleware.Recovery(), loginAs(1))
+	NewFileHandler(env.files).RegisterRoutes(server)
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	get := func() (*http.Response, []byte, error) {
+		resp, err := http.Get(srv.URL + "/file/archive?path=/docs")
+		if err != nil {
+			t.Fatalf("Error requesting archive: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp, body, err
+	}
+
+	resp, body, err := get()
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("Error downloading archive: %d %v", resp.StatusCode, err)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Disposition"), "docs.zip") || len(body) == 0 {
+		t.Fatalf("Archive mismatch: %v %d bytes", resp.Header, len(body))
+	}
+
+	// 第二个文件的内容丢失时响应已经开始，连接被中断而不是正常结束
+	if err := env.blobs.Delete(md5Hex("bbb")); err != nil {
+		t.Fatalf("Error deleting blob: %v", err)
+	}
+	resp, _, err = get()
+	if resp.StatusCode != http.StatusOK || err == nil {
+		t.Fatalf("Expected the response to be cut off, got %d %v", resp.StatusCode, err)
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	const content = "0123456789abcdef"
+	info := env.put(t, "1", "/docs/a.txt", content)
+	etag := fmt.Sprintf("%q", info.Digest)
+
+	server := gin.New()
+	server.Use(loginAs(1))
+	NewFileHandler(env.files).RegisterRoutes(server)
+
+	tests := []struct {
+		name         string
+		header       map[string]string
+		status       int
+		contentRange string
+		body         string
+	}{
+		{name: "full", status: http.StatusOK, body: content},
+		{name: "range", header: map[string]string{"Range": "bytes=2-5"}, status: http.StatusPartialContent,
+			contentRange: "bytes 2-5/16", body: "2345"},
+		{name: "suffix range", header: map[string]string{"Range": "bytes=-3"}, status: http.StatusPartialContent,
+			contentRange: "bytes 13-15/16", body: "def"},
+		{name: "open range", header: map[string]string{"Range": "bytes=14-"}, status: http.StatusPartialContent,
+			contentRange: "bytes 14-15/16", body: "ef"},
+		{name: "unsatisfiable range", header: map[string]string{"Range": "bytes=16-20"},
+			status: http.StatusRequestedRangeNotSatisfiable, contentRange: "bytes */16"},
+		{name: "matching etag", header: map[string]string{"If-None-Match": etag}, status: http.StatusNotModified},
+		{name: "other etag", header: map[string]string{"If-None-Match": `"other"`}, status: http.StatusOK, body: content},
+		{name: "current if-range", header: map[string]string{"Range": "bytes=2-5", "If-Range": etag},
+			status: http.StatusPartialContent, contentRange: "bytes 2-5/16", body: "2345"},
+		{name: "stale if-range", header: map[string]string{"Range": "bytes=2-5", "If-Range": `"stale"`},
+			status: http.StatusOK, body: content},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/file/download?path=/docs/a.txt", nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Fatalf("Expected Content-Range %q, got %q", tt.contentRange, got)
+			}
+			if rec.Code != http.StatusRequestedRangeNotSatisfiable && rec.Body.String() != tt.body {
+				t.Fatalf("Expected body %q, got %q", tt.body, rec.Body.String())
+			}
+			if rec.Code != http.StatusRequestedRangeNotSatisfiable && rec.Header().Get("ETag") != etag {
+				t.Fatalf("Expected ETag %s, got %q", etag, rec.Header().Get("ETag"))
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package web
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	ijwt "github.com/lvow2022/udisk/internel/web/jwt"
+	"github.com/lvow2022/udisk/pkg/ginx/errors"
+)
+
+// currentUser 从 CheckLogin 写入的 claims 中取出当前用户，并转换成
+// ufs.UserManager 使用的 key。没有 claims 的请求一律拒绝，避免以匿名
+// 身份操作某个共享的目录树
+func currentUser(ctx *gin.Context) (string, error) {
+	val, ok := ctx.Get("user")
+	if !ok {
+		return "", errors.WithCode(code.ErrTokenInvalid, "未登录")
+	}
+	uc, ok := val.(ijwt.UserClaims)
+	if !ok {
+		return "", errors.WithCode(code.ErrTokenInvalid, "登录信息无效")
+	}
+	if uc.Uid <= 0 {
+		return "", errors.WithCode(code.ErrPermissionDenied, "用户 %d 无权访问文件", uc.Uid)
+	}
+	return strconv.FormatInt(uc.Uid, 10), nil
+}
+
+// currentSession 返回当前登录会话的 ssid，调用方需要先通过 currentUser 校验身份
+func currentSession(ctx *gin.Context) string {
+	val, _ := ctx.Get("user")
+	uc, _ := val.(ijwt.UserClaims)
+	return uc.Ssid
+}
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	ijwt "github.com/lvow2022/udisk/internel/web/jwt"
+	"github.com/lvow2022/udisk/pkg/ginx"
+)
+
+func TestCurrentUserRejected(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	env.put(t, "0", "/zero.txt", "zero")
+
+	tests := []struct {
+		name   string
+		claims any
+		status int
+		code   int
+	}{
+		{name: "no claims", status: http.StatusUnauthorized, code: code.ErrTokenInvalid},
+		{name: "other claims", claims: "1", status: http.StatusUnauthorized, code: code.ErrTokenInvalid},
+		{name: "zero uid", claims: ijwt.UserClaims{Uid: 0, Ssid: "test"}, status: http.StatusForbidden, code: code.ErrPermissionDenied},
+		{name: "negative uid", claims: ijwt.UserClaims{Uid: -1, Ssid: "test"}, status: http.StatusForbidden, code: code.ErrPermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := gin.New()
+			server.Use(func(ctx *gin.Context) {
+				if tt.claims != nil {
+					ctx.Set("user", tt.claims)
+				}
+			})
+			NewFileHandler(env.files).RegisterRoutes(server)
+
+			for _, target := range []string{"/file/list?path=/", "/file/download?path=/zero.txt", "/file/stat?path=/zero.txt"} {
+				rec := httptest.NewRecorder()
+				server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+				var resp ginx.ErrResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != tt.status || resp.Code != tt.code {
+					t.Fatalf("%s: expected %d with code %d, got %d: %s", target, tt.status, tt.code, rec.Code, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestOwnerFromClaims(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	env.put(t, "2", "/theirs.txt", "theirs")
+
+	server := gin.New()
+	server.Use(loginAs(1))
+	NewFileHandler(env.files).RegisterRoutes(server)
+
+	// 请求中声称的用户被忽略，目录创建在登录用户的目录树中
+	body := `{"path": "/mine", "user_id": "2", "uid": 2, "owner": "2"}`
+	req := httptest.NewRequest(http.MethodPost, "/file/mkdir?user_id=2", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Error creating directory: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := env.um.User("1").Stat("/mine"); err != nil {
+		t.Fatalf("Expected the directory in the tree of user 1, got %v", err)
+	}
+	if _, err := env.um.User("2").Stat("/mine"); err == nil {
+		t.Fatalf("Expected the tree of user 2 to be untouched")
+	}
+
+	// 同样不能借助查询参数读取别人的文件
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/file/download?path=/theirs.txt&user_id=2", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected the file of user 2 not to be found, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAddUser(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	server := gin.New()
+	server.Use(loginAs(1))
+	NewFileHandler(env.files).RegisterRoutes(server)
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{body: `{}`, status: http.StatusOK},
+		{body: `{"user_id": "1"}`, status: http.StatusOK},
+		// 重复分配不是错误
+		{body: `{"user_id": "1"}`, status: http.StatusOK},
+		{body: `{"user_id": "2"}`, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/file/adduser", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Fatalf("%s: expected %d, got %d %s", tt.body, tt.status, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	ijwt "github.com/lvow2022/udisk/internel/web/jwt"
+)
+
+// AdminMiddlewareBuilder 只放行管理员，管理员由配置的用户 ID 决定。
+// 必须放在 CheckLogin 之后，从它写入的 claims 中取出当前用户
+type AdminMiddlewareBuilder struct {
+	admins map[int64]struct{}
+}
+
+func NewAdminMiddlewareBuilder(uids []int64) *AdminMiddlewareBuilder {
+	admins := make(map[int64]struct{}, len(uids))
+	for _, uid := range uids {
+		admins[uid] = struct{}{}
+	}
+	return &AdminMiddlewareBuilder{admins: admins}
+}
+
+func (m *AdminMiddlewareBuilder) CheckAdmin() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		uc, ok := ctx.Value("user").(ijwt.UserClaims)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		if _, ok := m.admins[uc.Uid]; !ok {
+			// 已登录但不是管理员
+			ctx.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	ijwt "github.com/lvow2022/udisk/internel/web/jwt"
 	"net/http"
+	"strings"
 )
 
 type LoginJWTMiddlewareBuilder struct {
@@ -25,6 +26,18 @@ func (m *LoginJWTMiddlewareBuilder) CheckLogin() gin.HandlerFunc {
 			// 不需要登录校验
 			return
 		}
+		if strings.HasPrefix(path, "/s/") {
+			// 分享链接由访客匿名访问，ShareHandler 校验 token 和提取码
+			return
+		}
+		if path == "/dav" || strings.HasPrefix(path, "/dav/") {
+			// WebDAV 客户端多数只支持 Basic 认证，由 DavHandler 自行认证
+			return
+		}
+		if path == "/s3" || strings.HasPrefix(path, "/s3/") {
+			// S3 客户端使用 SigV4 签名，由 S3Handler 自行认证
+			return
+		}
 		tokenStr := m.ExtractToken(ctx)
 		var uc ijwt.UserClaims
 		token, err := jwt.ParseWithClaims(tokenStr, &uc, func(token *jwt.Token) (interface{}, error) {
@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Recovery 和 gin.Recovery 一样把 panic 转换成 500，只有 http.ErrAbortHandler 例外。
+// 处理函数在响应头发出之后出错时用它中断响应，需要继续抛给 net/http 断开连接，
+// 否则响应会被正常结束，客户端无法发现内容不完整
+func Recovery() gin.HandlerFunc {
+	return gin.CustomRecovery(func(ctx *gin.Context, err any) {
+		if err == http.ErrAbortHandler {
+			panic(err)
+		}
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
@@ -0,0 +1,721 @@
+package web
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/service"
+	"github.com/lvow2022/udisk/pkg/ginx"
+	ierrors "github.com/lvow2022/udisk/pkg/ginx/errors"
+	"github.com/lvow2022/udisk/pkg/log"
+)
+
+const (
+	s3Prefix = "/s3"
+	// s3Bucket 每个用户只有一个 bucket，就是自己的整个目录树
+	s3Bucket     = "udisk"
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	// s3MaxXMLBody CompleteMultipartUpload 请求体的最大长度
+	s3MaxXMLBody = 1 << 20
+)
+
+// emptyETag 是空内容的 md5，S3 用它作为目录对象的 ETag
+var emptyETag = fmt.Sprintf("%q", hex.EncodeToString(md5.New().Sum(nil)))
+
+// S3Handler 通过 S3 兼容的接口访问当前用户的文件，只支持 path-style 请求
+// /s3/udisk/<key>，key 就是文件在目录树中的路径，以 / 结尾的 key 是目录。
+// 客户端用 /access_keys 下创建的密钥计算 SigV4 签名
+type S3Handler struct {
+	fileSvc service.FileService
+	keySvc  service.AccessKeyService
+}
+
+func NewS3Handler(fileSvc service.FileService, keySvc service.AccessKeyService) *S3Handler {
+	return &S3Handler{
+		fileSvc: fileSvc,
+		keySvc:  keySvc,
+	}
+}
+
+// RegisterRoutes 注册密钥管理接口和 /s3 下的所有路径，/s3 的认证由 Serve 完成，
+// 见 middleware.CheckLogin
+func (h *S3Handler) RegisterRoutes(server *gin.Engine) {
+	g := server.Group("/access_keys")
+	g.POST("/create", h.CreateKey)
+	g.GET("/list", h.ListKeys)
+	g.POST("/delete", h.DeleteKey)
+
+	for _, method := range []string{"GET", "HEAD", "PUT", "POST", "DELETE"} {
+		server.Handle(method, s3Prefix, h.Serve)
+		server.Handle(method, s3Prefix+"/*path", h.Serve)
+	}
+}
+
+// CreateKey 创建一个 S3 访问密钥，secret_access_key 只在这里返回一次
+func (h *S3Handler) CreateKey(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	key, err := h.keySvc.Create(ctx, userId)
+	ginx.WriteResponse(ctx, err, key)
+}
+
+// ListKeys 列出当前用户的 S3 访问密钥
+func (h *S3Handler) ListKeys(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	keys, err := h.keySvc.List(ctx, userId)
+	ginx.WriteResponse(ctx, err, keys)
+}
+
+// DeleteKey 删除一个 S3 访问密钥，使用它签名的请求立即失效
+func (h *S3Handler) DeleteKey(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	type request struct {
+		Id string `json:"access_key_id"`
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+	ginx.WriteResponse(ctx, h.keySvc.Delete(ctx, userId, req.Id), nil)
+}
+
+// s3Request 是通过签名校验的请求
+type s3Request struct {
+	userId   string
+	auth     *sigV4
+	secret   string
+	keyCtime time.Time
+	// key 是对象的 key，也就是去掉开头的 / 的路径
+	key string
+}
+
+// path 返回 key 对应的绝对路径
+func (r *s3Request) path() string {
+	return "/" + r.key
+}
+
+// body 返回请求体，分块签名和 sha256 在读取时校验
+func (r *s3Request) body(ctx *gin.Context) (*s3Payload, error) {
+	p, err := r.auth.payloadBody(ctx.Request, r.secret)
+	if err != nil {
+		return nil, &s3Error{status: http.StatusBadRequest, code: "InvalidRequest", message: err.Error()}
+	}
+	return p, nil
+}
+
+func (h *S3Handler) Serve(ctx *gin.Context) {
+	req, err := h.authenticate(ctx)
+	if err != nil {
+		writeS3Error(ctx, err, "")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(ctx.Param("path"), "/"), "/")
+	req.key = key
+
+	switch {
+	case bucket == "":
+		if ctx.Request.Method != http.MethodGet {
+			writeS3Error(ctx, errS3NotImplemented, "")
+			return
+		}
+		h.listBuckets(ctx, req)
+	case bucket != s3Bucket:
+		writeS3Error(ctx, &s3Error{status: http.StatusNotFound, code: "NoSuchBucket", message: "只有一个 bucket: " + s3Bucket}, "")
+	case key == "":
+		h.serveBucket(ctx, req)
+	default:
+		h.serveObject(ctx, req)
+	}
+}
+
+// authenticate 按请求携带的密钥 ID 查找密钥，校验签名
+func (h *S3Handler) authenticate(ctx *gin.Context) (*s3Request, error) {
+	auth, err := parseSigV4(ctx.Request)
+	if err != nil {
+		return nil, &s3Error{status: http.StatusForbidden, code: "AccessDenied", message: err.Error()}
+	}
+	key, err := h.keySvc.Find(ctx, auth.keyId)
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.verify(ctx.Request, key.Secret, time.Now()); err != nil {
+		return nil, err
+	}
+	return &s3Request{userId: key.UserId, auth: auth, secret: key.Secret, keyCtime: key.Ctime}, nil
+}
+
+func (h *S3Handler) serveBucket(ctx *gin.Context, req *s3Request) {
+	query := ctx.Request.URL.Query()
+	switch {
+	case ctx.Request.Method == http.MethodHead:
+		ctx.Status(http.StatusOK)
+	case ctx.Request.Method == http.MethodGet && query.Has("location"):
+		writeXML(ctx, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: s3Namespace})
+	case ctx.Request.Method == http.MethodGet && query.Get("list-type") == "2":
+		h.listObjects(ctx, req)
+	default:
+		writeS3Error(ctx, errS3NotImplemented, "")
+	}
+}
+
+func (h *S3Handler) serveObject(ctx *gin.Context, req *s3Request) {
+	query := ctx.Request.URL.Query()
+	switch ctx.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		h.getObject(ctx, req)
+	case http.MethodPut:
+		switch {
+		case query.Has("uploadId"):
+			h.uploadPart(ctx, req, query.Get("uploadId"))
+		case ctx.GetHeader("X-Amz-Copy-Source") != "":
+			h.copyObject(ctx, req)
+		default:
+			h.putObject(ctx, req)
+		}
+	case http.MethodPost:
+		switch {
+		case query.Has("uploads"):
+			h.createMultipart(ctx, req)
+		case query.Has("uploadId"):
+			h.completeMultipart(ctx, req, query.Get("uploadId"))
+		default:
+			writeS3Error(ctx, errS3NotImplemented, "")
+		}
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			h.abortMultipart(ctx, req, query.Get("uploadId"))
+			return
+		}
+		h.deleteObject(ctx, req)
+	}
+}
+
+func (h *S3Handler) listBuckets(ctx *gin.Context, req *s3Request) {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	writeXML(ctx, http.StatusOK, struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID          string
+			DisplayName string
+		}
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{
+		Xmlns: s3Namespace,
+		Owner: struct{ ID, DisplayName string }{req.userId, req.userId},
+		// 目录树的根没有创建时间，用密钥的创建时间代替
+		Buckets: []bucket{{Name: s3Bucket, CreationDate: s3Time(req.keyCtime)}},
+	})
+}
+
+// listObjects 实现 ListObjectsV2，continuation-token 就是上一页最后一个 key
+func (h *S3Handler) listObjects(ctx *gin.Context, req *s3Request) {
+	query := ctx.Request.URL.Query()
+	opts := service.ObjectListOptions{
+		Prefix:     query.Get("prefix"),
+		Delimiter:  query.Get("delimiter"),
+		StartAfter: query.Get("start-after"),
+		MaxKeys:    service.MaxObjectKeys,
+	}
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeS3Error(ctx, invalidArgument("max-keys 不合法: %s", v), "")
+			return
+		}
+		opts.MaxKeys = min(n, service.MaxObjectKeys)
+	}
+	token := query.Get("continuation-token")
+	if token != "" {
+		after, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			writeS3Error(ctx, invalidArgument("continuation-token 不合法: %s", token), "")
+			return
+		}
+		opts.StartAfter = max(opts.StartAfter, string(after))
+	}
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		writeS3Error(ctx, invalidArgument("不支持的 encoding-type: %s", encodingType), "")
+		return
+	}
+	encode := func(s string) string {
+		if encodingType == "" {
+			return s
+		}
+		return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+	}
+
+	// max-keys 为 0 时只返回空的一页
+	var list domain.ObjectList
+	if opts.MaxKeys > 0 {
+		var err error
+		if list, err = h.fileSvc.ListObjects(ctx, req.userId, opts); err != nil {
+			writeS3Error(ctx, err, "")
+			return
+		}
+	}
+
+	type object struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+		StorageClass string
+	}
+	type prefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Xmlns                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		EncodingType          string `xml:",omitempty"`
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		Contents              []object
+		CommonPrefixes        []prefix
+	}{
+		Xmlns:             s3Namespace,
+		Name:              s3Bucket,
+		Prefix:            encode(opts.Prefix),
+		Delimiter:         encode(opts.Delimiter),
+		StartAfter:        encode(query.Get("start-after")),
+		ContinuationToken: token,
+		EncodingType:      encodingType,
+		KeyCount:          len(list.Objects) + len(list.Prefixes),
+		MaxKeys:           opts.MaxKeys,
+		IsTruncated:       list.Truncated,
+	}
+	if list.Truncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(list.Next))
+	}
+	for _, meta := range list.Objects {
+		result.Contents = append(result.Contents, object{
+			Key:          encode(metadataKey(meta)),
+			LastModified: s3Time(meta.ModTime),
+			ETag:         etag(meta),
+			Size:         meta.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, p := range list.Prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, prefix{Prefix: encode(p)})
+	}
+	writeXML(ctx, http.StatusOK, result)
+}
+
+// getObject 实现 GetObject 和 HeadObject，支持 Range 和条件请求
+func (h *S3Handler) getObject(ctx *gin.Context, req *s3Request) {
+	if strings.HasSuffix(req.key, "/") {
+		meta, err := h.fileSvc.FileStat(ctx, req.userId, req.path())
+		if err == nil && !meta.IsDir {
+			err = ierrors.WithCode(code.ErrFileNotFound, "不是目录: %s", req.path())
+		}
+		if err != nil {
+			writeS3Error(ctx, err, "NoSuchKey")
+			return
+		}
+		ctx.Header("ETag", emptyETag)
+		ctx.Header("Last-Modified", meta.ModTime.UTC().Format(http.TimeFormat))
+		ctx.Header("Content-Length", "0")
+		ctx.Status(http.StatusOK)
+		return
+	}
+
+	content, err := h.fileSvc.Open(ctx, req.userId, req.path())
+	if err != nil {
+		// 目录只能通过以 / 结尾的 key 访问
+		if ierrors.IsCode(err, code.ErrNotAFile) {
+			err = ierrors.WithCode(code.ErrFileNotFound, "不是文件: %s", req.path())
+		}
+		writeS3Error(ctx, err, "NoSuchKey")
+		return
+	}
+	defer content.Close()
+	ctx.Header("ETag", fmt.Sprintf("%q", content.Digest))
+	if content.MimeType != "" {
+		ctx.Header("Content-Type", content.MimeType)
+	}
+	http.ServeContent(ctx.Writer, ctx.Request, "", content.ModTime, content)
+}
+
+// putObject 实现 PutObject，空的以 / 结尾的 key 创建目录
+func (h *S3Handler) putObject(ctx *gin.Context, req *s3Request) {
+	body, err := req.body(ctx)
+	if err != nil {
+		writeS3Error(ctx, err, "")
+		return
+	}
+	if strings.HasSuffix(req.key, "/") {
+		h.putDirectory(ctx, req, body)
+		return
+	}
+
+	// 带 Content-MD5 时由 blob 存储直接校验，否则由 PutObject 先计算 md5。
+	// 不使用 sha256 作为摘要，和其他方式上传的相同内容共享 blob
+	digest, err := contentMd5(ctx)
+	if err != nil {
+		writeS3Error(ctx, err, "")
+		return
+	}
+	meta, err := h.fileSvc.PutObject(ctx, req.userId, req.path(), body, body.size, digest)
+	if err != nil {
+		writeS3Error(ctx, bodyError(body, err), "NoSuchKey")
+		return
+	}
+	ctx.Header("ETag", etag(meta))
+	ctx.Status(http.StatusOK)
+}
+
+func (h *S3Handler) putDirectory(ctx *gin.Context, req *s3Request, body *s3Payload) {
+	if n, _ := body.Read(make([]byte, 1)); n > 0 {
+		writeS3Error(ctx, invalidArgument("以 / 结尾的 key 是目录，内容必须为空"), "")
+		return
+	}
+	if body.err != nil {
+		writeS3Error(ctx, body.err, "")
+		return
+	}
+	_, err := h.fileSvc.MakeDirectory(ctx, req.userId, req.path())
+	if ierrors.IsCode(err, code.ErrFileExists) {
+		var meta domain.FileMetadata
+		if meta, err = h.fileSvc.FileStat(ctx, req.userId, req.path()); err == nil && !meta.IsDir {
+			err = ierrors.WithCode(code.ErrNotADirectory, "不是目录: %s", req.path())
+		}
+	}
+	if err != nil {
+		writeS3Error(ctx, err, "NoSuchKey")
+		return
+	}
+	ctx.Header("ETag", emptyETag)
+	ctx.Status(http.StatusOK)
+}
+
+// copyObject 实现 CopyObject，只能复制文件，新文件与源文件共享内容
+func (h *S3Handler) copyObject(ctx *gin.Context, req *s3Request) {
+	src, err := parseCopySource(ctx.GetHeader("X-Amz-Copy-Source"))
+	if err != nil {
+		writeS3Error(ctx, err, "")
+		return
+	}
+	meta, err := h.fileSvc.CopyObject(ctx, req.userId, "/"+src, req.path())
+	if err != nil {
+		writeS3Error(ctx, err, "NoSuchKey")
+		return
+	}
+	writeXML(ctx, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		LastModified string
+		ETag         string
+	}{Xmlns: s3Namespace, LastModified: s3Time(meta.ModTime), ETag: etag(meta)})
+}
+
+// parseCopySource 解析 x-amz-copy-source，即 URL 编码的 [/]bucket/key，返回 key
+func parseCopySource(source string) (string, error) {
+	source, version, _ := strings.Cut(source, "?")
+	if version != "" {
+		return "", &s3Error{status: http.StatusNotImplemented, code: "NotImplemented", message: "不支持版本: " + version}
+	}
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		return "", invalidArgument("x-amz-copy-source 不合法: %s", source)
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	if bucket != s3Bucket {
+		return "", &s3Error{status: http.StatusNotFound, code: "NoSuchBucket", message: "只有一个 bucket: " + s3Bucket}
+	}
+	if key == "" {
+		return "", invalidArgument("x-amz-copy-source 不合法: %s", source)
+	}
+	return key, nil
+}
+
+// deleteObject 实现 DeleteObject，文件移入回收站。与 S3 相同，key 不存在时
+// 也返回成功；非空目录由其中的文件隐含，不会被删除
+func (h *S3Handler) deleteObject(ctx *gin.Context, req *s3Request) {
+	meta, err := h.fileSvc.FileStat(ctx, req.userId, req.path())
+	if err == nil && meta.IsDir == strings.HasSuffix(req.key, "/") {
+		err = h.fileSvc.Remove(ctx, req.userId, req.path(), false)
+		if ierrors.IsCode(err, code.ErrDirectoryNotEmpty) {
+			err = nil
+		}
+	}
+	if err != nil && !ierrors.IsCode(err, code.ErrFileNotFound) {
+		writeS3Error(ctx, err, "")
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (h *S3Handler) createMultipart(ctx *gin.Context, req *s3Request) {
+	session, err := h.fileSvc.CreateMultipart(ctx, req.userId, req.path())
+	if err != nil {
+		writeS3Error(ctx, err, "NoSuchKey")
+		return
+	}
+	writeXML(ctx, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: s3Bucket, Key: req.key, UploadId: session.Id})
+}
+
+func (h *S3Handler) uploadPart(ctx *gin.Context, req *s3Request, uploadId string) {
+	if ctx.GetHeader("X-Amz-Copy-Source") != "" {
+		writeS3Error(ctx, errS3NotImplemented, "")
+		return
+	}
+	partNumber, err := strconv.Atoi(ctx.Query("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > service.MaxParts {
+		writeS3Error(ctx, invalidArgument("partNumber 不合法: %s", ctx.Query("partNumber")), "")
+		return
+	}
+	body, err := req.body(ctx)
+	if err != nil {
+		writeS3Error(ctx, err, "")
+		return
+	}
+	digest, err := contentMd5(ctx)
+	if err != nil {
+		writeS3Error(ctx, err, "")
+		return
+	}
+
+	partMd5, err := h.fileSvc.UploadPart(ctx, req.userId, uploadId, partNumber-1, body, body.size)
+	if err != nil {
+		writeS3Error(ctx, bodyError(body, err), "NoSuchUpload")
+		return
+	}
+	// 分段已经保存，客户端会重新上传同一个分段覆盖它
+	if digest != "" && digest != partMd5 {
+		writeS3Error(ctx, blob.ErrDigestMismatch, "")
+		return
+	}
+	ctx.Header("ETag", fmt.Sprintf("%q", partMd5))
+	ctx.Status(http.StatusOK)
+}
+
+func (h *S3Handler) completeMultipart(ctx *gin.Context, req *s3Request, uploadId string) {
+	body, err := req.body(ctx)
+	if err != nil {
+		writeS3Error(ctx, err, "")
+		return
+	}
+	var upload struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(body, s3MaxXMLBody)).Decode(&upload); err != nil {
+		if body.err != nil {
+			writeS3Error(ctx, body.err, "")
+			return
+		}
+		writeS3Error(ctx, &s3Error{status: http.StatusBadRequest, code: "MalformedXML", message: err.Error()}, "")
+		return
+	}
+	parts := make([]domain.UploadPart, 0, len(upload.Parts))
+	for _, part := range upload.Parts {
+		parts = append(parts, domain.UploadPart{Index: part.PartNumber - 1, Md5: strings.Trim(part.ETag, `"`)})
+	}
+
+	meta, err := h.fileSvc.CompleteMultipart(ctx, req.userId, uploadId, parts)
+	if err != nil {
+		writeS3Error(ctx, err, "NoSuchUpload")
+		return
+	}
+	writeXML(ctx, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		Xmlns:    s3Namespace,
+		Location: s3Prefix + "/" + s3Bucket + "/" + req.key,
+		Bucket:   s3Bucket,
+		Key:      req.key,
+		ETag:     etag(meta),
+	})
+}
+
+func (h *S3Handler) abortMultipart(ctx *gin.Context, req *s3Request, uploadId string) {
+	if err := h.fileSvc.AbortMultipart(ctx, req.userId, uploadId); err != nil {
+		writeS3Error(ctx, err, "NoSuchUpload")
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// contentMd5 返回 Content-MD5 头对应的 16 进制 md5，没有时返回空字符串
+func contentMd5(ctx *gin.Context) (string, error) {
+	v := ctx.GetHeader("Content-MD5")
+	if v == "" {
+		return "", nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(sum) != md5.Size {
+		return "", &s3Error{status: http.StatusBadRequest, code: "InvalidDigest", message: "Content-MD5 不合法: " + v}
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// metadataKey 返回文件或目录的 key，目录以 / 结尾
+func metadataKey(meta domain.FileMetadata) string {
+	key := strings.TrimPrefix(meta.Path, "/")
+	if meta.IsDir {
+		key += "/"
+	}
+	return key
+}
+
+func etag(meta domain.FileMetadata) string {
+	if meta.IsDir {
+		return emptyETag
+	}
+	return fmt.Sprintf("%q", meta.Digest)
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format(s3TimeFormat)
+}
+
+// s3Error 是返回给 S3 客户端的错误，code 是 S3 的错误码
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.code + ": " + e.message
+}
+
+var errS3NotImplemented = &s3Error{status: http.StatusNotImplemented, code: "NotImplemented", message: "不支持的操作"}
+
+func invalidArgument(format string, args ...interface{}) *s3Error {
+	return &s3Error{status: http.StatusBadRequest, code: "InvalidArgument", message: fmt.Sprintf(format, args...)}
+}
+
+// bodyError 优先返回读取请求体时的错误，例如签名不对或者内容不完整
+func bodyError(body *s3Payload, err error) error {
+	if body.err != nil {
+		return body.err
+	}
+	return err
+}
+
+// toS3Error 把错误转换成 S3 的错误码，notFound 是文件不存在时使用的错误码
+func toS3Error(err error, notFound string) *s3Error {
+	var se *s3Error
+	if errors.As(err, &se) {
+		return se
+	}
+	switch {
+	case errors.Is(err, errSignatureMismatch):
+		return &s3Error{status: http.StatusForbidden, code: "SignatureDoesNotMatch", message: err.Error()}
+	case errors.Is(err, errRequestSkewed):
+		return &s3Error{status: http.StatusForbidden, code: "RequestTimeTooSkewed", message: err.Error()}
+	case errors.Is(err, errRequestExpired):
+		return &s3Error{status: http.StatusForbidden, code: "AccessDenied", message: err.Error()}
+	case errors.Is(err, errPayloadMismatch):
+		return &s3Error{status: http.StatusBadRequest, code: "XAmzContentSHA256Mismatch", message: err.Error()}
+	case errors.Is(err, blob.ErrDigestMismatch):
+		return &s3Error{status: http.StatusBadRequest, code: "BadDigest", message: "Content-MD5 与内容不符"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &s3Error{status: http.StatusBadRequest, code: "IncompleteBody", message: "请求体不完整"}
+	}
+
+	coder := ierrors.ParseCoder(err)
+	switch coder.Code() {
+	case code.ErrAccessKeyNotFound:
+		return &s3Error{status: http.StatusForbidden, code: "InvalidAccessKeyId", message: coder.String()}
+	case code.ErrFileNotFound:
+		if notFound == "" {
+			notFound = "NoSuchKey"
+		}
+		return &s3Error{status: http.StatusNotFound, code: notFound, message: coder.String()}
+	case code.ErrChunkOutOfRange:
+		return &s3Error{status: http.StatusBadRequest, code: "InvalidPart", message: coder.String()}
+	case code.ErrQuotaExceeded:
+		return &s3Error{status: http.StatusForbidden, code: "QuotaExceeded", message: coder.String()}
+	}
+	if status := coder.HTTPStatus(); status >= 400 && status < 500 {
+		return &s3Error{status: http.StatusBadRequest, code: "InvalidRequest", message: coder.String()}
+	}
+	return &s3Error{status: http.StatusInternalServerError, code: "InternalError", message: "服务器内部错误"}
+}
+
+func writeS3Error(ctx *gin.Context, err error, notFound string) {
+	se := toS3Error(err, notFound)
+	if se.status >= http.StatusInternalServerError && se != errS3NotImplemented {
+		log.Errorf("s3 %s %s failed: %v", ctx.Request.Method, ctx.Request.URL.Path, err)
+	}
+	ctx.Abort()
+	writeXML(ctx, se.status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: se.code, Message: se.message, Resource: ctx.Request.URL.Path})
+}
+
+// writeXML 写入 XML 响应，HEAD 请求只有状态码
+func writeXML(ctx *gin.Context, status int, v interface{}) {
+	ctx.Header("Content-Type", "application/xml")
+	ctx.Status(status)
+	if ctx.Request.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.WriteString(ctx.Writer, xml.Header); err != nil {
+		return
+	}
+	if err := xml.NewEncoder(ctx.Writer).Encode(v); err != nil {
+		log.Errorf("s3 %s %s: failed to encode response: %v", ctx.Request.Method, ctx.Request.URL.Path, err)
+	}
+}
@@ -0,0 +1,263 @@
+package web
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/repository"
+	"github.com/lvow2022/udisk/internel/repository/dao"
+	"github.com/lvow2022/udisk/internel/service"
+	ijwt "github.com/lvow2022/udisk/internel/web/jwt"
+	"github.com/lvow2022/udisk/internel/web/middleware"
+)
+
+// s3Client 用一个访问密钥给请求签名
+type s3Client struct {
+	t      *testing.T
+	url    string
+	key    domain.AccessKey
+	secret string
+	// now 是签名使用的时间，为零时使用当前时间
+	now time.Time
+}
+
+// do 发送签名的请求。payload 是 x-amz-content-sha256，为空时使用 body 的 sha256；
+// headers 是成对的头部名称和值，都参与签名
+func (c *s3Client) do(method, path, body, payload string, headers ...string) davResponse {
+	req, err := http.NewRequest(method, c.url+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatalf("Error creating request: %v", err)
+	}
+	now := c.now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	now = now.UTC()
+	if payload == "" {
+		sum := sha256.Sum256([]byte(body))
+		payload = hex.EncodeToString(sum[:])
+	}
+	s := &sigV4{
+		keyId:         c.key.Id,
+		amzDate:       now.Format(amzDateFormat),
+		scope:         now.Format("20060102") + "/us-east-1/s3/aws4_request",
+		signedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+		payload:       payload,
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+		s.signedHeaders = append(s.signedHeaders, strings.ToLower(headers[i]))
+	}
+	sort.Strings(s.signedHeaders)
+	req.Header.Set("X-Amz-Date", s.amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(c.secret), s.stringToSign(s.canonicalRequest(req))))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		sigV4Algorithm, c.key.Id, s.scope, strings.Join(s.signedHeaders, ";"), signature))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("Error sending %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatalf("Error reading %s %s: %v", method, path, err)
+	}
+	return davResponse{code: resp.StatusCode, body: string(b), header: resp.Header}
+}
+
+// expect 发送请求并检查状态码，s3Code 不为空时同时检查 S3 的错误码
+func (c *s3Client) expect(code int, s3Code string, method, path, body, payload string, headers ...string) davResponse {
+	resp := c.do(method, path, body, payload, headers...)
+	if resp.code != code {
+		c.t.Fatalf("%s %s: expected %d, got %d %s", method, path, code, resp.code, resp.body)
+	}
+	if s3Code != "" && !strings.Contains(resp.body, "<Code>"+s3Code+"</Code>") {
+		c.t.Fatalf("%s %s: expected %s, got %s", method, path, s3Code, resp.body)
+	}
+	return resp
+}
+
+// newTestS3Server 返回测试服务器和 uid 为 1 的用户的客户端。分段保存在当前
+// 目录的 tmp 下，测试期间切换到临时目录
+func newTestS3Server(t *testing.T, quota domain.Quota) (*testEnv, *s3Client) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Error getting working directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Error changing directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	env := newTestEnv(t, quota)
+	keys := service.NewAccessKeyService(repository.NewAccessKeyRepository(dao.NewAccessKeyDAO(env.db)))
+	key, err := keys.Create(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("Error creating access key: %v", err)
+	}
+
+	server := gin.New()
+	server.Use(middleware.Recovery(), middleware.NewLoginJWTMiddlewareBuilder(ijwt.NewLocalJWTHandler()).CheckLogin())
+	NewS3Handler(env.files, keys).RegisterRoutes(server)
+	srv := httptest.NewServer(server)
+	t.Cleanup(srv.Close)
+	return env, &s3Client{t: t, url: srv.URL, key: key, secret: key.Secret}
+}
+
+func TestS3Auth(t *testing.T) {
+	_, client := newTestS3Server(t, domain.Quota{MaxBytes: 1 << 20, MaxFiles: 100})
+	client.expect(http.StatusOK, "", "PUT", "/s3/udisk/a.txt", "hello", "")
+	if resp := client.expect(http.StatusOK, "", "GET", "/s3/udisk/a.txt", "", ""); resp.body != "hello" {
+		t.Fatalf("Content mismatch: %q", resp.body)
+	}
+
+	resp, err := http.Get(client.url + "/s3/udisk/a.txt")
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 without a signature, got %d", resp.StatusCode)
+	}
+
+	wrong := *client
+	wrong.secret = "wrong"
+	wrong.expect(http.StatusForbidden, "SignatureDoesNotMatch", "GET", "/s3/udisk/a.txt", "", "")
+	unknown := *client
+	unknown.key.Id = "AKUNKNOWN"
+	unknown.expect(http.StatusForbidden, "InvalidAccessKeyId", "GET", "/s3/udisk/a.txt", "", "")
+	skewed := *client
+	skewed.now = time.Now().Add(-time.Hour)
+	skewed.expect(http.StatusForbidden, "RequestTimeTooSkewed", "GET", "/s3/udisk/a.txt", "", "")
+
+	// 签名正确但内容与 x-amz-content-sha256 不符，文件不会被覆盖
+	sum := sha256.Sum256([]byte("other"))
+	client.expect(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "PUT", "/s3/udisk/a.txt", "tampered",
+		hex.EncodeToString(sum[:]))
+	client.expect(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "PUT", "/s3/udisk/b.txt", "tampered",
+		hex.EncodeToString(sum[:]))
+	if resp := client.expect(http.StatusOK, "", "GET", "/s3/udisk/a.txt", "", ""); resp.body != "hello" {
+		t.Fatalf("Expected the object to be unchanged, got %q", resp.body)
+	}
+	client.expect(http.StatusNotFound, "NoSuchKey", "GET", "/s3/udisk/b.txt", "", "")
+
+	md5Of := func(s string) string {
+		sum := md5.Sum([]byte(s))
+		return base64.StdEncoding.EncodeToString(sum[:])
+	}
+	client.expect(http.StatusBadRequest, "BadDigest", "PUT", "/s3/udisk/c.txt", "hello", unsignedPayload,
+		"Content-MD5", md5Of("other"))
+	client.expect(http.StatusOK, "", "PUT", "/s3/udisk/c.txt", "hello", unsignedPayload, "Content-MD5", md5Of("hello"))
+}
+
+func TestS3Multipart(t *testing.T) {
+	_, client := newTestS3Server(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 100})
+	uploadIdPattern := regexp.MustCompile(`<UploadId>(.*)</UploadId>`)
+	create := func(key string) string {
+		resp := client.expect(http.StatusOK, "", "POST", "/s3/udisk/"+key+"?uploads", "", "")
+		m := uploadIdPattern.FindStringSubmatch(resp.body)
+		if m == nil {
+			t.Fatalf("Expected an upload ID, got %s", resp.body)
+		}
+		return m[1]
+	}
+	uploadPart := func(key, id string, number int, content string) string {
+		resp := client.expect(http.StatusOK, "", "PUT",
+			fmt.Sprintf("/s3/udisk/%s?partNumber=%d&uploadId=%s", key, number, id), content, unsignedPayload)
+		return resp.header.Get("ETag")
+	}
+	complete := func(parts ...interface{}) string {
+		var b strings.Builder
+		b.WriteString("<CompleteMultipartUpload>")
+		for i := 0; i+1 < len(parts); i += 2 {
+			fmt.Fprintf(&b, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", parts[i], parts[i+1])
+		}
+		b.WriteString("</CompleteMultipartUpload>")
+		return b.String()
+	}
+
+	first := strings.Repeat("a", service.MinPartSize)
+	id := create("big/file.bin")
+	stale := uploadPart("big/file.bin", id, 1, "wrong")
+	// 重复上传同一个分段时覆盖之前的内容
+	e1 := uploadPart("big/file.bin", id, 1, first)
+	if e1 == stale || e1 != fmt.Sprintf("%q", md5Hex(first)) {
+		t.Fatalf("Expected the ETag of the replaced part, got %s", e1)
+	}
+	e2 := uploadPart("big/file.bin", id, 2, "tail")
+	client.expect(http.StatusNotFound, "", "HEAD", "/s3/udisk/big/file.bin", "", "")
+
+	// 完成时检查分段的顺序、ETag 和长度
+	client.expect(http.StatusBadRequest, "InvalidRequest", "POST", "/s3/udisk/big/file.bin?uploadId="+id,
+		complete(2, e2, 1, e1), "")
+	client.expect(http.StatusBadRequest, "InvalidRequest", "POST", "/s3/udisk/big/file.bin?uploadId="+id,
+		complete(1, e1, 1, e1), "")
+	client.expect(http.StatusBadRequest, "InvalidPart", "POST", "/s3/udisk/big/file.bin?uploadId="+id,
+		complete(1, stale, 2, e2), "")
+	client.expect(http.StatusBadRequest, "InvalidPart", "POST", "/s3/udisk/big/file.bin?uploadId="+id,
+		complete(1, e1, 3, e2), "")
+	client.expect(http.StatusBadRequest, "InvalidRequest", "POST", "/s3/udisk/big/file.bin?uploadId="+id,
+		complete(), "")
+	client.expect(http.StatusBadRequest, "MalformedXML", "POST", "/s3/udisk/big/file.bin?uploadId="+id,
+		"<CompleteMultipartUpload>", "")
+	client.expect(http.StatusNotFound, "NoSuchUpload", "POST", "/s3/udisk/big/file.bin?uploadId=unknown",
+		complete(1, e1, 2, e2), "")
+
+	resp := client.expect(http.StatusOK, "", "POST", "/s3/udisk/big/file.bin?uploadId="+id, complete(1, e1, 2, e2), "")
+	etag := fmt.Sprintf("%q", md5Hex(first+"tail"))
+	if !strings.Contains(resp.body, "<ETag>"+strings.ReplaceAll(etag, `"`, "&#34;")+"</ETag>") {
+		t.Fatalf("Expected ETag %s, got %s", etag, resp.body)
+	}
+	resp = client.expect(http.StatusOK, "", "GET", "/s3/udisk/big/file.bin", "", "")
+	if resp.body != first+"tail" || resp.header.Get("ETag") != etag {
+		t.Fatalf("Content mismatch: %d bytes, ETag %s", len(resp.body), resp.header.Get("ETag"))
+	}
+	// 完成后上传不再存在
+	client.expect(http.StatusNotFound, "NoSuchUpload", "PUT", "/s3/udisk/big/file.bin?partNumber=1&uploadId="+id,
+		"more", unsignedPayload)
+	client.expect(http.StatusNotFound, "NoSuchUpload", "DELETE", "/s3/udisk/big/file.bin?uploadId="+id, "", "")
+
+	// 除最后一个分段外每个分段至少 MinPartSize
+	id = create("small.bin")
+	s1 := uploadPart("small.bin", id, 1, "head")
+	s2 := uploadPart("small.bin", id, 2, "tail")
+	client.expect(http.StatusBadRequest, "InvalidRequest", "POST", "/s3/udisk/small.bin?uploadId="+id,
+		complete(1, s1, 2, s2), "")
+	// 只有一个分段时没有长度限制，没有列出的分段被丢弃
+	client.expect(http.StatusOK, "", "POST", "/s3/udisk/small.bin?uploadId="+id, complete(2, s2), "")
+	if resp := client.expect(http.StatusOK, "", "GET", "/s3/udisk/small.bin", "", ""); resp.body != "tail" {
+		t.Fatalf("Content mismatch: %q", resp.body)
+	}
+
+	for _, number := range []string{"0", "10001", "x"} {
+		client.expect(http.StatusBadRequest, "InvalidArgument", "PUT",
+			"/s3/udisk/x.bin?partNumber="+number+"&uploadId="+id, "data", unsignedPayload)
+	}
+	id = create("aborted.bin")
+	uploadPart("aborted.bin", id, 1, "data")
+	client.expect(http.StatusNoContent, "", "DELETE", "/s3/udisk/aborted.bin?uploadId="+id, "", "")
+	client.expect(http.StatusNotFound, "NoSuchUpload", "PUT", "/s3/udisk/aborted.bin?partNumber=2&uploadId="+id,
+		"data", unsignedPayload)
+	client.expect(http.StatusNotFound, "", "HEAD", "/s3/udisk/aborted.bin", "", "")
+	// 完成和放弃的上传都不留下分段
+	if entries, err := os.ReadDir("tmp"); err != nil || len(entries) != 0 {
+		t.Fatalf("Expected the parts to be removed, got %v (%v)", entries, err)
+	}
+}
@@ -0,0 +1,385 @@
+package web
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4，见
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	sigV4Terminal  = "aws4_request"
+	amzDateFormat  = "20060102T150405Z"
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// sigV4MaxSkew 请求时间与服务器时间最多相差多少
+	sigV4MaxSkew = 15 * time.Minute
+	// presignMaxExpires 预签名 URL 最长的有效期
+	presignMaxExpires = 7 * 24 * time.Hour
+)
+
+var (
+	errSignatureMismatch = errors.New("signature does not match")
+	errPayloadMismatch   = errors.New("payload does not match x-amz-content-sha256")
+	errRequestExpired    = errors.New("request has expired")
+	errRequestSkewed     = errors.New("request time differs too much from the server time")
+)
+
+// sigV4 请求中携带的签名，来自 Authorization 头或者预签名 URL 的查询参数
+type sigV4 struct {
+	keyId         string
+	scope         string // date/region/service/aws4_request
+	amzDate       string
+	time          time.Time
+	signedHeaders []string
+	signature     string
+	// payload 是 x-amz-content-sha256，即请求体的 sha256、UNSIGNED-PAYLOAD 或者分块签名的标记
+	payload string
+	// expires 只用于预签名 URL
+	expires   time.Duration
+	presigned bool
+}
+
+// parseSigV4 解析请求中的签名，不校验签名本身
+func parseSigV4(r *http.Request) (*sigV4, error) {
+	var s sigV4
+	var credential, signedHeaders string
+	query := r.URL.Query()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		fields, ok := strings.CutPrefix(auth, sigV4Algorithm+" ")
+		if !ok {
+			return nil, fmt.Errorf("只支持 %s 签名", sigV4Algorithm)
+		}
+		for _, field := range strings.Split(fields, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				s.signature = value
+			}
+		}
+		s.amzDate = r.Header.Get("X-Amz-Date")
+		s.payload = r.Header.Get("X-Amz-Content-Sha256")
+		if s.payload == "" {
+			return nil, fmt.Errorf("缺少 x-amz-content-sha256")
+		}
+	} else if query.Get("X-Amz-Algorithm") == sigV4Algorithm {
+		s.presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		s.signature = query.Get("X-Amz-Signature")
+		s.amzDate = query.Get("X-Amz-Date")
+		s.payload = unsignedPayload
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > presignMaxExpires {
+			return nil, fmt.Errorf("X-Amz-Expires 不合法: %s", query.Get("X-Amz-Expires"))
+		}
+		s.expires = time.Duration(seconds) * time.Second
+	} else {
+		return nil, fmt.Errorf("请求没有签名")
+	}
+
+	t, err := time.Parse(amzDateFormat, s.amzDate)
+	if err != nil {
+		return nil, fmt.Errorf("X-Amz-Date 不合法: %s", s.amzDate)
+	}
+	s.time = t
+	// Credential=<key id>/<date>/<region>/s3/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[1] != s.amzDate[:8] || parts[3] != "s3" || parts[4] != sigV4Terminal {
+		return nil, fmt.Errorf("Credential 不合法: %s", credential)
+	}
+	s.keyId = parts[0]
+	s.scope = strings.Join(parts[1:], "/")
+	s.signedHeaders = strings.Split(signedHeaders, ";")
+	if !slices.Contains(s.signedHeaders, "host") {
+		return nil, fmt.Errorf("SignedHeaders 必须包含 host: %s", signedHeaders)
+	}
+	if s.signature == "" {
+		return nil, fmt.Errorf("缺少签名")
+	}
+	return &s, nil
+}
+
+// verify 用 secret 校验签名和请求时间
+func (s *sigV4) verify(r *http.Request, secret string, now time.Time) error {
+	if s.presigned {
+		if now.Before(s.time.Add(-sigV4MaxSkew)) || now.After(s.time.Add(s.expires)) {
+			return errRequestExpired
+		}
+	} else if now.Sub(s.time) > sigV4MaxSkew || s.time.Sub(now) > sigV4MaxSkew {
+		return errRequestSkewed
+	}
+
+	expected := hex.EncodeToString(hmacSHA256(s.signingKey(secret), s.stringToSign(s.canonicalRequest(r))))
+	if !hmac.Equal([]byte(expected), []byte(s.signature)) {
+		return errSignatureMismatch
+	}
+	return nil
+}
+
+func (s *sigV4) canonicalRequest(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+	b.WriteString(uriEncode(r.URL.Path, false) + "\n")
+
+	// 查询参数按名称和值排序，预签名 URL 的签名本身不参与签名
+	query := r.URL.Query()
+	if s.presigned {
+		query.Del("X-Amz-Signature")
+	}
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	b.WriteString(strings.Join(pairs, "&") + "\n")
+
+	for _, name := range s.signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		b.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	b.WriteString("\n" + strings.Join(s.signedHeaders, ";") + "\n")
+	b.WriteString(s.payload)
+	return b.String()
+}
+
+func (s *sigV4) stringToSign(canonicalRequest string) string {
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	return sigV4Algorithm + "\n" + s.amzDate + "\n" + s.scope + "\n" + hex.EncodeToString(sum[:])
+}
+
+func (s *sigV4) signingKey(secret string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(s.scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode 按 SigV4 的规则编码，只保留字母、数字和 -_.~，encodeSlash 为 false 时保留 /
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// payloadBody 按签名方式返回请求体，分块签名的请求体逐块校验签名
+func (s *sigV4) payloadBody(r *http.Request, secret string) (*s3Payload, error) {
+	switch s.payload {
+	case unsignedPayload:
+		return &s3Payload{r: r.Body, size: r.ContentLength}, nil
+	case streamingPayload, streamingUnsignedTrailer:
+		size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			size = -1
+		}
+		cr := &awsChunkedReader{r: bufio.NewReader(r.Body), hash: sha256.New()}
+		if s.payload == streamingPayload {
+			cr.auth = s
+			cr.key = s.signingKey(secret)
+			cr.prevSignature = s.signature
+		}
+		return &s3Payload{r: cr, size: size}, nil
+	}
+	if len(s.payload) != 2*sha256.Size || strings.ToLower(s.payload) != s.payload {
+		return nil, fmt.Errorf("不支持的 x-amz-content-sha256: %s", s.payload)
+	}
+	return &s3Payload{r: r.Body, size: r.ContentLength, sha256: s.payload, hash: sha256.New()}, nil
+}
+
+// s3Payload 是请求体，size 为 -1 表示长度未知。请求体的 sha256 已经签名时，
+// 读完时校验
+type s3Payload struct {
+	r      io.Reader
+	size   int64
+	sha256 string
+	hash   hash.Hash
+	// err 读取时遇到的第一个错误，blob 存储不保留原始的错误，据此返回对应的 S3 错误
+	err error
+}
+
+func (p *s3Payload) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if p.hash != nil {
+		p.hash.Write(b[:n])
+		if err == io.EOF && hex.EncodeToString(p.hash.Sum(nil)) != p.sha256 {
+			err = errPayloadMismatch
+		}
+	}
+	if err != nil && err != io.EOF && p.err == nil {
+		p.err = err
+	}
+	return n, err
+}
+
+// awsChunkedReader 解码 aws-chunked 编码的请求体。每个块的格式为
+// "<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n"，以长度为 0 的块结束，
+// 之后可能有 trailer。有签名时逐块校验，每个块的签名以前一个块
+// 的签名为种子
+type awsChunkedReader struct {
+	r *bufio.Reader
+	// auth 为 nil 时块没有签名
+	auth          *sigV4
+	key           []byte
+	prevSignature string
+
+	hash      hash.Hash
+	signature string // 当前块的签名
+	remaining int64  // 当前块还没有读取的字节数
+	started   bool
+	done      bool
+	err       error
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	for c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if c.started {
+			// 上一个块读完了
+			if c.err = c.finishChunk(); c.err != nil {
+				return 0, c.err
+			}
+		}
+		c.started = true
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+		if c.remaining == 0 {
+			if c.err = c.finishLast(); c.err != nil {
+				return 0, c.err
+			}
+			c.done = true
+			return 0, io.EOF
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// nextChunk 读取块头
+func (c *awsChunkedReader) nextChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("aws-chunked: %w", io.ErrUnexpectedEOF)
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	sizeField, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("aws-chunked: 块长度不合法: %q", line)
+	}
+	c.signature, _ = strings.CutPrefix(ext, "chunk-signature=")
+	if c.auth != nil && c.signature == "" {
+		return fmt.Errorf("aws-chunked: 缺少块签名")
+	}
+	c.remaining = size
+	c.hash.Reset()
+	return nil
+}
+
+// finishChunk 校验读完的块的签名并跳过块尾的 \r\n
+func (c *awsChunkedReader) finishChunk() error {
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+	crlf := make([]byte, 2)
+	if _, err := io.ReadFull(c.r, crlf); err != nil || string(crlf) != "\r\n" {
+		return fmt.Errorf("aws-chunked: 块没有以 \\r\\n 结束")
+	}
+	return nil
+}
+
+// finishLast 校验最后一个空块，并跳过 trailer
+func (c *awsChunkedReader) finishLast() error {
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("aws-chunked: trailer 不完整")
+		}
+		if strings.TrimSpace(line) == "" {
+			return nil
+		}
+	}
+}
+
+func (c *awsChunkedReader) verifyChunk() error {
+	if c.auth == nil {
+		return nil
+	}
+	empty := sha256.Sum256(nil)
+	stringToSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.auth.amzDate + "\n" + c.auth.scope + "\n" + c.prevSignature + "\n" +
+		hex.EncodeToString(empty[:]) + "\n" + hex.EncodeToString(c.hash.Sum(nil))
+	expected := hex.EncodeToString(hmacSHA256(c.key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(c.signature)) {
+		return errSignatureMismatch
+	}
+	c.prevSignature = c.signature
+	return nil
+}
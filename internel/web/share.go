@@ -0,0 +1,272 @@
+package web
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/service"
+	"github.com/lvow2022/udisk/pkg/ginx"
+	"github.com/lvow2022/udisk/pkg/ginx/errors"
+)
+
+const (
+	// shareKey 是 gin.Context 中已经校验过的分享
+	shareKey = "share"
+	// visitorKey 是 gin.Context 中访客在分享中的标识
+	visitorKey = "share_visitor"
+	// visitorHeader 访客标识的响应头和请求头，不能保存 cookie 的客户端通过它回传标识
+	visitorHeader = "Share-Visitor"
+)
+
+type ShareHandler struct {
+	shareSvc service.ShareService
+	fileSvc  service.FileService
+}
+
+func NewShareHandler(shareSvc service.ShareService, fileSvc service.FileService) *ShareHandler {
+	return &ShareHandler{
+		shareSvc: shareSvc,
+		fileSvc:  fileSvc,
+	}
+}
+
+func (h *ShareHandler) RegisterRoutes(server *gin.Engine) {
+	// 分享者管理自己的分享
+	g := server.Group("/share")
+	g.POST("/create", h.Create)
+	g.GET("/list", h.List)
+	g.POST("/revoke", h.Revoke)
+	g.POST("/save", h.Save)
+	g.GET("/save/:job", h.SaveStatus)
+
+	// 访客通过 token 访问，不需要登录，见 middleware.CheckLogin
+	sg := server.Group("/s/:token", h.open)
+	sg.GET("", h.Info)
+	sg.GET("/list", h.Browse)
+	sg.GET("/download", h.Download)
+	sg.HEAD("/download", h.Download)
+	sg.POST("/validate/upload", h.ValidateUpload)
+	sg.POST("/upload", h.Upload)
+	sg.POST("/complete", h.Complete)
+}
+
+// Create 分享一个文件或目录，expire_in 是有效期 (秒)，0 表示永不过期
+func (h *ShareHandler) Create(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	type request struct {
+		Path         string `json:"path"`
+		Code         string `json:"code"`
+		ExpireIn     int64  `json:"expire_in"`
+		MaxDownloads int64  `json:"max_downloads"`
+		Mode         string `json:"mode"`
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+
+	share, err := h.shareSvc.Create(ctx, userId, service.ShareOptions{
+		Path:         h.abs(ctx, userId, req.Path),
+		Code:         req.Code,
+		ExpireIn:     time.Duration(req.ExpireIn) * time.Second,
+		MaxDownloads: req.MaxDownloads,
+		Mode:         req.Mode,
+	})
+	ginx.WriteResponse(ctx, err, share)
+}
+
+// List 列出当前用户创建的分享
+func (h *ShareHandler) List(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	shares, err := h.shareSvc.List(ctx, userId)
+	ginx.WriteResponse(ctx, err, shares)
+}
+
+// Revoke 取消一个分享，链接立即失效
+func (h *ShareHandler) Revoke(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	type request struct {
+		Id int64 `json:"id"`
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+	ginx.WriteResponse(ctx, h.shareSvc.Revoke(ctx, userId, req.Id), nil)
+}
+
+// Save 把别人分享的文件或目录转存到当前用户的 dst，立即返回后台任务，
+// 通过 GET /share/save/:job 查询进度
+func (h *ShareHandler) Save(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	type request struct {
+		Token    string `json:"token"`
+		Code     string `json:"code"`
+		Path     string `json:"path"` // 相对于分享的根，为空时转存整个分享
+		Dst      string `json:"dst"`
+		Conflict string `json:"conflict"`
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+
+	share, err := h.shareSvc.Open(ctx, req.Token, req.Code)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	job, err := h.shareSvc.Save(ctx, userId, share, req.Path, h.abs(ctx, userId, req.Dst), req.Conflict)
+	ginx.WriteResponse(ctx, err, job)
+}
+
+// SaveStatus 返回转存任务的进度
+func (h *ShareHandler) SaveStatus(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	job, err := h.shareSvc.SaveStatus(ctx, userId, ctx.Param("job"))
+	ginx.WriteResponse(ctx, err, job)
+}
+
+// open 校验 token 和提取码，提取码通过 Share-Code 头或查询参数 code 传递。
+// 校验通过后签发或续用访客标识，通过 cookie 和 Share-Visitor 头返回
+func (h *ShareHandler) open(ctx *gin.Context) {
+	shareCode := ctx.GetHeader("Share-Code")
+	if shareCode == "" {
+		shareCode = ctx.Query("code")
+	}
+	share, err := h.shareSvc.Open(ctx, ctx.Param("token"), shareCode)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		ctx.Abort()
+		return
+	}
+	visitor := ctx.GetHeader(visitorHeader)
+	if visitor == "" {
+		visitor, _ = ctx.Cookie(visitorKey)
+	}
+	visitor, err = h.shareSvc.Visitor(ctx, share, visitor)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		ctx.Abort()
+		return
+	}
+	ctx.SetCookie(visitorKey, visitor, 0, "/s/"+share.Token, "", false, true)
+	ctx.Header(visitorHeader, visitor)
+	ctx.Set(shareKey, share)
+	ctx.Set(visitorKey, visitor)
+}
+
+// currentShare 返回 open 校验过的分享
+func currentShare(ctx *gin.Context) domain.Share {
+	val, _ := ctx.Get(shareKey)
+	share, _ := val.(domain.Share)
+	return share
+}
+
+// Info 返回分享的根，不暴露分享者和分享的路径
+func (h *ShareHandler) Info(ctx *gin.Context) {
+	share := currentShare(ctx)
+	root, err := h.shareSvc.Stat(ctx, share, "/")
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	ginx.WriteResponse(ctx, nil, gin.H{
+		"mode":          share.Mode,
+		"expire":        share.Expire,
+		"max_downloads": share.MaxDownloads,
+		"downloads":     share.Downloads,
+		"root":          root,
+	})
+}
+
+// Browse 列出分享中的目录，path 相对于分享的根
+func (h *ShareHandler) Browse(ctx *gin.Context) {
+	page, err := strconv.Atoi(ctx.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		ginx.WriteResponse(ctx, errors.WithCode(code.ErrValidation, "页码不合法: %s", ctx.Query("page")), nil)
+		return
+	}
+	pageSize, err := strconv.Atoi(ctx.DefaultQuery("page_size", "0"))
+	if err != nil || pageSize < 0 {
+		ginx.WriteResponse(ctx, errors.WithCode(code.ErrValidation, "分页大小不合法: %s", ctx.Query("page_size")), nil)
+		return
+	}
+
+	list, err := h.shareSvc.ListDirectory(ctx, currentShare(ctx), ctx.Query("path"), service.ListOptions{
+		Page:     page,
+		PageSize: pageSize,
+		SortBy:   ctx.Query("sort"),
+		Desc:     ctx.Query("order") == "desc",
+	})
+	ginx.WriteResponse(ctx, err, list)
+}
+
+// Download 下载分享中的文件，分享的是文件时 path 可以省略。
+// 每个 GET 都计入下载次数，不论 Range 从哪里开始，同一个访客标识断点续传时只计一次；HEAD 不计入
+func (h *ShareHandler) Download(ctx *gin.Context) {
+	count := ctx.Request.Method == "GET"
+	content, err := h.shareSvc.Download(ctx, currentShare(ctx), ctx.Query("path"), ctx.GetString(visitorKey), count)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	writeContent(ctx, content)
+}
+
+// ValidateUpload 访客向允许上传的分享上传文件，dst 相对于分享的根
+func (h *ShareHandler) ValidateUpload(ctx *gin.Context) {
+	digest := ctx.DefaultQuery("digest", ctx.Query("file_md5"))
+	size, _ := strconv.ParseInt(ctx.Query("size"), 10, 64)
+
+	plan, err := h.shareSvc.ValidateUpload(ctx, currentShare(ctx), ctx.Query("src"), ctx.Query("dst"),
+		digest, size, ctx.Query("conflict"))
+	ginx.WriteResponse(ctx, err, plan)
+}
+
+func (h *ShareHandler) Upload(ctx *gin.Context) {
+	chunkIndex := ctx.GetHeader("Chunk-Index")
+	index, err := strconv.Atoi(chunkIndex)
+	if err != nil {
+		ginx.WriteResponse(ctx, errors.WithCode(code.ErrValidation, "分片序号不合法: %s", chunkIndex), nil)
+		return
+	}
+
+	err = h.shareSvc.Upload(ctx, currentShare(ctx), ctx.GetHeader("Upload-Session"), index, ctx.GetHeader("Chunk-Md5"))
+	ginx.WriteResponse(ctx, err, nil)
+}
+
+func (h *ShareHandler) Complete(ctx *gin.Context) {
+	path, err := h.shareSvc.CompleteUpload(ctx, currentShare(ctx), ctx.Query("session"))
+	ginx.WriteResponse(ctx, err, gin.H{
+		"path": path,
+	})
+}
+
+// abs 按当前会话的工作目录把 path 解析成绝对路径
+func (h *ShareHandler) abs(ctx *gin.Context, userId, path string) string {
+	return h.fileSvc.Abs(ctx, userId, currentSession(ctx), path)
+}
@@ -0,0 +1,122 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/code"
+	"github.com/lvow2022/udisk/internel/repository"
+	"github.com/lvow2022/udisk/internel/repository/dao"
+	"github.com/lvow2022/udisk/internel/service"
+	"github.com/lvow2022/udisk/pkg/ginx"
+)
+
+func TestShareDownloadVisitor(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	env.put(t, "1", "/docs/a.txt", "hello world")
+	shares := service.NewShareService(repository.NewShareRepository(dao.NewShareDAO(env.db)), env.files, env.um, env.quotas)
+	share, err := shares.Create(context.Background(), "1", service.ShareOptions{Path: "/docs"})
+	if err != nil {
+		t.Fatalf("Error creating share: %v", err)
+	}
+
+	server := gin.New()
+	NewShareHandler(shares, env.files).RegisterRoutes(server)
+	// 所有请求来自同一个地址和 User-Agent，例如同一个 NAT 后面的访客
+	download := func(setup func(req *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/s/"+share.Token+"/download?path=a.txt", nil)
+		req.Header.Set("User-Agent", "curl/8.0")
+		setup(req)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK && rec.Code != http.StatusPartialContent {
+			t.Fatalf("Error downloading: %d %s", rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+	downloads := func() int64 {
+		opened, err := shares.Open(context.Background(), share.Token, "")
+		if err != nil {
+			t.Fatalf("Error opening share: %v", err)
+		}
+		return opened.Downloads
+	}
+
+	first := download(func(*http.Request) {})
+	visitor := first.Header().Get(visitorHeader)
+	cookies := first.Result().Cookies()
+	if visitor == "" || len(cookies) != 1 || cookies[0].Value != visitor {
+		t.Fatalf("Expected a visitor in the header and the cookie, got %q and %v", visitor, cookies)
+	}
+
+	// 带着签发的标识续传不再计数，cookie 和请求头都可以
+	download(func(req *http.Request) {
+		req.AddCookie(cookies[0])
+		req.Header.Set("Range", "bytes=6-")
+	})
+	download(func(req *http.Request) { req.Header.Set(visitorHeader, visitor) })
+	if n := downloads(); n != 1 {
+		t.Fatalf("Expected 1 download, got %d", n)
+	}
+
+	// 同一个地址的另一个访客和伪造的标识都单独计数
+	download(func(*http.Request) {})
+	forged := download(func(req *http.Request) { req.Header.Set(visitorHeader, "forged") })
+	if got := forged.Header().Get(visitorHeader); got == "forged" || got == visitor {
+		t.Fatalf("Expected a new visitor instead of %q", got)
+	}
+	if n := downloads(); n != 3 {
+		t.Fatalf("Expected 3 downloads, got %d", n)
+	}
+}
+
+func TestShareExhausted(t *testing.T) {
+	env := newTestEnv(t, domain.Quota{MaxBytes: 1 << 30, MaxFiles: 1000})
+	env.put(t, "1", "/docs/a.txt", "hello world")
+	shares := service.NewShareService(repository.NewShareRepository(dao.NewShareDAO(env.db)), env.files, env.um, env.quotas)
+	share, err := shares.Create(context.Background(), "1", service.ShareOptions{
+		Path: "/docs", MaxDownloads: 1, Mode: domain.ShareModeUpload,
+	})
+	if err != nil {
+		t.Fatalf("Error creating share: %v", err)
+	}
+
+	server := gin.New()
+	NewShareHandler(shares, env.files).RegisterRoutes(server)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(method, "/s/"+share.Token+target, nil))
+		return rec
+	}
+	if rec := serve(http.MethodGet, "/download?path=a.txt"); rec.Code != http.StatusOK {
+		t.Fatalf("Error downloading: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// 次数用完后分享的所有访客接口都被拒绝
+	for _, route := range []struct{ method, target string }{
+		{http.MethodGet, ""},
+		{http.MethodGet, "/list"},
+		{http.MethodGet, "/download?path=a.txt"},
+		{http.MethodHead, "/download?path=a.txt"},
+		{http.MethodPost, "/validate/upload?src=b.txt&dst=/&size=1&digest=0"},
+		{http.MethodPost, "/upload"},
+		{http.MethodPost, "/complete"},
+	} {
+		rec := serve(route.method, route.target)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("%s %s: expected %d, got %d %s", route.method, route.target, http.StatusForbidden, rec.Code, rec.Body.String())
+		}
+		if route.method == http.MethodHead {
+			continue
+		}
+		var resp ginx.ErrResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Code != code.ErrShareExhausted {
+			t.Fatalf("%s %s: expected code %d, got %s", route.method, route.target, code.ErrShareExhausted, rec.Body.String())
+		}
+	}
+}
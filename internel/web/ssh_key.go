@@ -0,0 +1,72 @@
+package web
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/service"
+	"github.com/lvow2022/udisk/pkg/ginx"
+)
+
+// SSHKeyHandler 管理当前用户登录 SFTP 用的公钥
+type SSHKeyHandler struct {
+	keySvc service.SSHKeyService
+}
+
+func NewSSHKeyHandler(keySvc service.SSHKeyService) *SSHKeyHandler {
+	return &SSHKeyHandler{
+		keySvc: keySvc,
+	}
+}
+
+func (h *SSHKeyHandler) RegisterRoutes(server *gin.Engine) {
+	g := server.Group("/ssh_keys")
+	g.POST("/add", h.Add)
+	g.GET("/list", h.List)
+	g.POST("/delete", h.Delete)
+}
+
+// Add 登记一个公钥，public_key 是 authorized_keys 中的一行
+func (h *SSHKeyHandler) Add(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	type request struct {
+		Name      string `json:"name"`
+		PublicKey string `json:"public_key"`
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+	key, err := h.keySvc.Add(ctx, userId, req.Name, req.PublicKey)
+	ginx.WriteResponse(ctx, err, key)
+}
+
+// List 列出当前用户登记的公钥
+func (h *SSHKeyHandler) List(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	keys, err := h.keySvc.List(ctx, userId)
+	ginx.WriteResponse(ctx, err, keys)
+}
+
+// Delete 删除一个公钥，已经建立的 SFTP 连接不受影响
+func (h *SSHKeyHandler) Delete(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	type request struct {
+		Id int64 `json:"id"`
+	}
+	var req request
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
+	ginx.WriteResponse(ctx, h.keySvc.Delete(ctx, userId, req.Id), nil)
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/lvow2022/udisk/internel/domain"
 	"github.com/lvow2022/udisk/internel/service"
 	ijwt "github.com/lvow2022/udisk/internel/web/jwt"
+	"github.com/lvow2022/udisk/pkg/ginx"
 	"net/http"
 )
 
@@ -20,14 +21,16 @@ type UserHandler struct {
 	ijwt.Handler
 	emailRegex     *regexp.Regexp
 	passwordRexExp *regexp.Regexp
-	usrSvc         service.UsrService
+	usrSvc         service.UserService
+	quotaSvc       service.QuotaService
 }
 
-func NewUserHandler(usrSvc service.UsrService, jwtHdl ijwt.Handler) *UserHandler {
+func NewUserHandler(usrSvc service.UserService, quotaSvc service.QuotaService, jwtHdl ijwt.Handler) *UserHandler {
 	return &UserHandler{
 		emailRegex:     regexp.MustCompile(emailRegexPattern, regexp.None),
 		passwordRexExp: regexp.MustCompile(passwordRegexPattern, regexp.None),
 		usrSvc:         usrSvc,
+		quotaSvc:       quotaSvc,
 		Handler:        jwtHdl,
 	}
 }
@@ -37,6 +40,7 @@ func (h *UserHandler) RegisterRoutes(server *gin.Engine) {
 	ug.POST("/signup", h.SignUp)
 	ug.POST("/login", h.Login)
 	ug.POST("/logout", h.Logout)
+	ug.GET("/quota", h.Quota)
 }
 
 func (h *UserHandler) SignUp(ctx *gin.Context) {
@@ -91,18 +95,27 @@ func (h *UserHandler) SignUp(ctx *gin.Context) {
 }
 
 func (h *UserHandler) Login(ctx *gin.Context) {
+	type Req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	var req Req
+	if err := ctx.Bind(&req); err != nil {
+		return
+	}
 	u, err := h.usrSvc.Login(ctx, req.Email, req.Password)
 	switch err {
 	case nil:
 		err = h.SetLoginToken(ctx, u.Id)
 		if err != nil {
-
+			ctx.String(http.StatusOK, "系统错误")
+			return
 		}
-
+		ctx.String(http.StatusOK, "登录成功")
 	case service.ErrInvalidUserOrPassword:
-		return
+		ctx.String(http.StatusOK, "用户名或者密码不对")
 	default:
-		return
+		ctx.String(http.StatusOK, "系统错误")
 	}
 }
 
@@ -114,3 +127,14 @@ func (h *UserHandler) Logout(ctx *gin.Context) {
 	}
 	ctx.JSON(http.StatusOK, ginx.Result{Msg: "退出登录成功"})
 }
+
+// Quota 返回当前用户的存储限额及用量
+func (h *UserHandler) Quota(ctx *gin.Context) {
+	userId, err := currentUser(ctx)
+	if err != nil {
+		ginx.WriteResponse(ctx, err, nil)
+		return
+	}
+	quota, err := h.quotaSvc.Quota(ctx, userId)
+	ginx.WriteResponse(ctx, err, quota)
+}
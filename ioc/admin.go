@@ -0,0 +1,26 @@
+package ioc
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lvow2022/udisk/internel/web/middleware"
+)
+
+// InitAdminMiddleware 管理员是环境变量 UDISK_ADMIN_UIDS 中以逗号分隔的用户 ID，
+// 没有配置时任何人都不能访问管理接口
+func InitAdminMiddleware() *middleware.AdminMiddlewareBuilder {
+	var uids []int64
+	for _, s := range strings.Split(os.Getenv("UDISK_ADMIN_UIDS"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		uid, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		uids = append(uids, uid)
+	}
+	return middleware.NewAdminMiddlewareBuilder(uids)
+}
@@ -0,0 +1,11 @@
+package ioc
+
+import "github.com/lvow2022/udisk/internel/pkg/blob"
+
+func InitBlobStore() blob.BlobStore {
+	store, err := blob.NewLocalBlobStore("./all")
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
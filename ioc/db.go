@@ -1,6 +1,10 @@
 package ioc
 
 import (
+	"fmt"
+	"os"
+
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
 	"github.com/lvow2022/udisk/internel/repository/dao"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -17,5 +21,41 @@ func InitDB() *gorm.DB {
 		panic(err)
 	}
 
+	err = ufs.InitTables(db)
+	if err != nil {
+		panic(err)
+	}
+
 	return db
 }
+
+// defaultBoltPath 选择 bolt 存储时默认的 bbolt 文件，可以用环境变量 UDISK_BOLT_PATH 修改
+const defaultBoltPath = "./udisk.bolt"
+
+// InitBackend 选择保存用户文件记录的存储，由环境变量 UDISK_STORE 决定：
+//   - gorm (默认) 和其他数据一样保存在数据库中
+//   - bolt 保存在 UDISK_BOLT_PATH 指定的 bbolt 文件中
+//   - memory 只保存在内存中，进程退出后丢失
+//
+// 文件系统、垃圾回收、回收站清理和历史版本清理都从同一个 ufs.Backend 取得，
+// 保证它们读写的是同一个存储，否则垃圾回收会因为读不到引用计数删除所有 blob
+func InitBackend(db *gorm.DB) ufs.Backend {
+	switch store := os.Getenv("UDISK_STORE"); store {
+	case "", "gorm":
+		return ufs.GormBackend(db)
+	case "bolt":
+		path := os.Getenv("UDISK_BOLT_PATH")
+		if path == "" {
+			path = defaultBoltPath
+		}
+		bolt, err := ufs.NewBoltStore(path)
+		if err != nil {
+			panic(err)
+		}
+		return ufs.KVBackend(bolt)
+	case "memory":
+		return ufs.KVBackend(ufs.NewMemoryStore())
+	default:
+		panic(fmt.Errorf("环境变量 UDISK_STORE 不是合法的存储: %q", store))
+	}
+}
@@ -0,0 +1,84 @@
+package ioc
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	if err := ufs.InitTables(db); err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	return db
+}
+
+// TestInitBackend checks that whatever store UDISK_STORE selects, the
+// garbage collector, the trash purge and the version pruning see what the
+// file systems write.
+func TestInitBackend(t *testing.T) {
+	for _, store := range []string{"", "gorm", "bolt", "memory"} {
+		t.Run("store="+store, func(t *testing.T) {
+			t.Setenv("UDISK_STORE", store)
+			t.Setenv("UDISK_BOLT_PATH", filepath.Join(t.TempDir(), "udisk.bolt"))
+			backend := InitBackend(newTestDB(t))
+
+			um := ufs.NewUserManager(backend.Persistors)
+			fs := um.User("1")
+			a := ufs.BlobRef{Digest: "65a8e27d8879283831b664bd8b7f0ad4", Size: 10}
+			b := ufs.BlobRef{Digest: "0123456789abcdef0123456789abcdef", Size: 20}
+			for _, ref := range []ufs.BlobRef{a, b} {
+				if err := fs.LinkBlob("/a.txt", ref); err != nil {
+					t.Fatalf("Error linking blob: %v", err)
+				}
+			}
+
+			// The reference counts are the ones the file system keeps
+			for _, ref := range []ufs.BlobRef{a, b} {
+				count, found, err := backend.Refs.Refs(ref.Digest)
+				if err != nil || !found || count.Refs != 1 {
+					t.Fatalf("Expected 1 reference to %s, got %+v (%v)", ref.Digest, count, err)
+				}
+			}
+
+			// The replaced content is a version the pruner can see
+			pruned, err := backend.Versions.Prune(0, time.Now().Add(time.Second))
+			if err != nil || pruned != 1 {
+				t.Fatalf("Expected 1 version to be pruned, got %d (%v)", pruned, err)
+			}
+			if count, _, _ := backend.Refs.Refs(a.Digest); count.Refs != 0 {
+				t.Fatalf("Expected the pruned version to release %s, got %d references", a.Digest, count.Refs)
+			}
+
+			// The trash items are the ones the file system creates
+			item, err := fs.Trash("/a.txt")
+			if err != nil {
+				t.Fatalf("Error moving to trash: %v", err)
+			}
+			expired, err := backend.Trash.Expired(time.Now().Add(time.Second), 10)
+			if err != nil || len(expired) != 1 || expired[0].ID != item.ID {
+				t.Fatalf("Expected the trash item to expire, got %+v (%v)", expired, err)
+			}
+		})
+	}
+}
+
+func TestInitBackendUnknownStore(t *testing.T) {
+	t.Setenv("UDISK_STORE", "redis")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected an unknown store to panic")
+		}
+	}()
+	InitBackend(nil)
+}
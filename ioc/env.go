@@ -0,0 +1,34 @@
+package ioc
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envDuration 读取环境变量中 time.ParseDuration 格式的时长，例如 720h，没有设置时返回 def
+func envDuration(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		panic(fmt.Errorf("环境变量 %s 不是合法的时长: %q", name, s))
+	}
+	return d
+}
+
+// envInt 读取环境变量中的正整数，没有设置时返回 def
+func envInt(name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		panic(fmt.Errorf("环境变量 %s 不是合法的正整数: %q", name, s))
+	}
+	return n
+}
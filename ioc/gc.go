@@ -0,0 +1,18 @@
+package ioc
+
+import (
+	"context"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/pkg/blob"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/internel/service"
+)
+
+// InitGCService 创建垃圾回收服务并在后台每小时执行一次，
+// 失去引用超过一天的 blob 和一天没有新分片的分片目录会被回收
+func InitGCService(blobs blob.BlobStore, refs ufs.RefCounter) service.GCService {
+	svc := service.NewGCService(blobs, refs, "./tmp", 24*time.Hour)
+	go svc.Start(context.Background(), time.Hour)
+	return svc
+}
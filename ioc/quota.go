@@ -0,0 +1,21 @@
+package ioc
+
+import (
+	"github.com/lvow2022/udisk/internel/domain"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/internel/service"
+)
+
+const (
+	// defaultQuotaBytes 没有单独设置限额的用户可用的字节数
+	defaultQuotaBytes = 10 << 30
+	// defaultQuotaFiles 没有单独设置限额的用户可用的文件数
+	defaultQuotaFiles = 100000
+)
+
+func InitQuotaService(um ufs.UserManager) service.QuotaService {
+	return service.NewQuotaService(um, domain.Quota{
+		MaxBytes: defaultQuotaBytes,
+		MaxFiles: defaultQuotaFiles,
+	})
+}
@@ -0,0 +1,63 @@
+package ioc
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/lvow2022/udisk/internel/service"
+	"github.com/lvow2022/udisk/internel/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// defaultSftpAddr SFTP 默认的监听地址，可以用环境变量 UDISK_SFTP_ADDR 修改
+	defaultSftpAddr = "localhost:2022"
+	// defaultSftpHostKeyPath 主机密钥默认的位置，相对于工作目录，
+	// 可以用环境变量 UDISK_SFTP_HOST_KEY 修改
+	defaultSftpHostKeyPath = "./sftp_host_key"
+)
+
+// InitSftpServer 主机密钥是 UDISK_SFTP_HOST_KEY 指定的 OpenSSH 格式的私钥文件，
+// 例如 ssh-keygen -t ed25519 生成的密钥。文件不存在时自动生成一个 ed25519 密钥
+// 写入这个位置，之后一直使用同一个，否则客户端每次重启都会提示主机密钥改变
+func InitSftpServer(files service.FileSystemService, usrSvc service.UserService, keySvc service.SSHKeyService) *sftp.Server {
+	addr := os.Getenv("UDISK_SFTP_ADDR")
+	if addr == "" {
+		addr = defaultSftpAddr
+	}
+	keyPath := os.Getenv("UDISK_SFTP_HOST_KEY")
+	if keyPath == "" {
+		keyPath = defaultSftpHostKeyPath
+	}
+	hostKey, err := loadHostKey(keyPath)
+	if err != nil {
+		panic(fmt.Errorf("无法读取 SFTP 主机密钥 %s: %w", keyPath, err))
+	}
+	return sftp.NewServer(addr, hostKey, files, usrSvc, keySvc)
+}
+
+// loadHostKey 读取 OpenSSH 格式的主机密钥，文件不存在时生成一个 ed25519 密钥
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "udisk sftp host key")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
@@ -0,0 +1,74 @@
+package ioc
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadHostKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "host_key")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("Error creating directory: %v", err)
+	}
+
+	// 不存在时生成，之后读取同一个
+	key, err := loadHostKey(path)
+	if err != nil {
+		t.Fatalf("Error generating host key: %v", err)
+	}
+	again, err := loadHostKey(path)
+	if err != nil || !bytes.Equal(again.PublicKey().Marshal(), key.PublicKey().Marshal()) {
+		t.Fatalf("Expected the generated key to be reused (%v)", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected the key to be readable only by its owner, got %v (%v)", info.Mode(), err)
+	}
+
+	// 使用已有的密钥
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatalf("Error encoding key: %v", err)
+	}
+	existing := filepath.Join(t.TempDir(), "existing_key")
+	if err := os.WriteFile(existing, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+	want, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("Error creating signer: %v", err)
+	}
+	got, err := loadHostKey(existing)
+	if err != nil || !bytes.Equal(got.PublicKey().Marshal(), want.PublicKey().Marshal()) {
+		t.Fatalf("Expected the existing key to be loaded (%v)", err)
+	}
+
+	if err := os.WriteFile(existing, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+	if _, err := loadHostKey(existing); err == nil {
+		t.Fatal("Expected an invalid key to be rejected")
+	}
+}
+
+func TestInitSftpServerHostKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "udisk_host_key")
+	t.Setenv("UDISK_SFTP_HOST_KEY", path)
+	InitSftpServer(nil, nil, nil)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the host key at %s, got %v", path, err)
+	}
+	if _, err := os.Stat(defaultSftpHostKeyPath); !os.IsNotExist(err) {
+		t.Fatalf("Expected no key at the default path, got %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+package ioc
+
+import (
+	"context"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/internel/service"
+)
+
+// defaultTrashRetention 回收站中的项默认保留的时长，可以用环境变量 UDISK_TRASH_RETENTION 修改
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// InitTrashService 创建回收站清理服务并在后台每小时执行一次，
+// 在回收站中超过保留时长的项会被彻底删除
+func InitTrashService(um ufs.UserManager, trash ufs.TrashCollector) service.TrashService {
+	retention := envDuration("UDISK_TRASH_RETENTION", defaultTrashRetention)
+	svc := service.NewTrashService(um, trash, retention)
+	go svc.Start(context.Background(), time.Hour)
+	return svc
+}
@@ -0,0 +1,25 @@
+package ioc
+
+import (
+	"context"
+	"time"
+
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
+	"github.com/lvow2022/udisk/internel/service"
+)
+
+const (
+	// defaultVersionKeep 每个文件默认最多保留的历史版本数，可以用环境变量 UDISK_VERSION_KEEP 修改
+	defaultVersionKeep = 20
+	// defaultVersionRetention 历史版本被替换后默认保留的时长，可以用环境变量 UDISK_VERSION_RETENTION 修改
+	defaultVersionRetention = 90 * 24 * time.Hour
+)
+
+// InitVersionService 创建历史版本清理服务并在后台每小时执行一次
+func InitVersionService(pruner ufs.VersionPruner) service.VersionService {
+	keep := envInt("UDISK_VERSION_KEEP", defaultVersionKeep)
+	retention := envDuration("UDISK_VERSION_RETENTION", defaultVersionRetention)
+	svc := service.NewVersionService(pruner, keep, retention)
+	go svc.Start(context.Background(), time.Hour)
+	return svc
+}
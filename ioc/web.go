@@ -11,11 +11,18 @@ import (
 )
 
 func InitWebServer(mdls []gin.HandlerFunc,
-	userHdl *web.UserHandler, fileHdl *web.FileHandler) *gin.Engine {
-	server := gin.Default()
+	userHdl *web.UserHandler, fileHdl *web.FileHandler, shareHdl *web.ShareHandler, davHdl *web.DavHandler,
+	s3Hdl *web.S3Handler, sshKeyHdl *web.SSHKeyHandler, adminHdl *web.AdminHandler) *gin.Engine {
+	server := gin.New()
+	server.Use(gin.Logger(), middleware.Recovery())
 	server.Use(mdls...)
 	userHdl.RegisterRoutes(server)
 	fileHdl.RegisterRoutes(server)
+	shareHdl.RegisterRoutes(server)
+	davHdl.RegisterRoutes(server)
+	s3Hdl.RegisterRoutes(server)
+	sshKeyHdl.RegisterRoutes(server)
+	adminHdl.RegisterRoutes(server)
 	return server
 }
 
@@ -1,8 +1,13 @@
 package main
 
 func main() {
-	server := InitWebServer()
-	err := server.Run("localhost:8080")
+	app := InitApp()
+	go func() {
+		if err := app.Sftp.ListenAndServe(); err != nil {
+			panic(err)
+		}
+	}()
+	err := app.Web.Run("localhost:8080")
 	if err != nil {
 		panic(err)
 	}
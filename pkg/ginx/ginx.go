@@ -27,6 +27,14 @@ type ErrResponse struct {
 	Reference string `json:"reference,omitempty"`
 }
 
+// Result is the plain response body used by handlers that report a
+// message rather than an error code.
+type Result struct {
+	Code int         `json:"code"`
+	Msg  string      `json:"msg"`
+	Data interface{} `json:"data"`
+}
+
 // WriteResponse write an error or the response data into http response body.
 // It use errors.ParseCoder to parse any error into errors.Coder
 // errors.Coder contains error code, user-safe error message and http status code.
@@ -3,7 +3,6 @@
 package main
 
 import (
-	"github.com/gin-gonic/gin"
 	"github.com/google/wire"
 	"github.com/lvow2022/udisk/internel/pkg/ufs"
 	"github.com/lvow2022/udisk/internel/repository"
@@ -14,30 +13,58 @@ import (
 	"github.com/lvow2022/udisk/ioc"
 )
 
-func InitWebServer() *gin.Engine {
+func InitApp() *App {
 	wire.Build(
 		// 第三方依赖
 		ioc.InitDB,
+		ioc.InitBackend,
+		wire.FieldsOf(new(ufs.Backend), "Persistors", "Refs", "Trash", "Versions"),
+		ioc.InitBlobStore,
 
 		// dao
 		dao.NewUserDAO,
+		dao.NewUploadSessionDAO,
+		dao.NewShareDAO,
+		dao.NewAccessKeyDAO,
+		dao.NewSSHKeyDAO,
 		ufs.NewUserManager,
 		// repo
 		repository.NewUserRepository,
 		repository.NewFileRepository,
+		repository.NewUploadSessionRepository,
+		repository.NewShareRepository,
+		repository.NewAccessKeyRepository,
+		repository.NewSSHKeyRepository,
 
 		// service
 		service.NewUserService,
 		service.NewFileService,
+		ioc.InitQuotaService,
+		service.NewShareService,
+		service.NewFileSystemService,
+		service.NewDavService,
+		service.NewAccessKeyService,
+		service.NewSSHKeyService,
+		ioc.InitGCService,
+		ioc.InitTrashService,
+		ioc.InitVersionService,
 
 		// controller
 		web.NewUserHandler,
 		web.NewFileHandler,
+		web.NewShareHandler,
+		web.NewDavHandler,
+		web.NewS3Handler,
+		web.NewSSHKeyHandler,
+		web.NewAdminHandler,
 
 		// app
 		ijwt.NewLocalJWTHandler,
 		ioc.InitGinMiddlewares,
+		ioc.InitAdminMiddleware,
 		ioc.InitWebServer,
+		ioc.InitSftpServer,
+		wire.Struct(new(App), "*"),
 	)
 	return nil
 }
@@ -7,26 +7,63 @@
 package main
 
 import (
-	"github.com/gin-gonic/gin"
+	"github.com/lvow2022/udisk/internel/pkg/ufs"
 	"github.com/lvow2022/udisk/internel/repository"
 	"github.com/lvow2022/udisk/internel/repository/dao"
 	"github.com/lvow2022/udisk/internel/service"
 	"github.com/lvow2022/udisk/internel/web"
+	"github.com/lvow2022/udisk/internel/web/jwt"
 	"github.com/lvow2022/udisk/ioc"
 )
 
 // Injectors from wire.go:
 
-func InitWebServer() *gin.Engine {
-	v := ioc.InitGinMiddlewares()
+func InitApp() *App {
+	handler := jwt.NewLocalJWTHandler()
+	v := ioc.InitGinMiddlewares(handler)
 	db := ioc.InitDB()
 	userDAO := dao.NewUserDAO(db)
 	userRepository := repository.NewUserRepository(userDAO)
 	userService := service.NewUserService(userRepository)
-	userHandler := web.NewUserHandler(userService)
+	backend := ioc.InitBackend(db)
+	persistorFactory := backend.Persistors
+	userManager := ufs.NewUserManager(persistorFactory)
+	quotaService := ioc.InitQuotaService(userManager)
+	userHandler := web.NewUserHandler(userService, quotaService, handler)
 	fileRepository := repository.NewFileRepository()
-	fileService := service.NewFileService(fileRepository)
+	blobStore := ioc.InitBlobStore()
+	uploadSessionDAO := dao.NewUploadSessionDAO(db)
+	uploadSessionRepository := repository.NewUploadSessionRepository(uploadSessionDAO)
+	fileService := service.NewFileService(fileRepository, userManager, blobStore, uploadSessionRepository, quotaService)
 	fileHandler := web.NewFileHandler(fileService)
-	engine := ioc.InitWebServer(v, userHandler, fileHandler)
-	return engine
+	shareDAO := dao.NewShareDAO(db)
+	shareRepository := repository.NewShareRepository(shareDAO)
+	shareService := service.NewShareService(shareRepository, fileService, userManager, quotaService)
+	shareHandler := web.NewShareHandler(shareService, fileService)
+	fileSystemService := service.NewFileSystemService(userManager, blobStore, quotaService)
+	davService := service.NewDavService(fileSystemService)
+	davHandler := web.NewDavHandler(davService, userService, quotaService, handler)
+	accessKeyDAO := dao.NewAccessKeyDAO(db)
+	accessKeyRepository := repository.NewAccessKeyRepository(accessKeyDAO)
+	accessKeyService := service.NewAccessKeyService(accessKeyRepository)
+	s3Handler := web.NewS3Handler(fileService, accessKeyService)
+	sshKeyDAO := dao.NewSSHKeyDAO(db)
+	sshKeyRepository := repository.NewSSHKeyRepository(sshKeyDAO)
+	sshKeyService := service.NewSSHKeyService(sshKeyRepository)
+	sshKeyHandler := web.NewSSHKeyHandler(sshKeyService)
+	refCounter := backend.Refs
+	gcService := ioc.InitGCService(blobStore, refCounter)
+	trashCollector := backend.Trash
+	trashService := ioc.InitTrashService(userManager, trashCollector)
+	versionPruner := backend.Versions
+	versionService := ioc.InitVersionService(versionPruner)
+	adminMiddlewareBuilder := ioc.InitAdminMiddleware()
+	adminHandler := web.NewAdminHandler(gcService, trashService, versionService, adminMiddlewareBuilder)
+	engine := ioc.InitWebServer(v, userHandler, fileHandler, shareHandler, davHandler, s3Handler, sshKeyHandler, adminHandler)
+	server := ioc.InitSftpServer(fileSystemService, userService, sshKeyService)
+	app := &App{
+		Web:  engine,
+		Sftp: server,
+	}
+	return app
 }